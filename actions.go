@@ -1,6 +1,9 @@
 package porter
 
-import "fmt"
+import (
+	"fmt"
+	"slices"
+)
 
 // =============================================================================
 // ACTION REGISTRY
@@ -26,17 +29,57 @@ func register(action string, h actionHandler) {
 	actionHandlers[action] = h
 }
 
+// Actions returns the names of every registered action, sorted — the values
+// a playbook task's action may take.
+func Actions() []string {
+	names := make([]string, 0, len(actionHandlers))
+	for name := range actionHandlers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// actionOptions lists the options each action reads from its body, as its
+// builder methods set them. Every other action uses the body for content or a
+// command, so appending options to it would change what runs.
+var actionOptions = map[string][]string{
+	"upload":      {"compress"},
+	"unarchive":   {"remote_src", "strip"},
+	"fetch":       {"user", "password", "controller"},
+	"sync_dir":    {"delete", "exclude", "include", "checksum"},
+	"rsync":       {"flags", "delete", "exclude", "include", "compress", "progress", "dry-run", "bwlimit", "checksum", "partial", "inplace", "delta", "local", "ssh-port", "ssh-key"},
+	"git_clone":   {"shallow", "depth"},
+	"git_fetch":   {"prune"},
+	"git_reset":   {"hard"},
+	"git_clean":   {"force"},
+	"pkg_repo":    {"key"},
+	"user_add":    {"groups", "shell", "home"},
+	"user_mod":    {"groups", "shell", "home"},
+	"ensure_user": {"groups", "shell", "home"},
+	"reboot":      {"wait"},
+	"docker":      {"ports", "volumes", "env", "network", "detach", "restart", "init", "logrotate"},
+	"compose":     {"service", "build", "orphans", "volumes"},
+	"go":          {"goos", "goarch", "ldflags", "tags", "race", "verbose", "parallel", "failfast"},
+	"npm":         {"silent", "production", "legacy-peer-deps", "script"},
+}
+
+// ActionOptions returns the options action reads from its body — the keys a
+// playbook task's options may set — or nil if it takes none.
+func ActionOptions(action string) []string {
+	return slices.Clone(actionOptions[action])
+}
+
 // dispatch expands the task's fields and routes it to its registered handler.
 func (e *Executor) dispatch(t Task, vars *Vars) error {
-	src := vars.Expand(t.Src)
-	dest := vars.Expand(t.Dest)
-	body := vars.Expand(t.Body)
-	perm := vars.Expand(t.Perm)
-	own := vars.Expand(t.Own)
+	f, err := vars.renderFields(t.Src, t.Dest, t.Body, t.Perm, t.Own)
+	if err != nil {
+		return err
+	}
 
 	h, ok := actionHandlers[t.Action]
 	if !ok {
 		return fmt.Errorf("unknown action: %s", t.Action)
 	}
-	return h(e, t, src, dest, body, perm, own, vars)
+	return h(e, t, f[0], f[1], f[2], f[3], f[4], vars)
 }
@@ -7,6 +7,7 @@ func init() {
 	register("targz_extract", actTarGzExtract)
 	register("zip_create", actZipCreate)
 	register("zip_extract", actZipExtract)
+	register("unarchive", actUnarchive)
 }
 
 func actTarCreate(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
@@ -32,3 +33,7 @@ func actZipCreate(e *Executor, t Task, src, dest, body, perm, own string, vars *
 func actZipExtract(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
 	return e.runSudo("unzip -o " + src + " -d " + dest)
 }
+
+func actUnarchive(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	return e.unarchive(t, src, dest, body, own)
+}
@@ -67,7 +67,7 @@ func actDockerPs(e *Executor, t Task, src, dest, body, perm, own string, vars *V
 	if strings.Contains(body, "all:true") {
 		all = "-a "
 	}
-	out, err := e.runCapture("sudo docker ps " + all + "--format '{{.ID}}|{{.Names}}|{{.Image}}|{{.Status}}|{{.Ports}}|{{.CreatedAt}}|{{.State}}'")
+	out, err := e.runSudoCapture("docker ps " + all + "--format '{{.ID}}|{{.Names}}|{{.Image}}|{{.Status}}|{{.Ports}}|{{.CreatedAt}}|{{.State}}'")
 	if err != nil {
 		return err
 	}
@@ -78,7 +78,7 @@ func actDockerPs(e *Executor, t Task, src, dest, body, perm, own string, vars *V
 }
 
 func actDockerImages(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
-	out, err := e.runCapture("sudo docker images --format '{{.ID}}|{{.Repository}}|{{.Tag}}|{{.Size}}|{{.CreatedAt}}'")
+	out, err := e.runSudoCapture("docker images --format '{{.ID}}|{{.Repository}}|{{.Tag}}|{{.Size}}|{{.CreatedAt}}'")
 	if err != nil {
 		return err
 	}
@@ -89,7 +89,7 @@ func actDockerImages(e *Executor, t Task, src, dest, body, perm, own string, var
 }
 
 func actDockerVolumes(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
-	out, err := e.runCapture("sudo docker volume ls --format '{{.Name}}|{{.Driver}}|{{.Mountpoint}}'")
+	out, err := e.runSudoCapture("docker volume ls --format '{{.Name}}|{{.Driver}}|{{.Mountpoint}}'")
 	if err != nil {
 		return err
 	}
@@ -100,7 +100,7 @@ func actDockerVolumes(e *Executor, t Task, src, dest, body, perm, own string, va
 }
 
 func actDockerNetworks(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
-	out, err := e.runCapture("sudo docker network ls --format '{{.ID}}|{{.Name}}|{{.Driver}}|{{.Scope}}'")
+	out, err := e.runSudoCapture("docker network ls --format '{{.ID}}|{{.Name}}|{{.Driver}}|{{.Scope}}'")
 	if err != nil {
 		return err
 	}
@@ -111,7 +111,7 @@ func actDockerNetworks(e *Executor, t Task, src, dest, body, perm, own string, v
 }
 
 func actDockerInfo(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
-	out, err := e.runCapture("sudo docker info --format '{{.Containers}}|{{.ContainersRunning}}|{{.Images}}'")
+	out, err := e.runSudoCapture("docker info --format '{{.Containers}}|{{.ContainersRunning}}|{{.Images}}'")
 	if err != nil {
 		return err
 	}
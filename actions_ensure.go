@@ -17,6 +17,11 @@ func init() {
 	register("ensure_owner", actEnsureOwner)
 	register("ensure_absent", actEnsureAbsent)
 	register("ensure_git_repo", actEnsureGitRepo)
+	register("ensure_copy", actEnsureCopy)
+	register("ensure_move", actEnsureMove)
+	register("ensure_env", actEnsureEdit)
+	register("ensure_replace", actEnsureEdit)
+	register("ensure_block", actEnsureEdit)
 }
 
 func actEnsureFile(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
@@ -24,7 +29,7 @@ func actEnsureFile(e *Executor, t Task, src, dest, body, perm, own string, vars
 		e.noOp = true
 		return nil
 	}
-	return e.writeFile(dest, body, t.Sudo, perm, own)
+	return e.writeFile(dest, body, t.Sudo, perm, own, vars.Expand(t.Validate))
 }
 
 func actEnsureDir(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
@@ -48,10 +53,17 @@ func actEnsurePackage(e *Executor, t Task, src, dest, body, perm, own string, va
 		e.noOp = true
 		return nil
 	}
-	return e.runSudo("DEBIAN_FRONTEND=noninteractive apt-get install -y " + shellEscape(dest))
+	m, err := e.pkgManager()
+	if err != nil {
+		m = pkgManagers["apt"]
+	}
+	return e.runSudo(fmt.Sprintf(m.install, shellEscape(dest)))
 }
 
 func actEnsureLine(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	if advancedLine(t) {
+		return e.editFile(expandEdit(t, vars), src, dest, body, perm, own)
+	}
 	if e.linePresent(dest, body, t.Sudo) {
 		e.noOp = true
 		return nil
@@ -79,7 +91,7 @@ func actEnsureSystemdKey(e *Executor, t Task, src, dest, body, perm, own string,
 	}
 	// Empty perm/owner: writeFile cp's over the existing unit, preserving its
 	// mode and ownership (typically 0644 root:root).
-	return e.writeFile(dest, newContent, t.Sudo, "", "")
+	return e.writeFile(dest, newContent, t.Sudo, "", "", vars.Expand(t.Validate))
 }
 
 func actEnsureServiceRunning(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
@@ -148,3 +160,39 @@ func actEnsureAbsent(e *Executor, t Task, src, dest, body, perm, own string, var
 func actEnsureGitRepo(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
 	return e.ensureGitRepo(src, dest)
 }
+
+func actEnsureCopy(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	if e.copyConverged(src, dest, perm, own, t.Sudo) {
+		e.noOp = true
+		return nil
+	}
+	if err := e.runMaybeSudo(t.Sudo, "cp "+shellEscape(src)+" "+shellEscape(dest)); err != nil {
+		return err
+	}
+	if perm != "" {
+		if err := e.runMaybeSudo(t.Sudo, "chmod "+shellEscape(perm)+" "+shellEscape(dest)); err != nil {
+			return err
+		}
+	}
+	if own != "" {
+		return e.runMaybeSudo(t.Sudo, "chown "+shellEscape(own)+" "+shellEscape(dest))
+	}
+	return nil
+}
+
+func actEnsureMove(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	pending, err := e.movePending(src, dest)
+	if err != nil {
+		return fmt.Errorf("ensure_move: %w", err)
+	}
+	if !pending {
+		e.noOp = true
+		return nil
+	}
+	return e.runMaybeSudo(t.Sudo, "mv "+shellEscape(src)+" "+shellEscape(dest))
+}
+
+// actEnsureEdit runs the ensure_env, ensure_replace and ensure_block edits.
+func actEnsureEdit(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	return e.editFile(expandEdit(t, vars), src, dest, body, perm, own)
+}
@@ -14,36 +14,28 @@ func actRun(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars)
 		return e.runWithStdin(body, vars.Expand(t.StdinFile), t.Sudo)
 	}
 	if t.Sudo {
-		return e.runSudo(body)
+		body = e.sudo(body)
 	}
-	return e.run(body)
+	_, err := e.runResult(body)
+	return err
 }
 
 func actPause(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
 	if d, err := time.ParseDuration(body); err == nil {
-		time.Sleep(d)
+		return e.sleep(d)
 	}
 	return nil
 }
 
+// The command actions record a Result (see runResult); exec judges it and
+// registers it under t.Register.
+
 func actCapture(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
-	out, err := e.runCapture(body)
-	if err != nil {
-		return err
-	}
-	if t.Register != "" {
-		vars.Set(t.Register, out)
-	}
-	return nil
+	_, err := e.runResult(body)
+	return err
 }
 
 func actCaptureSudo(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
-	out, err := e.runSudoCapture(body)
-	if err != nil {
-		return err
-	}
-	if t.Register != "" {
-		vars.Set(t.Register, out)
-	}
-	return nil
+	_, err := e.runResult(e.sudo(body))
+	return err
 }
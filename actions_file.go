@@ -19,7 +19,13 @@ func init() {
 }
 
 func actUpload(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
-	return e.uploadFile(src, dest, t.Sudo, perm, own)
+	return e.upload(src, dest, uploadSpec{
+		sudo:     t.Sudo,
+		perm:     perm,
+		owner:    own,
+		validate: vars.Expand(t.Validate),
+		compress: e.parseOpt(body, "compress") == "true",
+	})
 }
 
 func actCopy(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
@@ -55,7 +61,7 @@ func actSed(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars)
 }
 
 func actWrite(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
-	return e.writeFile(dest, body, t.Sudo, perm, own)
+	return e.writeFile(dest, body, t.Sudo, perm, own, vars.Expand(t.Validate))
 }
 
 func actChown(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
@@ -1,6 +1,9 @@
 package porter
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 func init() {
 	register("backup", actBackup)
@@ -11,6 +14,7 @@ func init() {
 	register("rsync_install", actRsyncInstall)
 	register("rsync_check", actRsyncCheck)
 	register("rsync_version", actRsyncVersion)
+	register("sync_dir", actSyncDir)
 	register("download", actDownload)
 	register("upload_bytes", actUploadBytes)
 	register("read_file", actReadFile)
@@ -37,6 +41,18 @@ func actRsync(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars
 	return e.rsyncExec(src, dest, body, t.Sudo)
 }
 
+func actSyncDir(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	changes, err := e.syncDir(src, dest, e.parseSyncOpts(body), true)
+	if err != nil {
+		return err
+	}
+	e.noOp = len(changes) == 0
+	if t.Register != "" {
+		vars.Set(t.Register, strings.Join(changes, "\n"))
+	}
+	return nil
+}
+
 func actRsyncInstall(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
 	return e.rsyncInstall()
 }
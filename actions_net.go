@@ -5,6 +5,7 @@ import "strings"
 func init() {
 	register("curl", actCurl)
 	register("wget", actWget)
+	register("fetch", actFetch)
 	register("ping", actPing)
 	register("git_clone", actGitClone)
 	register("git_pull", actGitPull)
@@ -24,6 +25,10 @@ func actWget(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars)
 	return e.run("wget -q -O " + dest + " " + src)
 }
 
+func actFetch(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	return e.fetch(t, src, dest, perm, own, vars)
+}
+
 func actPing(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
 	return e.run("ping -c 1 " + dest)
 }
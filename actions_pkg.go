@@ -7,6 +7,10 @@ func init() {
 	register("apt_install", actAptInstall)
 	register("apt_remove", actAptRemove)
 	register("apt_upgrade", actAptUpgrade)
+	register("pkg", actPkg)
+	register("pkg_update", actPkgUpdate)
+	register("pkg_upgrade", actPkgUpgrade)
+	register("pkg_repo", actPkgRepo)
 	register("user_add", actUserAdd)
 	register("user_del", actUserDel)
 	register("user_mod", actUserMod)
@@ -43,6 +47,54 @@ func actAptUpgrade(e *Executor, t Task, src, dest, body, perm, own string, vars
 	return e.runSudo("DEBIAN_FRONTEND=noninteractive apt-get upgrade -y")
 }
 
+func actPkg(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	m, err := e.pkgManager()
+	if err != nil {
+		return err
+	}
+	changed, err := e.ensurePkg(m, t.State, parsePkgSpecs(dest))
+	e.noOp = err == nil && !changed
+	return err
+}
+
+func actPkgUpdate(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	m, err := e.pkgManager()
+	if err != nil {
+		return err
+	}
+	return e.runSudo(m.refresh)
+}
+
+func actPkgUpgrade(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	m, err := e.pkgManager()
+	if err != nil {
+		return err
+	}
+	before, err := e.runCapture(m.list)
+	if err != nil {
+		return fmt.Errorf("list packages: %w", err)
+	}
+	if err := e.runSudo(m.upgrade); err != nil {
+		return err
+	}
+	after, err := e.runCapture(m.list)
+	if err != nil {
+		return fmt.Errorf("list packages: %w", err)
+	}
+	e.noOp = before == after
+	return nil
+}
+
+func actPkgRepo(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	m, err := e.pkgManager()
+	if err != nil {
+		return err
+	}
+	changed, err := e.ensureRepo(m, t.State, dest, src, e.parseOpt(body, "key"))
+	e.noOp = err == nil && !changed
+	return err
+}
+
 func actUserAdd(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
 	return e.runSudo(e.buildUserCmd("useradd", dest, body))
 }
@@ -12,7 +12,7 @@ func actSecret(e *Executor, t Task, src, dest, body, perm, own string, vars *Var
 	if err != nil {
 		return err
 	}
-	return e.sftpWriteSecret(dest, plain, perm, own, t.Sudo)
+	return e.sftpWriteSecret(dest, plain, perm, own, t.Sudo, vars.Expand(t.Validate))
 }
 
 func actSecretCommand(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
@@ -20,7 +20,7 @@ func actSecretCommand(e *Executor, t Task, src, dest, body, perm, own string, va
 	if err != nil {
 		return err
 	}
-	return e.sftpWriteSecret(dest, plain, perm, own, t.Sudo)
+	return e.sftpWriteSecret(dest, plain, perm, own, t.Sudo, vars.Expand(t.Validate))
 }
 
 func actVerifyBlob(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
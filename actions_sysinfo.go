@@ -12,6 +12,7 @@ func init() {
 	register("require_disk", actRequireDisk)
 	register("require_memory", actRequireMemory)
 	register("require_command", actRequireCommand)
+	register("gather_facts", actGatherFacts)
 }
 
 func actDiskSpace(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
@@ -119,3 +120,11 @@ func actRequireCommand(e *Executor, t Task, src, dest, body, perm, own string, v
 	}
 	return nil
 }
+
+func actGatherFacts(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
+	f, err := e.gatherFacts()
+	if err != nil {
+		return err
+	}
+	return setFacts(vars, f)
+}
@@ -14,7 +14,7 @@ func init() {
 }
 
 func actReboot(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
-	return e.runSudo("reboot")
+	return e.reboot(e.parseOpt(body, "wait") == "true", t.Timeout)
 }
 
 func actShutdown(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
@@ -71,7 +71,7 @@ func actDaemonReload(e *Executor, t Task, src, dest, body, perm, own string, var
 }
 
 func actTemplate(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
-	return e.installTemplate(dest, body, t.User)
+	return e.installTemplate(dest, body, vars.Expand(t.Validate), t.User)
 }
 
 func actJournal(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) error {
@@ -1,5 +1,16 @@
 package porter
 
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
 // =============================================================================
 // ARCHIVE OPERATIONS
 // =============================================================================
@@ -9,7 +20,7 @@ func Tar(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "tar_create", Src: src, Dest: dest, Name: "Tar " + src}}
 }
 
-// Untar extracts a tar archive.
+// Untar extracts a tar archive. Unarchive is the idempotent form.
 func Untar(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "tar_extract", Src: src, Dest: dest, Name: "Untar " + src}}
 }
@@ -19,7 +30,8 @@ func TarGz(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "targz_create", Src: src, Dest: dest, Name: "TarGz " + src}}
 }
 
-// UntarGz extracts a gzip-compressed tar archive.
+// UntarGz extracts a gzip-compressed tar archive. Unarchive is the
+// idempotent form.
 func UntarGz(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "targz_extract", Src: src, Dest: dest, Name: "UntarGz " + src}}
 }
@@ -29,7 +41,187 @@ func Zip(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "zip_create", Src: src, Dest: dest, Name: "Zip " + src}}
 }
 
-// Unzip extracts a zip archive.
+// Unzip extracts a zip archive. Unarchive is the idempotent form.
 func Unzip(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "zip_extract", Src: src, Dest: dest, Name: "Unzip " + src}}
 }
+
+// =============================================================================
+// UNARCHIVE
+// =============================================================================
+
+// Unarchive extracts the archive src into dest, creating dest. src is a file
+// on the control machine, uploaded first, unless .RemoteSrc() says it is
+// already on the host. The format (tar, or tar compressed with gzip, xz, zstd
+// or bzip2, or zip) is detected from the archive's first bytes. A marker named
+// after the archive's sha256 is left in dest, so re-running with the same
+// archive reports ok without extracting again.
+func Unarchive(src, dest string) TaskBuilder {
+	return TaskBuilder{Task{Action: "unarchive", Src: src, Dest: dest, Name: "Unarchive " + src}}
+}
+
+// RemoteSrc marks an Unarchive's source as a path on the host.
+func (b TaskBuilder) RemoteSrc() TaskBuilder { return b.appendOpt("remote_src", "true") }
+
+// StripComponents drops the first n path components of every archive entry,
+// like tar --strip-components.
+func (b TaskBuilder) StripComponents(n int) TaskBuilder { return b.appendOpt("strip", itoa(n)) }
+
+// archiveMarker is the file Unarchive leaves in dest for the archive whose
+// sha256 is sum.
+func archiveMarker(dest, sum string) string {
+	return path.Join(dest, ".porter-unarchive-"+sum[:16])
+}
+
+// archiveMagic maps leading bytes to the compression or container they
+// identify. Anything else is taken to be a plain tar.
+var archiveMagic = []struct {
+	magic  []byte
+	format string
+}{
+	{[]byte{0x1f, 0x8b}, "gz"},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0}, "xz"},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, "zst"},
+	{[]byte("BZh"), "bz2"},
+	{[]byte("PK\x03\x04"), "zip"},
+}
+
+func archiveFormat(head []byte) string {
+	for _, m := range archiveMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.format
+		}
+	}
+	return "tar"
+}
+
+// extractCmd returns the shell command extracting the archive at src (a shell
+// word), of the given format, into the existing directory dest.
+func extractCmd(format, src, dest string, strip int) string {
+	s, d := src, shellEscape(dest)
+	if format == "zip" {
+		if strip == 0 {
+			return "unzip -q -o " + s + " -d " + d
+		}
+		// unzip cannot strip: extract aside, then copy what sits strip levels down.
+		n := itoa(strip)
+		return `tmp=$(mktemp -d) && unzip -q -o ` + s + ` -d "$tmp" && ` +
+			`(cd "$tmp" && find . -mindepth ` + n + ` -maxdepth ` + n + ` -exec cp -a {} ` + d + `/ \;); ` +
+			`rc=$?; rm -rf "$tmp"; [ $rc -eq 0 ]`
+	}
+	flags := map[string]string{"tar": "-xf", "gz": "-xzf", "xz": "-xJf", "bz2": "-xjf", "zst": "-I zstd -xf"}[format]
+	cmd := "tar " + flags + " " + s + " -C " + d
+	if strip > 0 {
+		cmd += " --strip-components=" + itoa(strip)
+	}
+	return cmd
+}
+
+// unarchiveOpts are an Unarchive's options parsed from the task body.
+type unarchiveOpts struct {
+	remote bool
+	strip  int
+}
+
+func (e *Executor) parseUnarchiveOpts(body string) (unarchiveOpts, error) {
+	o := unarchiveOpts{remote: e.parseOpt(body, "remote_src") == "true"}
+	if v := e.parseOpt(body, "strip"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return o, fmt.Errorf("unarchive: strip %q is not a count of path components", v)
+		}
+		o.strip = n
+	}
+	return o, nil
+}
+
+// archiveInfo returns the sha256 and first bytes of the archive at src, on
+// the host when remote is set and on the control machine otherwise.
+func (e *Executor) archiveInfo(src string, remote, sudo bool) (sum string, head []byte, err error) {
+	if !remote {
+		if sum, err = fileSHA256(src); err != nil {
+			return "", nil, err
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return "", nil, err
+		}
+		defer f.Close()
+		head = make([]byte, 6)
+		n, err := io.ReadFull(f, head)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return "", nil, fmt.Errorf("read local %s: %w", src, err)
+		}
+		return sum, head[:n], nil
+	}
+	if sum = e.remoteDigest("sha256", src, sudo); sum == "" {
+		return "", nil, fmt.Errorf("unarchive: cannot read %s on the host", src)
+	}
+	out, err := e.runCaptureMaybeSudo(sudo, "od -An -tx1 -N6 "+shellEscape(src))
+	if err != nil {
+		return "", nil, err
+	}
+	head, err = hex.DecodeString(strings.Join(strings.Fields(out), ""))
+	return sum, head, err
+}
+
+// unarchive extracts src into dest unless the marker for this archive is
+// already there, setting e.noOp in that case.
+func (e *Executor) unarchive(t Task, src, dest, body, own string) error {
+	o, err := e.parseUnarchiveOpts(body)
+	if err != nil {
+		return err
+	}
+	sum, head, err := e.archiveInfo(src, o.remote, t.Sudo)
+	if err != nil {
+		return err
+	}
+	marker := archiveMarker(dest, sum)
+	if _, err := e.runCaptureMaybeSudo(t.Sudo, "test -e "+shellEscape(marker)); err == nil {
+		e.noOp = true
+		return nil
+	}
+
+	archive := shellEscape(src)
+	if !o.remote {
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		tr := e.newTransfer(info.Size())
+		part, err := e.stageUpload(tr, src, sum, info.Size(), false)
+		tr.finish(src)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = e.run("rm -f " + shellEscape(part)) }()
+		archive = shellEscape(part)
+	}
+	extract := func(archive string) string {
+		cmd := "mkdir -p " + shellEscape(dest) + " && " + extractCmd(archiveFormat(head), archive, dest, o.strip) +
+			" && touch " + shellEscape(marker)
+		if own != "" {
+			cmd += " && chown -R " + shellEscape(own) + " " + shellEscape(dest)
+		}
+		return cmd
+	}
+	if o.remote {
+		return e.runMaybeSudo(t.Sudo, extract(archive))
+	}
+	_, err = e.runOnStaged(archive, t.Sudo, extract)
+	return err
+}
+
+// unarchivePending reports whether an Unarchive would extract, for dry-run.
+func (e *Executor) unarchivePending(t Task, src, dest, body string) (bool, error) {
+	o, err := e.parseUnarchiveOpts(body)
+	if err != nil {
+		return true, err
+	}
+	sum, _, err := e.archiveInfo(src, o.remote, t.Sudo)
+	if err != nil {
+		return true, err
+	}
+	_, err = e.runCaptureMaybeSudo(t.Sudo, "test -e "+shellEscape(archiveMarker(dest, sum)))
+	return err != nil, nil
+}
@@ -0,0 +1,78 @@
+package porter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveFormatAndExtractCmd(t *testing.T) {
+	for head, want := range map[string]string{
+		"\x1f\x8b\x08\x00":         "gz",
+		"\xfd7zXZ\x00":             "xz",
+		"\x28\xb5\x2f\xfd":         "zst",
+		"BZh91":                    "bz2",
+		"PK\x03\x04\x14":           "zip",
+		"app/\x00\x00\x00\x00\x00": "tar",
+	} {
+		if got := archiveFormat([]byte(head)); got != want {
+			t.Errorf("archiveFormat(%q) = %s, want %s", head, got, want)
+		}
+	}
+
+	if got := extractCmd("zst", shellEscape("/tmp/a b.tzst"), "/srv/app", 1); got != "tar -I zstd -xf '/tmp/a b.tzst' -C '/srv/app' --strip-components=1" {
+		t.Errorf("zst = %q", got)
+	}
+	if got := extractCmd("zip", shellEscape("a.zip"), "/srv/app", 0); got != "unzip -q -o 'a.zip' -d '/srv/app'" {
+		t.Errorf("zip = %q", got)
+	}
+	if got := extractCmd("zip", shellEscape("a.zip"), "/srv/app", 2); !strings.Contains(got, "-mindepth 2 -maxdepth 2 -exec cp -a {} '/srv/app'/") {
+		t.Errorf("zip strip = %q", got)
+	}
+}
+
+func TestUnarchiveRemoteSrcIsIdempotent(t *testing.T) {
+	sum := sha256Hex("archive")
+	marker := "'/srv/app/.porter-unarchive-" + sum[:16] + "'"
+	fr := &fakeRunner{rules: []rule{
+		{contains: "sha256sum '/tmp/app.tar.gz'", out: sum},
+		{contains: "od -An -tx1", out: " 1f 8b 08 00 00 00\n"},
+		{contains: "test -e " + marker, err: exitErr(1)},
+	}}
+	task := Unarchive("/tmp/app.tar.gz", "/srv/app").RemoteSrc().StripComponents(1).Owner("app:app").Sudo().Build()
+	changed, err := newTestExec(fr).exec(task, NewVars())
+	if err != nil || !changed {
+		t.Fatalf("changed=%v err=%v", changed, err)
+	}
+	want := "mkdir -p '/srv/app' && tar -xzf '/tmp/app.tar.gz' -C '/srv/app' --strip-components=1 && touch " + marker +
+		" && chown -R 'app:app' '/srv/app'"
+	if !fr.ran(want) {
+		t.Errorf("calls = %q, want %q", fr.calls, want)
+	}
+
+	fr.rules[2] = rule{contains: "test -e " + marker}
+	fr.calls = nil
+	changed, err = newTestExec(fr).exec(task, NewVars())
+	if err != nil || changed || fr.ran("tar -x") {
+		t.Errorf("second run: changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+}
+
+func TestUnarchiveLocalSrcSkipsUploadWhenExtracted(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "site.zip")
+	if err := os.WriteFile(local, []byte("PK\x03\x04rest"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256Hex("PK\x03\x04rest")
+	rel := NewRelease("/srv/site")
+	fr := &fakeRunner{rules: []rule{{contains: "test -e '" + rel.Dir() + "/.porter-unarchive-" + sum[:16] + "'"}}}
+	changed, err := newTestExec(fr).exec(rel.Unarchive(local).Build(), NewVars())
+	if err != nil || changed || fr.ran(partialDir) {
+		t.Errorf("changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+
+	if _, err := newTestExec(fr).exec(Unarchive(local, "/x").StripComponents(-1).Build(), NewVars()); err == nil {
+		t.Error("negative strip accepted")
+	}
+}
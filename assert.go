@@ -49,7 +49,7 @@ func AssertFileContains(file, substr string) TaskBuilder {
 	return TaskBuilder{t: Task{Action: "assert_file_contains", Dest: file, Body: substr, Name: "assert file contains: " + file}}
 }
 
-// AssertPackageInstalled fails unless the apt package is installed.
+// AssertPackageInstalled fails unless the package is installed.
 func AssertPackageInstalled(name string) TaskBuilder {
 	return TaskBuilder{t: Task{Action: "assert_package", Dest: name, Name: "assert package installed: " + name}}
 }
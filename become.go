@@ -0,0 +1,216 @@
+package porter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// =============================================================================
+// BECOME (privilege escalation)
+// =============================================================================
+//
+// Tasks marked .Sudo() — and every helper that escalates — run through the
+// executor's Become strategy. The default is the original one: the executor's
+// password piped into `sudo -S`. SetBecome picks another method, a target
+// user other than root, a password source, and extra flags:
+//
+//	e.SetBecome(porter.Become{Password: porter.NoPassword()})       // NOPASSWD sudo: sudo -n
+//	e.SetBecome(porter.Become{Method: porter.BecomeDoas})           // doas -n (needs a nopass rule)
+//	e.SetBecome(porter.Become{User: "app"})                         // sudo -u app
+//	e.SetBecome(porter.Become{Password: porter.EnvPassword("SUDO_PASS")})
+//
+// .BecomeUser("postgres") runs a single task as that user. doas, run0 and
+// pkexec cannot take a password without a terminal, so they are run
+// non-interactively and need a rule allowing the command (doas `nopass`, a
+// polkit rule). su is given the password on stdin, which most su builds refuse
+// without a terminal; it is mainly for a root login reaching a service
+// account, which needs no password and works under a nologin shell. A become
+// user other than root cannot read the files porter stages as the SSH user,
+// so writes, uploads and extractions hand it a copy over stdin.
+
+// Become methods.
+const (
+	BecomeSudo   = "sudo"
+	BecomeDoas   = "doas"
+	BecomeSu     = "su"
+	BecomeRun0   = "run0"
+	BecomePkexec = "pkexec"
+)
+
+// PasswordSource supplies the escalation password. It is called once per run.
+type PasswordSource func() (string, error)
+
+// StaticPassword is a PasswordSource for a fixed password.
+func StaticPassword(p string) PasswordSource { return func() (string, error) { return p, nil } }
+
+// EnvPassword reads the password from the control machine's environment.
+func EnvPassword(name string) PasswordSource {
+	return func() (string, error) {
+		p, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("become: $%s is not set", name)
+		}
+		return p, nil
+	}
+}
+
+// NoPassword is the PasswordSource for passwordless escalation (NOPASSWD
+// sudo): sudo is run with -n so it fails instead of waiting for a password.
+func NoPassword() PasswordSource { return StaticPassword("") }
+
+// Become is a privilege-escalation strategy. The zero value pipes the
+// executor's password into sudo to become root.
+type Become struct {
+	Method   string         // BecomeSudo (default), BecomeDoas, BecomeSu, BecomeRun0, BecomePkexec
+	User     string         // user to become; "" is root
+	Password PasswordSource // nil: the executor's password
+	Flags    []string       // extra flags for the escalation command
+}
+
+// SetBecome sets how the executor escalates privileges.
+func (e *Executor) SetBecome(b Become) *Executor {
+	e.become = b
+	e.becomePass = nil
+	return e
+}
+
+// BecomeUser runs the task as user through the executor's Become method
+// (sudo -u user by default). It implies Sudo.
+func (b TaskBuilder) BecomeUser(user string) TaskBuilder {
+	b.t.BecomeUser = user
+	b.t.Sudo = true
+	return b
+}
+
+// resolveBecome fetches the Become password once, at the start of a run, so
+// a failing source fails the run rather than each escalated command.
+func (e *Executor) resolveBecome() error {
+	if e.become.Password == nil || e.becomePass != nil {
+		return nil
+	}
+	p, err := e.become.Password()
+	if err != nil {
+		return err
+	}
+	e.becomePass = &p
+	return nil
+}
+
+// becomePassword is the password to send to the escalation method; piped
+// is false when none is sent at all.
+func (e *Executor) becomePassword() (password string, piped bool) {
+	if e.become.Password == nil {
+		return e.password, true
+	}
+	if e.becomePass == nil {
+		// Escalating outside a run: resolve on first use. A failing source
+		// sends no password, so the method fails rather than hangs.
+		if err := e.resolveBecome(); err != nil {
+			return "", false
+		}
+	}
+	return *e.becomePass, *e.becomePass != ""
+}
+
+// becomeTarget is the user the command in flight escalates to.
+func (e *Executor) becomeTarget() string {
+	if e.becomeUser != "" {
+		return e.becomeUser
+	}
+	return e.become.User
+}
+
+// becomeCommand is cmd wrapped in the escalation method, without the
+// password: with piped, the method reads it as the first line of its stdin.
+// fresh makes sudo ignore a cached credential, so it always consumes that
+// line (needed when the rest of stdin is the command's).
+func (e *Executor) becomeCommand(cmd string, fresh bool) (line, password string, piped bool) {
+	password, piped = e.becomePassword()
+	user := e.becomeTarget()
+	args := func(fixed ...string) string {
+		return strings.Join(slices.Concat(fixed, e.become.Flags), " ")
+	}
+	userOpt := func(flag string) []string {
+		if user == "" {
+			return nil
+		}
+		return []string{flag + shellEscape(user)}
+	}
+	sh := "sh -c " + shellEscape(cmd)
+
+	switch e.become.Method {
+	case BecomeDoas:
+		return args(slices.Concat([]string{"doas", "-n"}, userOpt("-u "))...) + " " + sh, "", false
+	case BecomeRun0:
+		return args(slices.Concat([]string{"run0", "--no-ask-password"}, userOpt("--user="))...) + " /bin/" + sh, "", false
+	case BecomePkexec:
+		return args(slices.Concat([]string{"pkexec", "--disable-internal-agent"}, userOpt("--user "))...) + " /bin/" + sh, "", false
+	case BecomeSu:
+		if user == "" {
+			user = "root"
+		}
+		return args("su") + " -s /bin/sh -c " + shellEscape(cmd) + " " + shellEscape(user), password, piped
+	}
+	if !piped {
+		return args(slices.Concat([]string{"sudo", "-n"}, userOpt("-u "))...) + " " + sh, "", false
+	}
+	fixed := []string{"sudo", "-S", "-p", "''"}
+	if fresh {
+		fixed = []string{"sudo", "-k", "-S", "-p", "''"}
+	}
+	return args(slices.Concat(fixed, userOpt("-u "))...) + " " + sh, password, true
+}
+
+// escalate wraps cmd so it runs under the Become strategy, feeding the
+// password (if any) with printf. See sudo for why cmd goes through sh -c.
+func (e *Executor) escalate(cmd string) string {
+	line, password, piped := e.becomeCommand(cmd, false)
+	if !piped {
+		return line
+	}
+	return "printf '%s\\n' " + shellEscape(password) + " | " + line
+}
+
+// escalateStdin is sudoStdinCommand under the Become strategy: cmd escalated
+// to read file on its stdin, behind the password line when there is one.
+func (e *Executor) escalateStdin(cmd string, file io.Reader) (string, io.Reader) {
+	if e.become.Method == "" && e.become.Password == nil && e.becomeTarget() == "" && len(e.become.Flags) == 0 {
+		return sudoStdinCommand(cmd, e.password, true, file)
+	}
+	line, password, piped := e.becomeCommand(cmd, true)
+	if !piped {
+		return line, file
+	}
+	return line, io.MultiReader(strings.NewReader(password+"\n"), file)
+}
+
+// becomesUser reports whether sudo escalates to a user other than root, who
+// cannot read the files the SSH user stages privately (mktemp, partialDir).
+func (e *Executor) becomesUser(sudo bool) bool {
+	user := e.becomeTarget()
+	return sudo && user != "" && user != "root"
+}
+
+// runOnStaged runs cmd(path) escalated when sudo is set, path being the
+// staged file at tmp (a shell word). A become user other than root is given
+// a private copy with the same mode instead, which it writes from the
+// staged file piped to its stdin.
+func (e *Executor) runOnStaged(tmp string, sudo bool, cmd func(path string) string) (string, error) {
+	if !e.becomesUser(sudo) {
+		return e.runCaptureMaybeSudo(sudo, cmd(tmp))
+	}
+	mode, err := e.runCapture("stat -c %a " + tmp)
+	if err != nil {
+		return "", err
+	}
+	script := `t=$(mktemp) && cat > "$t" && chmod ` + mode + ` "$t" && ` + cmd(`"$t"`) + `; rc=$?; rm -f "$t"; exit $rc`
+	line, password, piped := e.becomeCommand(script, true)
+	feed := "cat " + tmp
+	if piped {
+		feed = "{ printf '%s\\n' " + shellEscape(password) + "; cat " + tmp + "; }"
+	}
+	return e.runCapture(feed + " | " + line)
+}
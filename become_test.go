@@ -0,0 +1,135 @@
+package porter
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEscalateMethods(t *testing.T) {
+	cases := []struct {
+		b    Become
+		want string
+	}{
+		{Become{}, `printf '%s\n' 'pw' | sudo -S -p '' sh -c 'id -u'`},
+		{Become{User: "app", Flags: []string{"-H"}}, `printf '%s\n' 'pw' | sudo -S -p '' -u 'app' -H sh -c 'id -u'`},
+		{Become{Password: NoPassword()}, `sudo -n sh -c 'id -u'`},
+		{Become{Password: StaticPassword("it's")}, `printf '%s\n' 'it'\''s' | sudo -S -p '' sh -c 'id -u'`},
+		{Become{Method: BecomeDoas, User: "app"}, `doas -n -u 'app' sh -c 'id -u'`},
+		{Become{Method: BecomeRun0}, `run0 --no-ask-password /bin/sh -c 'id -u'`},
+		{Become{Method: BecomePkexec, User: "app"}, `pkexec --disable-internal-agent --user 'app' /bin/sh -c 'id -u'`},
+		{Become{Method: BecomeSu, Password: NoPassword(), User: "app"}, `su -s /bin/sh -c 'id -u' 'app'`},
+		{Become{Method: BecomeSu, Flags: []string{"-l"}}, `printf '%s\n' 'pw' | su -l -s /bin/sh -c 'id -u' 'root'`},
+	}
+	for _, c := range cases {
+		e := (&Executor{password: "pw"}).SetBecome(c.b)
+		if got := e.sudo("id -u"); got != c.want {
+			t.Errorf("%+v:\n got %s\nwant %s", c.b, got, c.want)
+		}
+	}
+}
+
+func TestEscalateStdin(t *testing.T) {
+	read := func(r io.Reader) string { b, _ := io.ReadAll(r); return string(b) }
+
+	e := &Executor{password: "pw"}
+	cmd, in := e.escalateStdin("docker load", strings.NewReader("IMG"))
+	if cmd != "sudo -k -S -p '' docker load" || read(in) != "pw\nIMG" {
+		t.Errorf("default: %q", cmd)
+	}
+
+	e.SetBecome(Become{User: "app"})
+	cmd, in = e.escalateStdin("docker load", strings.NewReader("IMG"))
+	if cmd != "sudo -k -S -p '' -u 'app' sh -c 'docker load'" || read(in) != "pw\nIMG" {
+		t.Errorf("user: %q", cmd)
+	}
+
+	e.SetBecome(Become{Method: BecomeDoas})
+	cmd, in = e.escalateStdin("docker load", strings.NewReader("IMG"))
+	if cmd != "doas -n sh -c 'docker load'" || read(in) != "IMG" {
+		t.Errorf("doas: %q", cmd)
+	}
+}
+
+func TestBecomeUserPerTask(t *testing.T) {
+	fr := &fakeRunner{}
+	e := newTestExec(fr)
+	_, err := e.Run("db", Tasks(
+		Run("psql -c 'select 1'").BecomeUser("postgres"),
+		Run("systemctl restart app").Sudo(),
+	), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fr.calls) != 2 ||
+		!strings.Contains(fr.calls[0], "sudo -S -p '' -u 'postgres' sh -c ") ||
+		!strings.Contains(fr.calls[1], "sudo -S -p '' sh -c ") {
+		t.Errorf("calls = %q", fr.calls)
+	}
+}
+
+func TestBecomePasswordSource(t *testing.T) {
+	t.Setenv("PORTER_TEST_BECOME", "s3cret")
+	var lines []string
+	fr := &fakeRunner{rules: []rule{{contains: "cat", out: "token s3cret\n"}}}
+	e := newTestExec(fr).SetBecome(Become{Password: EnvPassword("PORTER_TEST_BECOME")}).
+		OnOutput(func(p TaskProgress, ev StreamEvent) { lines = append(lines, ev.Data) })
+	e.runner = streamFake{fr}
+	if _, err := e.Run("x", Tasks(Run("cat token").Sudo()), NewVars()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fr.calls[0], "'s3cret' | sudo -S") {
+		t.Errorf("calls = %q", fr.calls)
+	}
+	if len(lines) != 1 || slices.ContainsFunc(lines, func(l string) bool { return strings.Contains(l, "s3cret") }) {
+		t.Errorf("password leaked into output: %q", lines)
+	}
+
+	fr = &fakeRunner{}
+	_, err := newTestExec(fr).SetBecome(Become{Password: EnvPassword("PORTER_TEST_UNSET")}).
+		Run("x", Tasks(Run("id").Sudo()), NewVars())
+	if err == nil || !strings.Contains(err.Error(), "PORTER_TEST_UNSET") || len(fr.calls) != 0 {
+		t.Errorf("err = %v, calls = %q", err, fr.calls)
+	}
+}
+
+func TestBecomeUserPlacesStagedCopy(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{
+		{contains: "mktemp", out: "/tmp/tmp.abc\n"},
+		{contains: "stat -c %a /tmp/tmp.abc", out: "600\n"},
+	}}
+	e := newTestExec(fr)
+	if _, err := e.Run("x", Tasks(Write("/srv/app/config", "x").Mode("0640").BecomeUser("app")), NewVars()); err != nil {
+		t.Fatal(err)
+	}
+	var place string
+	for _, c := range fr.calls {
+		if strings.Contains(c, "install -m") {
+			place = c
+		}
+	}
+	want := `{ printf '%s\n' ''; cat /tmp/tmp.abc; } | sudo -k -S -p '' -u 'app' sh -c ` +
+		shellEscape(`t=$(mktemp) && cat > "$t" && chmod 600 "$t" && install -m 0640 "$t" /srv/app/config; rc=$?; rm -f "$t"; exit $rc`)
+	if place != want {
+		t.Errorf("place:\n got %s\nwant %s", place, want)
+	}
+
+	fr.calls = nil
+	if _, err := e.Run("x", Tasks(Write("/etc/app.conf", "x").Mode("0640").Sudo()), NewVars()); err != nil {
+		t.Fatal(err)
+	}
+	if !fr.ran("install -m 0640 /tmp/tmp.abc /etc/app.conf") || fr.ran("stat -c") {
+		t.Errorf("root: calls = %q", fr.calls)
+	}
+}
+
+func TestPlaybookBecomeUser(t *testing.T) {
+	tasks, err := (&Playbook{Tasks: []PlaybookTask{{Action: "run", Body: "id", BecomeUser: "app"}}}).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tasks[0].Sudo || tasks[0].BecomeUser != "app" {
+		t.Errorf("task = %+v", tasks[0])
+	}
+}
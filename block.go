@@ -0,0 +1,153 @@
+package porter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// =============================================================================
+// BLOCK / RESCUE / ALWAYS
+//
+// A Block groups tasks so a failure can be recovered instead of aborting the
+// run: if a task in the block fails, the Rescue tasks run (a rollback, say);
+// the Always tasks run afterwards whatever happened (re-enable the load
+// balancer member). The failures a rescued block recovered from count in
+// Stats.Rescued instead of Failed. Nested tasks report progress under the
+// block's Index, like Loop iterations, and their spans are children of the
+// block's span.
+// =============================================================================
+
+// Block groups tasks into one unit with optional Rescue and Always sections.
+// When, Loop, Ignore and Name apply to the block as a whole.
+//
+// Example:
+//
+//	porter.Block(
+//	    porter.Run("lb-ctl disable {{host}}"),
+//	    porter.Run("/opt/app/bin/migrate"),
+//	    porter.Svc("app").Restart().Sudo(),
+//	).Rescue(
+//	    porter.Rollback("/opt/app"),
+//	).Always(
+//	    porter.Run("lb-ctl enable {{host}}"),
+//	).Name("Rolling deploy")
+func Block(tasks ...TaskBuilder) TaskBuilder {
+	return TaskBuilder{Task{Action: "block", Name: "Block", Tasks: Tasks(tasks...)}}
+}
+
+// Rescue sets the tasks a Block runs when one of its tasks fails. If they
+// succeed the block is reported as rescued and the run continues.
+func (b TaskBuilder) Rescue(tasks ...TaskBuilder) TaskBuilder {
+	b.t.Rescue = Tasks(tasks...)
+	return b
+}
+
+// Always sets the tasks a Block runs after its tasks and any Rescue, whether
+// they succeeded or not. They are skipped only when the run is cancelled.
+func (b TaskBuilder) Always(tasks ...TaskBuilder) TaskBuilder {
+	b.t.Always = Tasks(tasks...)
+	return b
+}
+
+// runBlock runs a Block's sections and reports the block's own outcome.
+func (e *Executor) runBlock(idx int, block Task, vars *Vars, stats *Stats) error {
+	name := vars.Expand(block.Name)
+	progress := TaskProgress{
+		Index:      idx,
+		Total:      stats.Total,
+		Name:       name,
+		Action:     block.Action,
+		Status:     StatusRunning,
+		Attempt:    1,
+		MaxAttempt: 1,
+		StartTime:  time.Now(),
+		When:       block.WhenExpr,
+	}
+	defer func() { e.logTask(progress) }()
+
+	if e.verbose {
+		log.Printf("\033[1;34mBLOCK\033[0m %s", name)
+	}
+	e.emitProgress(progress)
+
+	span := e.tracer.StartSpan("block "+name, e.parentSpanID)
+	if span != nil {
+		prev := e.parentSpanID
+		e.parentSpanID = span.ID()
+		defer func() { e.parentSpanID = prev }()
+	}
+
+	changedBefore, failedBefore := stats.Changed, stats.Failed
+	rescued := false
+	// The block's entry in Total passes to the tasks it runs (see Stats).
+	stats.Total--
+
+	err := e.runSection(idx, block.Tasks, vars, stats)
+	if err != nil && len(block.Rescue) > 0 && e.taskCtx().Err() == nil {
+		if e.verbose {
+			log.Printf("\033[1;34mRESCUE\033[0m %s: %v", name, err)
+		}
+		if rerr := e.runSection(idx, block.Rescue, vars, stats); rerr != nil {
+			err = fmt.Errorf("%w; rescue failed: %w", err, rerr)
+		} else {
+			stats.Rescued += stats.Failed - failedBefore // recovered: not failures
+			stats.Failed = failedBefore
+			rescued = true
+			err = nil
+		}
+	}
+	if len(block.Always) > 0 && e.taskCtx().Err() == nil {
+		if e.verbose {
+			log.Printf("\033[1;34mALWAYS\033[0m %s", name)
+		}
+		if aerr := e.runSection(idx, block.Always, vars, stats); aerr != nil {
+			err = errors.Join(err, aerr)
+		}
+	}
+
+	changed := stats.Changed > changedBefore
+	if span != nil {
+		span.SetAttribute("porter.action", block.Action)
+		span.SetAttribute("porter.changed", changed && err == nil)
+		span.SetAttribute("porter.rescued", rescued)
+		span.End(err)
+	}
+
+	progress.Duration = time.Since(progress.StartTime)
+	switch {
+	case err != nil && e.taskCtx().Err() != nil:
+		progress.Status = StatusCancelled
+		progress.Error = e.taskCtx().Err()
+	case err != nil:
+		progress.Status = StatusFailed
+		progress.Error = err
+	case rescued:
+		progress.Status = StatusRescued
+	case changed:
+		progress.Status = StatusChanged
+	default:
+		progress.Status = StatusOK
+	}
+	e.emitProgress(progress)
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// runSection runs one section of a Block, stopping at the first failure.
+func (e *Executor) runSection(idx int, tasks []Task, vars *Vars, stats *Stats) error {
+	for _, t := range tasks {
+		if err := e.taskCtx().Err(); err != nil {
+			return err
+		}
+		stats.Total++
+		if err := e.step(idx, t, vars, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package porter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBlockRescueRecoversAndAlwaysRuns(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{{contains: "migrate", err: errors.New("exit 1")}}}
+	e := newTestExec(fr)
+	var blockStatus TaskStatus
+	e.OnProgress(func(p TaskProgress) {
+		if p.Action == "block" {
+			blockStatus = p.Status
+		}
+	})
+	tasks := Tasks(
+		Block(Run("migrate"), Run("never reached")).
+			Rescue(Run("rollback")).
+			Always(Run("lb enable")),
+		Run("after"),
+	)
+	stats, err := e.Run("deploy", tasks, NewVars())
+	if err != nil {
+		t.Fatalf("a rescued block must not fail the run: %v", err)
+	}
+	if fr.ran("never reached") {
+		t.Error("tasks after the failure in the block must not run")
+	}
+	for _, c := range []string{"rollback", "lb enable", "after"} {
+		if !fr.ran(c) {
+			t.Errorf("%q should have run", c)
+		}
+	}
+	if stats.Rescued != 1 || stats.Failed != 0 {
+		t.Errorf("stats = %+v, want rescued=1 failed=0", stats)
+	}
+	if blockStatus != StatusRescued {
+		t.Errorf("block progress = %s, want rescued", blockStatus)
+	}
+}
+
+func TestStatsOutcomesAddUpToTotal(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{{contains: "fail", err: errors.New("exit 1")}}}
+	var lastTotal int
+	e := newTestExec(fr).OnProgress(func(p TaskProgress) { lastTotal = p.Total })
+	stats, err := e.Run("deploy", Tasks(
+		Run("a"),
+		Run("b").When(IfEquals("env", "prod")),
+		Run("c {{item}}").Loop("1", "2", "3"),
+		Block(Run("fail"), Run("never")).Rescue(Run("rollback")).Always(Run("lb enable")),
+		Block(Block(Run("x")), Run("y").Notify("h")).Loop("1", "2"),
+		Run("fail too").Ignore(),
+		Handler("h", Run("h1"), Run("h2")),
+	), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a, b, c×3, fail+rollback+lb enable, (x, y)×2, fail too, h1, h2
+	if stats.Total != 15 || lastTotal != 15 {
+		t.Errorf("Total = %d (progress %d), want 15", stats.Total, lastTotal)
+	}
+	if sum := stats.OK + stats.Skipped + stats.Failed + stats.Cancelled + stats.Rescued; sum != stats.Total {
+		t.Errorf("outcomes add up to %d: %+v", sum, stats)
+	}
+	if stats.Skipped != 1 || stats.Rescued != 1 || stats.Failed != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestBlockWithoutRescueFailsAfterAlways(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{{contains: "migrate", err: errors.New("exit 1")}}}
+	tasks := Tasks(
+		Block(Run("migrate")).Always(Run("lb enable")).Name("Deploy"),
+		Run("after"),
+	)
+	stats, err := newTestExec(fr).Run("deploy", tasks, NewVars())
+	if err == nil || !strings.HasPrefix(err.Error(), "Deploy: ") {
+		t.Fatalf("err = %v, want the block's failure", err)
+	}
+	if !fr.ran("lb enable") {
+		t.Error("Always must run after a failure")
+	}
+	if fr.ran("after") {
+		t.Error("the run must stop after an unrescued block")
+	}
+	if stats.Failed != 1 || stats.Rescued != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestBlockRescueFailureFailsBlock(t *testing.T) {
+	fr := &fakeRunner{fallErr: errors.New("exit 1")}
+	_, err := newTestExec(fr).Run("deploy", Tasks(Block(Run("a")).Rescue(Run("b"))), NewVars())
+	if err == nil || !strings.Contains(err.Error(), "rescue failed") {
+		t.Fatalf("err = %v, want rescue failure", err)
+	}
+}
+
+func TestBlockSpanIsParentOfTaskSpans(t *testing.T) {
+	var buf bytes.Buffer
+	e := newTestExec(&fakeRunner{}).SetTracer(NewTracer(&buf, "", ""))
+	if _, err := e.Run("deploy", Tasks(Block(Run("a"), Run("b")).Name("grp")), NewVars()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	spans := map[string]Span{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var s Span
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		spans[s.Name] = s
+	}
+	block, ok := spans["block grp"]
+	if !ok {
+		t.Fatalf("no block span in %v", spans)
+	}
+	for _, n := range []string{"run Run: a", "run Run: b"} {
+		if spans[n].ParentID != block.SpanID {
+			t.Errorf("%s parent = %q, want block span %q", n, spans[n].ParentID, block.SpanID)
+		}
+	}
+}
@@ -37,6 +37,14 @@ func (b TaskBuilder) Loop(items ...string) TaskBuilder { b.t.Loop = items; retur
 // Ignore continues execution even if this task fails.
 func (b TaskBuilder) Ignore() TaskBuilder { b.t.Ignore = true; return b }
 
+// Notify queues the named handlers to run at the next flush (the end of the
+// run, or an explicit FlushHandlers task) if this task changed something.
+// Each handler runs at most once per flush however many tasks notify it.
+func (b TaskBuilder) Notify(handlers ...string) TaskBuilder {
+	b.t.Notify = append(b.t.Notify, handlers...)
+	return b
+}
+
 // Creates skips the task if the specified path already exists.
 func (b TaskBuilder) Creates(path string) TaskBuilder { b.t.Creates = path; return b }
 
@@ -45,6 +53,18 @@ func (b TaskBuilder) Creates(path string) TaskBuilder { b.t.Creates = path; retu
 // local tar into `docker load` without ever writing it to the target's disk.
 func (b TaskBuilder) StdinFile(path string) TaskBuilder { b.t.StdinFile = path; return b }
 
+// Validate runs cmd against the staged new content before it replaces the
+// file — %s is the staged path, e.g. "nginx -t -c %s", "visudo -cf %s" or
+// "sshd -t -f %s" — and fails the task, leaving the live file untouched, if
+// cmd exits non-zero. It runs under sudo with .Sudo(). Honoured by Write,
+// EnsureFile, EnsureSystemdKey, Template, Upload, Secret, SecretCommand and
+// the file edits (EnsureLine, EnsureBlock, ...); not run in dry-run.
+func (b TaskBuilder) Validate(cmd string) TaskBuilder { b.t.Validate = cmd; return b }
+
+// Sensitive marks the task's content as secret: with SetDiff, its diff shows
+// which lines changed but not what they hold.
+func (b TaskBuilder) Sensitive() TaskBuilder { b.t.Sensitive = true; return b }
+
 // =============================================================================
 // PRIVILEGE ESCALATION
 // =============================================================================
@@ -94,6 +114,16 @@ func (b TaskBuilder) Timeout(d string) TaskBuilder {
 	return b
 }
 
+// Deadline bounds the task's total wall time, retries and retry delays
+// included. When it passes, the command in flight is killed on the remote and
+// the task fails (it is not retried).
+func (b TaskBuilder) Deadline(d string) TaskBuilder {
+	if dur, err := time.ParseDuration(d); err == nil {
+		b.t.Deadline = dur
+	}
+	return b
+}
+
 // =============================================================================
 // INTERNAL HELPERS
 // =============================================================================
@@ -1,5 +1,7 @@
 package porter
 
+import "strings"
+
 // When is a condition function that determines if a task should run.
 type When func(*Vars) bool
 
@@ -16,10 +18,15 @@ func If(key string) When { return func(v *Vars) bool { return v.GetBool(key) } }
 func IfNot(key string) When { return func(v *Vars) bool { return !v.GetBool(key) } }
 
 // IfSet returns true if the variable is set (non-empty).
-func IfSet(key string) When { return func(v *Vars) bool { return v.Get(key) != "" } }
+// Neither it nor IfNotSet counts as an undefined reference in strict mode.
+func IfSet(key string) When {
+	return func(v *Vars) bool { s, _ := v.lookup(key); return s != "" }
+}
 
 // IfNotSet returns true if the variable is not set (empty).
-func IfNotSet(key string) When { return func(v *Vars) bool { return v.Get(key) == "" } }
+func IfNotSet(key string) When {
+	return func(v *Vars) bool { s, _ := v.lookup(key); return s == "" }
+}
 
 // IfEquals returns true if the variable equals the given value.
 func IfEquals(key, val string) When { return func(v *Vars) bool { return v.Get(key) == val } }
@@ -53,3 +60,25 @@ func Or(conds ...When) When {
 		return false
 	}
 }
+
+// IfTemplate renders tmpl as a text/template against the run's Vars (in
+// either expansion mode; see SetTemplates for the filters) and is true
+// unless the result is empty, "false" or "0" — e.g.
+// IfTemplate(`{{and (eq .env "prod") .hosts}}`). A template error is reported
+// as the task's failure in strict mode and otherwise evaluates false.
+func IfTemplate(tmpl string) When {
+	return func(v *Vars) bool {
+		out, err := v.renderTemplate(tmpl)
+		if err != nil {
+			if v.strict {
+				v.whenErr = err
+			}
+			return false
+		}
+		switch strings.TrimSpace(out) {
+		case "", "false", "0", "<no value>":
+			return false
+		}
+		return true
+	}
+}
@@ -83,43 +83,14 @@ func SSHPing(ip string, cfg Config) (time.Duration, error) {
 	return time.Since(start), nil
 }
 
-// UploadDir uploads an entire directory to the remote server.
-// It creates a tar archive locally, uploads it, and extracts on the remote.
+// UploadDir uploads an entire directory to the remote server, file by file
+// over SFTP like an Upload task: files whose sha256 already matches are
+// skipped, symlinks are recreated, and an interrupted transfer resumes when
+// UploadDir is called again. Sockets, devices and pipes are skipped.
 func UploadDir(client *goph.Client, localDir, remoteDir string) error {
-	// Create remote directory
-	_, err := client.Run("mkdir -p " + shellEscape(remoteDir))
-	if err != nil {
-		return fmt.Errorf("failed to create remote directory: %w", err)
-	}
-
-	// Create tar of local directory
-	tarFile, err := os.CreateTemp("", "porter-upload-*.tar.gz")
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
-	}
-	tarPath := tarFile.Name()
-	tarFile.Close()
-	defer os.Remove(tarPath)
-
-	// Create tar archive using system tar command (paths shell-quoted)
-	cmd := "tar -czf " + shellEscape(tarPath) + " -C " + shellEscape(localDir) + " ."
-	if err := runLocalCommand(cmd); err != nil {
-		return fmt.Errorf("failed to create tar archive: %w", err)
-	}
-
-	// Upload tar file under an unpredictable name (no /tmp race/symlink attack)
-	remoteTar := "/tmp/porter-upload-" + randomID(8) + ".tar.gz"
-	if err := client.Upload(tarPath, remoteTar); err != nil {
-		return fmt.Errorf("failed to upload tar: %w", err)
-	}
-
-	// Extract on remote
-	_, err = client.Run("tar -xzf " + shellEscape(remoteTar) + " -C " + shellEscape(remoteDir) + " && rm -f " + shellEscape(remoteTar))
-	if err != nil {
-		return fmt.Errorf("failed to extract tar: %w", err)
-	}
-
-	return nil
+	e := NewExecutor(client, "")
+	e.verbose = false
+	return e.upload(localDir, remoteDir, uploadSpec{})
 }
 
 // DownloadDir downloads an entire directory from the remote server.
@@ -0,0 +1,253 @@
+package porter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines kept around each change.
+const diffContext = 3
+
+// diffMaxCells bounds the LCS table. Beyond it the whole file is reported as
+// replaced — still a correct diff, just not a minimal one.
+const diffMaxCells = 4 << 20
+
+// unifiedDiff returns a unified diff turning a into b, labelled with the
+// from/to names, or "" when they are equal. A trailing newline is not
+// significant: remote reads are trimmed.
+func unifiedDiff(a, b, from, to string) string {
+	if a == b {
+		return ""
+	}
+	al, bl := diffLines(a), diffLines(b)
+	ops := diffOps(al, bl)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", from, to)
+	for start := 0; start < len(ops); {
+		// Find the next change, then extend the hunk while changes are within
+		// 2*diffContext lines of each other.
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		lo := max(start-diffContext, 0)
+		hi := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				hi = i
+			} else if i-hi > 2*diffContext {
+				break
+			}
+		}
+		hi = min(hi+diffContext+1, len(ops))
+
+		aStart, bStart, aLen, bLen := ops[lo].a+1, ops[lo].b+1, 0, 0
+		for _, op := range ops[lo:hi] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+		for _, op := range ops[lo:hi] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.text)
+			sb.WriteByte('\n')
+		}
+		start = hi
+	}
+	return sb.String()
+}
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	text string
+	a, b int // line index in a and b where the op sits
+}
+
+func diffLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffOps is the edit script from a to b via the longest common subsequence.
+func diffOps(a, b []string) []diffOp {
+	// Trim the common prefix and suffix; config edits are usually local.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	am, bm := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	var ops []diffOp
+	for i := 0; i < pre; i++ {
+		ops = append(ops, diffOp{' ', a[i], i, i})
+	}
+	n, m := len(am), len(bm)
+	if (n+1)*(m+1) > diffMaxCells {
+		for i, l := range am {
+			ops = append(ops, diffOp{'-', l, pre + i, pre})
+		}
+		for j, l := range bm {
+			ops = append(ops, diffOp{'+', l, pre + n, pre + j})
+		}
+	} else {
+		// lcs[i][j] is the LCS length of am[i:] and bm[j:].
+		lcs := make([][]int, n+1)
+		for i := range lcs {
+			lcs[i] = make([]int, m+1)
+		}
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if am[i] == bm[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < n || j < m {
+			switch {
+			case i < n && j < m && am[i] == bm[j]:
+				ops = append(ops, diffOp{' ', am[i], pre + i, pre + j})
+				i, j = i+1, j+1
+			case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, diffOp{'-', am[i], pre + i, pre + j})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', bm[j], pre + i, pre + j})
+				j++
+			}
+		}
+	}
+	for k := 0; k < suf; k++ {
+		ops = append(ops, diffOp{' ', a[len(a)-suf+k], len(a) - suf + k, len(b) - suf + k})
+	}
+	return ops
+}
+
+// hunkRange formats one side of a hunk header. An empty range names the line
+// before it, as diff(1) does.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		start--
+	}
+	if n == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, n)
+}
+
+// =============================================================================
+// CONTENT DIFFS (SetDiff)
+// =============================================================================
+
+// contentTarget returns the content a file task would leave in its file,
+// given the current content (exists is false for a missing file). An error
+// means the change cannot be predicted.
+type contentTarget func(t Task, src, dest, body, current string, exists bool) (want string, err error)
+
+// contentTargets are the file tasks SetDiff reports on. path maps the task to
+// the file it writes; nil means dest.
+var contentTargets = map[string]struct {
+	path func(t Task, dest string) string
+	want contentTarget
+}{
+	"ensure_file": {nil, wantBody},
+	"write":       {nil, wantBody},
+	"template":    {templatePath, wantBody},
+	"ensure_line": {nil, fileEdits["ensure_line"]},
+	"ensure_systemd_key": {nil, func(t Task, src, dest, body, current string, exists bool) (string, error) {
+		if !exists {
+			return "", errors.New(dest + " does not exist")
+		}
+		want, _, err := ensureSystemdKeyInContent(current, src, body)
+		return want, err
+	}},
+	"ensure_env":     {nil, fileEdits["ensure_env"]},
+	"ensure_replace": {nil, fileEdits["ensure_replace"]},
+	"ensure_block":   {nil, fileEdits["ensure_block"]},
+	"env_set": {nil, func(t Task, src, dest, body, current string, exists bool) (string, error) {
+		return envInContent(current, src, body)
+	}},
+}
+
+func wantBody(t Task, src, dest, body, current string, exists bool) (string, error) {
+	return body, nil
+}
+
+// templatePath is where installTemplate puts a unit.
+func templatePath(t Task, dest string) string {
+	if t.User {
+		return "/etc/systemd/user/" + dest + ".service"
+	}
+	return "/etc/systemd/system/" + dest + ".service"
+}
+
+// contentDiff returns the unified diff t would make to its file, "" if t is
+// not a file task or leaves the content as it is. It reads the remote file
+// and changes nothing.
+func (e *Executor) contentDiff(t Task, vars *Vars) string {
+	target, ok := contentTargets[t.Action]
+	if !ok {
+		return ""
+	}
+	t = expandEdit(t, vars)
+	f, err := vars.renderFields(t.Src, t.Dest, t.Body, t.Perm, t.Own)
+	if err != nil {
+		return ""
+	}
+	src, dest, body := f[0], f[1], f[2]
+	path := dest
+	if target.path != nil {
+		path = target.path(t, dest)
+	}
+
+	current, exists, err := e.readRemote(path, t.Sudo)
+	if err != nil {
+		return "(diff unavailable: " + err.Error() + ")\n"
+	}
+	want, err := target.want(t, src, dest, body, current, exists)
+	if err != nil {
+		return "(diff unavailable: " + err.Error() + ")\n"
+	}
+	from := path
+	if !exists {
+		from = "/dev/null"
+	}
+	d := unifiedDiff(current, want, from, path)
+	if t.Sensitive {
+		d = redactDiff(d)
+	}
+	return d
+}
+
+// redactDiff keeps a diff's headers and line markers and drops the content,
+// so the reader sees where a secret file changed but not what it holds.
+func redactDiff(d string) string {
+	var sb strings.Builder
+	for _, l := range diffLines(d) {
+		switch {
+		case strings.HasPrefix(l, "--- "), strings.HasPrefix(l, "+++ "), strings.HasPrefix(l, "@@"):
+			sb.WriteString(l)
+		default:
+			sb.WriteString(l[:1] + " [redacted]")
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
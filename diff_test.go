@@ -0,0 +1,81 @@
+package porter
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\nnew\n12\n"
+	got := unifiedDiff(strings.Replace(a, "2\n", "two\n", 1), b, "a", "b")
+	want := "--- a\n+++ b\n" +
+		"@@ -1,5 +1,5 @@\n 1\n-two\n+2\n 3\n 4\n 5\n" +
+		"@@ -9,4 +9,5 @@\n 9\n 10\n 11\n+new\n 12\n"
+	if got != want {
+		t.Errorf("diff =\n%s\nwant\n%s", got, want)
+	}
+	if unifiedDiff(a, a, "a", "b") != "" {
+		t.Error("equal inputs should give no diff")
+	}
+}
+
+func TestSetDiffReportsFileChanges(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{
+		{contains: "sha256sum", out: "0000"},
+		{contains: "cat '/etc/app.conf'", out: "port=80\nlog=info\n"},
+	}}
+	var logs, trace bytes.Buffer
+	var final TaskProgress
+	e := newTestExec(fr).SetDiff(true).
+		SetLogger(slog.New(slog.NewJSONHandler(&logs, nil))).
+		SetTracer(NewTracer(&trace, "", "")).
+		OnProgress(func(p TaskProgress) { final = p })
+	if _, err := e.Run("deploy", Tasks(EnsureFile("/etc/app.conf", "port=8080\nlog=info\n")), NewVars()); err != nil {
+		t.Fatal(err)
+	}
+	want := "--- /etc/app.conf\n+++ /etc/app.conf\n@@ -1,2 +1,2 @@\n-port=80\n+port=8080\n log=info\n"
+	if final.Status != StatusChanged || final.Diff != want {
+		t.Errorf("progress = %s %q", final.Status, final.Diff)
+	}
+	if !strings.Contains(logs.String(), `"diff":"--- /etc/app.conf`) {
+		t.Errorf("log = %s", logs.String())
+	}
+	if !strings.Contains(trace.String(), `porter.diff`) {
+		t.Errorf("trace = %s", trace.String())
+	}
+}
+
+func TestSetDiffDryRunAndRedaction(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{
+		{contains: "cat '/etc/app.env'", out: "PORT=80\nDB_PASSWORD=old\n"},
+		{contains: "cat '/etc/hosts'", out: "127.0.0.1 localhost"},
+	}}
+	var diffs []string
+	e := newTestExec(fr).SetDryRun(true).SetDiff(true).OnProgress(func(p TaskProgress) {
+		if p.Status == StatusChanged {
+			diffs = append(diffs, p.Diff)
+		}
+	})
+	_, err := e.Run("deploy", Tasks(
+		EnvSet("/etc/app.env", "DB_PASSWORD", "hunter2").Sensitive(),
+		EnsureLine("/etc/hosts", "10.0.0.5 db"),
+	), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 {
+		t.Fatalf("diffs = %q", diffs)
+	}
+	if strings.Contains(diffs[0], "hunter2") || strings.Contains(diffs[0], "old") || !strings.Contains(diffs[0], "- [redacted]\n+ [redacted]\n") {
+		t.Errorf("redacted diff = %q", diffs[0])
+	}
+	if !strings.HasSuffix(diffs[1], " 127.0.0.1 localhost\n+10.0.0.5 db\n") {
+		t.Errorf("line diff = %q", diffs[1])
+	}
+	if fr.ran("sed -i") || fr.ran(">>") {
+		t.Errorf("dry-run changed the host: %q", fr.calls)
+	}
+}
@@ -0,0 +1,423 @@
+package porter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// CHECK MODE (drift reports)
+//
+// Check re-runs a converged playbook in dry-run against a host and, for every
+// Ensure* and Assert* task, records what the task wants, what the host has,
+// and — for file contents — a unified diff between the two. Nothing on the
+// host is changed. The report is machine-readable (JSON tags), so a nightly
+// audit can ship it somewhere and alert when a box was edited by hand:
+//
+//	report, err := porter.NewExecutor(client, pw).Check(ctx, "audit", tasks, vars)
+//	for _, d := range report.Drifted() {
+//		log.Printf("%s: %s: want %s, have %s\n%s", report.Host, d.Resource, d.Desired, d.Actual, d.Diff)
+//	}
+//
+// Other tasks run exactly as in dry-run: read-only tasks and gather_facts
+// still execute so registered outputs and conditions hold, and the rest are
+// previewed.
+// =============================================================================
+
+// Drift is the desired-versus-actual comparison of one Ensure* or Assert*
+// task.
+type Drift struct {
+	Task     string `json:"task"`
+	Action   string `json:"action"`
+	Resource string `json:"resource"`       // what the task manages, e.g. "file:/etc/app.conf"
+	Desired  string `json:"desired"`        // the state the task converges to
+	Actual   string `json:"actual"`         // the state found on the host
+	Diff     string `json:"diff,omitempty"` // unified diff, actual -> desired, for file contents
+	Drifted  bool   `json:"drifted"`
+	Error    string `json:"error,omitempty"` // the host could not be inspected; Drifted is set
+}
+
+// DriftReport is the outcome of a Check run on one host.
+type DriftReport struct {
+	Host    string    `json:"host"`
+	Name    string    `json:"name"`
+	Checked time.Time `json:"checked"`
+	Items   []Drift   `json:"items"` // one per Ensure*/Assert* task run, in order
+}
+
+// Drifted returns the items whose host state differs from the desired state.
+func (r *DriftReport) Drifted() []Drift {
+	var out []Drift
+	for _, d := range r.Items {
+		if d.Drifted {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// HasDrift reports whether any item drifted.
+func (r *DriftReport) HasDrift() bool { return len(r.Drifted()) > 0 }
+
+// Check runs tasks in check mode and returns the drift report. The error is
+// the run's: a task that failed to evaluate, or ctx's cancellation. Drift and
+// failed assertions are reported, not returned as errors.
+func (e *Executor) Check(ctx context.Context, name string, tasks []Task, vars *Vars) (*DriftReport, error) {
+	report, _, err := e.check(ctx, name, tasks, vars)
+	return report, err
+}
+
+// check is Check, also returning the run's Stats (changed counts drifted
+// tasks) for Fleet.
+func (e *Executor) check(ctx context.Context, name string, tasks []Task, vars *Vars) (*DriftReport, *Stats, error) {
+	if vars == nil {
+		vars = NewVars()
+	}
+	report := &DriftReport{Name: name, Checked: time.Now()}
+	if e.client != nil {
+		report.Host = e.client.Config.Addr
+	}
+	prevDry, prevDrift := e.dryRun, e.drift
+	e.dryRun, e.drift = true, report
+	defer func() { e.dryRun, e.drift = prevDry, prevDrift }()
+
+	stats, err := e.RunContext(ctx, name, tasks, vars)
+	return report, stats, err
+}
+
+// driftProbe inspects the host for one task, with its fields rendered. It
+// fills Resource, Desired, Actual, Drifted and, where it applies, Diff.
+type driftProbe func(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift
+
+var driftProbes = map[string]driftProbe{
+	"ensure_file":            probeFile,
+	"ensure_dir":             probeDir,
+	"ensure_symlink":         probeSymlink,
+	"ensure_package":         probePackage,
+	"pkg":                    probePkg,
+	"pkg_repo":               probePkgRepo,
+	"ensure_line":            probeLine,
+	"ensure_systemd_key":     probeSystemdKey,
+	"ensure_service_running": probeServiceRunning,
+	"ensure_service_enabled": probeServiceEnabled,
+	"ensure_cron":            probeCron,
+	"ensure_user":            probeUser,
+	"ensure_mode":            probeMode,
+	"ensure_owner":           probeOwner,
+	"ensure_absent":          probeAbsent,
+	"ensure_git_repo":        probeGitRepo,
+	"ensure_copy":            probeCopy,
+	"ensure_move":            probeMove,
+	"ensure_env":             probeEdit,
+	"ensure_replace":         probeEdit,
+	"ensure_block":           probeEdit,
+}
+
+// probeDrift records the drift of t if it is an Ensure* or Assert* task,
+// returning preview's changed/detail pair for it. ok is false for any other
+// action.
+func (e *Executor) probeDrift(name string, t Task, vars *Vars) (changed bool, detail string, ok bool) {
+	probe := driftProbes[t.Action]
+	if probe == nil && strings.HasPrefix(t.Action, "assert_") {
+		probe = probeAssert
+	}
+	if probe == nil {
+		return false, "", false
+	}
+	f, err := vars.renderFields(t.Src, t.Dest, t.Body, t.Perm, t.Own)
+	var d Drift
+	if err != nil {
+		d = Drift{Drifted: true, Error: err.Error()}
+	} else {
+		d = probe(e, expandEdit(t, vars), f[0], f[1], f[2], f[3], f[4], vars)
+	}
+	d.Task, d.Action = name, t.Action
+	e.drift.Items = append(e.drift.Items, d)
+	if !d.Drifted {
+		return false, t.Action + ": " + d.Resource + " in sync", true
+	}
+	detail = t.Action + ": " + d.Resource + " drifted: want " + d.Desired + ", have " + d.Actual
+	if d.Error != "" {
+		detail = t.Action + ": " + d.Resource + ": " + d.Error
+	}
+	return true, detail, true
+}
+
+// driftOf is the Drift for a yes/no fact: in sync when have equals want.
+func driftOf(resource, want, have string) Drift {
+	return Drift{Resource: resource, Desired: want, Actual: have, Drifted: want != have}
+}
+
+func presence(ok bool, yes, no string) string {
+	if ok {
+		return yes
+	}
+	return no
+}
+
+// sensitiveDiff masks the content lines of a Sensitive task's drift diff,
+// which would otherwise carry the secret into the report.
+func sensitiveDiff(t Task, diff string) string {
+	if t.Sensitive && diff != "" {
+		return redactDiff(diff)
+	}
+	return diff
+}
+
+func probeFile(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	d := Drift{Resource: "file:" + dest, Desired: "sha256:" + sha256Hex(body)}
+	if e.fileConverged(dest, body, t.Sudo) {
+		d.Actual = d.Desired
+		return d
+	}
+	d.Drifted = true
+	if !e.pathExists(shellEscape(dest)) {
+		d.Actual = "absent"
+		d.Diff = sensitiveDiff(t, unifiedDiff("", body, "/dev/null", dest))
+		return d
+	}
+	actual, err := e.runCaptureMaybeSudo(t.Sudo, "cat "+shellEscape(dest))
+	if err != nil {
+		d.Error = fmt.Sprintf("read %s: %v", dest, err)
+		return d
+	}
+	sum, _ := e.runCaptureMaybeSudo(t.Sudo, "sha256sum "+shellEscape(dest)+" | cut -d' ' -f1")
+	d.Actual = "sha256:" + sum
+	d.Diff = sensitiveDiff(t, unifiedDiff(actual, body, dest+" (actual)", dest+" (desired)"))
+	if d.Diff == "" {
+		// Only trailing whitespace differs, which the read trims away.
+		d.Diff = "(contents differ in trailing whitespace)\n"
+	}
+	return d
+}
+
+func probeDir(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	have := "absent"
+	if e.dirExists(dest) {
+		have = "directory"
+	} else if e.pathExists(shellEscape(dest)) {
+		have = "not a directory"
+	}
+	return driftOf("dir:"+dest, "directory", have)
+}
+
+func probeSymlink(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	got, _ := e.runCapture("readlink " + shellEscape(dest) + " 2>/dev/null")
+	have := "-> " + got
+	if got == "" {
+		have = presence(e.pathExists(shellEscape(dest)), "not a symlink", "absent")
+	}
+	return driftOf("symlink:"+dest, "-> "+src, have)
+}
+
+func probePackage(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	return driftOf("package:"+dest, "installed", presence(e.packageInstalled(dest), "installed", "not installed"))
+}
+
+func probePkg(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	d := Drift{Resource: "package:" + dest, Desired: t.State}
+	m, err := e.pkgManager()
+	if err != nil {
+		d.Drifted, d.Error = true, err.Error()
+		return d
+	}
+	specs := parsePkgSpecs(dest)
+	if t.State == "latest" {
+		// Whether a newer version exists is a repository question, not drift:
+		// latest is in sync once every package is installed.
+		t.State = "present"
+	}
+	pending, err := e.pkgPending(m, t.State, specs)
+	if err != nil {
+		d.Drifted, d.Error = true, err.Error()
+		return d
+	}
+	versions, _ := e.installedVersions(m, specs)
+	have := make([]string, len(specs))
+	for i, s := range specs {
+		v := versions[s.name]
+		if v == "" {
+			v = "not installed"
+		}
+		have[i] = s.name + " " + v
+	}
+	d.Actual = strings.Join(have, ", ")
+	d.Drifted = len(pending) > 0
+	return d
+}
+
+func probePkgRepo(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	d := Drift{Resource: "repo:" + dest, Desired: t.State}
+	changed, detail := e.previewPkg(t, src, dest, body)
+	d.Drifted = changed
+	d.Actual = presence(changed, strings.TrimPrefix(detail, "pkg_repo: "), t.State)
+	return d
+}
+
+func probeLine(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	if advancedLine(t) {
+		return probeEdit(e, t, src, dest, body, perm, own, vars)
+	}
+	d := driftOf("line:"+dest, "present", presence(e.linePresent(dest, body, t.Sudo), "present", "missing"))
+	if d.Drifted {
+		d.Diff = sensitiveDiff(t, "+"+body+"\n")
+	}
+	return d
+}
+
+func probeSystemdKey(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	d := Drift{Resource: "unit:" + dest, Desired: "[" + src + "] " + body}
+	if t.Sensitive {
+		d.Desired = "[" + src + "] " + redactedOutput
+	}
+	content, err := e.runCaptureMaybeSudo(t.Sudo, "cat "+shellEscape(dest))
+	if err != nil {
+		d.Drifted, d.Error = true, fmt.Sprintf("read %s: %v", dest, err)
+		return d
+	}
+	want, changed, err := ensureSystemdKeyInContent(content, src, body)
+	if err != nil {
+		d.Drifted, d.Error = true, err.Error()
+		return d
+	}
+	d.Actual = d.Desired
+	if changed {
+		d.Drifted, d.Actual = true, "differs"
+		d.Diff = sensitiveDiff(t, unifiedDiff(content, want, dest+" (actual)", dest+" (desired)"))
+	}
+	return d
+}
+
+func probeServiceRunning(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	sc, _ := systemctlPrefix(t.User)
+	got, _ := e.runCapture(sc + "is-active " + shellEscape(dest))
+	return driftOf("service:"+dest, "active", firstNonEmpty(got, "unknown"))
+}
+
+func probeServiceEnabled(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	sc, _ := systemctlPrefix(t.User)
+	got, _ := e.runCapture(sc + "is-enabled " + shellEscape(dest))
+	d := driftOf("service:"+dest, "enabled", firstNonEmpty(got, "unknown"))
+	// ensure_service_enabled accepts what `is-enabled --quiet` accepts.
+	d.Drifted = !e.serviceEnabled(dest, t.User)
+	return d
+}
+
+func probeCron(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	_, err := e.runCapture("crontab -l 2>/dev/null | grep -qxF -- " + shellEscape(body))
+	d := driftOf("cron:"+body, "present", presence(err == nil, "present", "missing"))
+	if d.Drifted {
+		d.Diff = sensitiveDiff(t, "+"+body+"\n")
+	}
+	return d
+}
+
+func probeUser(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	_, err := e.runCapture("id " + shellEscape(dest) + " >/dev/null 2>&1")
+	return driftOf("user:"+dest, "present", presence(err == nil, "present", "absent"))
+}
+
+func probeMode(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	got, _ := e.runCaptureMaybeSudo(t.Sudo, "stat -c '%a' "+shellEscape(dest)+" 2>/dev/null")
+	d := driftOf("file:"+dest, perm, firstNonEmpty(got, "absent"))
+	d.Drifted = !e.modeMatches(dest, perm, t.Sudo)
+	return d
+}
+
+func probeOwner(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	format := "%U:%G"
+	if !strings.Contains(own, ":") {
+		format = "%U"
+	}
+	got, _ := e.runCaptureMaybeSudo(t.Sudo, "stat -c '"+format+"' "+shellEscape(dest)+" 2>/dev/null")
+	return driftOf("file:"+dest, own, firstNonEmpty(got, "absent"))
+}
+
+func probeAbsent(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	return driftOf("path:"+dest, "absent", presence(e.pathExists(shellEscape(dest)), "present", "absent"))
+}
+
+func probeCopy(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	d := Drift{Resource: "file:" + dest, Desired: "copy of " + src, Actual: "copy of " + src}
+	if !e.copyConverged(src, dest, perm, own, t.Sudo) {
+		d.Drifted, d.Actual = true, presence(e.pathExists(shellEscape(dest)), "differs", "absent")
+	}
+	return d
+}
+
+func probeMove(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	d := Drift{Resource: "path:" + dest, Desired: "moved from " + src, Actual: "moved from " + src}
+	pending, err := e.movePending(src, dest)
+	switch {
+	case err != nil:
+		d.Drifted, d.Error = true, err.Error()
+	case pending:
+		d.Drifted, d.Actual = true, src+" not moved"
+	}
+	return d
+}
+
+// probeEdit checks the ensure_env, ensure_replace and ensure_block edits.
+func probeEdit(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	d := Drift{Resource: "file:" + dest, Desired: t.Action + " " + src, Actual: t.Action + " " + src}
+	current, exists, err := e.readRemote(dest, t.Sudo)
+	if err != nil {
+		d.Drifted, d.Error = true, err.Error()
+		return d
+	}
+	want, err := fileEdits[t.Action](t, src, dest, body, current, exists)
+	if err != nil {
+		d.Drifted, d.Error = true, err.Error()
+		return d
+	}
+	if editChanges(t, current, want, exists) {
+		d.Drifted, d.Actual = true, presence(exists, "differs", "absent")
+		from := dest + " (actual)"
+		if !exists {
+			from = "/dev/null"
+		}
+		d.Diff = sensitiveDiff(t, unifiedDiff(current, want, from, dest+" (desired)"))
+	}
+	return d
+}
+
+// probeGitRepo checks the clone exists at the commit it last fetched and has
+// no local modifications. It does not fetch: a check must not change the host,
+// and new upstream commits are a release, not drift.
+func probeGitRepo(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	d := Drift{Resource: "repo:" + dest, Desired: "clone of " + src}
+	if _, err := e.runCapture("test -d " + shellEscape(dest+"/.git")); err != nil {
+		d.Drifted, d.Actual = true, "absent"
+		return d
+	}
+	g := "git -C " + shellEscape(dest) + " "
+	local, _ := e.runCapture(g + "rev-parse HEAD")
+	upstream, err := e.runCapture(g + "rev-parse '@{u}'")
+	if err == nil {
+		d.Desired = "clean at " + upstream
+	}
+	status, _ := e.runCapture(g + "status --porcelain")
+	d.Actual = "clean at " + local
+	if status != "" {
+		d.Actual = "modified at " + local
+		d.Diff = status + "\n"
+	}
+	d.Drifted = status != "" || (err == nil && local != upstream)
+	return d
+}
+
+// probeAssert runs the assertion itself; a failure is the drift.
+func probeAssert(e *Executor, t Task, src, dest, body, perm, own string, vars *Vars) Drift {
+	d := Drift{Resource: firstNonEmpty(dest, body), Desired: "assertion holds", Actual: "assertion holds"}
+	h, ok := actionHandlers[t.Action]
+	if !ok {
+		d.Drifted, d.Error = true, "unknown action: "+t.Action
+		return d
+	}
+	if err := h(e, t, src, dest, body, perm, own, vars); err != nil {
+		d.Drifted, d.Actual = true, strings.TrimPrefix(err.Error(), "assertion failed: ")
+	}
+	return d
+}
@@ -0,0 +1,130 @@
+package porter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckReportsDriftWithoutChanges(t *testing.T) {
+	want := "listen 80;\nworkers 4;\nlog info;\n"
+	fr := &fakeRunner{rules: []rule{
+		{contains: "sha256sum", out: "0000\n"},
+		{contains: "cat '/etc/app.conf'", out: "listen 80;\nworkers 2;\nlog info;\n"},
+		{contains: "is-active", out: "inactive\n", err: exitErr(3)},
+		{contains: "is-enabled", out: "enabled\n"},
+		{contains: "pgrep", err: exitErr(1)},
+	}}
+	report, err := newTestExec(fr).Check(context.Background(), "audit", Tasks(
+		EnsureFile("/etc/app.conf", want),
+		EnsureServiceRunning("app"),
+		EnsureServiceEnabled("app"),
+		AssertProcessRunning("app-worker"),
+		Run("systemctl restart app"),
+	), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range fr.calls {
+		if strings.Contains(c, "restart") || strings.Contains(c, "systemctl start") || strings.Contains(c, "cat >") {
+			t.Errorf("check mode changed the host: %q", c)
+		}
+	}
+	if len(report.Items) != 4 {
+		t.Fatalf("items = %+v, want one per Ensure*/Assert* task", report.Items)
+	}
+
+	file := report.Items[0]
+	if !file.Drifted || file.Resource != "file:/etc/app.conf" || file.Actual != "sha256:0000" {
+		t.Errorf("file = %+v", file)
+	}
+	if !strings.Contains(file.Diff, "-workers 2;\n+workers 4;\n") || !strings.Contains(file.Diff, "@@ -1,3 +1,3 @@") {
+		t.Errorf("diff = %q", file.Diff)
+	}
+	if svc := report.Items[1]; !svc.Drifted || svc.Desired != "active" || svc.Actual != "inactive" {
+		t.Errorf("running = %+v", svc)
+	}
+	if svc := report.Items[2]; svc.Drifted || svc.Actual != "enabled" {
+		t.Errorf("enabled = %+v", svc)
+	}
+	if a := report.Items[3]; !a.Drifted || !strings.Contains(a.Actual, "app-worker") {
+		t.Errorf("assert = %+v", a)
+	}
+	if got := len(report.Drifted()); got != 3 || !report.HasDrift() {
+		t.Errorf("Drifted() = %d", got)
+	}
+
+	out, _ := json.Marshal(report.Items[2])
+	if !strings.Contains(string(out), `"resource":"service:app"`) || strings.Contains(string(out), `"diff"`) {
+		t.Errorf("json = %s", out)
+	}
+}
+
+func TestCheckInSyncAndMissingFile(t *testing.T) {
+	body := "a=1\n"
+	fr := &fakeRunner{rules: []rule{
+		{contains: "sha256sum '/etc/a'", out: sha256Hex(body)},
+		{contains: "test -e '/etc/b'", err: errors.New("missing")},
+		{contains: "test -d", out: ""},
+	}}
+	report, err := newTestExec(fr).Check(context.Background(), "audit", Tasks(
+		EnsureFile("/etc/a", body),
+		EnsureFile("/etc/b", body),
+		EnsureDir("/srv/app"),
+	), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Items[0].Drifted || report.Items[2].Drifted {
+		t.Errorf("items = %+v, want /etc/a and /srv/app in sync", report.Items)
+	}
+	if b := report.Items[1]; !b.Drifted || b.Actual != "absent" || b.Diff != "--- /dev/null\n+++ /etc/b\n@@ -0,0 +1 @@\n+a=1\n" {
+		t.Errorf("missing file = %+v", b)
+	}
+}
+
+func TestCheckRedactsSensitiveDiffs(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{
+		{contains: "sha256sum", out: "0000\n"},
+		{contains: "test -e '/etc/new.key'", err: errors.New("missing")},
+		{contains: "cat '/etc/app.env'", out: "TOKEN=old-secret\n"},
+		{contains: "cat '/etc/systemd/system/app.service'", out: "[Service]\nUser=app\n"},
+	}}
+	report, err := newTestExec(fr).Check(context.Background(), "audit", Tasks(
+		EnsureFile("/etc/app.env", "TOKEN=hunter2\n").Sensitive(),
+		EnsureFile("/etc/new.key", "hunter2\n").Sensitive(),
+		EnsureSystemdKey("/etc/systemd/system/app.service", "Service", "Environment", "TOKEN=hunter2").Sensitive(),
+	), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(report)
+	if strings.Contains(string(out), "hunter2") || strings.Contains(string(out), "old-secret") {
+		t.Errorf("secret in report: %s", out)
+	}
+	for _, d := range report.Items {
+		if !d.Drifted || (d.Diff != "" && !strings.Contains(d.Diff, "[redacted]")) {
+			t.Errorf("item = %+v", d)
+		}
+	}
+}
+
+func TestFleetCheck(t *testing.T) {
+	f, _, _ := testFleet([]string{"web1", "web2"}, map[string]bool{"web2": true}, time.Millisecond)
+	recap, err := f.SetCheck(true).Run("audit", Tasks(EnsureDir("/srv/app")), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recap.Drifted(); len(got) != 1 || got[0] != "web2" {
+		t.Errorf("Drifted() = %v", got)
+	}
+	if d := recap.Hosts[1].Drift; d == nil || d.Host != "web2" || d.Items[0].Actual != "absent" {
+		t.Errorf("web2 drift = %+v", d)
+	}
+	if recap.Total.Changed != 1 {
+		t.Errorf("total = %+v", recap.Total)
+	}
+}
@@ -0,0 +1,473 @@
+package porter
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// =============================================================================
+// IDEMPOTENT FILE EDITS
+//
+// Declarative counterparts of the raw Copy, Move, Sed and EnvSet actions. Like
+// the other Ensure* primitives they shell-escape every argument, run under
+// sudo only with .Sudo(), act only when the host differs (ok, not changed,
+// otherwise) and preview in dry-run. The edits read the file, transform its
+// content in Go and write it back only if the result differs, so they also
+// report exact diffs with SetDiff.
+//
+// EnsureLine and EnsureBlock take the lineinfile/blockinfile options: Match
+// selects the line to replace (or, with EnsureLineAbsent, the lines to
+// remove), InsertAfter/InsertBefore place new content, Validate checks the
+// staged file before it replaces the original, and Backup keeps a copy:
+//
+//	porter.EnsureLine("/etc/ssh/sshd_config", "PermitRootLogin no").
+//		Match(`^#?PermitRootLogin`).InsertAfter(`^#?Port `).
+//		Validate("sshd -t -f %s").Backup().Sudo()
+// =============================================================================
+
+// EnsureCopy ensures dest is a copy of the remote file src: copied only if
+// dest is missing or its content differs. .Mode() and .Owner() are applied to
+// dest and checked too.
+func EnsureCopy(src, dest string) TaskBuilder {
+	return TaskBuilder{t: Task{Action: "ensure_copy", Src: src, Dest: dest}}
+}
+
+// EnsureMove ensures src has been moved to dest. No-op once src is gone and
+// dest exists; fails if neither exists.
+func EnsureMove(src, dest string) TaskBuilder {
+	return TaskBuilder{t: Task{Action: "ensure_move", Src: src, Dest: dest}}
+}
+
+// EnsureEnv ensures the environment file has key=value: an existing key= line
+// is rewritten in place (every one, if repeated), otherwise the line is
+// appended. The file is created if missing. The value is written verbatim.
+func EnsureEnv(file, key, value string) TaskBuilder {
+	return TaskBuilder{t: Task{Action: "ensure_env", Dest: file, Src: key, Body: value}}
+}
+
+// EnsureReplace replaces every match of the regular expression pattern (Go
+// RE2 syntax; prefix (?m) to anchor ^ and $ at lines) in file with
+// replacement, which may use $1-style group references. No-op when the
+// result is unchanged — write patterns the replacement no longer matches.
+// Fails if file does not exist.
+func EnsureReplace(file, pattern, replacement string) TaskBuilder {
+	return TaskBuilder{t: Task{Action: "ensure_replace", Dest: file, Src: pattern, Body: replacement}}
+}
+
+// EnsureBlock ensures file contains content between the lines
+// "# BEGIN <marker>" and "# END <marker>". An existing block is replaced in
+// place; otherwise the block is inserted per InsertAfter/InsertBefore, or
+// appended. The file is created if missing.
+func EnsureBlock(file, marker, content string) TaskBuilder {
+	return TaskBuilder{t: Task{Action: "ensure_block", Dest: file, Src: marker, Body: content}}
+}
+
+// EnsureBlockAbsent ensures file has no block named marker.
+func EnsureBlockAbsent(file, marker string) TaskBuilder {
+	return TaskBuilder{t: Task{Action: "ensure_block", Dest: file, Src: marker, State: "absent"}}
+}
+
+// EnsureLineAbsent ensures no line of file matches the regexp pattern. No-op
+// (and no error) when the file does not exist.
+func EnsureLineAbsent(file, pattern string) TaskBuilder {
+	return TaskBuilder{t: Task{Action: "ensure_line", Dest: file, Match: pattern, State: "absent"}}
+}
+
+// Match makes EnsureLine replace the last line matching the regexp pattern
+// with its line; the line is inserted as usual only when nothing matches.
+func (b TaskBuilder) Match(pattern string) TaskBuilder { b.t.Match = pattern; return b }
+
+// InsertAfter places a new line or block after the last line matching the
+// regexp pattern ("EOF": at the end). Without a match it is appended.
+func (b TaskBuilder) InsertAfter(pattern string) TaskBuilder { b.t.InsertAfter = pattern; return b }
+
+// InsertBefore places a new line or block before the last line matching the
+// regexp pattern ("BOF": at the start). Without a match it is appended.
+// InsertBefore wins over InsertAfter.
+func (b TaskBuilder) InsertBefore(pattern string) TaskBuilder { b.t.InsertBefore = pattern; return b }
+
+// Backup copies the file to <file>.bak.<timestamp> before changing it.
+func (b TaskBuilder) Backup() TaskBuilder { b.t.Backup = true; return b }
+
+// fileEdits are the content transforms behind the edit actions. Each returns
+// the new content of the file given its current content; exists is false
+// when the file is missing.
+var fileEdits = map[string]contentTarget{
+	"ensure_env": func(t Task, src, dest, body, current string, exists bool) (string, error) {
+		return envInContent(current, src, body)
+	},
+	"ensure_replace": func(t Task, src, dest, body, current string, exists bool) (string, error) {
+		if !exists {
+			return "", fmt.Errorf("%s does not exist", dest)
+		}
+		return replaceInContent(current, src, body)
+	},
+	"ensure_block": func(t Task, src, dest, body, current string, exists bool) (string, error) {
+		return blockInContent(t, current, src, body)
+	},
+	"ensure_line": func(t Task, src, dest, body, current string, exists bool) (string, error) {
+		return lineInContent(t, current, body)
+	},
+}
+
+// compileAnchor compiles a Match, InsertAfter or InsertBefore pattern. ""
+// and the BOF/EOF keywords compile to nil.
+func compileAnchor(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" || pattern == "BOF" || pattern == "EOF" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// lastMatch returns the index of the last line re matches, or -1.
+func lastMatch(lines []string, re *regexp.Regexp) int {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if re.MatchString(lines[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// insertLines inserts add into lines at the place t's anchors name.
+func insertLines(t Task, lines, add []string) ([]string, error) {
+	at := len(lines)
+	switch {
+	case t.InsertBefore == "BOF":
+		at = 0
+	case t.InsertBefore != "":
+		re, err := compileAnchor(t.InsertBefore)
+		if err != nil {
+			return nil, fmt.Errorf("insert_before: %w", err)
+		}
+		if i := lastMatch(lines, re); i >= 0 {
+			at = i
+		}
+	case t.InsertAfter != "" && t.InsertAfter != "EOF":
+		re, err := compileAnchor(t.InsertAfter)
+		if err != nil {
+			return nil, fmt.Errorf("insert_after: %w", err)
+		}
+		if i := lastMatch(lines, re); i >= 0 {
+			at = i + 1
+		}
+	}
+	return slices.Concat(lines[:at], add, lines[at:]), nil
+}
+
+// lineInContent applies EnsureLine (or EnsureLineAbsent) to content.
+func lineInContent(t Task, content, line string) (string, error) {
+	match, err := compileAnchor(t.Match)
+	if err != nil {
+		return "", fmt.Errorf("match: %w", err)
+	}
+	lines := splitKeepEnd(content)
+	if t.State == "absent" {
+		var kept []string
+		for _, l := range lines {
+			if (match != nil && match.MatchString(l)) || (match == nil && l == line) {
+				continue
+			}
+			kept = append(kept, l)
+		}
+		if len(kept) == len(lines) {
+			return content, nil
+		}
+		return joinLines(kept, content), nil
+	}
+	if match != nil {
+		if i := lastMatch(lines, match); i >= 0 {
+			if lines[i] == line {
+				return content, nil
+			}
+			lines[i] = line
+			return joinLines(lines, content), nil
+		}
+	}
+	if slices.Contains(lines, line) {
+		return content, nil
+	}
+	if lines, err = insertLines(t, lines, []string{line}); err != nil {
+		return "", err
+	}
+	return joinLines(lines, content), nil
+}
+
+// envInContent sets key=value in env-file content.
+func envInContent(content, key, value string) (string, error) {
+	if key == "" || strings.ContainsAny(key, "=\n") {
+		return "", fmt.Errorf("invalid env key %q", key)
+	}
+	if strings.Contains(value, "\n") {
+		return "", fmt.Errorf("env value for %s spans lines", key)
+	}
+	kv, found := key+"="+value, false
+	lines := splitKeepEnd(content)
+	for i, l := range lines {
+		if strings.HasPrefix(l, key+"=") {
+			lines[i], found = kv, true
+		}
+	}
+	if !found {
+		lines = append(lines, kv)
+	}
+	return joinLines(lines, content), nil
+}
+
+// replaceInContent applies a regexp replacement to content.
+func replaceInContent(content, pattern, replacement string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("pattern: %w", err)
+	}
+	return re.ReplaceAllString(content, replacement), nil
+}
+
+// blockMarkers returns the lines delimiting the block named marker.
+func blockMarkers(marker string) (begin, end string) {
+	return "# BEGIN " + marker, "# END " + marker
+}
+
+// blockInContent puts block between marker lines in content, replacing an
+// existing block of the same name, or removes the block when t's state is
+// absent.
+func blockInContent(t Task, content, marker, block string) (string, error) {
+	if marker == "" || strings.Contains(marker, "\n") {
+		return "", fmt.Errorf("invalid block marker %q", marker)
+	}
+	begin, end := blockMarkers(marker)
+	want := []string{begin}
+	if block != "" {
+		want = append(want, splitKeepEnd(block)...)
+	}
+	want = append(want, end)
+
+	lines := splitKeepEnd(content)
+	b, e := -1, -1
+	for i, l := range lines {
+		switch {
+		case l == begin && b < 0:
+			b = i
+		case l == end && b >= 0:
+			e = i
+		}
+		if e >= 0 {
+			break
+		}
+	}
+	switch {
+	case b >= 0 && e < 0:
+		return "", errors.New("block " + marker + " has no end marker")
+	case t.State == "absent" && b < 0:
+		return content, nil
+	case t.State == "absent":
+		lines = slices.Concat(lines[:b], lines[e+1:])
+	case b >= 0:
+		if slices.Equal(lines[b:e+1], want) {
+			return content, nil
+		}
+		lines = slices.Concat(lines[:b], want, lines[e+1:])
+	default:
+		var err error
+		if lines, err = insertLines(t, lines, want); err != nil {
+			return "", err
+		}
+	}
+	return joinLines(lines, content), nil
+}
+
+// splitKeepEnd splits content into lines, without the final newline.
+func splitKeepEnd(content string) []string {
+	content = strings.TrimSuffix(content, "\n")
+	if content == "" {
+		return nil
+	}
+	return strings.Split(content, "\n")
+}
+
+// joinLines joins lines and ends them with a newline, as text files are,
+// unless the original content was non-empty and had none.
+func joinLines(lines []string, original string) string {
+	s := strings.Join(lines, "\n")
+	if s == "" || (original != "" && !strings.HasSuffix(original, "\n")) {
+		return s
+	}
+	return s + "\n"
+}
+
+// readRemote returns the content of path, untrimmed. exists is false (and err
+// nil) only when path does not exist: a failed probe is an error, so an edit
+// never rebuilds a file it merely could not read. Only stdout is kept, so a
+// warning from sudo never becomes part of the content.
+func (e *Executor) readRemote(path string, sudo bool) (content string, exists bool, err error) {
+	p := shellEscape(path)
+	cmd := "if [ -e " + p + " ]; then cat " + p + "; else exit 3; fi"
+	if sudo {
+		cmd = e.sudo(cmd)
+	}
+	var stdout []byte
+	err = e.withConn(func() (err error) {
+		if sr, ok := e.runner.(splitRunner); ok {
+			stdout, _, err = sr.RunSplit(e.taskCtx(), cmd)
+		} else {
+			stdout, err = e.runner.Run(e.taskCtx(), cmd)
+		}
+		return err
+	})
+	if exitCode(err) == 3 {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("read %s: %w", path, err)
+	}
+	return string(stdout), true, nil
+}
+
+// putFile replaces dest with exactly content (no newline added, unlike
+// writeFile). The content goes over stdin, so file size is not bound by the
+// argument limit. An existing dest keeps its mode and owner unless perm or owner
+// are set.
+func (e *Executor) putFile(dest, content string, sudo bool, perm, owner string) error {
+	if !sudo && perm == "" && owner == "" {
+		return e.runStdin("cat > "+shellEscape(dest), strings.NewReader(content), false)
+	}
+	tmp, err := e.stageContent(content)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = e.run("rm -f " + tmp) }()
+	return e.placeStaged(tmp, shellEscape(dest), sudo, perm, owner)
+}
+
+// stageContent writes content to a private temp file (mktemp, 0600) and
+// returns its path; the caller removes it.
+func (e *Executor) stageContent(content string) (string, error) {
+	tmp, err := e.runCapture("mktemp")
+	if err != nil {
+		return "", err
+	}
+	if err := e.runStdin("cat > "+tmp, strings.NewReader(content), false); err != nil {
+		_ = e.run("rm -f " + tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// validateStaged runs a Validate command against the staged file at tmp.
+func (e *Executor) validateStaged(cmd, tmp string, sudo bool) error {
+	if !strings.Contains(cmd, "%s") {
+		return fmt.Errorf("validate %q: must contain %%s, the staged file's path", cmd)
+	}
+	out, err := e.runOnStaged(shellEscape(tmp), sudo, func(path string) string {
+		return strings.ReplaceAll(cmd, "%s", path) + " 2>&1"
+	})
+	if err != nil {
+		return fmt.Errorf("validate %q failed: %w: %s", cmd, err, out)
+	}
+	return nil
+}
+
+// backupFile copies path aside as path.bak.<timestamp>, like Backup.
+func (e *Executor) backupFile(path string, sudo bool) error {
+	return e.runMaybeSudo(sudo, "cp -a "+shellEscape(path)+" "+shellEscape(path)+".bak.$(date +%Y%m%d%H%M%S)")
+}
+
+// placeContent replaces dest with content, validating the staged content and
+// backing up the current file first when t asks for it.
+func (e *Executor) placeContent(t Task, dest, content, perm, own string, exists bool) error {
+	if t.Validate == "" && !t.Backup {
+		return e.putFile(dest, content, t.Sudo, perm, own)
+	}
+	tmp, err := e.stageContent(content)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = e.run("rm -f " + tmp) }()
+	if t.Validate != "" {
+		if err := e.validateStaged(t.Validate, tmp, t.Sudo); err != nil {
+			return err
+		}
+	}
+	if t.Backup && exists {
+		if err := e.backupFile(dest, t.Sudo); err != nil {
+			return fmt.Errorf("backup %s: %w", dest, err)
+		}
+	}
+	return e.placeStaged(tmp, shellEscape(dest), t.Sudo, perm, own)
+}
+
+// expandEdit expands the vars in t's edit options.
+func expandEdit(t Task, vars *Vars) Task {
+	t.Match = vars.Expand(t.Match)
+	t.InsertAfter = vars.Expand(t.InsertAfter)
+	t.InsertBefore = vars.Expand(t.InsertBefore)
+	t.Validate = vars.Expand(t.Validate)
+	return t
+}
+
+// editFile applies t's edit to dest, writing only when the content changes.
+func (e *Executor) editFile(t Task, src, dest, body, perm, own string) error {
+	current, exists, err := e.readRemote(dest, t.Sudo)
+	if err != nil {
+		return err
+	}
+	want, err := fileEdits[t.Action](t, src, dest, body, current, exists)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", t.Action, dest, err)
+	}
+	if !editChanges(t, current, want, exists) {
+		e.noOp = true
+		return nil
+	}
+	return e.placeContent(t, dest, want, perm, own, exists)
+}
+
+// editPending reports whether t's edit would change dest.
+func (e *Executor) editPending(t Task, src, dest, body string) (bool, error) {
+	current, exists, err := e.readRemote(dest, t.Sudo)
+	if err != nil {
+		return false, err
+	}
+	want, err := fileEdits[t.Action](t, src, dest, body, current, exists)
+	if err != nil {
+		return false, err
+	}
+	return editChanges(t, current, want, exists), nil
+}
+
+// editChanges reports whether writing want over current changes the file. A
+// removal from a missing file changes nothing.
+func editChanges(t Task, current, want string, exists bool) bool {
+	return want != current || (!exists && t.State != "absent")
+}
+
+// advancedLine reports whether an ensure_line task uses the lineinfile
+// options, and so is applied as an edit rather than a grep-and-append.
+func advancedLine(t Task) bool {
+	return t.Match != "" || t.InsertAfter != "" || t.InsertBefore != "" || t.State == "absent" || t.Validate != "" || t.Backup
+}
+
+// copyConverged reports whether dest already holds src's content, and the
+// mode and owner when set.
+func (e *Executor) copyConverged(src, dest, perm, own string, sudo bool) bool {
+	sums, err := e.runCaptureMaybeSudo(sudo, "sha256sum "+shellEscape(src)+" "+shellEscape(dest)+" 2>/dev/null | cut -d' ' -f1")
+	f := strings.Fields(sums)
+	if err != nil || len(f) != 2 || f[0] != f[1] {
+		return false
+	}
+	return (perm == "" || e.modeMatches(dest, perm, sudo)) && (own == "" || e.ownerMatches(dest, own, sudo))
+}
+
+// movePending reports whether src still has to be moved to dest.
+func (e *Executor) movePending(src, dest string) (bool, error) {
+	if e.pathExists(shellEscape(src)) {
+		return true, nil
+	}
+	if e.pathExists(shellEscape(dest)) {
+		return false, nil
+	}
+	return false, fmt.Errorf("neither %s nor %s exists", src, dest)
+}
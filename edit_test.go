@@ -0,0 +1,266 @@
+package porter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEditTransforms(t *testing.T) {
+	for _, tt := range []struct {
+		name, got, want string
+	}{
+		{"env replace", must(envInContent("A=1\nB=2\n", "B", "3")), "A=1\nB=3\n"},
+		{"env append", must(envInContent("A=1", "B", "x y")), "A=1\nB=x y"},
+		{"env create", must(envInContent("", "B", "1")), "B=1\n"},
+		{"replace", must(replaceInContent("port 80\nport 81\n", `(?m)^port (\d+)$`, "listen $1")), "listen 80\nlisten 81\n"},
+		{"block append", must(blockInContent(Task{}, "a\n", "app", "x\ny")), "a\n# BEGIN app\nx\ny\n# END app\n"},
+		{"block replace", must(blockInContent(Task{}, "a\n# BEGIN app\nold\n# END app\nz\n", "app", "new")), "a\n# BEGIN app\nnew\n# END app\nz\n"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+	if _, err := envInContent("", "A=B", "1"); err == nil {
+		t.Error("env key with '=' accepted")
+	}
+	if _, err := blockInContent(Task{}, "# BEGIN app\n", "app", "x"); err == nil {
+		t.Error("unterminated block accepted")
+	}
+}
+
+func must(s string, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return s
+}
+
+func TestEnsureEnvEscapesAndHonoursSudo(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{{contains: "cat '/srv/my app/.env'", out: "PORT=80\nNAME=x\n"}}}
+	changed, err := newTestExec(fr).exec(EnsureEnv("/srv/my app/.env", "NAME", "it's").Build(), NewVars())
+	if err != nil || !changed {
+		t.Fatalf("changed=%v err=%v", changed, err)
+	}
+	if fr.stdin[`cat > '/srv/my app/.env'`] != "PORT=80\nNAME=it's\n" || fr.ran("sudo") {
+		t.Errorf("calls = %q", fr.calls)
+	}
+
+	fr = &fakeRunner{rules: []rule{{contains: "cat '/etc/app.env'", out: "PORT=80\n"}}}
+	changed, err = newTestExec(fr).exec(EnsureEnv("/etc/app.env", "PORT", "80").Sudo().Build(), NewVars())
+	if err != nil || changed || len(fr.stdin) != 0 {
+		t.Errorf("converged: changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+	if !strings.Contains(fr.calls[len(fr.calls)-1], "sudo -S") {
+		t.Errorf("read without sudo: %q", fr.calls)
+	}
+}
+
+func TestEditUnreadableFileIsNotRebuilt(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{{contains: "-e '/etc/sudoers.d/app'", err: exitErr(1)}}}
+	for _, task := range []Task{
+		EnsureBlock("/etc/sudoers.d/app", "deploy", "deploy ALL=(ALL) NOPASSWD: ALL").Sudo().Build(),
+		EnsureEnv("/etc/sudoers.d/app", "A", "1").Build(),
+	} {
+		fr.calls, fr.stdin = nil, nil
+		if _, err := newTestExec(fr).exec(task, NewVars()); err == nil {
+			t.Errorf("%s: a failed read succeeded", task.Action)
+		}
+		if len(fr.stdin) != 0 || fr.ran("install ") || fr.ran("cp ") {
+			t.Errorf("%s: wrote after a failed read: %q", task.Action, fr.calls)
+		}
+	}
+
+	fr = &fakeRunner{rules: []rule{{contains: "cat '/etc/app.env'", err: exitErr(3)}}}
+	if _, err := newTestExec(fr).exec(EnsureEnv("/etc/app.env", "A", "1").Build(), NewVars()); err != nil {
+		t.Fatal(err)
+	}
+	if fr.stdin[`cat > '/etc/app.env'`] != "A=1\n" {
+		t.Errorf("missing file: stdin = %q", fr.stdin)
+	}
+}
+
+func TestEditKeepsSudoWarningsOutOfContent(t *testing.T) {
+	sf := &splitFake{stdout: "PORT=80\n", stderr: "sudo: unable to resolve host web1"}
+	e := &Executor{runner: sf}
+	current, exists, err := e.readRemote("/etc/app.env", true)
+	if err != nil || !exists || current != "PORT=80\n" {
+		t.Errorf("readRemote = %q, %v, %v", current, exists, err)
+	}
+}
+
+func TestEditLargeFileOverStdin(t *testing.T) {
+	big := strings.Repeat("x", 256<<10) + "\n"
+	fr := &fakeRunner{rules: []rule{
+		{contains: "cat '/etc/big.conf'", out: big},
+		{contains: "mktemp", out: "/tmp/tmp.abc\n"},
+	}}
+	for _, task := range []Task{
+		EnsureEnv("/etc/big.conf", "TAIL", "1").Build(),
+		EnsureEnv("/etc/big.conf", "TAIL", "1").Sudo().Build(),
+	} {
+		fr.calls, fr.stdin = nil, nil
+		if _, err := newTestExec(fr).exec(task, NewVars()); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range fr.calls {
+			if len(c) > 4096 {
+				t.Fatalf("content passed as an argument (%d bytes)", len(c))
+			}
+		}
+		if len(fr.stdin) != 1 {
+			t.Errorf("stdin = %d writes, calls = %q", len(fr.stdin), fr.calls)
+		}
+		for _, in := range fr.stdin {
+			if in != big+"TAIL=1\n" {
+				t.Errorf("wrote %d bytes", len(in))
+			}
+		}
+	}
+}
+
+func TestEnsureCopyAndMove(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{{contains: "sha256sum", out: "aaa\naaa"}}}
+	changed, err := newTestExec(fr).exec(EnsureCopy("/opt/a b", "/opt/c").Build(), NewVars())
+	if err != nil || changed || fr.ran("cp ") {
+		t.Errorf("same content: changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+	fr = &fakeRunner{rules: []rule{{contains: "sha256sum", out: "aaa"}}}
+	changed, err = newTestExec(fr).exec(EnsureCopy("/opt/a b", "/opt/c").Mode("0640").Sudo().Build(), NewVars())
+	if err != nil || !changed || !fr.ran("cp '/opt/a b' '/opt/c'") || !fr.ran("chmod '0640' '/opt/c'") {
+		t.Errorf("copy: changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+
+	fr = &fakeRunner{rules: []rule{{contains: "test -e '/tmp/new'", err: exitErr(1)}}}
+	changed, err = newTestExec(fr).exec(EnsureMove("/tmp/new", "/opt/app").Build(), NewVars())
+	if err != nil || changed || fr.ran("mv ") {
+		t.Errorf("moved: changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+	fr = &fakeRunner{fallErr: exitErr(1)}
+	if _, err := newTestExec(fr).exec(EnsureMove("/tmp/new", "/opt/app").Build(), NewVars()); err == nil {
+		t.Error("move with neither path present succeeded")
+	}
+}
+
+func TestEnsureBlockPreviewAndDiff(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{{contains: "cat '/etc/hosts'", out: "127.0.0.1 localhost\n"}}}
+	var final TaskProgress
+	e := newTestExec(fr).SetDryRun(true).SetDiff(true).OnProgress(func(p TaskProgress) { final = p })
+	if _, err := e.Run("deploy", Tasks(EnsureBlock("/etc/hosts", "cluster", "10.0.0.1 a\n10.0.0.2 b")), NewVars()); err != nil {
+		t.Fatal(err)
+	}
+	if final.Status != StatusChanged || !strings.Contains(final.Diff, "+# BEGIN cluster\n+10.0.0.1 a\n+10.0.0.2 b\n+# END cluster\n") {
+		t.Errorf("progress = %s %q", final.Status, final.Diff)
+	}
+	if len(fr.stdin) != 0 {
+		t.Errorf("dry-run wrote: %q", fr.calls)
+	}
+}
+
+func TestLineInFile(t *testing.T) {
+	sshd := "Port 22\n#PermitRootLogin yes\nPasswordAuthentication yes\n"
+	for _, tt := range []struct {
+		name string
+		t    Task
+		line string
+		in   string
+		want string
+	}{
+		{"replace last match", Task{Match: `^#?PermitRootLogin`}, "PermitRootLogin no", sshd, "Port 22\nPermitRootLogin no\nPasswordAuthentication yes\n"},
+		{"insert after anchor", Task{Match: `^UseDNS`, InsertAfter: `^Port `}, "UseDNS no", sshd, "Port 22\nUseDNS no\n#PermitRootLogin yes\nPasswordAuthentication yes\n"},
+		{"insert before anchor", Task{InsertBefore: `^Password`}, "X11Forwarding no", sshd, "Port 22\n#PermitRootLogin yes\nX11Forwarding no\nPasswordAuthentication yes\n"},
+		{"insert at BOF", Task{InsertBefore: "BOF"}, "# managed", "a\n", "# managed\na\n"},
+		{"anchor missing appends", Task{InsertAfter: `^nope`}, "b", "a\n", "a\nb\n"},
+		{"already present", Task{Match: `^Port`}, "Port 22", sshd, sshd},
+		{"remove matches", Task{Match: `^#`, State: "absent"}, "", "#a\nb\n#c\n", "b\n"},
+	} {
+		got, err := lineInContent(tt.t, tt.in, tt.line)
+		if err != nil || got != tt.want {
+			t.Errorf("%s = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	absent := Task{State: "absent"}
+	if got := must(blockInContent(absent, "a\n# BEGIN x\n1\n# END x\nb\n", "x", "")); got != "a\nb\n" {
+		t.Errorf("block absent = %q", got)
+	}
+	in := "a\n# BEGIN x\n1\n# END x\n"
+	if got := must(blockInContent(Task{}, in, "x", "1")); got != in {
+		t.Errorf("block unchanged = %q", got)
+	}
+	if got := must(blockInContent(Task{InsertAfter: `^a$`}, "a\nb\n", "x", "1")); got != "a\n# BEGIN x\n1\n# END x\nb\n" {
+		t.Errorf("block insert after = %q", got)
+	}
+}
+
+func TestEditValidateAndBackup(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{
+		{contains: "cat '/etc/sudoers'", out: "root ALL=(ALL) ALL\n"},
+		{contains: "mktemp", out: "/tmp/tmp.abc\n"},
+		{contains: "visudo -cf", out: "parse error", err: exitErr(1)},
+	}}
+	task := EnsureLine("/etc/sudoers", "deploy ALL=(ALL) NOPASSWD: ALL").Validate("visudo -cf %s").Backup().Sudo().Build()
+	_, err := newTestExec(fr).exec(task, NewVars())
+	if err == nil || !strings.Contains(err.Error(), "parse error") {
+		t.Fatalf("err = %v, want the validator's output", err)
+	}
+	if !fr.ran("visudo -cf '/tmp/tmp.abc'") || fr.ran(".bak.") || fr.ran("cp /tmp/tmp.abc") {
+		t.Errorf("invalid content was placed: %q", fr.calls)
+	}
+
+	fr.rules = fr.rules[:2]
+	fr.calls = nil
+	changed, err := newTestExec(fr).exec(task, NewVars())
+	if err != nil || !changed {
+		t.Fatalf("changed=%v err=%v", changed, err)
+	}
+	backup, place := -1, -1
+	for i, c := range fr.calls {
+		if strings.Contains(unwrapSudo(c), "cp -a '/etc/sudoers' '/etc/sudoers'.bak.") {
+			backup = i
+		}
+		if strings.Contains(unwrapSudo(c), "cp /tmp/tmp.abc '/etc/sudoers'") {
+			place = i
+		}
+	}
+	if backup < 0 || place < backup {
+		t.Errorf("want backup then place: %q", fr.calls)
+	}
+}
+
+func TestPlaybookRejectsBadEditPattern(t *testing.T) {
+	p, err := ParsePlaybook([]byte("version: 1\ntasks:\n  - action: ensure_line\n    dest: /etc/hosts\n    body: x\n    match: '('\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Compile(); err == nil || !strings.Contains(err.Error(), "match") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestValidateBeforePlace(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{
+		{contains: "mktemp", out: "/tmp/tmp.x\n"},
+		{contains: "nginx -t", out: "unknown directive \"lisen\"", err: exitErr(1)},
+	}}
+	_, err := newTestExec(fr).exec(Write("/etc/nginx/nginx.conf", "lisen 80;").Validate("nginx -t -c %s").Build(), NewVars())
+	if err == nil || !strings.Contains(err.Error(), "unknown directive") {
+		t.Fatalf("err = %v", err)
+	}
+	for _, c := range fr.calls {
+		if strings.Contains(c, "/etc/nginx/nginx.conf") {
+			t.Errorf("broken config reached its live path: %q", c)
+		}
+	}
+
+	fr = &fakeRunner{rules: []rule{{contains: "mktemp", out: "/tmp/tmp.x\n"}}}
+	changed, err := newTestExec(fr).exec(EnsureFile("/etc/nginx/nginx.conf", "listen 80;").Validate("nginx -t -c %s").Sudo().Build(), NewVars())
+	if err != nil || !changed || !fr.ran("nginx -t -c '/tmp/tmp.x'") || !fr.ran("cp /tmp/tmp.x /etc/nginx/nginx.conf") {
+		t.Errorf("changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+
+	fr = &fakeRunner{rules: []rule{{contains: "systemd-analyze", err: exitErr(1)}}}
+	_, err = newTestExec(fr).exec(Template("app", "[Service]\nExecStart=").Validate("systemd-analyze verify %s").Build(), NewVars())
+	if err == nil || fr.ran("/etc/systemd/system/app.service") {
+		t.Errorf("template: err=%v calls=%q", err, fr.calls)
+	}
+}
@@ -44,8 +44,8 @@ func EnsureSymlink(src, dest string) TaskBuilder {
 	return TaskBuilder{t: Task{Action: "ensure_symlink", Src: src, Dest: dest}}
 }
 
-// EnsurePackage ensures an apt package is installed. No-op if dpkg already
-// reports it installed.
+// EnsurePackage ensures a package is installed with the host's package
+// manager (see Pkg). No-op if it already is.
 func EnsurePackage(name string) TaskBuilder {
 	return TaskBuilder{t: Task{Action: "ensure_package", Dest: name}}
 }
@@ -184,11 +184,6 @@ func (e *Executor) symlinkPointsAt(dest, src string) bool {
 	return got == src
 }
 
-func (e *Executor) packageInstalled(name string) bool {
-	_, err := e.runCapture("dpkg-query -W -f='${Status}' " + shellEscape(name) + " 2>/dev/null | grep -q 'install ok installed'")
-	return err == nil
-}
-
 func (e *Executor) linePresent(file, line string, sudo bool) bool {
 	_, err := e.runCaptureMaybeSudo(sudo, "grep -qxF -- "+shellEscape(line)+" "+shellEscape(file)+" 2>/dev/null")
 	return err == nil
@@ -214,7 +209,7 @@ func (e *Executor) serviceEnabled(name string, user bool) bool {
 }
 
 func (e *Executor) pathExists(p string) bool {
-	_, err := e.runner.Run("test -e " + p)
+	_, err := e.runCapture("test -e " + p)
 	return err == nil
 }
 
@@ -273,6 +268,13 @@ func (e *Executor) ensureGitRepo(url, dest string) error {
 // the path; otherwise it assumes a change ("would run"). With no connection it
 // degrades to the action classification.
 func (e *Executor) preview(t Task, vars *Vars) (bool, string) {
+	if t.Action == "gather_facts" {
+		// Read-only, and later conditions need the facts to preview faithfully.
+		if err := actGatherFacts(e, t, "", "", "", "", "", vars); err != nil {
+			return false, "gather_facts: " + err.Error()
+		}
+		return false, ""
+	}
 	if e.client == nil {
 		if readOnlyActions[t.Action] {
 			return false, ""
@@ -297,6 +299,38 @@ func (e *Executor) preview(t Task, vars *Vars) (bool, string) {
 			return false, "ensure_file: " + dest + " already up to date"
 		}
 		return true, "ensure_file: would write " + dest
+	case "fetch":
+		pending, err := e.fetchPending(t, src, dest, vars)
+		switch {
+		case err != nil:
+			return true, "fetch: " + err.Error()
+		case !pending:
+			return false, "fetch: " + dest + " already matches"
+		}
+		return true, "fetch: would download " + src + " to " + dest
+	case "unarchive":
+		pending, err := e.unarchivePending(t, src, dest, body)
+		switch {
+		case err != nil:
+			return true, "unarchive: " + err.Error()
+		case !pending:
+			return false, "unarchive: " + src + " already extracted in " + dest
+		}
+		return true, "unarchive: would extract " + src + " into " + dest
+	case "sync_dir":
+		changes, err := e.syncDir(src, dest, e.parseSyncOpts(body), false)
+		switch {
+		case err != nil:
+			return true, "sync_dir: " + err.Error()
+		case len(changes) == 0:
+			return false, "sync_dir: " + dest + " in sync"
+		}
+		return true, "sync_dir: would apply\n  " + strings.Join(changes, "\n  ")
+	case "upload":
+		if !e.uploadPending(src, dest, t.Sudo) {
+			return false, "upload: " + dest + " already up to date"
+		}
+		return true, "upload: would transfer " + src + " to " + dest
 	case "ensure_dir":
 		if e.dirExists(dest) {
 			return false, "ensure_dir: " + dest + " exists"
@@ -312,7 +346,12 @@ func (e *Executor) preview(t Task, vars *Vars) (bool, string) {
 			return false, "ensure_package: " + dest + " installed"
 		}
 		return true, "ensure_package: would install " + dest
+	case "pkg", "pkg_repo":
+		return e.previewPkg(t, src, dest, body)
 	case "ensure_line":
+		if advancedLine(t) {
+			return e.previewEdit(expandEdit(t, vars), src, dest, body)
+		}
 		if e.linePresent(dest, body, t.Sudo) {
 			return false, "ensure_line: present in " + dest
 		}
@@ -352,6 +391,22 @@ func (e *Executor) preview(t Task, vars *Vars) (bool, string) {
 			return false, "ensure_absent: " + dest + " already gone"
 		}
 		return true, "ensure_absent: would remove " + dest
+	case "ensure_copy":
+		if e.copyConverged(src, dest, vars.Expand(t.Perm), vars.Expand(t.Own), t.Sudo) {
+			return false, "ensure_copy: " + dest + " matches " + src
+		}
+		return true, "ensure_copy: would copy " + src + " -> " + dest
+	case "ensure_move":
+		pending, err := e.movePending(src, dest)
+		switch {
+		case err != nil:
+			return true, "ensure_move: " + err.Error()
+		case !pending:
+			return false, "ensure_move: " + src + " already moved to " + dest
+		}
+		return true, "ensure_move: would move " + src + " -> " + dest
+	case "ensure_env", "ensure_replace", "ensure_block":
+		return e.previewEdit(expandEdit(t, vars), src, dest, body)
 	case "ensure_git_repo":
 		if _, err := e.runCapture("test -d " + shellEscape(dest+"/.git")); err != nil {
 			return true, "ensure_git_repo: would clone " + src + " -> " + dest
@@ -364,3 +419,15 @@ func (e *Executor) preview(t Task, vars *Vars) (bool, string) {
 	}
 	return true, "would run " + t.Action
 }
+
+// previewEdit is preview for the file edits (see editFile).
+func (e *Executor) previewEdit(t Task, src, dest, body string) (bool, string) {
+	pending, err := e.editPending(t, src, dest, body)
+	switch {
+	case err != nil:
+		return true, t.Action + ": " + err.Error()
+	case !pending:
+		return false, t.Action + ": " + dest + " already up to date"
+	}
+	return true, t.Action + ": would edit " + dest
+}
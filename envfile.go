@@ -4,7 +4,8 @@ package porter
 // ENVIRONMENT FILE OPERATIONS
 // =============================================================================
 
-// EnvSet sets a key-value pair in an environment file (.env format).
+// EnvSet sets a key-value pair in an environment file (.env format). EnsureEnv
+// is the idempotent, escaped form.
 func EnvSet(file, key, value string) TaskBuilder {
 	return TaskBuilder{Task{Action: "env_set", Dest: file, Src: key, Body: value, Name: "Set " + key + " in " + file}}
 }
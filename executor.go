@@ -1,6 +1,9 @@
 package porter
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,13 +15,93 @@ import (
 	"time"
 
 	"github.com/melbahja/goph"
+	"golang.org/x/crypto/ssh"
 )
 
 // cmdRunner runs a command on the remote and returns its combined output.
-// *goph.Client satisfies it; tests substitute a fake to exercise the dispatch
-// switch, idempotency no-op detection, and assertions without a live SSH host.
+// sshRunner adapts a *goph.Client to it; tests substitute a fake to exercise
+// the dispatch switch, idempotency no-op detection, and assertions without a
+// live SSH host.
 type cmdRunner interface {
-	Run(cmd string) ([]byte, error)
+	Run(ctx context.Context, cmd string) ([]byte, error)
+}
+
+// sshRunner runs each command in its own SSH session bound to ctx. When ctx is
+// cancelled (or its deadline passes) the remote process is killed and the
+// session closed, so a hung apt-get or curl is torn down on the host rather
+// than left running behind an abandoned call.
+type sshRunner struct{ client *goph.Client }
+
+func (r sshRunner) Run(ctx context.Context, cmd string) ([]byte, error) {
+	session, err := r.client.NewSession()
+	if err != nil {
+		return nil, &noSessionError{err}
+	}
+	defer session.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+	})
+	defer stop()
+
+	out, err := session.CombinedOutput(cmd)
+	if err != nil && ctx.Err() != nil {
+		return out, ctx.Err()
+	}
+	return out, err
+}
+
+// RunSplit is Run with stdout and stderr kept apart (see splitRunner).
+func (r sshRunner) RunSplit(ctx context.Context, cmd string) (stdout, stderr []byte, err error) {
+	session, err := r.client.NewSession()
+	if err != nil {
+		return nil, nil, &noSessionError{err}
+	}
+	defer session.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+	})
+	defer stop()
+
+	var outBuf, errBuf bytes.Buffer
+	session.Stdout, session.Stderr = &outBuf, &errBuf
+	err = session.Run(cmd)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return outBuf.Bytes(), errBuf.Bytes(), err
+}
+
+// stdinRunner is a cmdRunner that can feed a command's stdin, so content
+// reaches the host without being passed as an argument (which the kernel caps
+// at 128 KiB). An executor whose runner lacks it opens a session of its own.
+type stdinRunner interface {
+	RunStdin(ctx context.Context, cmd string, stdin io.Reader) ([]byte, error)
+}
+
+// RunStdin is Run with stdin fed to the command (see stdinRunner).
+func (r sshRunner) RunStdin(ctx context.Context, cmd string, stdin io.Reader) ([]byte, error) {
+	session, err := r.client.NewSession()
+	if err != nil {
+		return nil, &noSessionError{err}
+	}
+	defer session.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+	})
+	defer stop()
+
+	session.Stdin = stdin
+	out, err := session.CombinedOutput(cmd)
+	if err != nil && ctx.Err() != nil {
+		return out, ctx.Err()
+	}
+	return out, err
 }
 
 // Executor runs tasks on a remote server.
@@ -28,20 +111,94 @@ type Executor struct {
 	password   string
 	verbose    bool
 	dryRun     bool
+	diff       bool
 	onProgress ProgressFunc
+	onOutput   OutputFunc
+	redact     []string
 	tracer     *Tracer
-	rootSpanID string
 	logger     *slog.Logger
 
+	// parentSpanID is the span task spans are children of: the run's root
+	// span, or the enclosing Block's span while its tasks run.
+	parentSpanID string
+
+	// ctx governs the task in flight: the context passed to RunContext,
+	// narrowed by the task's Deadline while it runs. nil outside a run.
+	ctx context.Context
+
+	// handlers are the Handler definitions of the current run, in definition
+	// order; notified holds the names notified since the last flush.
+	handlers []Task
+	notified map[string]bool
+
+	// facts caches the host's facts once gathered; it is reset every run.
+	facts *Facts
+
 	// noOp is set by an action that determined the remote was already in the
 	// desired state and did nothing (the Ensure* primitives). It is reset
 	// before every dispatch and read by exec to report "ok, unchanged".
 	noOp bool
+
+	// result is the record of the command a command action ran, set by
+	// runResult during dispatch and judged and registered by exec.
+	result *Result
+
+	// drift collects the Ensure*/Assert* comparisons while Check runs; nil
+	// otherwise.
+	drift *DriftReport
+
+	// inflight is the progress record of the task being executed, so a long
+	// transfer can report its byte counts (and a sync its change list)
+	// through the ProgressFunc.
+	inflight *TaskProgress
+
+	// dial redials a dropped connection (see reconnect.go); ownsClient is set
+	// once client is one the executor dialled, so Close closes it.
+	dial             func() (*goph.Client, error)
+	ownsClient       bool
+	reconnectTimeout time.Duration
+	keepalive        time.Duration
+	stopKeepalive    func()
+
+	// sensitive is set while a Sensitive task runs, so its streamed output
+	// is withheld.
+	sensitive bool
+
+	// become is the privilege-escalation strategy (see become.go);
+	// becomePass caches its resolved password, and becomeUser is the task
+	// in flight's BecomeUser.
+	become     Become
+	becomePass *string
+	becomeUser string
 }
 
 // NewExecutor creates a new Executor.
 func NewExecutor(client *goph.Client, password string) *Executor {
-	return &Executor{client: client, runner: client, password: password, verbose: true}
+	return &Executor{client: client, runner: sshRunner{client}, password: password, verbose: true}
+}
+
+// taskCtx returns the context governing the task in flight, or Background
+// when the executor is driven outside RunContext.
+func (e *Executor) taskCtx() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// sleep pauses for d, returning the context's error early if the run is
+// cancelled or the task's deadline passes first. Retry delays, wait loops and
+// Pause all sleep through here so none of them outlive a cancellation.
+func (e *Executor) sleep(d time.Duration) error {
+	ctx := e.taskCtx()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 // SetVerbose enables or disables verbose output.
@@ -50,9 +207,30 @@ func (e *Executor) SetVerbose(v bool) *Executor { e.verbose = v; return e }
 // SetDryRun enables or disables dry-run mode.
 func (e *Executor) SetDryRun(v bool) *Executor { e.dryRun = v; return e }
 
+// SetDiff reports what file tasks change: for EnsureFile, Write, Template,
+// EnsureLine, EnsureSystemdKey and EnvSet the current remote content is read
+// first, and a task that changes it carries a unified diff on its final
+// TaskProgress, its log record and its trace span. Works in dry-run too.
+// Diffs of Sensitive tasks are redacted.
+func (e *Executor) SetDiff(v bool) *Executor { e.diff = v; return e }
+
 // OnProgress sets a callback function that is called for each task state change.
 func (e *Executor) OnProgress(fn ProgressFunc) *Executor { e.onProgress = fn; return e }
 
+// OnOutput sets a callback that receives the stdout and stderr of the
+// commands tasks run, line by line as they print it, with the progress
+// record of the task — so a long apt upgrade or go build can be followed
+// live. Probes (checksums, existence tests) are not streamed. The sudo
+// password and every Redact value are masked as ****, and the lines of a
+// Sensitive task are replaced by [redacted].
+func (e *Executor) OnOutput(fn OutputFunc) *Executor { e.onOutput = fn; return e }
+
+// Redact adds values (tokens, passwords) to mask in streamed output.
+func (e *Executor) Redact(values ...string) *Executor {
+	e.redact = append(e.redact, values...)
+	return e
+}
+
 // SetTracer attaches a Tracer so the deploy is recorded as a trace (one root
 // span per Run, one child span per task). Pass nil to disable.
 func (e *Executor) SetTracer(t *Tracer) *Executor { e.tracer = t; return e }
@@ -80,13 +258,42 @@ func (e *Executor) logTask(p TaskProgress) {
 	if p.Error != nil {
 		attrs = append(attrs, "error", p.Error.Error())
 	}
+	if p.Diff != "" {
+		attrs = append(attrs, "diff", p.Diff)
+	}
+	if len(p.Changes) > 0 {
+		attrs = append(attrs, "changes", p.Changes)
+	}
+	if p.RoundTrips > 0 {
+		attrs = append(attrs, "round_trips", p.RoundTrips)
+	}
 	e.logger.Info("porter.task", attrs...)
 }
 
 // Run executes a list of tasks.
 func (e *Executor) Run(name string, tasks []Task, vars *Vars) (*Stats, error) {
+	return e.RunContext(context.Background(), name, tasks, vars)
+}
+
+// RunContext executes a list of tasks under ctx. Cancelling ctx aborts the
+// task in flight — its remote session is closed and any retry delay or wait
+// loop returns at once — reports it as StatusCancelled rather than failed, and
+// skips the remaining tasks. The returned error wraps ctx.Err(), so callers
+// can test it with errors.Is(err, context.Canceled).
+func (e *Executor) RunContext(ctx context.Context, name string, tasks []Task, vars *Vars) (*Stats, error) {
+	tasks, handlers := splitHandlers(tasks)
+	if err := errors.Join(checkNotify(tasks, handlers), checkWhen(tasks), checkWhen(handlers)); err != nil {
+		return &Stats{}, fmt.Errorf("%s: %w", name, err)
+	}
+	if err := e.resolveBecome(); err != nil {
+		return &Stats{}, fmt.Errorf("%s: %w", name, err)
+	}
 	stats := &Stats{Total: len(tasks)}
 
+	prev, prevHandlers, prevNotified := e.ctx, e.handlers, e.notified
+	e.ctx, e.handlers, e.notified, e.facts = ctx, handlers, nil, nil
+	defer func() { e.ctx, e.handlers, e.notified = prev, prevHandlers, prevNotified }()
+
 	if e.verbose {
 		log.Printf("\n\033[1;36mPLAY [%s]\033[0m\n", name)
 	}
@@ -97,45 +304,117 @@ func (e *Executor) Run(name string, tasks []Task, vars *Vars) (*Stats, error) {
 		if e.client != nil {
 			root.SetAttribute("server.address", e.client.Config.Addr)
 		}
-		e.rootSpanID = root.ID()
+		e.parentSpanID = root.ID()
 	}
 
 	for i, task := range tasks {
-		taskName := vars.Expand(task.Name)
+		if err := ctx.Err(); err != nil {
+			return stats, fmt.Errorf("%s: %w", name, err)
+		}
+		if err := e.step(i, task, vars, stats); err != nil {
+			return stats, err
+		}
+	}
+
+	if err := e.flushHandlers(vars, stats); err != nil {
+		return stats, err
+	}
+
+	if e.verbose {
+		log.Printf("\n\033[1;36mRECAP\033[0m: ok=%d changed=%d skipped=%d failed=%d rescued=%d cancelled=%d\n",
+			stats.OK, stats.Changed, stats.Skipped, stats.Failed, stats.Rescued, stats.Cancelled)
+	}
+	return stats, nil
+}
+
+// step runs one entry of a task list: evaluates When, expands Loop, and runs
+// the task (or flushes handlers for a FlushHandlers marker). It returns an
+// error only when the run must stop.
+func (e *Executor) step(idx int, task Task, vars *Vars, stats *Stats) error {
+	taskName := vars.Expand(task.Name)
+
+	switch task.Action {
+	case "handler":
+		return nil // definitions are collected before the run starts
+	case "flush_handlers":
+		stats.OK++
+		e.emitProgress(TaskProgress{Index: idx, Total: stats.Total, Name: taskName, Action: task.Action, Status: StatusOK})
+		return e.flushHandlers(vars, stats)
+	}
 
-		if task.When != nil && !task.When(vars) {
+	if task.When != nil {
+		ok, err := vars.eval(task.When)
+		if err != nil {
+			return e.failUnrun(idx, task, taskName, err, stats)
+		}
+		if !ok {
+			if e.verbose && task.WhenExpr != "" {
+				log.Printf("\033[1;33mTASK\033[0m %s \033[36m...skipped (when: %s)\033[0m", taskName, task.WhenExpr)
+			}
 			stats.Skipped++
 			e.emitProgress(TaskProgress{
-				Index:  i,
-				Total:  len(tasks),
+				Index:  idx,
+				Total:  stats.Total,
 				Name:   taskName,
 				Action: task.Action,
 				Status: StatusSkipped,
+				When:   task.WhenExpr,
 			})
-			continue
+			return nil
 		}
+	}
 
-		if len(task.Loop) > 0 {
-			for _, item := range task.Loop {
-				vars.Item = item
-				if err := e.runTask(i, task, vars, stats); err != nil && !task.Ignore {
-					return stats, err
-				}
+	if len(task.Loop) > 0 {
+		for i, item := range task.Loop {
+			if i > 0 {
+				stats.Total++ // each iteration is a task run of its own
+			}
+			vars.Item = item
+			if err := e.runOne(idx, task, vars, stats); err != nil && !task.Ignore {
+				vars.Item = ""
+				return err
 			}
-			vars.Item = ""
-			continue
 		}
+		vars.Item = ""
+		return nil
+	}
 
-		if err := e.runTask(i, task, vars, stats); err != nil && !task.Ignore {
-			return stats, err
-		}
+	if err := e.runOne(idx, task, vars, stats); err != nil && (!task.Ignore || e.taskCtx().Err() != nil) {
+		return err
+	}
+	return nil
+}
+
+// runOne runs a single task, or a Block's sections.
+func (e *Executor) runOne(idx int, task Task, vars *Vars, stats *Stats) error {
+	if task.Action == "block" {
+		return e.runBlock(idx, task, vars, stats)
 	}
+	return e.runTask(idx, task, vars, stats)
+}
 
+// failUnrun reports a task that failed before running — its When or fields
+// referenced an undefined variable in strict mode — honouring Ignore.
+func (e *Executor) failUnrun(idx int, task Task, name string, err error, stats *Stats) error {
+	progress := TaskProgress{Index: idx, Total: stats.Total, Name: name, Action: task.Action, Attempt: 1, MaxAttempt: 1, When: task.WhenExpr}
+	defer func() { e.logTask(progress) }()
+	if task.Ignore {
+		if e.verbose {
+			log.Printf("  \033[33m%s: %v ...ignoring\033[0m", name, err)
+		}
+		stats.OK++
+		progress.Status = StatusOK
+		e.emitProgress(progress)
+		return nil
+	}
 	if e.verbose {
-		log.Printf("\n\033[1;36mRECAP\033[0m: ok=%d changed=%d skipped=%d failed=%d\n",
-			stats.OK, stats.Changed, stats.Skipped, stats.Failed)
+		log.Printf("  \033[1;31mFAILED\033[0m: %s: %v", name, err)
 	}
-	return stats, nil
+	stats.Failed++
+	progress.Status = StatusFailed
+	progress.Error = err
+	e.emitProgress(progress)
+	return fmt.Errorf("%s: %w", name, err)
 }
 
 // emitProgress calls the progress callback if set
@@ -166,6 +445,7 @@ func (e *Executor) runTask(idx int, task Task, vars *Vars, stats *Stats) error {
 		Attempt:    1,
 		MaxAttempt: maxAttempts,
 		StartTime:  time.Now(),
+		When:       task.WhenExpr,
 	}
 
 	// Emit one structured log record per task at completion, with the final
@@ -183,27 +463,62 @@ func (e *Executor) runTask(idx int, task Task, vars *Vars, stats *Stats) error {
 	// Emit running status
 	e.emitProgress(progress)
 
+	// Long actions report transfer progress and change lists on the record.
+	prevInflight := e.inflight
+	prevSensitive, prevBecomeUser := e.sensitive, e.becomeUser
+	e.inflight, e.sensitive = &progress, task.Sensitive || prevSensitive
+	if task.BecomeUser != "" {
+		e.becomeUser = task.BecomeUser
+	}
+	defer func() { e.inflight, e.sensitive, e.becomeUser = prevInflight, prevSensitive, prevBecomeUser }()
+
 	if e.dryRun {
-		changed, detail := e.preview(task, vars)
+		if _, err := vars.renderFields(task.Src, task.Dest, task.Body, task.Perm, task.Own); err != nil {
+			return e.failUnrun(idx, task, name, err, stats)
+		}
+		changed, detail, probed := false, "", false
+		if e.drift != nil {
+			changed, detail, probed = e.probeDrift(name, task, vars)
+		}
+		if !probed {
+			changed, detail = e.preview(task, vars)
+		}
 		stats.OK++
 		if changed {
 			stats.Changed++
 			progress.Status = StatusChanged
+			e.notify(task.Notify)
+			if e.diff {
+				progress.Diff = e.contentDiff(task, vars)
+			}
 		} else {
 			progress.Status = StatusOK
 		}
 		if e.verbose && detail != "" {
 			log.Printf("  \033[35m%s\033[0m", detail)
 		}
+		e.logDiff(progress.Diff)
 		progress.Duration = time.Since(progress.StartTime)
 		e.emitProgress(progress)
 		return nil
 	}
 
+	// A Deadline bounds the whole task, retries included. parent is kept so a
+	// caller's cancellation (StatusCancelled) can be told apart from the
+	// task's own deadline passing (an ordinary failure).
+	parent := e.taskCtx()
+	if task.Deadline > 0 {
+		ctx, cancel := context.WithTimeout(parent, task.Deadline)
+		defer cancel()
+		prev := e.ctx
+		e.ctx = ctx
+		defer func() { e.ctx = prev }()
+	}
+
 	// Check Creates condition - skip if path exists
 	if task.Creates != "" {
 		creates := vars.Expand(task.Creates)
-		if _, err := e.runner.Run("test -e " + creates); err == nil {
+		if _, err := e.runCapture("test -e " + creates); err == nil {
 			if e.verbose {
 				log.Printf("  \033[36m...skipped (exists: %s)\033[0m", creates)
 			}
@@ -223,9 +538,19 @@ func (e *Executor) runTask(idx int, task Task, vars *Vars, stats *Stats) error {
 		delay = 2 * time.Second
 	}
 
-	span := e.tracer.StartSpan(task.Action+" "+name, e.rootSpanID)
+	// The diff is taken before the task runs, while the file still holds
+	// the content it is about to replace.
+	var diff string
+	if e.diff {
+		diff = e.contentDiff(task, vars)
+	}
+
+	span := e.tracer.StartSpan(task.Action+" "+name, e.parentSpanID)
 	if span != nil {
 		span.SetAttribute("porter.action", task.Action)
+		if task.WhenExpr != "" {
+			span.SetAttribute("porter.when", task.WhenExpr)
+		}
 	}
 
 	for i := 0; i < maxAttempts; i++ {
@@ -238,7 +563,9 @@ func (e *Executor) runTask(idx int, task Task, vars *Vars, stats *Stats) error {
 			if e.verbose {
 				log.Printf("  \033[33mRetrying (%d/%d)...\033[0m", i, task.Retry)
 			}
-			time.Sleep(delay)
+			if err = e.sleep(delay); err != nil {
+				break
+			}
 
 			progress.Status = StatusRunning
 			e.emitProgress(progress)
@@ -249,16 +576,38 @@ func (e *Executor) runTask(idx int, task Task, vars *Vars, stats *Stats) error {
 			break
 		}
 		progress.Error = err
+		if e.taskCtx().Err() != nil {
+			break // cancelled or past the deadline: retrying cannot succeed
+		}
+	}
+
+	if err != nil && parent.Err() == nil && e.taskCtx().Err() != nil {
+		err = fmt.Errorf("deadline of %s exceeded: %w", task.Deadline, err)
 	}
 
 	if span != nil {
 		span.SetAttribute("porter.attempts", progress.Attempt)
 		span.SetAttribute("porter.changed", changed && err == nil)
+		span.SetAttribute("porter.round_trips", progress.RoundTrips)
+		if changed && err == nil && diff != "" {
+			span.SetAttribute("porter.diff", diff)
+		}
 		span.End(err)
 	}
 
 	progress.Duration = time.Since(progress.StartTime)
 
+	if err != nil && parent.Err() != nil {
+		if e.verbose {
+			log.Printf("  \033[1;35mCANCELLED\033[0m: %v", parent.Err())
+		}
+		stats.Cancelled++
+		progress.Status = StatusCancelled
+		progress.Error = parent.Err()
+		e.emitProgress(progress)
+		return fmt.Errorf("%s: %w", name, parent.Err())
+	}
+
 	if err != nil {
 		if task.Ignore {
 			if e.verbose {
@@ -283,6 +632,9 @@ func (e *Executor) runTask(idx int, task Task, vars *Vars, stats *Stats) error {
 	if changed {
 		stats.Changed++
 		progress.Status = StatusChanged
+		progress.Diff = diff
+		e.notify(task.Notify)
+		e.logDiff(diff)
 	} else {
 		progress.Status = StatusOK
 	}
@@ -290,6 +642,25 @@ func (e *Executor) runTask(idx int, task Task, vars *Vars, stats *Stats) error {
 	return nil
 }
 
+// logDiff prints a content diff in verbose mode, coloured like diff(1).
+func (e *Executor) logDiff(diff string) {
+	if !e.verbose || diff == "" {
+		return
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+		color := ""
+		switch {
+		case strings.HasPrefix(l, "+"):
+			color = "\033[32m"
+		case strings.HasPrefix(l, "-"):
+			color = "\033[31m"
+		case strings.HasPrefix(l, "@@"):
+			color = "\033[36m"
+		}
+		log.Printf("    %s%s\033[0m", color, l)
+	}
+}
+
 // =============================================================================
 // COMMAND HELPERS
 // =============================================================================
@@ -305,12 +676,21 @@ func (e *Executor) sudo(cmd string) string {
 	// operator at the top level — only the first simple command would run under
 	// sudo and the rest as the SSH user (e.g. `systemctl daemon-reload &&
 	// systemctl enable x` enabled nothing and exited 1).
-	return "printf '%s\\n' " + shellEscape(e.password) + " | sudo -S -p '' sh -c " + shellEscape(cmd)
+	//
+	// Other methods, target users and password sources come from the
+	// executor's Become strategy (become.go); the default is exactly this.
+	return e.escalate(cmd)
 }
 
 func (e *Executor) run(cmd string) error {
-	_, err := e.runner.Run(cmd)
-	return err
+	return e.withConn(func() error {
+		if sr, ok := e.streaming(); ok {
+			_, _, err := sr.RunStream(e.taskCtx(), cmd, e.emitOutput)
+			return err
+		}
+		_, err := e.runner.Run(e.taskCtx(), cmd)
+		return err
+	})
 }
 
 // writeFile writes content to dest. With no sudo, mode, or owner it streams
@@ -320,9 +700,10 @@ func (e *Executor) run(cmd string) error {
 // set, install applies that mode atomically — pass .Mode("600") for a secret
 // such as a private key so dest itself is never world-readable; with only an
 // owner, dest is copied (default umask mode, like a plain write) then chowned.
-// The temp is always removed.
-func (e *Executor) writeFile(dest, content string, sudo bool, perm, owner string) error {
-	if !sudo && perm == "" && owner == "" {
+// The temp is always removed. A non-empty validate command (see Validate) is
+// run against the staged temp first, and dest is left untouched if it fails.
+func (e *Executor) writeFile(dest, content string, sudo bool, perm, owner, validate string) error {
+	if !sudo && perm == "" && owner == "" && validate == "" {
 		return e.run("cat > " + dest + " <<'PORTER_EOF'\n" + content + "\nPORTER_EOF")
 	}
 	tmp, err := e.runCapture("mktemp")
@@ -333,82 +714,39 @@ func (e *Executor) writeFile(dest, content string, sudo bool, perm, owner string
 	if err := e.run("cat > " + tmp + " <<'PORTER_EOF'\n" + content + "\nPORTER_EOF"); err != nil {
 		return err
 	}
+	if validate != "" {
+		if err := e.validateStaged(validate, tmp, sudo); err != nil {
+			return err
+		}
+	}
 	return e.placeStaged(tmp, dest, sudo, perm, owner)
 }
 
 // placeStaged moves an already-staged temp file at tmp into dest, applying mode
 // and owner. With a mode it uses install (atomic mode/owner); without a mode it
 // copies then chowns so install's default 0755 isn't forced. Runs under sudo
-// when sudo is set. Shared by writeFile and uploadFile.
+// when sudo is set, on a copy the become user can read when that is not root
+// (see runOnStaged). Shared by writeFile and uploadFile.
 func (e *Executor) placeStaged(tmp, dest string, sudo bool, perm, owner string) error {
-	place := e.run
-	if sudo {
-		place = e.runSudo
-	}
-	if perm != "" {
-		cmd := "install -m " + perm
-		if owner != "" {
-			user, group, hasGroup := splitOwner(owner)
-			cmd += " -o " + user
-			if hasGroup {
-				cmd += " -g " + group
+	_, err := e.runOnStaged(tmp, sudo, func(src string) string {
+		if perm != "" {
+			cmd := "install -m " + perm
+			if owner != "" {
+				user, group, hasGroup := splitOwner(owner)
+				cmd += " -o " + user
+				if hasGroup {
+					cmd += " -g " + group
+				}
 			}
+			return cmd + " " + src + " " + dest
 		}
-		return place(cmd + " " + tmp + " " + dest)
-	}
-	if err := place("cp " + tmp + " " + dest); err != nil {
-		return err
-	}
-	if owner != "" {
-		return place("chown " + owner + " " + dest)
-	}
-	return nil
-}
-
-// uploadFile streams the LOCAL file at localPath to dest on the remote over
-// SFTP. With no sudo/mode/owner it transfers straight to dest. Otherwise it
-// uploads into a private temp (mktemp, 0600 — so a secret never sits
-// world-readable while staged) and places it into dest with placeStaged.
-func (e *Executor) uploadFile(localPath, dest string, sudo bool, perm, owner string) error {
-	if !sudo && perm == "" && owner == "" {
-		return e.client.Upload(localPath, dest)
-	}
-	tmp, err := e.runCapture("mktemp")
-	if err != nil {
-		return err
-	}
-	defer func() { _ = e.run("rm -f " + tmp) }()
-	if err := e.sftpUploadInto(localPath, tmp); err != nil {
-		return err
-	}
-	return e.placeStaged(tmp, dest, sudo, perm, owner)
-}
-
-// sftpUploadInto streams localPath into the existing remote file at remotePath
-// (truncating it), preserving that file's mode — so when remotePath was created
-// by mktemp (0600), the staged copy stays 0600 throughout the transfer.
-func (e *Executor) sftpUploadInto(localPath, remotePath string) error {
-	local, err := os.Open(localPath)
-	if err != nil {
-		return fmt.Errorf("open local %s: %w", localPath, err)
-	}
-	defer local.Close()
-
-	ftp, err := e.client.NewSftp()
-	if err != nil {
-		return fmt.Errorf("sftp session failed: %w", err)
-	}
-	defer ftp.Close()
-
-	remote, err := ftp.OpenFile(remotePath, os.O_WRONLY|os.O_TRUNC)
-	if err != nil {
-		return fmt.Errorf("open remote temp failed: %w", err)
-	}
-	if _, err := io.Copy(remote, local); err != nil {
-		remote.Close()
-		return fmt.Errorf("upload copy failed: %w", err)
-	}
-	return remote.Close()
+		cmd := "cp " + src + " " + dest
+		if owner != "" {
+			cmd += " && chown " + owner + " " + dest
+		}
+		return cmd
+	})
+	return err
 }
 
 // sudoStdinCommand returns the command to run and the stdin reader for piping a
@@ -432,17 +770,31 @@ func (e *Executor) runWithStdin(cmd, localPath string, sudo bool) error {
 		return fmt.Errorf("open local %s: %w", localPath, err)
 	}
 	defer f.Close()
+	return e.runStdin(cmd, f, sudo)
+}
 
-	session, err := e.client.NewSession()
-	if err != nil {
-		return fmt.Errorf("ssh session failed: %w", err)
+// runStdin runs cmd on the remote with in piped to its stdin, escalated via
+// escalateStdin when sudo is set. The persistent session's stdin is its shell,
+// so that runner gets a session of its own.
+func (e *Executor) runStdin(cmd string, in io.Reader, sudo bool) error {
+	full, stdin := cmd, in
+	if sudo {
+		full, stdin = e.escalateStdin(cmd, in)
 	}
-	defer session.Close()
-
-	full, stdin := sudoStdinCommand(cmd, e.password, sudo, f)
-	session.Stdin = stdin
-	out, err := session.CombinedOutput(full)
+	var out []byte
+	err := e.withConn(func() error {
+		sr, ok := e.runner.(stdinRunner)
+		if !ok {
+			sr = sshRunner{e.client}
+		}
+		var err error
+		out, err = sr.RunStdin(e.taskCtx(), full, stdin)
+		return err
+	})
 	if err != nil {
+		if e.taskCtx().Err() != nil {
+			return e.taskCtx().Err()
+		}
 		return fmt.Errorf("%s: %w", strings.TrimSpace(string(out)), err)
 	}
 	return nil
@@ -480,7 +832,7 @@ func (e *Executor) trustCAContent(anchor, pem string) error {
 		anchor += ".crt"
 	}
 	target := "/usr/local/share/ca-certificates/" + anchor
-	if err := e.writeFile(target, pem, true, "0644", ""); err != nil {
+	if err := e.writeFile(target, pem, true, "0644", "", ""); err != nil {
 		return err
 	}
 	return e.runSudo("update-ca-certificates")
@@ -517,7 +869,12 @@ func (e *Executor) runCaptureMaybeSudo(sudo bool, cmd string) (string, error) {
 }
 
 func (e *Executor) runCapture(cmd string) (string, error) {
-	out, err := e.runner.Run(cmd)
+	var out []byte
+	err := e.withConn(func() error {
+		var err error
+		out, err = e.runner.Run(e.taskCtx(), cmd)
+		return err
+	})
 	return strings.TrimSpace(string(out)), err
 }
 
@@ -563,7 +920,7 @@ var readOnlyActions = map[string]bool{
 	"file_exists": true, "dir_exists": true, "service_running": true,
 	"wait_port": true, "wait_http": true, "wait_file": true, "pause": true,
 	"disk_space": true, "memory_info": true, "cpu_info": true, "load_average": true,
-	"command_exists": true, "nproc": true, "sysinfo": true,
+	"command_exists": true, "nproc": true, "sysinfo": true, "gather_facts": true,
 	"require_disk": true, "require_memory": true, "require_command": true,
 	"docker_ps": true, "docker_images": true, "docker_volumes": true,
 	"docker_networks": true, "docker_info": true,
@@ -583,14 +940,13 @@ var readOnlyActions = map[string]bool{
 // read-only action, or an Ensure* primitive that found the host already
 // converged (e.noOp), counts as ok-but-unchanged.
 func (e *Executor) exec(t Task, vars *Vars) (bool, error) {
-	e.noOp = false
-	if err := e.dispatch(t, vars); err != nil {
-		return false, err
+	e.noOp, e.result = false, nil
+	err := e.dispatch(t, vars)
+	changed := err == nil && !e.noOp && !readOnlyActions[t.Action]
+	if e.result != nil {
+		return e.judge(t, vars, e.result, changed, err)
 	}
-	if e.noOp || readOnlyActions[t.Action] {
-		return false, nil
-	}
-	return true, nil
+	return changed, err
 }
 
 // =============================================================================
@@ -616,11 +972,16 @@ func (e *Executor) serviceCtl(name, state string, user bool) error {
 	return e.runSudo("systemctl " + state + " " + svc)
 }
 
-func (e *Executor) installTemplate(name, content string, user bool) error {
+func (e *Executor) installTemplate(name, content, validate string, user bool) error {
 	filename := name + ".service"
 	if err := e.run("cat > " + filename + " <<'EOF'\n" + content + "\nEOF"); err != nil {
 		return err
 	}
+	if validate != "" {
+		if err := e.validateStaged(validate, filename, false); err != nil {
+			return err
+		}
+	}
 	target := "/etc/systemd/system/" + filename
 	if user {
 		target = "/etc/systemd/user/" + filename
@@ -839,7 +1200,9 @@ func (e *Executor) waitForPort(host, port string, timeout time.Duration) error {
 		if err := e.run("nc -z " + host + " " + port); err == nil {
 			return nil
 		}
-		time.Sleep(time.Second)
+		if err := e.sleep(time.Second); err != nil {
+			return err
+		}
 	}
 	return fmt.Errorf("timeout waiting for %s:%s", host, port)
 }
@@ -857,7 +1220,9 @@ func (e *Executor) waitForHttp(url, expectedCode string, timeout time.Duration)
 		if err == nil && out == expectedCode {
 			return nil
 		}
-		time.Sleep(2 * time.Second)
+		if err := e.sleep(2 * time.Second); err != nil {
+			return err
+		}
 	}
 	return fmt.Errorf("timeout waiting for %s to return %s", url, expectedCode)
 }
@@ -871,7 +1236,9 @@ func (e *Executor) waitForFile(path string, timeout time.Duration) error {
 		if err := e.run("test -f " + path); err == nil {
 			return nil
 		}
-		time.Sleep(time.Second)
+		if err := e.sleep(time.Second); err != nil {
+			return err
+		}
 	}
 	return fmt.Errorf("timeout waiting for file %s", path)
 }
@@ -900,7 +1267,7 @@ func (e *Executor) checkServiceRunning(name string, user bool) bool {
 // =============================================================================
 
 func (e *Executor) sftpRead(path string) ([]byte, error) {
-	ftp, err := e.client.NewSftp()
+	ftp, err := e.newSftp()
 	if err != nil {
 		return nil, fmt.Errorf("sftp session failed: %w", err)
 	}
@@ -920,7 +1287,7 @@ func (e *Executor) sftpRead(path string) ([]byte, error) {
 }
 
 func (e *Executor) sftpWrite(path string, data []byte) error {
-	ftp, err := e.client.NewSftp()
+	ftp, err := e.newSftp()
 	if err != nil {
 		return fmt.Errorf("sftp session failed: %w", err)
 	}
@@ -943,8 +1310,8 @@ func (e *Executor) sftpWrite(path string, data []byte) error {
 // BEFORE writing the bytes so the plaintext is never briefly world-readable,
 // then optionally chowns. perm defaults to 0600. The plaintext is never placed
 // in a shell command or logged.
-func (e *Executor) sftpWriteSecret(dest string, data []byte, perm, owner string, sudo bool) error {
-	ftp, err := e.client.NewSftp()
+func (e *Executor) sftpWriteSecret(dest string, data []byte, perm, owner string, sudo bool, validate string) error {
+	ftp, err := e.newSftp()
 	if err != nil {
 		return fmt.Errorf("sftp session failed: %w", err)
 	}
@@ -952,6 +1319,32 @@ func (e *Executor) sftpWriteSecret(dest string, data []byte, perm, owner string,
 
 	mode := parseFileMode(perm, 0o600)
 
+	if validate != "" {
+		// Stage in a private temp (mktemp creates it 0600) so the secret is
+		// checked before it reaches dest.
+		tmp, err := e.runCapture("mktemp")
+		if err != nil {
+			return err
+		}
+		defer func() { _ = e.run("rm -f " + tmp) }()
+		f, err := ftp.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC)
+		if err != nil {
+			return fmt.Errorf("open staged secret failed: %w", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return fmt.Errorf("write staged secret failed: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("close staged secret failed: %w", err)
+		}
+		if err := e.validateStaged(validate, tmp, sudo); err != nil {
+			// The validator's output may quote the secret.
+			return fmt.Errorf("validate %q failed on the staged secret", validate)
+		}
+		return e.placeStaged(tmp, shellEscape(dest), sudo, fmt.Sprintf("%04o", mode), owner)
+	}
+
 	file, err := ftp.Create(dest)
 	if err != nil {
 		return fmt.Errorf("create remote secret failed: %w", err)
@@ -1304,6 +1697,9 @@ func (e *Executor) rsyncExec(src, dest, opts string, sudo bool) error {
 			sshCmd += " -i " + sshKey
 		}
 		sshCmd += " -o StrictHostKeyChecking=" + sshStrictOption()
+		if hashingKnownHosts() {
+			sshCmd += " -o HashKnownHosts=yes"
+		}
 		if kh := knownHostsFile(); kh != "" {
 			sshCmd += " -o UserKnownHostsFile=" + shellEscape(kh)
 		}
@@ -0,0 +1,302 @@
+package porter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// =============================================================================
+// TEMPLATE EXPANSION
+//
+// By default task fields are expanded with a literal {{key}} replace, which is
+// safe for commands that carry Go-template syntax of their own (docker
+// --format '{{.Names}}'). SetTemplates switches a Vars to text/template:
+// variables are fields of dot ({{.version}}), structured values set with
+// SetValue can be indexed and ranged over, and filters are available as
+// pipeline functions:
+//
+//	{{.env | default "staging"}}   {{.name | upper}}   {{.token | b64}}
+//	{{.path | quote}}              {{.cfg | toJSON}}   {{.hosts | join ","}}
+//	{{range .servers}}server {{.}};{{end}}   {{item}} (the Loop item)
+//
+// SetStrict makes a reference to an undefined variable an error that fails
+// the task — in its fields, its Template body and its When condition — in
+// either mode. Piping into default counts as handling the undefined case.
+// =============================================================================
+
+// SetTemplates switches expansion to text/template (see the section comment).
+func (v *Vars) SetTemplates(on bool) *Vars { v.templates = on; return v }
+
+// SetStrict makes undefined variable references fail the task instead of
+// expanding to "" (template mode) or staying as a literal {{name}}.
+func (v *Vars) SetStrict(on bool) *Vars { v.strict = on; return v }
+
+// placeholderRe matches a plain-mode {{name}} placeholder. A leading dot, as
+// in docker's --format '{{.Names}}', is not a porter variable.
+var placeholderRe = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_.-]*)\s*\}\}`)
+
+// dottedRe matches a plain-mode {{name.path}} placeholder into a structured
+// value.
+var dottedRe = regexp.MustCompile(`\{\{[A-Za-z_][A-Za-z0-9_-]*(\.[A-Za-z0-9_-]+)+\}\}`)
+
+// Render expands s like Expand but reports what Expand hides: a template that
+// does not parse or execute, and — in strict mode — undefined variables.
+func (v *Vars) Render(s string) (string, error) {
+	if s == "" {
+		return s, nil
+	}
+	if !v.templates {
+		if v.strict {
+			var missing []string
+			for _, m := range placeholderRe.FindAllStringSubmatch(s, -1) {
+				if _, ok := v.resolve(m[1]); !ok && !slices.Contains(missing, m[1]) {
+					missing = append(missing, m[1])
+				}
+			}
+			if len(missing) > 0 {
+				return v.expandPlain(s), undefinedErr(missing)
+			}
+		}
+		return v.expandPlain(s), nil
+	}
+	return v.renderTemplate(s)
+}
+
+// parseTemplate parses s with the porter filters.
+func (v *Vars) parseTemplate(s string) (*template.Template, error) {
+	tmpl, err := template.New("").Funcs(v.funcs()).Option("missingkey=zero").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderTemplate renders s as a text/template, whatever the expansion mode.
+func (v *Vars) renderTemplate(s string) (string, error) {
+	tmpl, err := v.parseTemplate(s)
+	if err != nil {
+		return s, err
+	}
+	data := make(map[string]any, len(v.data)+len(v.values)+1)
+	for k, val := range v.values {
+		data[k] = val
+	}
+	for k, val := range v.data {
+		data[k] = val
+	}
+	data["item"] = v.Item
+
+	if v.strict {
+		var missing []string
+		walkRefs(tmpl.Tree.Root, false, func(path []string) {
+			if _, ok := data[path[0]]; !ok && !slices.Contains(missing, path[0]) {
+				missing = append(missing, path[0])
+			}
+		})
+		if len(missing) > 0 {
+			return s, undefinedErr(missing)
+		}
+	}
+	walkRefs(tmpl.Tree.Root, true, func(path []string) { fillMissing(data, path) })
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return s, fmt.Errorf("template: %w", err)
+	}
+	return out.String(), nil
+}
+
+// renderFields renders several task fields, stopping at the first error.
+func (v *Vars) renderFields(fields ...string) ([]string, error) {
+	out := make([]string, len(fields))
+	for i, f := range fields {
+		r, err := v.Render(f)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = r
+	}
+	return out, nil
+}
+
+// eval runs a When condition, failing in strict mode if it referenced an
+// undefined variable.
+func (v *Vars) eval(w When) (bool, error) {
+	v.refErrs, v.whenErr = nil, nil
+	ok := w(v)
+	refs, werr := v.refErrs, v.whenErr
+	v.refErrs, v.whenErr = nil, nil
+	if werr != nil {
+		return false, fmt.Errorf("when: %w", werr)
+	}
+	if len(refs) > 0 {
+		return false, fmt.Errorf("when: %w", undefinedErr(refs))
+	}
+	return ok, nil
+}
+
+func undefinedErr(names []string) error {
+	return fmt.Errorf("undefined variable(s): %s", strings.Join(names, ", "))
+}
+
+// walkRefs reports every variable path a template references through dot
+// ({{.name}}, {{.name.sub}}). Fields inside range/with bodies are relative
+// to the new dot and are not variables. Unless defaults is set, a pipeline
+// ending in default is skipped: it handles its own undefined case (as does
+// the default "x" .name form).
+func walkRefs(n parse.Node, defaults bool, ref func(path []string)) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walkRefs(c, defaults, ref)
+		}
+	case *parse.ActionNode:
+		walkRefs(n.Pipe, defaults, ref)
+	case *parse.IfNode:
+		walkRefs(n.Pipe, defaults, ref)
+		walkRefs(n.List, defaults, ref)
+		walkRefs(n.ElseList, defaults, ref)
+	case *parse.RangeNode:
+		walkRefs(n.Pipe, defaults, ref)
+		walkRefs(n.ElseList, defaults, ref)
+	case *parse.WithNode:
+		walkRefs(n.Pipe, defaults, ref)
+		walkRefs(n.ElseList, defaults, ref)
+	case *parse.PipeNode:
+		if n == nil || len(n.Cmds) == 0 {
+			return
+		}
+		for _, c := range n.Cmds {
+			if !defaults && isIdent(c.Args[0], "default") {
+				return
+			}
+		}
+		for _, c := range n.Cmds {
+			for _, a := range c.Args {
+				walkRefs(a, defaults, ref)
+			}
+		}
+	case *parse.FieldNode:
+		ref(n.Ident)
+	case *parse.ChainNode:
+		walkRefs(n.Node, defaults, ref)
+	}
+}
+
+// fillMissing sets the variable at path to "" in data where it is missing, so
+// it renders empty, like an unset shell variable, instead of as "<no value>"
+// (what missingkey=zero gives a map[string]any). Maps along the path are
+// copied before they are written to: they belong to the Vars.
+func fillMissing(data map[string]any, path []string) {
+	m := data
+	for i, k := range path {
+		val, ok := m[k]
+		if !ok {
+			if i == len(path)-1 {
+				m[k] = ""
+				return
+			}
+			val = map[string]any{}
+		}
+		switch next := val.(type) {
+		case registered:
+			c := maps.Clone(next)
+			m[k], m = c, c
+		case map[string]any:
+			c := maps.Clone(next)
+			m[k], m = c, c
+		default:
+			return
+		}
+	}
+}
+
+func isIdent(n parse.Node, name string) bool {
+	id, ok := n.(*parse.IdentifierNode)
+	return ok && id.Ident == name
+}
+
+// funcs returns the template filters. item is a function too, so templates
+// written for plain mode's {{item}} keep working.
+func (v *Vars) funcs() template.FuncMap {
+	return template.FuncMap{
+		"item": func() string { return v.Item },
+		"default": func(def, val any) any {
+			if isEmpty(val) {
+				return def
+			}
+			return val
+		},
+		"upper": func(s any) string { return strings.ToUpper(toString(s)) },
+		"lower": func(s any) string { return strings.ToLower(toString(s)) },
+		"trim":  func(s any) string { return strings.TrimSpace(toString(s)) },
+		"replace": func(old, new string, s any) string {
+			return strings.ReplaceAll(toString(s), old, new)
+		},
+		"b64": func(s any) string { return base64.StdEncoding.EncodeToString([]byte(toString(s))) },
+		"b64dec": func(s any) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(toString(s))
+			return string(b), err
+		},
+		"quote": func(s any) string { return shellEscape(toString(s)) },
+		"toJSON": func(val any) (string, error) {
+			b, err := json.Marshal(val)
+			return string(b), err
+		},
+		"join": func(sep string, list any) (string, error) {
+			items, err := toStrings(list)
+			return strings.Join(items, sep), err
+		},
+	}
+}
+
+func isEmpty(val any) bool {
+	if val == nil {
+		return true
+	}
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	}
+	return false
+}
+
+func toString(val any) string {
+	switch s := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	}
+	return fmt.Sprint(val)
+}
+
+func toStrings(list any) ([]string, error) {
+	if list == nil {
+		return nil, nil
+	}
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, errors.New("join: not a list")
+	}
+	out := make([]string, rv.Len())
+	for i := range out {
+		out[i] = toString(rv.Index(i).Interface())
+	}
+	return out, nil
+}
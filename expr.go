@@ -0,0 +1,555 @@
+package porter
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// =============================================================================
+// WHEN EXPRESSIONS
+//
+// A small, side-effect-free expression language for conditions that must be
+// written down rather than compiled in: playbooks, dashboard manifests, dry-run
+// output. CompileWhen turns source into a When; Task.WhenExpr keeps the source
+// so progress callbacks, logs and traces can show it.
+//
+//	os_family == "debian" && version >= "1.4"
+//	registered.rc != 0
+//	"docker" in groups || !defined(docker_host)
+//	(env == "prod" or env == "staging") and not maintenance
+//
+// Operands are variables (dotted paths walk into structured values set with
+// SetValue, or into JSON held in a string variable), quoted strings, numbers
+// and true/false. Comparison is numeric when both sides are numbers, dotted
+// version-wise when both look like versions (1.10 > 1.4), and textual
+// otherwise. `in` tests list membership, map keys or substrings. A bare
+// operand is true unless it is undefined, empty, "false" or "0".
+// =============================================================================
+
+// CompileWhen parses an expression into a When. The error, if any, points at
+// the offending position in src.
+func CompileWhen(src string) (When, error) {
+	n, err := parseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	return func(v *Vars) bool { return truthy(n.eval(v)) }, nil
+}
+
+// WhenExpr sets the task's condition from an expression (see CompileWhen).
+// The source is kept for progress and trace output. A parse error fails the
+// run before its first task executes.
+func (b TaskBuilder) WhenExpr(src string) TaskBuilder {
+	b.t.When, _ = CompileWhen(src)
+	b.t.WhenExpr = src
+	return b
+}
+
+// checkWhen reports expressions that do not compile — a WhenExpr without its
+// When, a FailedWhen or ChangedWhen — before anything runs.
+func checkWhen(tasks []Task) error {
+	for _, t := range tasks {
+		if t.WhenExpr != "" && t.When == nil {
+			if _, err := CompileWhen(t.WhenExpr); err != nil {
+				return fmt.Errorf("task %q: when: %w", t.Name, err)
+			}
+		}
+		for _, p := range []struct{ key, src string }{{"failed_when", t.FailedWhen}, {"changed_when", t.ChangedWhen}} {
+			if p.src == "" {
+				continue
+			}
+			if _, err := CompileWhen(p.src); err != nil {
+				return fmt.Errorf("task %q: %s: %w", t.Name, p.key, err)
+			}
+		}
+		for _, nested := range [][]Task{t.Tasks, t.Rescue, t.Always} {
+			if err := checkWhen(nested); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ---- evaluation ------------------------------------------------------------
+
+type exprNode interface{ eval(v *Vars) any }
+
+type (
+	litNode struct{ val any }
+	varNode struct{ path string }
+	defNode struct{ path string }
+	notNode struct{ x exprNode }
+	andNode struct{ l, r exprNode }
+	orNode  struct{ l, r exprNode }
+	cmpNode struct {
+		op   string
+		l, r exprNode
+	}
+)
+
+func (n litNode) eval(*Vars) any { return n.val }
+
+func (n varNode) eval(v *Vars) any {
+	val, ok := v.resolve(n.path)
+	if !ok && v.strict && !slices.Contains(v.refErrs, n.path) {
+		v.refErrs = append(v.refErrs, n.path)
+	}
+	return val
+}
+
+func (n defNode) eval(v *Vars) any { _, ok := v.resolve(n.path); return ok }
+func (n notNode) eval(v *Vars) any { return !truthy(n.x.eval(v)) }
+func (n andNode) eval(v *Vars) any { return truthy(n.l.eval(v)) && truthy(n.r.eval(v)) }
+func (n orNode) eval(v *Vars) any  { return truthy(n.l.eval(v)) || truthy(n.r.eval(v)) }
+
+func (n cmpNode) eval(v *Vars) any {
+	l, r := n.l.eval(v), n.r.eval(v)
+	switch n.op {
+	case "==":
+		return compare(l, r) == 0
+	case "!=":
+		return compare(l, r) != 0
+	case "<":
+		return compare(l, r) < 0
+	case "<=":
+		return compare(l, r) <= 0
+	case ">":
+		return compare(l, r) > 0
+	case ">=":
+		return compare(l, r) >= 0
+	case "in":
+		return contains(r, l)
+	case "not in":
+		return !contains(r, l)
+	}
+	return false
+}
+
+// resolve looks up a dotted path: the longest prefix naming a variable, then
+// map keys / list indexes into its value. A string variable holding JSON is
+// decoded on the way, so a registered JSON result can be navigated.
+func (v *Vars) resolve(path string) (any, bool) {
+	if path == "item" {
+		return v.Item, true
+	}
+	parts := strings.Split(path, ".")
+	for i := len(parts); i > 0; i-- {
+		val, ok := v.Value(strings.Join(parts[:i], "."))
+		if !ok {
+			continue
+		}
+		for _, key := range parts[i:] {
+			if val, ok = child(val, key); !ok {
+				return nil, false
+			}
+		}
+		return val, true
+	}
+	return nil, false
+}
+
+func child(val any, key string) (any, bool) {
+	if s, ok := val.(string); ok {
+		var decoded any
+		if json.Unmarshal([]byte(s), &decoded) != nil {
+			return nil, false
+		}
+		val = decoded
+	}
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		e := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+		if !e.IsValid() {
+			return nil, false
+		}
+		return e.Interface(), true
+	case reflect.Slice, reflect.Array:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= rv.Len() {
+			return nil, false
+		}
+		return rv.Index(i).Interface(), true
+	}
+	return nil, false
+}
+
+func truthy(val any) bool {
+	switch val := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return val
+	case float64:
+		return val != 0
+	case string:
+		switch strings.TrimSpace(val) {
+		case "", "false", "0":
+			return false
+		}
+		return true
+	case fmt.Stringer:
+		return truthy(val.String())
+	}
+	return !isEmpty(val)
+}
+
+// compare orders two operands: numerically, by version, or as text.
+func compare(a, b any) int {
+	if ab, ok := a.(bool); ok {
+		a = strconv.FormatBool(ab)
+	}
+	if bb, ok := b.(bool); ok {
+		b = strconv.FormatBool(bb)
+	}
+	as, bs := scalarString(a), scalarString(b)
+	if av, ok := versionParts(as); ok {
+		if bv, ok := versionParts(bs); ok {
+			for i := 0; i < max(len(av), len(bv)); i++ {
+				var x, y int
+				if i < len(av) {
+					x = av[i]
+				}
+				if i < len(bv) {
+					y = bv[i]
+				}
+				if x != y {
+					return cmpInt(x, y)
+				}
+			}
+			return 0
+		}
+	}
+	if af, err := strconv.ParseFloat(as, 64); err == nil {
+		if bf, err := strconv.ParseFloat(bs, 64); err == nil {
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(as, bs)
+}
+
+func cmpInt(x, y int) int {
+	if x < y {
+		return -1
+	}
+	return 1
+}
+
+// versionParts splits "1.10.2" into [1 10 2]; ok is false for anything that
+// is not dot-separated non-negative integers.
+func versionParts(s string) ([]int, bool) {
+	if s == "" {
+		return nil, false
+	}
+	var out []int
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || p == "" || p[0] == '+' {
+			return nil, false
+		}
+		out = append(out, n)
+	}
+	return out, true
+}
+
+func scalarString(val any) string {
+	switch val := val.(type) {
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case string:
+		return val
+	case nil:
+		return ""
+	case fmt.Stringer:
+		return val.String()
+	}
+	if b, err := json.Marshal(val); err == nil && !strings.HasPrefix(string(b), "\"") {
+		return string(b)
+	}
+	return fmt.Sprint(val)
+}
+
+// contains reports whether needle is in haystack: an element of a list, a key
+// of a map, or a substring of a string (a string holding a JSON list or
+// object is decoded first).
+func contains(haystack, needle any) bool {
+	if s, ok := haystack.(string); ok {
+		var decoded any
+		if (strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{")) && json.Unmarshal([]byte(s), &decoded) == nil {
+			haystack = decoded
+		} else {
+			return strings.Contains(s, scalarString(needle))
+		}
+	}
+	rv := reflect.ValueOf(haystack)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := range rv.Len() {
+			if compare(rv.Index(i).Interface(), needle) == 0 {
+				return true
+			}
+		}
+	case reflect.Map:
+		for _, k := range rv.MapKeys() {
+			if compare(k.Interface(), needle) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ---- parsing ---------------------------------------------------------------
+
+type token struct {
+	kind string // "str", "num", "ident", "op", "(", ")", "eof"
+	text string
+	pos  int
+}
+
+func lexExpr(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, token{string(c), string(c), i})
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			var b strings.Builder
+			i++
+			for i < len(src) && src[i] != c {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				b.WriteByte(src[i])
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			toks = append(toks, token{"str", b.String(), start})
+		case strings.ContainsRune("=!<>&|", rune(c)):
+			start := i
+			two := ""
+			if i+1 < len(src) {
+				two = src[i : i+2]
+			}
+			switch two {
+			case "==", "!=", "<=", ">=", "&&", "||":
+				toks = append(toks, token{"op", two, start})
+				i += 2
+				continue
+			}
+			switch c {
+			case '<', '>', '!':
+				toks = append(toks, token{"op", string(c), start})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected %q at %d", string(c), start)
+			}
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(src) && (src[i] == '.' || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+			if src[start:i] == "-" {
+				return nil, fmt.Errorf("unexpected \"-\" at %d", start)
+			}
+			toks = append(toks, token{"num", src[start:i], start})
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '.' || src[i] == '-' ||
+				unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			toks = append(toks, token{"ident", src[start:i], start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", string(c), i)
+		}
+	}
+	return append(toks, token{"eof", "", len(src)}), nil
+}
+
+type exprParser struct {
+	toks []token
+	i    int
+}
+
+func parseExpr(src string) (exprNode, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, fmt.Errorf("empty expression")
+	}
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return n, nil
+}
+
+func (p *exprParser) peek() token { return p.toks[p.i] }
+func (p *exprParser) next() token { t := p.toks[p.i]; p.i++; return t }
+
+// isOp reports whether the next token is one of ops (symbols or keywords).
+func (p *exprParser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != "op" && t.kind != "ident" {
+		return false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) or() (exprNode, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||", "or") {
+		p.next()
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = orNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) and() (exprNode, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&", "and") {
+		p.next()
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l = andNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) not() (exprNode, error) {
+	if p.isOp("!", "not") {
+		p.next()
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{x}, nil
+	}
+	return p.cmp()
+}
+
+func (p *exprParser) cmp() (exprNode, error) {
+	l, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case p.isOp("==", "!=", "<", "<=", ">", ">=", "in"):
+		op := p.next().text
+		r, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return cmpNode{op, l, r}, nil
+	case p.isOp("not") && p.toks[p.i+1].kind == "ident" && p.toks[p.i+1].text == "in":
+		p.i += 2
+		r, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return cmpNode{"not in", l, r}, nil
+	}
+	return l, nil
+}
+
+func (p *exprParser) operand() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case "str":
+		return litNode{t.text}, nil
+	case "num":
+		// Dotted numbers (1.4, 1.2.3) stay text so compare orders them
+		// version-wise.
+		if strings.Contains(t.text, ".") {
+			return litNode{t.text}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at %d", t.text, t.pos)
+		}
+		return litNode{f}, nil
+	case "(":
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != ")" {
+			return nil, fmt.Errorf("expected ) at %d", c.pos)
+		}
+		return n, nil
+	case "ident":
+		switch t.text {
+		case "true":
+			return litNode{true}, nil
+		case "false":
+			return litNode{false}, nil
+		case "and", "or", "not", "in":
+			return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+		case "defined":
+			if p.peek().kind == "(" {
+				p.next()
+				arg := p.next()
+				if arg.kind != "ident" {
+					return nil, fmt.Errorf("defined() takes a variable name at %d", arg.pos)
+				}
+				if c := p.next(); c.kind != ")" {
+					return nil, fmt.Errorf("expected ) at %d", c.pos)
+				}
+				return defNode{arg.text}, nil
+			}
+		}
+		return varNode{t.text}, nil
+	case "eof":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
@@ -0,0 +1,91 @@
+package porter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompileWhen(t *testing.T) {
+	vars := NewVars()
+	vars.Set("os_family", "debian")
+	vars.Set("version", "1.10.2")
+	vars.Set("registered", `{"rc": 2, "stdout": "boom"}`)
+	vars.Set("maintenance", "false")
+	vars.SetValue("groups", []string{"docker", "sudo"})
+	vars.SetValue("facts", map[string]any{"os": map[string]any{"family": "debian"}, "cpus": 8})
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`os_family == "debian" && version >= "1.4"`, true},
+		{`version > 1.9`, true},
+		{`version < "1.10"`, false},
+		{`registered.rc != 0`, true},
+		{`registered.stdout == 'boom'`, true},
+		{`"docker" in groups`, true},
+		{`"wheel" not in groups`, true},
+		{`facts.os.family == "debian" and facts.cpus >= 4`, true},
+		{`facts.cpus > 16 or not maintenance`, true},
+		{`!(os_family == "debian")`, false},
+		{`defined(os_family) && !defined(missing)`, true},
+		{`missing`, false},
+		{`maintenance`, false},
+		{`"deb" in os_family`, true},
+	}
+	for _, tt := range tests {
+		w, err := CompileWhen(tt.expr)
+		if err != nil {
+			t.Errorf("CompileWhen(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := w(vars); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCompileWhenErrors(t *testing.T) {
+	for _, src := range []string{``, `a ==`, `(a == "b"`, `a = "b"`, `"unterminated`, `a == "b" c`, `defined("x")`} {
+		if _, err := CompileWhen(src); err == nil {
+			t.Errorf("CompileWhen(%q) should fail", src)
+		}
+	}
+}
+
+func TestWhenExprParseErrorFailsBeforeRun(t *testing.T) {
+	fr := &fakeRunner{}
+	_, err := newTestExec(fr).Run("deploy", Tasks(Run("first"), Run("second").WhenExpr(`env ==`)), NewVars())
+	if err == nil || !strings.Contains(err.Error(), "when") {
+		t.Fatalf("err = %v, want a when parse error", err)
+	}
+	if len(fr.calls) != 0 {
+		t.Errorf("no task may run, got %q", fr.calls)
+	}
+}
+
+func TestWhenExprSourceInProgressAndTrace(t *testing.T) {
+	var buf bytes.Buffer
+	e := newTestExec(&fakeRunner{}).SetTracer(NewTracer(&buf, "", ""))
+	var skipped TaskProgress
+	e.OnProgress(func(p TaskProgress) {
+		if p.Status == StatusSkipped {
+			skipped = p
+		}
+	})
+	vars := NewVars().Set("env", "prod")
+	tasks := Tasks(
+		Run("a").WhenExpr(`env == "prod"`),
+		Run("b").WhenExpr(`env == "dev"`),
+	)
+	if _, err := e.Run("deploy", tasks, vars); err != nil {
+		t.Fatal(err)
+	}
+	if skipped.When != `env == "dev"` {
+		t.Errorf("skipped progress When = %q", skipped.When)
+	}
+	if !strings.Contains(buf.String(), `"porter.when":"env == \"prod\""`) {
+		t.Errorf("trace lacks porter.when: %s", buf.String())
+	}
+}
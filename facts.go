@@ -0,0 +1,265 @@
+package porter
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// =============================================================================
+// FACTS
+//
+// GatherFacts probes the host once — OS and distro, architecture, init
+// system, package manager, CPU, memory, disks, network interfaces and
+// container runtimes — and stores the result as the structured "facts" var:
+//
+//	porter.GatherFacts(),
+//	porter.AptInstall("nginx").WhenExpr(`facts.os.family == "debian"`),
+//	porter.Run("dnf -y install nginx").WhenExpr(`facts.pkg_manager == "dnf"`),
+//	porter.Run("make -j{{.facts.cpu.count}}"),   // template mode
+//
+// Facts are cached on the Executor for the rest of the run, so a second
+// GatherFacts (in a handler, say) does not probe again. Gathering is
+// read-only and also runs in dry-run mode, so a check run evaluates the same
+// conditions a real run would.
+// =============================================================================
+
+// FactsVar is the variable GatherFacts stores the host's facts under.
+const FactsVar = "facts"
+
+// Facts describes a host, as gathered by GatherFacts. Sizes are in MB.
+type Facts struct {
+	Hostname          string         `json:"hostname"`
+	FQDN              string         `json:"fqdn"`
+	OS                OSFacts        `json:"os"`
+	Arch              string         `json:"arch"`
+	Init              string         `json:"init"`
+	PkgManager        string         `json:"pkg_manager"`
+	CPU               CPUFacts       `json:"cpu"`
+	Memory            MemoryFacts    `json:"memory"`
+	Disks             []DiskFacts    `json:"disks"`
+	Interfaces        []NetworkFacts `json:"interfaces"`
+	DefaultIPv4       string         `json:"default_ipv4"`
+	ContainerRuntimes []string       `json:"container_runtimes"`
+}
+
+// OSFacts identifies the operating system. Family groups related distros:
+// debian (Debian, Ubuntu, Mint, ...), redhat (RHEL, CentOS, Fedora, Rocky,
+// Alma, Amazon Linux), suse, arch and alpine; any other distro reports its
+// ID, and a host without /etc/os-release its kernel name.
+type OSFacts struct {
+	Family        string `json:"family"`
+	Distro        string `json:"distro"`
+	Version       string `json:"version"`
+	Codename      string `json:"codename"`
+	Name          string `json:"name"`
+	Kernel        string `json:"kernel"`
+	KernelRelease string `json:"kernel_release"`
+}
+
+// CPUFacts describes the processors.
+type CPUFacts struct {
+	Count int    `json:"count"`
+	Model string `json:"model"`
+}
+
+// MemoryFacts describes RAM.
+type MemoryFacts struct {
+	TotalMB     int `json:"total_mb"`
+	AvailableMB int `json:"available_mb"`
+}
+
+// DiskFacts describes one mounted block-device filesystem.
+type DiskFacts struct {
+	Mount       string `json:"mount"`
+	Device      string `json:"device"`
+	SizeMB      int    `json:"size_mb"`
+	AvailableMB int    `json:"available_mb"`
+}
+
+// NetworkFacts describes one network interface. Addresses are in CIDR form.
+type NetworkFacts struct {
+	Name string   `json:"name"`
+	MAC  string   `json:"mac"`
+	IPv4 []string `json:"ipv4"`
+	IPv6 []string `json:"ipv6"`
+}
+
+// GatherFacts collects the host's facts into the "facts" var (see Facts).
+// Place it first; later tasks' When conditions and templates can use them.
+func GatherFacts() TaskBuilder {
+	return TaskBuilder{Task{Action: "gather_facts", Name: "Gather facts"}}
+}
+
+// Facts returns the facts gathered during the current or last run, or nil if
+// none were.
+func (e *Executor) Facts() *Facts { return e.facts }
+
+// factsScript prints one key=value line per fact. Lists repeat their key.
+const factsScript = `echo "hostname=$(hostname 2>/dev/null)"
+echo "fqdn=$(hostname -f 2>/dev/null)"
+echo "kernel=$(uname -s)"
+echo "kernel_release=$(uname -r)"
+echo "arch=$(uname -m)"
+[ -r /etc/os-release ] && grep -E '^(ID|ID_LIKE|VERSION_ID|VERSION_CODENAME|PRETTY_NAME)=' /etc/os-release | sed 's/^/os_/'
+if [ -d /run/systemd/system ]; then echo init=systemd; else echo "init=$(cat /proc/1/comm 2>/dev/null)"; fi
+for c in apt-get dnf yum zypper pacman apk; do command -v $c >/dev/null 2>&1 && echo pkg=$c; done
+for c in docker podman containerd nerdctl crictl; do command -v $c >/dev/null 2>&1 && echo runtime=$c; done
+echo "cpus=$(nproc 2>/dev/null)"
+grep -m1 '^model name' /proc/cpuinfo 2>/dev/null | sed 's/^[^:]*: */cpu_model=/'
+awk '/^MemTotal:/ {print "mem_total_kb=" $2} /^MemAvailable:/ {print "mem_avail_kb=" $2}' /proc/meminfo 2>/dev/null
+df -P -k 2>/dev/null | awk 'NR > 1 && $1 ~ /^\// {print "disk=" $6 " " $1 " " $2 " " $4}'
+for i in /sys/class/net/*; do [ -e "$i" ] && echo "iface=${i##*/} $(cat "$i/address" 2>/dev/null)"; done
+ip -o addr show 2>/dev/null | awk '{print "addr=" $2 " " $3 " " $4}'
+ip -4 route get 1.1.1.1 2>/dev/null | awk '{for (i = 1; i < NF; i++) if ($i == "src") print "default_ipv4=" $(i+1)}'
+true`
+
+// gatherFacts returns the host's facts, probing the host the first time in a
+// run. Actions that branch on the distro call it too.
+func (e *Executor) gatherFacts() (*Facts, error) {
+	if e.facts != nil {
+		return e.facts, nil
+	}
+	out, err := e.runCapture(factsScript)
+	if err != nil {
+		return nil, fmt.Errorf("gather facts: %w", err)
+	}
+	e.facts = parseFacts(out)
+	return e.facts, nil
+}
+
+// setFacts stores facts in vars as a structured value, so expressions and
+// templates address them by their JSON names (facts.os.family).
+func setFacts(vars *Vars, f *Facts) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	vars.SetValue(FactsVar, m)
+	return nil
+}
+
+// parseFacts reads factsScript's output.
+func parseFacts(out string) *Facts {
+	f := &Facts{Disks: []DiskFacts{}, Interfaces: []NetworkFacts{}, ContainerRuntimes: []string{}}
+	var idLike string
+	iface := func(name string) *NetworkFacts {
+		for i := range f.Interfaces {
+			if f.Interfaces[i].Name == name {
+				return &f.Interfaces[i]
+			}
+		}
+		f.Interfaces = append(f.Interfaces, NetworkFacts{Name: name, IPv4: []string{}, IPv6: []string{}})
+		return &f.Interfaces[len(f.Interfaces)-1]
+	}
+
+	for line := range strings.SplitSeq(out, "\n") {
+		key, val, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(val)
+		switch key {
+		case "hostname":
+			f.Hostname = val
+		case "fqdn":
+			f.FQDN = val
+		case "kernel":
+			f.OS.Kernel = val
+		case "kernel_release":
+			f.OS.KernelRelease = val
+		case "arch":
+			f.Arch = val
+		case "os_ID":
+			f.OS.Distro = unquote(val)
+		case "os_ID_LIKE":
+			idLike = unquote(val)
+		case "os_VERSION_ID":
+			f.OS.Version = unquote(val)
+		case "os_VERSION_CODENAME":
+			f.OS.Codename = unquote(val)
+		case "os_PRETTY_NAME":
+			f.OS.Name = unquote(val)
+		case "init":
+			f.Init = val
+		case "pkg":
+			if f.PkgManager == "" {
+				f.PkgManager = strings.TrimSuffix(val, "-get")
+			}
+		case "runtime":
+			f.ContainerRuntimes = append(f.ContainerRuntimes, val)
+		case "cpus":
+			f.CPU.Count, _ = strconv.Atoi(val)
+		case "cpu_model":
+			f.CPU.Model = val
+		case "mem_total_kb":
+			kb, _ := strconv.Atoi(val)
+			f.Memory.TotalMB = kb / 1024
+		case "mem_avail_kb":
+			kb, _ := strconv.Atoi(val)
+			f.Memory.AvailableMB = kb / 1024
+		case "disk":
+			if len(fields) == 4 {
+				size, _ := strconv.Atoi(fields[2])
+				avail, _ := strconv.Atoi(fields[3])
+				f.Disks = append(f.Disks, DiskFacts{Mount: fields[0], Device: fields[1], SizeMB: size / 1024, AvailableMB: avail / 1024})
+			}
+		case "iface":
+			if len(fields) > 0 {
+				n := iface(fields[0])
+				if len(fields) > 1 {
+					n.MAC = fields[1]
+				}
+			}
+		case "addr":
+			if len(fields) == 3 {
+				n := iface(fields[0])
+				switch fields[1] {
+				case "inet":
+					n.IPv4 = append(n.IPv4, fields[2])
+				case "inet6":
+					n.IPv6 = append(n.IPv6, fields[2])
+				}
+			}
+		case "default_ipv4":
+			f.DefaultIPv4 = val
+		}
+	}
+	f.OS.Family = osFamily(f.OS.Distro, idLike, f.OS.Kernel)
+	return f
+}
+
+// osFamilies maps distro IDs (and ID_LIKE entries) to their family.
+var osFamilies = map[string]string{
+	"debian": "debian", "ubuntu": "debian", "linuxmint": "debian", "raspbian": "debian", "pop": "debian", "kali": "debian",
+	"rhel": "redhat", "centos": "redhat", "fedora": "redhat", "rocky": "redhat", "almalinux": "redhat", "ol": "redhat", "amzn": "redhat",
+	"suse": "suse", "opensuse": "suse", "opensuse-leap": "suse", "opensuse-tumbleweed": "suse", "sles": "suse",
+	"arch": "arch", "manjaro": "arch", "endeavouros": "arch",
+	"alpine": "alpine",
+}
+
+func osFamily(id, idLike, kernel string) string {
+	for _, c := range slices.Concat([]string{id}, strings.Fields(idLike)) {
+		if fam, ok := osFamilies[c]; ok {
+			return fam
+		}
+	}
+	if id != "" {
+		return id
+	}
+	return strings.ToLower(kernel)
+}
+
+// unquote strips the optional quotes around an os-release value.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,132 @@
+package porter
+
+import (
+	"strings"
+	"testing"
+)
+
+const ubuntuFacts = `hostname=web1
+fqdn=web1.example.com
+kernel=Linux
+kernel_release=6.8.0-45-generic
+arch=x86_64
+os_PRETTY_NAME="Ubuntu 24.04.1 LTS"
+os_VERSION_ID="24.04"
+os_VERSION_CODENAME=noble
+os_ID=ubuntu
+os_ID_LIKE=debian
+init=systemd
+pkg=apt-get
+runtime=docker
+runtime=containerd
+cpus=8
+cpu_model=AMD EPYC 7763 64-Core Processor
+mem_total_kb=16384000
+mem_avail_kb=8192000
+disk=/ /dev/sda1 102400000 51200000
+iface=lo 00:00:00:00:00:00
+iface=eth0 52:54:00:12:34:56
+addr=lo inet 127.0.0.1/8
+addr=eth0 inet 10.0.0.5/24
+addr=eth0 inet6 fe80::5054:ff:fe12:3456/64
+default_ipv4=10.0.0.5`
+
+func TestParseFacts(t *testing.T) {
+	f := parseFacts(ubuntuFacts)
+	if f.OS.Family != "debian" || f.OS.Distro != "ubuntu" || f.OS.Version != "24.04" || f.OS.Name != "Ubuntu 24.04.1 LTS" {
+		t.Errorf("os = %+v", f.OS)
+	}
+	if f.PkgManager != "apt" || f.Init != "systemd" || f.Arch != "x86_64" {
+		t.Errorf("pkg=%q init=%q arch=%q", f.PkgManager, f.Init, f.Arch)
+	}
+	if f.CPU.Count != 8 || f.Memory.TotalMB != 16000 || len(f.Disks) != 1 || f.Disks[0].AvailableMB != 50000 {
+		t.Errorf("cpu=%+v memory=%+v disks=%+v", f.CPU, f.Memory, f.Disks)
+	}
+	if len(f.Interfaces) != 2 || f.Interfaces[1].MAC != "52:54:00:12:34:56" || len(f.Interfaces[1].IPv6) != 1 {
+		t.Errorf("interfaces = %+v", f.Interfaces)
+	}
+	if strings.Join(f.ContainerRuntimes, ",") != "docker,containerd" || f.DefaultIPv4 != "10.0.0.5" {
+		t.Errorf("runtimes=%v default_ipv4=%q", f.ContainerRuntimes, f.DefaultIPv4)
+	}
+
+	for _, tt := range []struct{ id, like, kernel, want string }{
+		{"rocky", "rhel centos fedora", "Linux", "redhat"},
+		{"linuxmint", "ubuntu debian", "Linux", "debian"},
+		{"opensuse-leap", "suse opensuse", "Linux", "suse"},
+		{"nixos", "", "Linux", "nixos"},
+		{"", "", "Darwin", "darwin"},
+	} {
+		if got := osFamily(tt.id, tt.like, tt.kernel); got != tt.want {
+			t.Errorf("osFamily(%q, %q) = %q, want %q", tt.id, tt.like, got, tt.want)
+		}
+	}
+}
+
+func TestGatherFactsDrivesWhenAndIsCached(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{{contains: "/etc/os-release", out: ubuntuFacts}}}
+	e := newTestExec(fr)
+	vars := NewVars().SetTemplates(true)
+	stats, err := e.Run("deploy", Tasks(
+		GatherFacts(),
+		Run("apt-get install -y nginx").WhenExpr(`facts.os.family == "debian" && facts.cpu.count >= 4`),
+		Run("dnf install -y nginx").WhenExpr(`facts.pkg_manager == "dnf"`),
+		Run("make -j{{.facts.cpu.count}}"),
+		GatherFacts(),
+	), vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fr.ran("apt-get install -y nginx") || fr.ran("dnf install") || !fr.ran("make -j8") {
+		t.Errorf("calls = %q", fr.calls)
+	}
+	probes := 0
+	for _, c := range fr.calls {
+		if strings.Contains(c, "/etc/os-release") {
+			probes++
+		}
+	}
+	if probes != 1 {
+		t.Errorf("facts gathered %d times, want 1 (cached)", probes)
+	}
+	if stats.Changed != 2 || stats.Skipped != 1 {
+		t.Errorf("stats = %+v (gather_facts must not count as a change)", stats)
+	}
+	if e.Facts() == nil || e.Facts().Hostname != "web1" {
+		t.Errorf("Facts() = %+v", e.Facts())
+	}
+}
+
+func TestGatherFactsInDryRun(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{{contains: "/etc/os-release", out: ubuntuFacts}}}
+	e := newTestExec(fr).SetDryRun(true)
+	var skipped []string
+	e.OnProgress(func(p TaskProgress) {
+		if p.Status == StatusSkipped {
+			skipped = append(skipped, p.Name)
+		}
+	})
+	_, err := e.Run("check", Tasks(
+		GatherFacts(),
+		Run("apk add nginx").WhenExpr(`facts.os.family == "alpine"`).Name("alpine"),
+	), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0] != "alpine" {
+		t.Errorf("skipped = %v, want the alpine task skipped from gathered facts", skipped)
+	}
+}
+
+func TestPlaybookGatherFacts(t *testing.T) {
+	p, err := ParsePlaybook([]byte("version: 1\ngather_facts: true\ntasks:\n  - {action: run, body: uptime}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := p.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 || tasks[0].Action != "gather_facts" {
+		t.Errorf("tasks = %+v", tasks)
+	}
+}
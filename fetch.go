@@ -0,0 +1,315 @@
+package porter
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// =============================================================================
+// FETCH (checksum-pinned downloads)
+// =============================================================================
+//
+// Fetch is the idempotent counterpart of Curl/Wget. The download is pinned to
+// a sha256 or sha512 digest; when dest already has it nothing is downloaded
+// and the task reports ok. Otherwise the file is downloaded to a private temp
+// file, verified, and only then placed into dest (with .Mode/.Owner/.Sudo).
+// By default the remote host downloads it with curl; .OnController()
+// downloads on the control machine and pushes it over SFTP, for hosts without
+// internet access. Headers and basic-auth credentials are expanded at run
+// time and never appear on a remote command line.
+
+// Fetch downloads url to dest on the remote host. A checksum is required; see
+// TaskBuilder.Checksum.
+func Fetch(url, dest string) TaskBuilder {
+	return TaskBuilder{Task{Action: "fetch", Src: url, Dest: dest, Name: "Fetch " + url}}
+}
+
+// Checksum pins a Fetch: "sha256:<hex>", "sha512:<hex>", or the algorithm
+// and the URL of a checksum file ("sha256:https://example.com/SHA256SUMS"),
+// whose entry for the downloaded file's name is used.
+func (b TaskBuilder) Checksum(sum string) TaskBuilder { b.t.Checksum = sum; return b }
+
+// Header adds an HTTP request header to a Fetch. The value is expanded at run
+// time, so a token can stay in Vars: Header("Authorization", "Bearer {{token}}").
+func (b TaskBuilder) Header(name, value string) TaskBuilder {
+	b.t.Headers = append(slices.Clone(b.t.Headers), name+": "+value)
+	return b
+}
+
+// BasicAuth sets HTTP basic credentials for a Fetch, expanded at run time.
+// Pass the password as a {{var}} reference.
+func (b TaskBuilder) BasicAuth(user, password string) TaskBuilder {
+	return b.appendOpt("user", user).appendOpt("password", password)
+}
+
+// OnController makes a Fetch download on the control machine and push the
+// verified file to the host over SFTP.
+func (b TaskBuilder) OnController() TaskBuilder { return b.appendOpt("controller", "true") }
+
+// checksumSpec is a parsed Fetch checksum: a digest, or the URL of a
+// checksum file holding it.
+type checksumSpec struct {
+	algo   string // sha256 or sha512
+	digest string // lower-case hex; empty when url is set
+	url    string
+}
+
+// digestLen is the hex length of each supported digest.
+var digestLen = map[string]int{"sha256": 64, "sha512": 128}
+
+func parseChecksum(s string) (checksumSpec, error) {
+	if s == "" {
+		return checksumSpec{}, errors.New("a checksum is required (sha256:<hex>, sha512:<hex> or sha256:<checksum file URL>)")
+	}
+	algo, rest, _ := strings.Cut(s, ":")
+	n, ok := digestLen[algo]
+	if !ok {
+		return checksumSpec{}, fmt.Errorf("checksum %q: algorithm must be sha256 or sha512", s)
+	}
+	if strings.HasPrefix(rest, "https://") || strings.HasPrefix(rest, "http://") {
+		return checksumSpec{algo: algo, url: rest}, nil
+	}
+	if _, err := hex.DecodeString(rest); err != nil || len(rest) != n {
+		return checksumSpec{}, fmt.Errorf("checksum %q: want %d hex digits", s, n)
+	}
+	return checksumSpec{algo: algo, digest: strings.ToLower(rest)}, nil
+}
+
+// digestFromSums picks name's digest from a checksum file in sha256sum
+// format ("<hex>  <name>", "*" marking binary mode), or returns the lone
+// digest of a file that holds nothing else.
+func digestFromSums(content, name, algo string) (string, error) {
+	lines := strings.Split(strings.TrimSpace(content), "\n")
+	for _, line := range lines {
+		f := strings.Fields(line)
+		switch {
+		case len(f) == 1 && len(lines) == 1 && len(f[0]) == digestLen[algo]:
+			return strings.ToLower(f[0]), nil
+		case len(f) >= 2 && path.Base(strings.TrimPrefix(f[1], "*")) == name && len(f[0]) == digestLen[algo]:
+			return strings.ToLower(f[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no %s entry for %s in the checksum file", algo, name)
+}
+
+func newDigest(algo string) hash.Hash {
+	if algo == "sha512" {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// fetchOpts are a Fetch's request settings, expanded.
+type fetchOpts struct {
+	headers        []string // "Name: value"
+	user, password string
+	controller     bool
+}
+
+// fetchOptsOf expands t's request settings. The credentials are read from
+// the unrendered body so an expanded value may contain the option separator.
+func (e *Executor) fetchOptsOf(t Task, vars *Vars) fetchOpts {
+	o := fetchOpts{
+		user:       vars.Expand(e.parseOpt(t.Body, "user")),
+		password:   vars.Expand(e.parseOpt(t.Body, "password")),
+		controller: e.parseOpt(t.Body, "controller") == "true",
+	}
+	for _, h := range t.Headers {
+		o.headers = append(o.headers, vars.Expand(h))
+	}
+	return o
+}
+
+// curlConfig renders the headers and credentials as a curl config file, or ""
+// when there are none.
+func (o fetchOpts) curlConfig() string {
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+	}
+	var b strings.Builder
+	for _, h := range o.headers {
+		b.WriteString("header = " + quote(h) + "\n")
+	}
+	if o.user != "" {
+		b.WriteString("user = " + quote(o.user+":"+o.password) + "\n")
+	}
+	return b.String()
+}
+
+// curl runs curl on the remote host, writing url to out ("-" captures it).
+// Headers and credentials go through a private config file written over
+// SFTP rather than on the command line.
+func (e *Executor) curl(rawURL, out string, o fetchOpts) (string, error) {
+	cmd := "curl --proto-redir =https --tlsv1.2 -fsSL"
+	if cfg := o.curlConfig(); cfg != "" {
+		tmp, err := e.runCapture("mktemp")
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = e.run("rm -f " + tmp) }()
+		if err := e.sftpWriteSecret(tmp, []byte(cfg), "0600", "", false, ""); err != nil {
+			return "", err
+		}
+		cmd += " -K " + tmp
+	}
+	return e.runCapture(cmd + " -o " + shellEscape(out) + " " + shellEscape(rawURL))
+}
+
+// httpFetch downloads rawURL on the control machine into w. Like the remote
+// curl, it refuses redirects away from https.
+func httpFetch(ctx context.Context, rawURL string, o fetchOpts, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	for _, h := range o.headers {
+		name, value, _ := strings.Cut(h, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if o.user != "" {
+		req.SetBasicAuth(o.user, o.password)
+	}
+	client := &http.Client{CheckRedirect: func(r *http.Request, via []*http.Request) error {
+		if r.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to %s refused: not https", r.URL.Redacted())
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// fetchDigest resolves the digest a Fetch of rawURL must match, downloading
+// the checksum file (on the same side as the download) when one is given.
+func (e *Executor) fetchDigest(spec checksumSpec, rawURL string, o fetchOpts) (string, error) {
+	if spec.url == "" {
+		return spec.digest, nil
+	}
+	var sums string
+	if o.controller {
+		var b strings.Builder
+		if err := httpFetch(e.taskCtx(), spec.url, o, &b); err != nil {
+			return "", fmt.Errorf("checksum file: %w", err)
+		}
+		sums = b.String()
+	} else {
+		out, err := e.curl(spec.url, "-", o)
+		if err != nil {
+			return "", fmt.Errorf("checksum file %s: %w", spec.url, err)
+		}
+		sums = out
+	}
+	name := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		name = u.Path
+	}
+	return digestFromSums(sums, path.Base(name), spec.algo)
+}
+
+// remoteDigest is the algo digest of the remote file at p, or "" when
+// unreadable.
+func (e *Executor) remoteDigest(algo, p string, sudo bool) string {
+	sum, _ := e.runCaptureMaybeSudo(sudo, algo+"sum "+shellEscape(p)+" 2>/dev/null | cut -d' ' -f1")
+	return sum
+}
+
+// fetch brings dest in line with the download of rawURL pinned by t's
+// checksum, setting e.noOp when it already was.
+func (e *Executor) fetch(t Task, rawURL, dest, perm, own string, vars *Vars) error {
+	spec, err := parseChecksum(vars.Expand(t.Checksum))
+	if err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+	o := e.fetchOptsOf(t, vars)
+	want, err := e.fetchDigest(spec, rawURL, o)
+	if err != nil {
+		return fmt.Errorf("fetch %s: %w", rawURL, err)
+	}
+	place := uploadSpec{sudo: t.Sudo, perm: perm, owner: own}
+	if e.remoteDigest(spec.algo, dest, t.Sudo) == want {
+		changed, err := e.fixAttrs(dest, place)
+		e.noOp = !changed
+		return err
+	}
+	if o.controller {
+		return e.fetchOnController(rawURL, dest, spec.algo, want, o, place)
+	}
+
+	tmp, err := e.runCapture("mktemp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = e.run("rm -f " + tmp) }()
+	if _, err := e.curl(rawURL, tmp, o); err != nil {
+		return fmt.Errorf("fetch %s: %w", rawURL, err)
+	}
+	if got := e.remoteDigest(spec.algo, tmp, false); got != want {
+		return fmt.Errorf("fetch %s: %s mismatch: got %s, want %s", rawURL, spec.algo, got, want)
+	}
+	if perm == "" {
+		if err := e.run("chmod 0644 " + tmp); err != nil {
+			return err
+		}
+	}
+	return e.placeStaged(tmp, shellEscape(dest), t.Sudo, perm, own)
+}
+
+// fetchOnController downloads rawURL locally, verifies it, and uploads it.
+func (e *Executor) fetchOnController(rawURL, dest, algo, want string, o fetchOpts, place uploadSpec) error {
+	f, err := os.CreateTemp("", "porter-fetch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	h := newDigest(algo)
+	err = httpFetch(e.taskCtx(), rawURL, o, io.MultiWriter(f, h))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("fetch %s: %w", rawURL, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("fetch %s: %s mismatch: got %s, want %s", rawURL, algo, got, want)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return e.upload(f.Name(), dest, place)
+}
+
+// fetchPending reports whether a Fetch would download, for dry-run.
+func (e *Executor) fetchPending(t Task, rawURL, dest string, vars *Vars) (bool, error) {
+	spec, err := parseChecksum(vars.Expand(t.Checksum))
+	if err != nil {
+		return true, err
+	}
+	want, err := e.fetchDigest(spec, rawURL, e.fetchOptsOf(t, vars))
+	if err != nil {
+		return true, err
+	}
+	return e.remoteDigest(spec.algo, dest, t.Sudo) != want, nil
+}
@@ -0,0 +1,126 @@
+package porter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseChecksum(t *testing.T) {
+	sha := strings.Repeat("ab", 32)
+	for in, want := range map[string]checksumSpec{
+		"sha256:" + sha:                         {algo: "sha256", digest: sha},
+		"sha256:" + strings.ToUpper(sha):        {algo: "sha256", digest: sha},
+		"sha512:" + sha + sha:                   {algo: "sha512", digest: sha + sha},
+		"sha256:https://example.com/SHA256SUMS": {algo: "sha256", url: "https://example.com/SHA256SUMS"},
+	} {
+		if got, err := parseChecksum(in); err != nil || got != want {
+			t.Errorf("parseChecksum(%q) = %+v, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"", sha, "md5:" + sha, "sha256:abc", "sha512:" + sha, "sha256:" + strings.Repeat("zz", 32)} {
+		if _, err := parseChecksum(in); err == nil {
+			t.Errorf("parseChecksum(%q) accepted", in)
+		}
+	}
+
+	sums := "1111111111111111111111111111111111111111111111111111111111111111  app-1.0.tar.gz\n" +
+		sha + " *dist/app-1.1.tar.gz\n"
+	if got, err := digestFromSums(sums, "app-1.1.tar.gz", "sha256"); err != nil || got != sha {
+		t.Errorf("digestFromSums = %q, %v", got, err)
+	}
+	if _, err := digestFromSums(sums, "app-2.0.tar.gz", "sha256"); err == nil {
+		t.Error("missing entry accepted")
+	}
+	if got, _ := digestFromSums(sha+"\n", "anything", "sha256"); got != sha {
+		t.Errorf("lone digest = %q", got)
+	}
+}
+
+func TestFetchSkipsWhenDestMatches(t *testing.T) {
+	sha := sha256Hex("release")
+	fr := &fakeRunner{rules: []rule{{contains: "sha256sum '/opt/app.tgz'", out: sha}}}
+	changed, err := newTestExec(fr).exec(Fetch("https://example.com/app.tgz", "/opt/app.tgz").Checksum("sha256:"+sha).Build(), NewVars())
+	if err != nil || changed || fr.ran("curl") {
+		t.Errorf("changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+}
+
+func TestFetchVerifiesBeforePlacing(t *testing.T) {
+	sha := sha256Hex("release")
+	sums := sha + "  app.tgz\n"
+	newRunner := func(downloaded string) *fakeRunner {
+		return &fakeRunner{rules: []rule{
+			{contains: "sha256sum '/opt/app.tgz'", out: "old"},
+			{contains: "mktemp", out: "/tmp/tmp.1"},
+			{contains: "-o '-' 'https://example.com/SHA256SUMS'", out: sums},
+			{contains: "sha256sum '/tmp/tmp.1'", out: downloaded},
+		}}
+	}
+	task := Fetch("https://example.com/dl/app.tgz?v=2", "/opt/app.tgz").
+		Checksum("sha256:https://example.com/SHA256SUMS").Mode("0755").Sudo().Build()
+
+	fr := newRunner(sha)
+	changed, err := newTestExec(fr).exec(task, NewVars())
+	if err != nil || !changed {
+		t.Fatalf("changed=%v err=%v", changed, err)
+	}
+	if !fr.ran("curl --proto-redir =https --tlsv1.2 -fsSL -o '/tmp/tmp.1' 'https://example.com/dl/app.tgz?v=2'") {
+		t.Errorf("no download: %q", fr.calls)
+	}
+	if !fr.ran("install -m 0755 /tmp/tmp.1 '/opt/app.tgz'") {
+		t.Errorf("not placed: %q", fr.calls)
+	}
+
+	fr = newRunner(sha256Hex("tampered"))
+	if _, err := newTestExec(fr).exec(task, NewVars()); err == nil || !strings.Contains(err.Error(), "sha256 mismatch") {
+		t.Errorf("err = %v", err)
+	}
+	if fr.ran("install -m") {
+		t.Errorf("placed a file that failed verification: %q", fr.calls)
+	}
+}
+
+func TestFetchRequestSettings(t *testing.T) {
+	vars := NewVars()
+	vars.Set("token", "s3cr;et")
+	vars.Set("pass", `p"w`)
+	task := Fetch("u", "d").Header("Authorization", "Bearer {{token}}").BasicAuth("deploy", "{{pass}}").OnController().Build()
+	o := (&Executor{}).fetchOptsOf(task, vars)
+	if !o.controller || o.password != `p"w` || o.headers[0] != "Authorization: Bearer s3cr;et" {
+		t.Errorf("opts = %+v", o)
+	}
+	if cfg := o.curlConfig(); cfg != "header = \"Authorization: Bearer s3cr;et\"\nuser = \"deploy:p\\\"w\"\n" {
+		t.Errorf("curl config = %q", cfg)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if r.Header.Get("X-Token") != "s3cr;et" || user != "deploy" || pass != `p"w` {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("payload"))
+	}))
+	defer srv.Close()
+	o.headers = []string{"X-Token: s3cr;et"}
+	var b strings.Builder
+	if err := httpFetch(context.Background(), srv.URL, o, &b); err != nil || b.String() != "payload" {
+		t.Errorf("httpFetch = %q, %v", b.String(), err)
+	}
+	if err := httpFetch(context.Background(), srv.URL, fetchOpts{}, &b); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("unauthenticated err = %v", err)
+	}
+}
+
+func TestPlaybookFetchNeedsChecksum(t *testing.T) {
+	if _, err := (PlaybookTask{Action: "fetch", Src: "https://x/a", Dest: "/a"}).Task(); err == nil || !strings.Contains(err.Error(), "checksum is required") {
+		t.Errorf("err = %v", err)
+	}
+	task, err := PlaybookTask{Action: "fetch", Src: "https://x/a", Dest: "/a", Checksum: "sha256:" + sha256Hex("a"), Headers: []string{"X-A: 1"}}.Task()
+	if err != nil || task.Checksum == "" || task.Headers[0] != "X-A: 1" {
+		t.Errorf("task = %+v, %v", task, err)
+	}
+}
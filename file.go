@@ -14,12 +14,13 @@ func Upload(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "upload", Src: src, Dest: dest, Name: "Upload " + src}}
 }
 
-// Copy copies a file on the remote server.
+// Copy copies a file on the remote server, always under sudo. EnsureCopy is
+// the idempotent, escaped form.
 func Copy(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "copy", Src: src, Dest: dest, Name: "Copy " + src}}
 }
 
-// Move moves/renames a file on the remote server.
+// Move moves/renames a file on the remote server. See also EnsureMove.
 func Move(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "move", Src: src, Dest: dest, Name: "Move " + src}}
 }
@@ -29,7 +30,8 @@ func Write(dest, content string) TaskBuilder {
 	return TaskBuilder{Task{Action: "write", Dest: dest, Body: content, Name: "Write " + dest}}
 }
 
-// Mkdir creates a directory (use .Recursive() for nested directories).
+// Mkdir creates a directory (use .Recursive() for nested directories). See
+// also EnsureDir.
 func Mkdir(path string) TaskBuilder {
 	return TaskBuilder{Task{Action: "mkdir", Dest: path, Name: "Mkdir " + path}}
 }
@@ -44,7 +46,8 @@ func Chmod(path string) TaskBuilder {
 	return TaskBuilder{Task{Action: "chmod", Dest: path, Name: "Chmod " + path}}
 }
 
-// Rm removes a file or directory (use .Recursive() for directories).
+// Rm removes a file or directory (use .Recursive() for directories). See also
+// EnsureAbsent.
 func Rm(path string) TaskBuilder {
 	return TaskBuilder{Task{Action: "rm", Dest: path, Name: "Remove " + path}}
 }
@@ -54,7 +57,7 @@ func Touch(path string) TaskBuilder {
 	return TaskBuilder{Task{Action: "touch", Dest: path, Name: "Touch " + path}}
 }
 
-// Symlink creates a symbolic link from src to dest.
+// Symlink creates a symbolic link from src to dest. See also EnsureSymlink.
 func Symlink(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "symlink", Src: src, Dest: dest, Name: "Link " + src}}
 }
@@ -64,7 +67,8 @@ func Install(src, dest string) TaskBuilder {
 	return TaskBuilder{Task{Action: "install", Src: src, Dest: dest, Name: "Install " + dest}}
 }
 
-// Sed performs in-place text substitution using sed patterns.
+// Sed performs in-place text substitution using sed patterns. EnsureReplace
+// is the idempotent form.
 func Sed(pattern, file string) TaskBuilder {
 	return TaskBuilder{Task{Action: "sed", Body: pattern, Dest: file, Name: "Sed " + file}}
 }
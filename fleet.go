@@ -0,0 +1,320 @@
+package porter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/melbahja/goph"
+)
+
+// =============================================================================
+// FLEET EXECUTION (inventory, forks, serial batches, failure policy)
+//
+// An Executor drives exactly one host. A Fleet runs the same []Task across an
+// inventory of hosts: each host gets its own Executor and its own copy of the
+// Vars, at most Forks hosts run at once, Serial splits the inventory into
+// rolling batches ("2 at a time"), and MaxFailPercentage stops the rollout
+// when too many hosts in a batch fail. The result is a per-host recap plus the
+// merged Stats — the Ansible PLAY RECAP, as a value.
+// =============================================================================
+
+// Host is one inventory entry. Either Client is an established connection
+// (left open after the run) or Dial connects on demand once a fork is free
+// (the connection is closed when the host finishes).
+type Host struct {
+	Name     string                       // Identifies the host in progress callbacks and the recap
+	Client   *goph.Client                 // Established connection; takes precedence over Dial
+	Dial     func() (*goph.Client, error) // Connects lazily when Client is nil; redials a dropped link
+	Password string                       // Sudo password for this host's Executor
+	Vars     map[string]any               // Per-host overrides layered over the run's Vars (lists and maps structured, as in Playbook.NewVars)
+}
+
+// HostResult is the outcome of a run on one host.
+type HostResult struct {
+	Host        string        // Host.Name
+	Stats       *Stats        // nil if the host never started (batch aborted or run cancelled)
+	Vars        *Vars         // The host's Vars after the run (registered outputs)
+	Err         error         // The first failure, a connection error, or the cancellation
+	Unreachable bool          // Dial failed; no task ran
+	Duration    time.Duration // Wall time for this host, connection included
+	Drift       *DriftReport  // The host's drift report when the Fleet runs in check mode
+}
+
+// FleetRecap is the merged outcome of a Fleet run.
+type FleetRecap struct {
+	Hosts   []HostResult // In inventory order
+	Total   Stats        // Sum of every host's Stats
+	Aborted bool         // MaxFailPercentage was exceeded and the rollout stopped
+}
+
+// Drifted returns the names of hosts whose drift report has drifted items.
+func (r *FleetRecap) Drifted() []string {
+	var out []string
+	for _, h := range r.Hosts {
+		if h.Drift != nil && h.Drift.HasDrift() {
+			out = append(out, h.Host)
+		}
+	}
+	return out
+}
+
+// Failed returns the names of hosts that failed or were unreachable.
+func (r *FleetRecap) Failed() []string {
+	var out []string
+	for _, h := range r.Hosts {
+		if h.Err != nil && !errors.Is(h.Err, context.Canceled) {
+			out = append(out, h.Host)
+		}
+	}
+	return out
+}
+
+// HostProgressFunc is called for each task state change on each host. Hosts
+// run concurrently, so the callback must be safe for concurrent use.
+type HostProgressFunc func(host string, p TaskProgress)
+
+// HostOutputFunc is called for each line of command output on each host (see
+// Executor.OnOutput). Like HostProgressFunc, it must be safe for concurrent use.
+type HostOutputFunc func(host string, p TaskProgress, ev StreamEvent)
+
+// Fleet runs tasks across an inventory of hosts.
+type Fleet struct {
+	hosts      []Host
+	forks      int
+	serial     int
+	maxFail    int // percent; negative disables the abort
+	verbose    bool
+	dryRun     bool
+	check      bool
+	onProgress HostProgressFunc
+	onOutput   HostOutputFunc
+	setup      func(h Host, e *Executor) func()
+
+	// newExecutor builds a host's Executor; tests substitute one backed by a
+	// fake runner.
+	newExecutor func(client *goph.Client, password string) *Executor
+}
+
+// NewFleet creates a Fleet over hosts. Defaults: 5 forks, one batch holding
+// the whole inventory, no failure threshold (every host runs to completion
+// regardless of the others), and quiet executors — interleaved per-task logs
+// from parallel hosts are unreadable; use OnProgress or SetVerbose.
+func NewFleet(hosts ...Host) *Fleet {
+	return &Fleet{hosts: hosts, forks: 5, maxFail: -1, newExecutor: NewExecutor}
+}
+
+// Forks caps how many hosts run at the same time (default 5). 0 runs every
+// host in a batch at once.
+func (f *Fleet) Forks(n int) *Fleet { f.forks = n; return f }
+
+// Serial rolls the deploy out in batches of n hosts: a batch must finish
+// before the next starts, and the failure threshold is checked per batch.
+// 0 (the default) runs the whole inventory as one batch.
+func (f *Fleet) Serial(n int) *Fleet { f.serial = n; return f }
+
+// MaxFailPercentage aborts the rollout once more than pct percent of the
+// hosts in the current batch have failed: hosts still running in that batch
+// are cancelled and later batches never start. 0 aborts on the first failure.
+func (f *Fleet) MaxFailPercentage(pct int) *Fleet { f.maxFail = pct; return f }
+
+// SetVerbose enables per-host executor logging and the final recap.
+func (f *Fleet) SetVerbose(v bool) *Fleet { f.verbose = v; return f }
+
+// SetDryRun runs every host's Executor in dry-run mode.
+func (f *Fleet) SetDryRun(v bool) *Fleet { f.dryRun = v; return f }
+
+// SetCheck runs every host's Executor in check mode (see Executor.Check):
+// nothing is changed, and each HostResult carries the host's drift report.
+func (f *Fleet) SetCheck(v bool) *Fleet { f.check = v; return f }
+
+// OnProgress sets a callback for every task state change on every host.
+func (f *Fleet) OnProgress(fn HostProgressFunc) *Fleet { f.onProgress = fn; return f }
+
+// OnOutput streams the command output of every host, line by line.
+func (f *Fleet) OnOutput(fn HostOutputFunc) *Fleet { f.onOutput = fn; return f }
+
+// Setup registers a hook called with each host's Executor before its run —
+// attach a Tracer, Logger, or anything else per host. A non-nil returned func
+// is called when that host finishes (e.g. to close a trace file).
+func (f *Fleet) Setup(fn func(h Host, e *Executor) func()) *Fleet { f.setup = fn; return f }
+
+// Run executes tasks on every host. See RunContext.
+func (f *Fleet) Run(name string, tasks []Task, vars *Vars) (*FleetRecap, error) {
+	return f.RunContext(context.Background(), name, tasks, vars)
+}
+
+// RunContext executes tasks on every host under ctx. vars is the shared base:
+// each host runs against its own clone with Host.Vars layered on top and
+// inventory_hostname set to Host.Name. The recap is always returned; the error
+// joins every host failure (and the abort reason or ctx's error, if any).
+func (f *Fleet) RunContext(ctx context.Context, name string, tasks []Task, vars *Vars) (*FleetRecap, error) {
+	if vars == nil {
+		vars = NewVars()
+	}
+	recap := &FleetRecap{Hosts: make([]HostResult, len(f.hosts))}
+	for i, h := range f.hosts {
+		recap.Hosts[i].Host = h.Name
+	}
+
+	batch := f.serial
+	if batch <= 0 || batch > len(f.hosts) {
+		batch = len(f.hosts)
+	}
+	for start := 0; start < len(f.hosts) && ctx.Err() == nil; start += batch {
+		end := min(start+batch, len(f.hosts))
+		if f.runBatch(ctx, name, tasks, vars, recap.Hosts[start:end], f.hosts[start:end]) {
+			recap.Aborted = true
+			break
+		}
+	}
+
+	var errs []error
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	if recap.Aborted {
+		errs = append(errs, fmt.Errorf("aborted: more than %d%% of hosts in a batch failed", f.maxFail))
+	}
+	for _, h := range recap.Hosts {
+		if h.Stats != nil {
+			recap.Total.add(*h.Stats)
+		}
+		if h.Err != nil && !errors.Is(h.Err, context.Canceled) {
+			errs = append(errs, fmt.Errorf("%s: %w", h.Host, h.Err))
+		}
+	}
+
+	if f.verbose {
+		log.Printf("\n\033[1;36mFLEET RECAP [%s]\033[0m\n", name)
+		for _, h := range recap.Hosts {
+			switch {
+			case h.Unreachable:
+				log.Printf("  %-24s unreachable: %v", h.Host, h.Err)
+			case h.Stats == nil:
+				log.Printf("  %-24s not run", h.Host)
+			default:
+				log.Printf("  %-24s ok=%d changed=%d skipped=%d failed=%d rescued=%d cancelled=%d",
+					h.Host, h.Stats.OK, h.Stats.Changed, h.Stats.Skipped, h.Stats.Failed, h.Stats.Rescued, h.Stats.Cancelled)
+			}
+		}
+	}
+	return recap, errors.Join(errs...)
+}
+
+// runBatch runs one batch of hosts with at most f.forks in flight, writing
+// each outcome into the matching results slot. It reports whether the batch
+// crossed the failure threshold (and so cancelled its remaining hosts).
+func (f *Fleet) runBatch(ctx context.Context, name string, tasks []Task, vars *Vars, results []HostResult, hosts []Host) (aborted bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	forks := f.forks
+	if forks <= 0 {
+		forks = len(hosts)
+	}
+	sem := make(chan struct{}, forks)
+
+	var (
+		mu     sync.Mutex
+		failed int
+		wg     sync.WaitGroup
+	)
+launch:
+	for i := range hosts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break launch // hosts not yet started stay "not run"
+		}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			res := f.runHost(ctx, hosts[i], name, tasks, vars)
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[i] = res
+			if res.Err != nil && !errors.Is(res.Err, context.Canceled) {
+				failed++
+				if f.maxFail >= 0 && failed*100 > f.maxFail*len(hosts) && !aborted {
+					aborted = true
+					cancel()
+				}
+			}
+		})
+	}
+	wg.Wait()
+	return aborted
+}
+
+// runHost connects (if needed) and runs tasks on a single host.
+func (f *Fleet) runHost(ctx context.Context, h Host, name string, tasks []Task, base *Vars) (res HostResult) {
+	res.Host = h.Name
+	start := time.Now()
+	defer func() { res.Duration = time.Since(start) }()
+
+	client := h.Client
+	if client == nil {
+		if h.Dial == nil {
+			res.Unreachable = true
+			res.Err = errors.New("host has neither a Client nor a Dial func")
+			return res
+		}
+		c, err := h.Dial()
+		if err != nil {
+			res.Unreachable = true
+			res.Err = fmt.Errorf("connect: %w", err)
+			return res
+		}
+		defer c.Close()
+		client = c
+	}
+
+	e := f.newExecutor(client, h.Password).SetVerbose(f.verbose).SetDryRun(f.dryRun)
+	if h.Dial != nil {
+		// A dropped link is redialled; Close releases any client dialled
+		// that way.
+		e.SetDialer(h.Dial)
+		defer e.Close()
+	}
+	if f.onProgress != nil {
+		e.OnProgress(func(p TaskProgress) { f.onProgress(h.Name, p) })
+	}
+	if f.onOutput != nil {
+		e.OnOutput(func(p TaskProgress, ev StreamEvent) { f.onOutput(h.Name, p, ev) })
+	}
+	if f.setup != nil {
+		if teardown := f.setup(h, e); teardown != nil {
+			defer teardown()
+		}
+	}
+
+	vars := base.Clone()
+	for k, v := range h.Vars {
+		vars.setAny(k, v)
+	}
+	vars.Set("inventory_hostname", h.Name)
+
+	res.Vars = vars
+	if f.check {
+		res.Drift, res.Stats, res.Err = e.check(ctx, name, tasks, vars)
+		res.Drift.Host = h.Name
+		return res
+	}
+	res.Stats, res.Err = e.RunContext(ctx, name, tasks, vars)
+	return res
+}
+
+// add accumulates o into s.
+func (s *Stats) add(o Stats) {
+	s.Total += o.Total
+	s.OK += o.OK
+	s.Changed += o.Changed
+	s.Skipped += o.Skipped
+	s.Failed += o.Failed
+	s.Cancelled += o.Cancelled
+	s.Rescued += o.Rescued
+}
@@ -0,0 +1,137 @@
+package porter
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/melbahja/goph"
+)
+
+// hostRunner is a cmdRunner for fleet tests: it fails any command on a host
+// listed in fail and tracks how many hosts are running at once.
+type hostRunner struct {
+	host    string
+	fail    map[string]bool
+	active  *atomic.Int32
+	peak    *atomic.Int32
+	ran     *sync.Map
+	holdFor time.Duration
+}
+
+func (h *hostRunner) Run(ctx context.Context, cmd string) ([]byte, error) {
+	n := h.active.Add(1)
+	defer h.active.Add(-1)
+	for {
+		p := h.peak.Load()
+		if n <= p || h.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+	h.ran.Store(h.host, true)
+	select {
+	case <-time.After(h.holdFor):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if h.fail[h.host] {
+		return nil, errors.New("boom")
+	}
+	return nil, nil
+}
+
+// testFleet builds a Fleet whose executors run against hostRunners, keyed by
+// the password field (tests set Password to the host name).
+func testFleet(names []string, fail map[string]bool, hold time.Duration) (*Fleet, *atomic.Int32, *sync.Map) {
+	var active, peak atomic.Int32
+	ran := &sync.Map{}
+	hosts := make([]Host, len(names))
+	for i, n := range names {
+		hosts[i] = Host{Name: n, Client: &goph.Client{}, Password: n}
+	}
+	f := NewFleet(hosts...)
+	f.newExecutor = func(_ *goph.Client, host string) *Executor {
+		return &Executor{runner: &hostRunner{host: host, fail: fail, active: &active, peak: &peak, ran: ran, holdFor: hold}}
+	}
+	return f, &peak, ran
+}
+
+func TestFleetRespectsForksAndMergesStats(t *testing.T) {
+	f, peak, _ := testFleet([]string{"a", "b", "c", "d", "e", "f"}, nil, 20*time.Millisecond)
+	recap, err := f.Forks(2).Run("deploy", Tasks(Run("echo 1"), Run("echo 2")), NewVars())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if p := peak.Load(); p > 2 {
+		t.Errorf("peak concurrency = %d, want <= 2 forks", p)
+	}
+	if recap.Total.Total != 12 || recap.Total.Changed != 12 {
+		t.Errorf("merged stats: %+v", recap.Total)
+	}
+	for _, h := range recap.Hosts {
+		if h.Vars.Get("inventory_hostname") != h.Host {
+			t.Errorf("%s: inventory_hostname = %q", h.Host, h.Vars.Get("inventory_hostname"))
+		}
+	}
+}
+
+func TestFleetHostVarsKeepStructure(t *testing.T) {
+	f, _, _ := testFleet([]string{"web1"}, nil, 0)
+	f.hosts[0].Vars = map[string]any{
+		"role":  "canary",
+		"port":  8080,
+		"peers": []string{"10.0.0.2", "10.0.0.3"},
+		"db":    map[string]any{"host": "db1"},
+	}
+	recap, err := f.Run("deploy", Tasks(Run("true")), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := recap.Hosts[0].Vars.SetTemplates(true)
+	got, err := vars.Render(`{{.role}} {{.port}} {{.peers | join ","}} {{.db.host}}`)
+	if err != nil || got != "canary 8080 10.0.0.2,10.0.0.3 db1" {
+		t.Errorf("Render = %q, %v", got, err)
+	}
+}
+
+func TestFleetSerialAbortsOnMaxFailPercentage(t *testing.T) {
+	f, _, ran := testFleet([]string{"a", "b", "c", "d"}, map[string]bool{"a": true}, time.Millisecond)
+	recap, err := f.Serial(2).MaxFailPercentage(0).Run("deploy", Tasks(Run("deploy")), NewVars())
+	if err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Fatalf("err = %v, want abort", err)
+	}
+	if !recap.Aborted {
+		t.Error("recap should be marked aborted")
+	}
+	for _, h := range []string{"c", "d"} {
+		if _, ok := ran.Load(h); ok {
+			t.Errorf("host %s in the second batch must not run after the abort", h)
+		}
+	}
+	if got := recap.Failed(); len(got) != 1 || got[0] != "a" {
+		t.Errorf("Failed() = %v, want [a]", got)
+	}
+}
+
+func TestFleetWithoutThresholdRunsEveryHost(t *testing.T) {
+	f, _, _ := testFleet([]string{"a", "b", "c"}, map[string]bool{"b": true}, time.Millisecond)
+	recap, err := f.Serial(1).Run("deploy", Tasks(Run("deploy")), NewVars())
+	if err == nil {
+		t.Fatal("a failed host should surface in the error")
+	}
+	if recap.Aborted || recap.Total.OK != 2 || recap.Total.Failed != 1 {
+		t.Errorf("recap: aborted=%v total=%+v", recap.Aborted, recap.Total)
+	}
+}
+
+func TestFleetUnreachableHost(t *testing.T) {
+	f := NewFleet(Host{Name: "down", Dial: func() (*goph.Client, error) { return nil, errors.New("no route") }})
+	recap, err := f.Run("deploy", Tasks(Run("x")), nil)
+	if err == nil || !recap.Hosts[0].Unreachable || recap.Hosts[0].Stats != nil {
+		t.Errorf("unreachable host: err=%v result=%+v", err, recap.Hosts[0])
+	}
+}
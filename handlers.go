@@ -0,0 +1,133 @@
+package porter
+
+import (
+	"fmt"
+	"log"
+)
+
+// =============================================================================
+// HANDLERS (notify / flush)
+//
+// A handler is a named list of tasks that runs only when a task that notified
+// it actually changed something — "restart nginx if any of its config
+// changed". Notifications are deduplicated and flushed at the end of the run
+// or at an explicit FlushHandlers() task; handlers run in definition order,
+// once per flush. In dry-run mode notifications are recorded from the preview,
+// so the check run reports which handlers would fire.
+// =============================================================================
+
+// Handler defines a named handler. Place it anywhere in the task list: it is
+// not run in sequence, only when a task notifies it by name.
+//
+// Example:
+//
+//	tasks := porter.Tasks(
+//	    porter.EnsureFile("/etc/nginx/nginx.conf", conf).Sudo().Notify("restart nginx"),
+//	    porter.EnsureFile("/etc/nginx/conf.d/app.conf", site).Sudo().Notify("restart nginx"),
+//	    porter.Handler("restart nginx", porter.Svc("nginx").Restart().Sudo()),
+//	)
+func Handler(name string, tasks ...TaskBuilder) TaskBuilder {
+	return TaskBuilder{Task{Action: "handler", Name: name, Tasks: Tasks(tasks...)}}
+}
+
+// FlushHandlers runs every handler notified so far, at this point in the run
+// instead of at the end.
+func FlushHandlers() TaskBuilder {
+	return TaskBuilder{Task{Action: "flush_handlers", Name: "Flush handlers"}}
+}
+
+// splitHandlers separates Handler definitions from the tasks run in sequence.
+func splitHandlers(tasks []Task) (run, handlers []Task) {
+	for _, t := range tasks {
+		if t.Action == "handler" {
+			handlers = append(handlers, t)
+			continue
+		}
+		run = append(run, t)
+	}
+	return run, handlers
+}
+
+// checkNotify rejects a Notify naming a handler that is not defined, before
+// anything runs — a typo would otherwise silently never fire.
+func checkNotify(tasks, handlers []Task) error {
+	defined := make(map[string]bool, len(handlers))
+	for _, h := range handlers {
+		defined[h.Name] = true
+	}
+	var walk func([]Task) error
+	walk = func(ts []Task) error {
+		for _, t := range ts {
+			for _, n := range t.Notify {
+				if !defined[n] {
+					return fmt.Errorf("task %q notifies undefined handler %q", t.Name, n)
+				}
+			}
+			for _, nested := range [][]Task{t.Tasks, t.Rescue, t.Always} {
+				if err := walk(nested); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(tasks); err != nil {
+		return err
+	}
+	return walk(handlers)
+}
+
+// notify queues handlers for the next flush.
+func (e *Executor) notify(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	if e.notified == nil {
+		e.notified = make(map[string]bool)
+	}
+	for _, n := range names {
+		e.notified[n] = true
+	}
+}
+
+// flushHandlers runs the notified handlers in definition order. A handler
+// that notifies a later one is picked up in the same pass, an earlier one in
+// another pass; no handler runs twice in one flush.
+func (e *Executor) flushHandlers(vars *Vars, stats *Stats) error {
+	ran := make(map[string]bool)
+	for len(e.notified) > 0 {
+		pending := false
+		for _, h := range e.handlers {
+			if !e.notified[h.Name] {
+				continue
+			}
+			delete(e.notified, h.Name)
+			if ran[h.Name] {
+				continue
+			}
+			ran[h.Name] = true
+			pending = true
+
+			if e.verbose {
+				mode := ""
+				if e.dryRun {
+					mode = " \033[35m(CHECK: would run)\033[0m"
+				}
+				log.Printf("\033[1;36mRUNNING HANDLER [%s]\033[0m%s", h.Name, mode)
+			}
+			for _, t := range h.Tasks {
+				if err := e.taskCtx().Err(); err != nil {
+					return fmt.Errorf("handler %s: %w", h.Name, err)
+				}
+				stats.Total++
+				if err := e.step(stats.Total-1, t, vars, stats); err != nil {
+					return fmt.Errorf("handler %s: %w", h.Name, err)
+				}
+			}
+		}
+		if !pending {
+			break
+		}
+	}
+	return nil
+}
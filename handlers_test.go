@@ -0,0 +1,110 @@
+package porter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHandlersRunOnceAfterChangeAtEnd(t *testing.T) {
+	fr := &fakeRunner{}
+	e := newTestExec(fr)
+	tasks := Tasks(
+		Run("write config a").Notify("restart app"),
+		Run("write config b").Notify("restart app"),
+		Handler("restart app", Run("systemctl restart app")),
+		Handler("reload proxy", Run("systemctl reload proxy")),
+		Run("last task"),
+	)
+	stats, err := e.Run("deploy", tasks, NewVars())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var restarts int
+	for _, c := range fr.calls {
+		if strings.Contains(c, "systemctl restart app") {
+			restarts++
+		}
+	}
+	if restarts != 1 {
+		t.Errorf("handler ran %d times, want 1", restarts)
+	}
+	if fr.ran("reload proxy") {
+		t.Error("un-notified handler must not run")
+	}
+	if last := fr.calls[len(fr.calls)-1]; !strings.Contains(last, "restart app") {
+		t.Errorf("handler should run after every task, last call = %q", last)
+	}
+	if stats.Total != 4 || stats.Changed != 4 {
+		t.Errorf("stats = %+v, want 3 tasks + 1 handler changed", stats)
+	}
+}
+
+func TestHandlersSkippedWhenNotifierUnchanged(t *testing.T) {
+	fr := &fakeRunner{}
+	e := newTestExec(fr)
+	tasks := Tasks(
+		Capture("cat /etc/app.conf").Register("conf").Notify("restart app"),
+		Handler("restart app", Run("systemctl restart app")),
+	)
+	if _, err := e.Run("deploy", tasks, NewVars()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if fr.ran("systemctl restart app") {
+		t.Error("a read-only task must not fire its handler")
+	}
+}
+
+func TestFlushHandlersRunsMidPlay(t *testing.T) {
+	fr := &fakeRunner{}
+	e := newTestExec(fr)
+	tasks := Tasks(
+		Run("install unit").Notify("reload systemd"),
+		FlushHandlers(),
+		Run("start service"),
+		Handler("reload systemd", Run("systemctl daemon-reload")),
+	)
+	if _, err := e.Run("deploy", tasks, NewVars()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := []string{"install unit", "daemon-reload", "start service"}
+	if len(fr.calls) != len(want) {
+		t.Fatalf("calls = %q", fr.calls)
+	}
+	for i, w := range want {
+		if !strings.Contains(fr.calls[i], w) {
+			t.Errorf("call %d = %q, want %q", i, fr.calls[i], w)
+		}
+	}
+}
+
+func TestHandlersDryRunReportsWouldFire(t *testing.T) {
+	e := newTestExec(&fakeRunner{})
+	e.SetDryRun(true)
+	var fired []string
+	e.OnProgress(func(p TaskProgress) {
+		if p.Status == StatusChanged {
+			fired = append(fired, p.Name)
+		}
+	})
+	tasks := Tasks(
+		Run("write config").Notify("restart app"),
+		Handler("restart app", Run("systemctl restart app").Name("Restart app")),
+	)
+	if _, err := e.Run("deploy", tasks, NewVars()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(fired) != 2 || fired[1] != "Restart app" {
+		t.Errorf("dry-run progress = %v, want the handler previewed after the notifier", fired)
+	}
+}
+
+func TestNotifyUndefinedHandlerFailsBeforeRunning(t *testing.T) {
+	fr := &fakeRunner{}
+	_, err := newTestExec(fr).Run("deploy", Tasks(Run("x").Notify("restart ngnix")), NewVars())
+	if err == nil || !strings.Contains(err.Error(), "undefined handler") {
+		t.Fatalf("err = %v, want undefined handler", err)
+	}
+	if len(fr.calls) != 0 {
+		t.Errorf("nothing should run, got %q", fr.calls)
+	}
+}
@@ -34,6 +34,7 @@ var (
 	hostKeyMode    = HostKeyTOFU
 	knownHostsPath = defaultKnownHostsPath()
 	hostCAPath     string // optional file of trusted host-CA public keys (step-ca @cert-authority)
+	hashKnownHosts bool   // pin hashed host names (see SetHashKnownHosts)
 )
 
 // SetHostKeyMode sets the global host-key verification policy.
@@ -118,6 +119,11 @@ func HostKeyCallback() ssh.HostKeyCallback {
 	}
 
 	checker := &ssh.CertChecker{
+		// known_hosts @revoked lines apply to CA-signed hosts too.
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			r, err := revokedIn(khPath, cert)
+			return r != nil || err != nil
+		},
 		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
 			authMarshaled := auth.Marshal()
 			for _, ca := range authorities {
@@ -143,6 +149,15 @@ func knownHostsVerifier(mode HostKeyMode, path string) ssh.HostKeyCallback {
 			return fmt.Errorf("porter: cannot access known_hosts %q: %w", path, err)
 		}
 
+		// knownhosts checks @revoked only against the exact key presented;
+		// also reject a certificate whose key or signing CA is revoked.
+		if r, err := revokedIn(path, key); err != nil {
+			return fmt.Errorf("porter: failed to load known_hosts %q: %w", path, err)
+		} else if r != nil {
+			return fmt.Errorf("porter: host key %s presented by %s is revoked (%s:%d)",
+				ssh.FingerprintSHA256(key), hostname, path, r.Line)
+		}
+
 		verify, err := knownhosts.New(path)
 		if err != nil {
 			return fmt.Errorf("porter: failed to load known_hosts %q: %w", path, err)
@@ -162,7 +177,8 @@ func knownHostsVerifier(mode HostKeyMode, path string) ssh.HostKeyCallback {
 		// presented one — treat as a potential man-in-the-middle, always fail.
 		if len(keyErr.Want) > 0 {
 			return fmt.Errorf("porter: host key mismatch for %s — pinned key changed (possible MITM); "+
-				"if intentional, remove the stale line from %s: %w", hostname, path, keyErr)
+				"if intentional, confirm the new fingerprint (%s) on the host and re-pin it with "+
+				"ReplaceHostKey, or remove the stale line from %s: %w", hostname, ssh.FingerprintSHA256(key), path, keyErr)
 		}
 
 		// Empty Want means the host is unknown.
@@ -180,21 +196,15 @@ func knownHostsVerifier(mode HostKeyMode, path string) ssh.HostKeyCallback {
 }
 
 func appendKnownHost(path, hostname string, remote net.Addr, key ssh.PublicKey) error {
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	addrs := []string{knownhosts.Normalize(hostname)}
+	hosts := []string{knownhosts.Normalize(hostname)}
 	if remote != nil {
-		if r := knownhosts.Normalize(remote.String()); r != addrs[0] {
-			addrs = append(addrs, r)
+		if r := knownhosts.Normalize(remote.String()); r != hosts[0] {
+			hosts = append(hosts, r)
 		}
 	}
-	line := knownhosts.Line(addrs, key)
-	_, err = fmt.Fprintln(f, line)
-	return err
+	knownHostsEditMu.Lock()
+	defer knownHostsEditMu.Unlock()
+	return appendKnownHostLocked(path, hosts, key)
 }
 
 func loadHostCAs(path string) ([]ssh.PublicKey, error) {
@@ -2,9 +2,13 @@ package porter
 
 import (
 	"crypto/ed25519"
+	"crypto/rand"
 	"net"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -74,3 +78,155 @@ func TestHostKeyInsecureModeSkipsVerification(t *testing.T) {
 		t.Fatalf("insecure mode should accept any key, got: %v", err)
 	}
 }
+
+// useKnownHosts points porter at a fresh known_hosts file for the test.
+func useKnownHosts(t *testing.T) string {
+	t.Helper()
+	kh := filepath.Join(t.TempDir(), "known_hosts")
+	prev := knownHostsFile()
+	SetKnownHostsPath(kh)
+	t.Cleanup(func() { SetKnownHostsPath(prev) })
+	return kh
+}
+
+func TestReplaceHostKeyNeedsConfirmedFingerprint(t *testing.T) {
+	kh := useKnownHosts(t)
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.20"), Port: 22}
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.21"), Port: 22}
+	cb := knownHostsVerifier(HostKeyTOFU, kh)
+	if err := cb("10.0.0.20:22", other, testHostKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("10.0.0.21:22", addr, testHostKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt := testHostKey(t)
+	if err := cb("10.0.0.21:22", addr, rebuilt); err == nil || !strings.Contains(err.Error(), ssh.FingerprintSHA256(rebuilt)) {
+		t.Fatalf("changed key: %v", err)
+	}
+	if err := ReplaceHostKey("10.0.0.21", rebuilt, ssh.FingerprintSHA256(testHostKey(t))); err == nil {
+		t.Fatal("replaced with an unconfirmed fingerprint")
+	}
+	if err := ReplaceHostKey("10.0.0.21", rebuilt, ssh.FingerprintSHA256(rebuilt)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("10.0.0.21:22", addr, rebuilt); err != nil {
+		t.Fatalf("re-pinned key rejected: %v", err)
+	}
+
+	entries, err := KnownHosts()
+	if err != nil || len(entries) != 2 || !entries[0].Matches("10.0.0.20") || entries[1].Fingerprint != ssh.FingerprintSHA256(rebuilt) {
+		t.Errorf("entries = %+v, %v", entries, err)
+	}
+}
+
+func TestRevokedHostKeyIsRejected(t *testing.T) {
+	kh := useKnownHosts(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.22"), Port: 22}
+	key := testHostKey(t)
+	cb := knownHostsVerifier(HostKeyTOFU, kh)
+	if err := cb("10.0.0.22:22", addr, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeHostKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeHostKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := KnownHosts(); len(entries) != 2 || entries[1].Marker != MarkerRevoked {
+		t.Errorf("entries = %+v", entries)
+	}
+	if err := cb("10.0.0.22:22", addr, key); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("revoked pinned key: %v", err)
+	}
+	if err := ReplaceHostKey("10.0.0.22", key, ssh.FingerprintSHA256(key)); err == nil {
+		t.Error("re-pinned a revoked key")
+	}
+
+	// A certificate is rejected when its key or its CA is revoked, which
+	// knownhosts alone does not check.
+	_, caPriv, _ := ed25519.GenerateKey(nil)
+	ca, _ := ssh.NewSignerFromKey(caPriv)
+	hostKey := testHostKey(t)
+	cert := &ssh.Certificate{Key: hostKey, CertType: ssh.HostCert, ValidPrincipals: []string{"10.0.0.23"}, ValidBefore: ssh.CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendLine(kh, MarkerCertAuthority+" * "+strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.PublicKey())))); err != nil {
+		t.Fatal(err)
+	}
+	certAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.23"), Port: 22}
+	if err := cb("10.0.0.23:22", certAddr, cert); err != nil {
+		t.Fatalf("valid certificate rejected: %v", err)
+	}
+	if err := RevokeHostKey(ca.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("10.0.0.23:22", certAddr, cert); err == nil {
+		t.Error("certificate from a revoked CA accepted")
+	}
+}
+
+func TestHashedKnownHosts(t *testing.T) {
+	kh := useKnownHosts(t)
+	SetHashKnownHosts(true)
+	defer SetHashKnownHosts(false)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.30"), Port: 2222}
+	key := testHostKey(t)
+	cb := knownHostsVerifier(HostKeyTOFU, kh)
+	if err := cb("web1:2222", addr, key); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(kh)
+	if strings.Contains(string(data), "web1") || strings.Count(string(data), "|1|") != 2 {
+		t.Fatalf("known_hosts = %s", data)
+	}
+	if err := cb("web1:2222", addr, key); err != nil {
+		t.Fatalf("hashed pin not verified: %v", err)
+	}
+
+	pinned, err := PinnedHostKeys("web1:2222")
+	if err != nil || len(pinned) != 1 || !pinned[0].Hashed {
+		t.Fatalf("pinned = %+v, %v", pinned, err)
+	}
+	if p, _ := PinnedHostKeys("web1"); len(p) != 0 {
+		t.Errorf("port 22 matched a :2222 pin: %+v", p)
+	}
+	if n, err := RemoveHostKey("[web1]:2222"); n != 1 || err != nil {
+		t.Errorf("removed %d, %v", n, err)
+	}
+	if entries, _ := KnownHosts(); len(entries) != 1 || !entries[0].Matches("10.0.0.30:2222") {
+		t.Errorf("entries = %+v", entries)
+	}
+}
+
+func TestScanHostKey(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	signer, _ := ssh.NewSignerFromKey(priv)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback:", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		cfg := &ssh.ServerConfig{NoClientAuth: true}
+		cfg.AddHostKey(signer)
+		_, _, _, _ = ssh.NewServerConn(conn, cfg)
+	}()
+
+	key, err := ScanHostKey(ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh.FingerprintSHA256(key) != ssh.FingerprintSHA256(signer.PublicKey()) {
+		t.Errorf("scanned %s", ssh.FingerprintSHA256(key))
+	}
+}
@@ -0,0 +1,388 @@
+package porter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// =============================================================================
+// KNOWN_HOSTS MANAGEMENT
+// =============================================================================
+//
+// TOFU pins a host's key the first time porter connects, and every later
+// connection must present the same key. When a host is rebuilt its key
+// changes legitimately, and the connection fails as a possible MITM. The
+// functions here inspect and edit the known_hosts file porter uses
+// (SetKnownHostsPath), so the key can be re-pinned without hand-editing:
+//
+//	key, _ := porter.ScanHostKey("10.0.0.5", 10*time.Second)
+//	// compare ssh.FingerprintSHA256(key) with the fingerprint read on the
+//	// host's console (ssh-keygen -lf /etc/ssh/ssh_host_ed25519_key.pub)
+//	err := porter.ReplaceHostKey("10.0.0.5", key, "SHA256:...")
+//
+// Lines marked @revoked reject their key for every host, whether it is
+// presented as a plain key, as a host certificate, or as the CA that signed
+// one. Hashed host names (|1|salt|hash, as written by HashKnownHosts yes) are
+// matched like plain ones, and SetHashKnownHosts(true) makes porter write them.
+
+// Markers of known_hosts lines.
+const (
+	MarkerCertAuthority = "@cert-authority"
+	MarkerRevoked       = "@revoked"
+)
+
+// KnownHost is one entry of the known_hosts file.
+type KnownHost struct {
+	Line        int           `json:"line"`             // 1-based line number
+	Marker      string        `json:"marker,omitempty"` // MarkerCertAuthority, MarkerRevoked, or "" for a pin
+	Hosts       []string      `json:"hosts"`            // patterns as written; a hashed name stays hashed
+	Hashed      bool          `json:"hashed"`
+	KeyType     string        `json:"key_type"`
+	Fingerprint string        `json:"fingerprint"` // SHA256:...
+	Comment     string        `json:"comment,omitempty"`
+	Key         ssh.PublicKey `json:"-"`
+}
+
+// Matches reports whether the entry's host patterns cover host (a name or
+// address, optionally with ":port"). Wildcards and !negations are honoured,
+// and hashed names are compared by hash.
+func (k KnownHost) Matches(host string) bool {
+	host = knownhosts.Normalize(host)
+	if k.Hashed {
+		return hashedHostMatch(k.Hosts[0], host)
+	}
+	return matchPatternList(k.Hosts, host)
+}
+
+// matchesExactly reports whether the entry names host itself rather than
+// through a wildcard.
+func (k KnownHost) matchesExactly(host string) bool {
+	host = knownhosts.Normalize(host)
+	if k.Hashed {
+		return hashedHostMatch(k.Hosts[0], host)
+	}
+	for _, h := range k.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashedHostMatch checks host against a |1|salt|hash entry.
+func hashedHostMatch(entry, host string) bool {
+	parts := strings.Split(entry, "|")
+	if len(parts) != 4 || parts[1] != "1" {
+		return false
+	}
+	salt, err1 := base64.StdEncoding.DecodeString(parts[2])
+	hash, err2 := base64.StdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// knownHostsEditMu serialises porter's own writes to known_hosts, so a TOFU
+// pin cannot interleave with a rewrite.
+var knownHostsEditMu sync.Mutex
+
+// SetHashKnownHosts makes porter write hashed host names when it pins a key
+// (like OpenSSH's HashKnownHosts yes), so the file does not list the hosts
+// it knows. Existing lines are left as they are.
+func SetHashKnownHosts(v bool) {
+	hostKeyMu.Lock()
+	defer hostKeyMu.Unlock()
+	hashKnownHosts = v
+}
+
+func hashingKnownHosts() bool {
+	hostKeyMu.RLock()
+	defer hostKeyMu.RUnlock()
+	return hashKnownHosts
+}
+
+// KnownHosts returns every entry of the known_hosts file porter uses. A
+// missing file has none.
+func KnownHosts() ([]KnownHost, error) {
+	entries, _, err := readKnownHosts(knownHostsFile())
+	return entries, err
+}
+
+// PinnedHostKeys returns the keys pinned for host (a name or address,
+// optionally with ":port"), including wildcard entries that cover it.
+func PinnedHostKeys(host string) ([]KnownHost, error) {
+	entries, err := KnownHosts()
+	if err != nil {
+		return nil, err
+	}
+	var pinned []KnownHost
+	for _, k := range entries {
+		if k.Marker == "" && k.Matches(host) {
+			pinned = append(pinned, k)
+		}
+	}
+	return pinned, nil
+}
+
+// RemoveHostKey removes the lines pinning a key for host and returns how
+// many it removed; in TOFU mode the next connection pins afresh. As with
+// ssh-keygen -R, a line listing host among others goes whole. Wildcard
+// entries and @cert-authority/@revoked lines are left alone.
+func RemoveHostKey(host string) (int, error) {
+	knownHostsEditMu.Lock()
+	defer knownHostsEditMu.Unlock()
+	return removeKnownHost(knownHostsFile(), host)
+}
+
+// ReplaceHostKey re-pins host to key after a legitimate key change. The
+// caller confirms the change out of band: fingerprint is the SHA256
+// fingerprint of the new key as read on the host itself, and the key is
+// refused unless it matches. Revoked keys are refused too.
+func ReplaceHostKey(host string, key ssh.PublicKey, fingerprint string) error {
+	if got := ssh.FingerprintSHA256(key); strings.TrimSpace(fingerprint) != got {
+		return fmt.Errorf("porter: host key for %s is %s, not the confirmed %q; not replacing", host, got, fingerprint)
+	}
+	path := knownHostsFile()
+	if path == "" {
+		return errors.New("porter: no known_hosts path configured")
+	}
+	knownHostsEditMu.Lock()
+	defer knownHostsEditMu.Unlock()
+	if r, err := revokedIn(path, key); err != nil {
+		return err
+	} else if r != nil {
+		return fmt.Errorf("porter: host key %s is revoked (%s:%d); not pinning it", ssh.FingerprintSHA256(key), path, r.Line)
+	}
+	if _, err := removeKnownHost(path, host); err != nil {
+		return err
+	}
+	return appendKnownHostLocked(path, []string{host}, key)
+}
+
+// RevokeHostKey adds a @revoked line for key, so no host is accepted with it
+// again. Revoking a key already revoked is a no-op.
+func RevokeHostKey(key ssh.PublicKey) error {
+	path := knownHostsFile()
+	if path == "" {
+		return errors.New("porter: no known_hosts path configured")
+	}
+	knownHostsEditMu.Lock()
+	defer knownHostsEditMu.Unlock()
+	if r, err := revokedIn(path, key); err != nil || r != nil {
+		return err
+	}
+	if err := ensureFile(path); err != nil {
+		return err
+	}
+	return appendLine(path, MarkerRevoked+" * "+strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+}
+
+// errScanned stops ScanHostKey's handshake once the host key is known.
+var errScanned = errors.New("host key scanned")
+
+// ScanHostKey connects to addr (host or host:port) only far enough to read
+// the host key it presents, without verifying or pinning it — like
+// ssh-keyscan. Confirm its fingerprint before trusting it.
+func ScanHostKey(addr string, timeout time.Duration) (ssh.PublicKey, error) {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	var key ssh.PublicKey
+	_, _, _, err = ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User: "porter",
+		HostKeyCallback: func(_ string, _ net.Addr, k ssh.PublicKey) error {
+			key = k
+			return errScanned
+		},
+		Timeout: timeout,
+	})
+	if key == nil {
+		return nil, fmt.Errorf("scan host key of %s: %w", addr, err)
+	}
+	return key, nil
+}
+
+// readKnownHosts parses path, returning its entries and raw lines.
+func readKnownHosts(path string) ([]KnownHost, []string, error) {
+	if path == "" {
+		return nil, nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	var entries []KnownHost
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		k, err := parseKnownHost(l)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		k.Line = i + 1
+		entries = append(entries, k)
+	}
+	return entries, lines, nil
+}
+
+func parseKnownHost(line string) (KnownHost, error) {
+	var k KnownHost
+	f := strings.Fields(line)
+	if len(f) > 0 && (f[0] == MarkerCertAuthority || f[0] == MarkerRevoked) {
+		k.Marker, f = f[0], f[1:]
+	}
+	if len(f) < 3 {
+		return k, errors.New("want hosts, key type and key")
+	}
+	blob, err := base64.StdEncoding.DecodeString(f[2])
+	if err != nil {
+		return k, err
+	}
+	if k.Key, err = ssh.ParsePublicKey(blob); err != nil {
+		return k, err
+	}
+	k.Hosts = strings.Split(f[0], ",")
+	k.Hashed = strings.HasPrefix(f[0], "|")
+	k.KeyType = k.Key.Type()
+	k.Fingerprint = ssh.FingerprintSHA256(k.Key)
+	k.Comment = strings.Join(f[3:], " ")
+	return k, nil
+}
+
+// revokedIn returns the @revoked entry of path that rejects key, if any: for
+// a certificate, one revoking it, its key, or the CA that signed it.
+func revokedIn(path string, key ssh.PublicKey) (*KnownHost, error) {
+	entries, _, err := readKnownHosts(path)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []ssh.PublicKey{key}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		candidates = append(candidates, cert.Key, cert.SignatureKey)
+	}
+	for _, k := range entries {
+		if k.Marker != MarkerRevoked {
+			continue
+		}
+		for _, c := range candidates {
+			if bytes.Equal(k.Key.Marshal(), c.Marshal()) {
+				return &k, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// removeKnownHost drops the pins naming host from path. The caller holds
+// knownHostsEditMu.
+func removeKnownHost(path, host string) (int, error) {
+	entries, lines, err := readKnownHosts(path)
+	if err != nil {
+		return 0, err
+	}
+	drop := map[int]bool{}
+	for _, k := range entries {
+		if k.Marker == "" && k.matchesExactly(host) {
+			drop[k.Line] = true
+		}
+	}
+	if len(drop) == 0 {
+		return 0, nil
+	}
+	var kept []string
+	for i, l := range lines {
+		if !drop[i+1] {
+			kept = append(kept, l)
+		}
+	}
+	return len(drop), writeKnownHosts(path, kept)
+}
+
+// writeKnownHosts replaces path with lines, atomically and keeping its mode.
+func writeKnownHosts(path string, lines []string) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".known_hosts-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	var content string
+	if len(lines) > 0 {
+		content = strings.Join(lines, "\n") + "\n"
+	}
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// appendKnownHostLocked pins key for hosts, one hashed line per host when
+// hashing is on. The caller holds knownHostsEditMu.
+func appendKnownHostLocked(path string, hosts []string, key ssh.PublicKey) error {
+	if err := ensureFile(path); err != nil {
+		return err
+	}
+	if !hashingKnownHosts() {
+		return appendLine(path, knownhosts.Line(hosts, key))
+	}
+	for _, h := range hosts {
+		if err := appendLine(path, knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize(h))}, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendLine(path, line string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, line)
+	return err
+}
@@ -4,12 +4,14 @@ package porter
 // NETWORK OPERATIONS
 // =============================================================================
 
-// Curl downloads a file using curl.
+// Curl downloads a file using curl. Fetch is the checksum-pinned,
+// idempotent form.
 func Curl(url, output string) TaskBuilder {
 	return TaskBuilder{Task{Action: "curl", Src: url, Dest: output, Name: "Curl " + url}}
 }
 
-// Wget downloads a file using wget.
+// Wget downloads a file using wget. Fetch is the checksum-pinned,
+// idempotent form.
 func Wget(url, output string) TaskBuilder {
 	return TaskBuilder{Task{Action: "wget", Src: url, Dest: output, Name: "Wget " + url}}
 }
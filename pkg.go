@@ -0,0 +1,644 @@
+package porter
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// =============================================================================
+// PACKAGE MANAGEMENT (any distro)
+//
+// Pkg works on every host whatever its package manager — apt, dnf, yum,
+// zypper, apk or pacman, detected from the host's facts (see GatherFacts) —
+// and, like the Ensure* primitives, acts only on the packages that are not
+// already in the desired state, so a converged host reports "ok". Changes run
+// under sudo:
+//
+//	porter.Pkg("nginx", "curl").Present()
+//	porter.Pkg("postgresql-16=16.4*").Hold()   // pin, then hold
+//	porter.Pkg("telnet").Absent()
+//	porter.PkgRepo("docker", "https://download.docker.com/linux/ubuntu").
+//	    Key("https://download.docker.com/linux/ubuntu/gpg").Present()
+//
+// A version pin is written name=version on every manager; a trailing * matches
+// any version with that prefix. pacman cannot pin, and apk and pacman cannot
+// hold; asking them to fails the task. Holding on dnf/yum needs the
+// versionlock plugin.
+// =============================================================================
+
+// PkgBuilder provides a fluent API for package operations.
+type PkgBuilder struct{ t Task }
+
+// Pkg creates a package builder for one or more packages, each optionally
+// pinned as name=version.
+func Pkg(packages ...string) PkgBuilder {
+	return PkgBuilder{Task{Action: "pkg", Dest: strings.Join(packages, " ")}}
+}
+
+// Present installs the packages that are missing or not at their pinned
+// version.
+func (p PkgBuilder) Present() TaskBuilder {
+	p.t.State = "present"
+	p.t.Name = "Install " + p.t.Dest
+	return TaskBuilder(p)
+}
+
+// Latest installs the packages or upgrades them to the newest available
+// version. It reports a change only if a version actually moved.
+func (p PkgBuilder) Latest() TaskBuilder {
+	p.t.State = "latest"
+	p.t.Name = "Upgrade " + p.t.Dest
+	return TaskBuilder(p)
+}
+
+// Absent removes the packages that are installed.
+func (p PkgBuilder) Absent() TaskBuilder {
+	p.t.State = "absent"
+	p.t.Name = "Remove " + p.t.Dest
+	return TaskBuilder(p)
+}
+
+// Hold installs the packages like Present, then holds them at their version
+// so upgrades leave them alone.
+func (p PkgBuilder) Hold() TaskBuilder {
+	p.t.State = "hold"
+	p.t.Name = "Hold " + p.t.Dest
+	return TaskBuilder(p)
+}
+
+// Unhold releases held packages.
+func (p PkgBuilder) Unhold() TaskBuilder {
+	p.t.State = "unhold"
+	p.t.Name = "Unhold " + p.t.Dest
+	return TaskBuilder(p)
+}
+
+// PkgUpdate refreshes the package index (apt-get update, dnf makecache, ...).
+func PkgUpdate() TaskBuilder {
+	return TaskBuilder{Task{Action: "pkg_update", Name: "Refresh package index"}}
+}
+
+// PkgUpgrade upgrades every installed package. It reports a change only if
+// the installed package set changed.
+func PkgUpgrade() TaskBuilder {
+	return TaskBuilder{Task{Action: "pkg_upgrade", Name: "Upgrade packages"}}
+}
+
+// PkgRepoBuilder provides a fluent API for package repositories.
+type PkgRepoBuilder struct{ t Task }
+
+// PkgRepo creates a builder for the repository name at url. For apt, url may
+// be followed by the suite and components ("https://... noble stable"); the
+// suite defaults to the host's codename and the components to main.
+func PkgRepo(name, url string) PkgRepoBuilder {
+	return PkgRepoBuilder{Task{Action: "pkg_repo", Dest: name, Src: url}}
+}
+
+// Key sets the URL of the repository's signing key.
+func (r PkgRepoBuilder) Key(url string) PkgRepoBuilder {
+	r.t = TaskBuilder(r).appendOpt("key", url).t
+	return r
+}
+
+// Present adds the repository (and its key) if it is missing or differs, then
+// refreshes the package index.
+func (r PkgRepoBuilder) Present() TaskBuilder {
+	r.t.State = "present"
+	r.t.Name = "Add repository " + r.t.Dest
+	return TaskBuilder(r)
+}
+
+// Absent removes the repository if it is configured.
+func (r PkgRepoBuilder) Absent() TaskBuilder {
+	r.t.State = "absent"
+	r.t.Name = "Remove repository " + r.t.Dest
+	return TaskBuilder(r)
+}
+
+// pkgManager describes how to drive one package manager. Command fields
+// taking packages are format strings for the space-separated package list.
+type pkgManager struct {
+	name     string
+	pinSep   string // joins name and version in an install argument; "" = pins unsupported
+	query    string // prints the installed version of package $p, nothing if absent
+	refresh  string
+	install  string
+	latest   string
+	remove   string
+	upgrade  string
+	list     string // every installed package and its version
+	hold     string // "" = holds unsupported
+	unhold   string
+	holds    string // held package names, one per line
+	lockList bool   // holds lists versionlock entries (name-[epoch:]version)
+}
+
+var pkgManagers = map[string]*pkgManager{
+	"apt": {
+		name:    "apt",
+		pinSep:  "=",
+		query:   `dpkg-query -W -f='${db:Status-Status} ${Version}' "$p" 2>/dev/null | awk '$1 == "installed" {print $2}'`,
+		refresh: "apt-get update",
+		install: "DEBIAN_FRONTEND=noninteractive apt-get install -y --allow-downgrades %s",
+		latest:  "DEBIAN_FRONTEND=noninteractive apt-get install -y %s",
+		remove:  "DEBIAN_FRONTEND=noninteractive apt-get remove -y %s",
+		upgrade: "DEBIAN_FRONTEND=noninteractive apt-get upgrade -y",
+		list:    `dpkg-query -W -f='${Package} ${Version}\n'`,
+		hold:    "apt-mark hold %s",
+		unhold:  "apt-mark unhold %s",
+		holds:   "apt-mark showhold",
+	},
+	"dnf": {
+		name:     "dnf",
+		pinSep:   "-",
+		query:    `rpm -q --qf '%{VERSION}-%{RELEASE}\n' "$p" 2>/dev/null | grep -v 'not installed' | tail -1`,
+		refresh:  "dnf makecache",
+		install:  "dnf install -y %s",
+		latest:   "dnf install -y %[1]s && dnf upgrade -y %[1]s",
+		remove:   "dnf remove -y %s",
+		upgrade:  "dnf upgrade -y",
+		list:     `rpm -qa --qf '%{NAME} %{VERSION}-%{RELEASE}\n' | sort`,
+		hold:     "dnf versionlock add %s",
+		unhold:   "dnf versionlock delete %s",
+		holds:    "dnf versionlock list 2>/dev/null",
+		lockList: true,
+	},
+	"yum": {
+		name:     "yum",
+		pinSep:   "-",
+		query:    `rpm -q --qf '%{VERSION}-%{RELEASE}\n' "$p" 2>/dev/null | grep -v 'not installed' | tail -1`,
+		refresh:  "yum makecache",
+		install:  "yum install -y %s",
+		latest:   "yum install -y %[1]s && yum update -y %[1]s",
+		remove:   "yum remove -y %s",
+		upgrade:  "yum update -y",
+		list:     `rpm -qa --qf '%{NAME} %{VERSION}-%{RELEASE}\n' | sort`,
+		hold:     "yum versionlock add %s",
+		unhold:   "yum versionlock delete %s",
+		holds:    "yum versionlock list 2>/dev/null",
+		lockList: true,
+	},
+	"zypper": {
+		name:    "zypper",
+		pinSep:  "=",
+		query:   `rpm -q --qf '%{VERSION}-%{RELEASE}\n' "$p" 2>/dev/null | grep -v 'not installed' | tail -1`,
+		refresh: "zypper --non-interactive --gpg-auto-import-keys refresh",
+		install: "zypper --non-interactive install --oldpackage %s",
+		latest:  "zypper --non-interactive install %s",
+		remove:  "zypper --non-interactive remove %s",
+		upgrade: "zypper --non-interactive update",
+		list:    `rpm -qa --qf '%{NAME} %{VERSION}-%{RELEASE}\n' | sort`,
+		hold:    "zypper --non-interactive addlock %s",
+		unhold:  "zypper --non-interactive removelock %s",
+		holds:   `zypper --quiet locks 2>/dev/null | awk -F'|' 'NR > 2 {gsub(/ /, "", $2); print $2}'`,
+	},
+	"apk": {
+		name:    "apk",
+		pinSep:  "=",
+		query:   `apk list -I "$p" 2>/dev/null | awk 'NR == 1 {print $1}' | sed "s/^$p-//"`,
+		refresh: "apk update",
+		install: "apk add %s",
+		latest:  "apk add --upgrade %s",
+		remove:  "apk del %s",
+		upgrade: "apk upgrade",
+		list:    "apk info -v | sort",
+	},
+	"pacman": {
+		name:    "pacman",
+		query:   `pacman -Q "$p" 2>/dev/null | awk '{print $2}'`,
+		refresh: "pacman -Sy",
+		install: "pacman -S --noconfirm --needed %s",
+		latest:  "pacman -S --noconfirm %s",
+		remove:  "pacman -R --noconfirm %s",
+		upgrade: "pacman -Syu --noconfirm",
+		list:    "pacman -Q",
+	},
+}
+
+// pkgSpec is one package of a Pkg task, with its optional version pin.
+type pkgSpec struct{ name, version string }
+
+func parsePkgSpecs(s string) []pkgSpec {
+	var specs []pkgSpec
+	for _, f := range strings.Fields(s) {
+		name, version, _ := strings.Cut(f, "=")
+		specs = append(specs, pkgSpec{name, version})
+	}
+	return specs
+}
+
+// arg formats spec as an install argument.
+func (m *pkgManager) arg(s pkgSpec) (string, error) {
+	if s.version == "" {
+		return shellEscape(s.name), nil
+	}
+	if m.pinSep == "" {
+		return "", fmt.Errorf("%s cannot install a pinned version (%s=%s)", m.name, s.name, s.version)
+	}
+	return shellEscape(s.name + m.pinSep + s.version), nil
+}
+
+func (m *pkgManager) args(specs []pkgSpec) (string, error) {
+	out := make([]string, len(specs))
+	for i, s := range specs {
+		a, err := m.arg(s)
+		if err != nil {
+			return "", err
+		}
+		out[i] = a
+	}
+	return strings.Join(out, " "), nil
+}
+
+func pkgNames(specs []pkgSpec) string {
+	names := make([]string, len(specs))
+	for i, s := range specs {
+		names[i] = shellEscape(s.name)
+	}
+	return strings.Join(names, " ")
+}
+
+// pkgManager returns the manager for the host, from its facts.
+func (e *Executor) pkgManager() (*pkgManager, error) {
+	f, err := e.gatherFacts()
+	if err != nil {
+		return nil, err
+	}
+	m := pkgManagers[f.PkgManager]
+	if m == nil {
+		return nil, errors.New("no supported package manager found (apt, dnf, yum, zypper, apk, pacman)")
+	}
+	return m, nil
+}
+
+// installedVersions returns the installed version of each package ("" if
+// not installed) in one round trip.
+func (e *Executor) installedVersions(m *pkgManager, specs []pkgSpec) (map[string]string, error) {
+	out, err := e.runCapture("for p in " + pkgNames(specs) + `; do echo "$p $(` + m.query + `)"; done`)
+	if err != nil {
+		return nil, fmt.Errorf("query packages: %w", err)
+	}
+	versions := make(map[string]string, len(specs))
+	for line := range strings.SplitSeq(out, "\n") {
+		if f := strings.Fields(line); len(f) == 2 {
+			versions[f[0]] = f[1]
+		}
+	}
+	return versions, nil
+}
+
+// heldPackages returns the names of the held packages.
+func (e *Executor) heldPackages(m *pkgManager) (map[string]bool, error) {
+	out, err := e.runCapture(m.holds)
+	if err != nil {
+		return nil, fmt.Errorf("list held packages: %w", err)
+	}
+	held := make(map[string]bool)
+	for line := range strings.SplitSeq(out, "\n") {
+		name := strings.TrimSpace(line)
+		if m.lockList {
+			name = lockName(name)
+		}
+		if name != "" {
+			held[name] = true
+		}
+	}
+	return held, nil
+}
+
+// lockName extracts the package name from a versionlock entry such as
+// "nginx-1:1.24.0-1.el9.*": everything before the first -<digit>.
+func lockName(entry string) string {
+	for i := 0; i+1 < len(entry); i++ {
+		if entry[i] == '-' && entry[i+1] >= '0' && entry[i+1] <= '9' {
+			return entry[:i]
+		}
+	}
+	return ""
+}
+
+// pkgVersionMatches reports whether an installed version satisfies a pin.
+// A pin without a revision matches any revision (1.24.0 matches 1.24.0-1),
+// an epoch is ignored unless the pin has one, and * globs.
+func pkgVersionMatches(installed, want string) bool {
+	if want == "" {
+		return installed != ""
+	}
+	if i := strings.Index(installed, ":"); i >= 0 && !strings.Contains(want, ":") {
+		installed = installed[i+1:]
+	}
+	if strings.Contains(want, "*") {
+		ok, _ := path.Match(want, installed)
+		return ok
+	}
+	return installed == want || strings.HasPrefix(installed, want+"-")
+}
+
+// pkgPending returns the packages a Pkg task still has to act on. Latest
+// cannot know without trying, so it returns every package.
+func (e *Executor) pkgPending(m *pkgManager, state string, specs []pkgSpec) ([]pkgSpec, error) {
+	switch state {
+	case "present", "absent", "hold", "unhold", "latest":
+	default:
+		return nil, fmt.Errorf("unknown package state %q", state)
+	}
+	if (state == "hold" || state == "unhold") && m.hold == "" {
+		return nil, fmt.Errorf("%s cannot hold packages", m.name)
+	}
+	if state == "latest" {
+		return specs, nil
+	}
+
+	versions, err := e.installedVersions(m, specs)
+	if err != nil {
+		return nil, err
+	}
+	var held map[string]bool
+	if state == "hold" || state == "unhold" {
+		if held, err = e.heldPackages(m); err != nil {
+			return nil, err
+		}
+	}
+
+	var pending []pkgSpec
+	for _, s := range specs {
+		installed := versions[s.name]
+		var todo bool
+		switch state {
+		case "present":
+			todo = !pkgVersionMatches(installed, s.version)
+		case "absent":
+			todo = installed != ""
+		case "hold":
+			todo = !pkgVersionMatches(installed, s.version) || !held[s.name]
+		case "unhold":
+			todo = held[s.name]
+		}
+		if todo {
+			pending = append(pending, s)
+		}
+	}
+	return pending, nil
+}
+
+// ensurePkg brings the packages to state, reporting whether anything changed.
+func (e *Executor) ensurePkg(m *pkgManager, state string, specs []pkgSpec) (bool, error) {
+	pending, err := e.pkgPending(m, state, specs)
+	if err != nil || len(pending) == 0 {
+		return false, err
+	}
+
+	switch state {
+	case "present", "hold":
+		var install []pkgSpec
+		versions, err := e.installedVersions(m, pending)
+		if err != nil {
+			return false, err
+		}
+		for _, s := range pending {
+			if !pkgVersionMatches(versions[s.name], s.version) {
+				install = append(install, s)
+			}
+		}
+		if len(install) > 0 {
+			args, err := m.args(install)
+			if err != nil {
+				return false, err
+			}
+			if err := e.runSudo(fmt.Sprintf(m.install, args)); err != nil {
+				return false, err
+			}
+		}
+		if state == "hold" {
+			return true, e.runSudo(fmt.Sprintf(m.hold, pkgNames(pending)))
+		}
+		return true, nil
+	case "latest":
+		before, err := e.installedVersions(m, specs)
+		if err != nil {
+			return false, err
+		}
+		args, err := m.args(specs)
+		if err != nil {
+			return false, err
+		}
+		if err := e.runSudo(fmt.Sprintf(m.latest, args)); err != nil {
+			return false, err
+		}
+		after, err := e.installedVersions(m, specs)
+		if err != nil {
+			return false, err
+		}
+		for _, s := range specs {
+			if before[s.name] != after[s.name] {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "absent":
+		return true, e.runSudo(fmt.Sprintf(m.remove, pkgNames(pending)))
+	default: // unhold
+		return true, e.runSudo(fmt.Sprintf(m.unhold, pkgNames(pending)))
+	}
+}
+
+// packageInstalled reports whether a package is installed. It falls back to
+// dpkg when the host's package manager cannot be determined.
+func (e *Executor) packageInstalled(name string) bool {
+	m, err := e.pkgManager()
+	if err != nil {
+		m = pkgManagers["apt"]
+	}
+	versions, err := e.installedVersions(m, []pkgSpec{{name: name}})
+	return err == nil && versions[name] != ""
+}
+
+// pkgRepo is a repository configuration rendered for one package manager.
+type pkgRepo struct {
+	file    string // the file holding the repository definition
+	content string // its desired content; "" when entry is a line in file
+	entry   string // a line (apk) or section header (pacman) added to file
+	keyFile string // where the signing key is installed, if downloaded
+}
+
+// repoFor renders repository name at url for the host's package manager.
+func (e *Executor) repoFor(m *pkgManager, name, url, key string) (pkgRepo, error) {
+	switch m.name {
+	case "apt":
+		fields := strings.Fields(url)
+		if len(fields) == 0 {
+			return pkgRepo{}, errors.New("repository URL is empty")
+		}
+		if len(fields) == 1 {
+			f, err := e.gatherFacts()
+			if err != nil {
+				return pkgRepo{}, err
+			}
+			if f.OS.Codename == "" {
+				return pkgRepo{}, errors.New("cannot tell the host's codename: give the suite after the URL")
+			}
+			fields = append(fields, f.OS.Codename)
+		}
+		if len(fields) == 2 {
+			fields = append(fields, "main")
+		}
+		r := pkgRepo{file: "/etc/apt/sources.list.d/" + name + ".list"}
+		line := "deb " + strings.Join(fields, " ")
+		if key != "" {
+			r.keyFile = "/etc/apt/keyrings/" + name + ".asc"
+			line = "deb [signed-by=" + r.keyFile + "] " + strings.Join(fields, " ")
+		}
+		r.content = line + "\n"
+		return r, nil
+	case "dnf", "yum", "zypper":
+		dir := "/etc/yum.repos.d/"
+		var extra string
+		if m.name == "zypper" {
+			dir, extra = "/etc/zypp/repos.d/", "type=rpm-md\nautorefresh=1\n"
+		}
+		gpg := "gpgcheck=0\n"
+		if key != "" {
+			gpg = "gpgcheck=1\ngpgkey=" + key + "\n"
+		}
+		return pkgRepo{
+			file:    dir + name + ".repo",
+			content: "[" + name + "]\nname=" + name + "\nbaseurl=" + url + "\nenabled=1\n" + gpg + extra,
+		}, nil
+	case "apk":
+		r := pkgRepo{file: "/etc/apk/repositories", entry: url}
+		if key != "" {
+			// apk matches a signature to its key by file name.
+			r.keyFile = "/etc/apk/keys/" + path.Base(key)
+		}
+		return r, nil
+	case "pacman":
+		return pkgRepo{file: "/etc/pacman.conf", entry: "[" + name + "]"}, nil
+	}
+	return pkgRepo{}, fmt.Errorf("%s repositories are not supported", m.name)
+}
+
+// repoPresent reports whether the repository is configured as rendered.
+func (e *Executor) repoPresent(r pkgRepo) bool {
+	if r.content != "" {
+		return e.fileConverged(r.file, r.content, true)
+	}
+	return e.linePresent(r.file, r.entry, true)
+}
+
+// repoConfigured reports whether the repository is configured at all.
+func (e *Executor) repoConfigured(r pkgRepo) bool {
+	if r.content != "" {
+		return e.pathExists(r.file)
+	}
+	return e.linePresent(r.file, r.entry, true)
+}
+
+// ensureRepo adds or removes a repository, reporting whether anything
+// changed. A change refreshes the package index.
+func (e *Executor) ensureRepo(m *pkgManager, state, name, url, key string) (bool, error) {
+	r, err := e.repoFor(m, name, url, key)
+	if err != nil {
+		return false, err
+	}
+	switch state {
+	case "present":
+		keyMissing := r.keyFile != "" && !e.pathExists(r.keyFile)
+		if e.repoPresent(r) && !keyMissing {
+			return false, nil
+		}
+		if keyMissing {
+			if err := e.runSudo("mkdir -p " + shellEscape(path.Dir(r.keyFile)) + " && curl -fsSL " + shellEscape(key) + " -o " + shellEscape(r.keyFile)); err != nil {
+				return false, fmt.Errorf("install key: %w", err)
+			}
+		}
+		switch {
+		case r.content != "":
+			err = e.runSudo("printf '%s' " + shellEscape(r.content) + " > " + shellEscape(r.file))
+		case m.name == "pacman" && !e.repoConfigured(r):
+			err = e.pacmanAddRepo(name, url, key)
+		case m.name != "pacman" && !e.repoConfigured(r):
+			err = e.runSudo("printf '%s\\n' " + shellEscape(r.entry) + " >> " + shellEscape(r.file))
+		}
+		if err != nil {
+			return false, err
+		}
+	case "absent":
+		if !e.repoConfigured(r) {
+			return false, nil
+		}
+		switch {
+		case r.content != "":
+			err = e.runSudo("rm -f " + shellEscape(r.file))
+			if err == nil && r.keyFile != "" {
+				err = e.runSudo("rm -f " + shellEscape(r.keyFile))
+			}
+		case m.name == "pacman":
+			// Drop the [name] section up to the next section header.
+			err = e.runSudo("awk -v s=" + shellEscape(r.entry) + ` '/^\[/ {skip = ($0 == s)} !skip' ` + r.file + " > " + r.file + ".porter && cat " + r.file + ".porter > " + r.file + " && rm -f " + r.file + ".porter")
+		default:
+			err = e.runSudo("grep -vxF -- " + shellEscape(r.entry) + " " + r.file + " > " + r.file + ".porter; cat " + r.file + ".porter > " + r.file + " && rm -f " + r.file + ".porter")
+		}
+		if err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("unknown repository state %q", state)
+	}
+	return true, e.runSudo(m.refresh)
+}
+
+// pacmanAddRepo appends a [name] section to pacman.conf, first adding and
+// locally signing the repository's key if one is given.
+func (e *Executor) pacmanAddRepo(name, url, key string) error {
+	if key != "" {
+		tmp := "/tmp/porter-" + name + ".key"
+		cmd := "curl -fsSL " + shellEscape(key) + " -o " + tmp +
+			" && pacman-key --add " + tmp +
+			" && pacman-key --lsign-key \"$(gpg --with-colons --show-keys " + tmp + " | awk -F: '/^fpr/ {print $10; exit}')\"" +
+			"; rc=$?; rm -f " + tmp + "; exit $rc"
+		if err := e.runSudo(cmd); err != nil {
+			return fmt.Errorf("install key: %w", err)
+		}
+	}
+	section := "\n[" + name + "]\nServer = " + url + "\n"
+	return e.runSudo("printf '%s' " + shellEscape(section) + " >> /etc/pacman.conf")
+}
+
+// previewPkg is preview for the Pkg and PkgRepo actions.
+func (e *Executor) previewPkg(t Task, src, dest, body string) (bool, string) {
+	m, err := e.pkgManager()
+	if err != nil {
+		return true, t.Action + ": " + err.Error()
+	}
+	if t.Action == "pkg_repo" {
+		r, err := e.repoFor(m, dest, src, e.parseOpt(body, "key"))
+		if err != nil {
+			return true, "pkg_repo: " + err.Error()
+		}
+		if t.State == "absent" {
+			if !e.repoConfigured(r) {
+				return false, "pkg_repo: " + dest + " not configured"
+			}
+			return true, "pkg_repo: would remove " + dest
+		}
+		if e.repoPresent(r) && (r.keyFile == "" || e.pathExists(r.keyFile)) {
+			return false, "pkg_repo: " + dest + " configured"
+		}
+		return true, "pkg_repo: would add " + dest
+	}
+	pending, err := e.pkgPending(m, t.State, parsePkgSpecs(dest))
+	if err != nil {
+		return true, "pkg: " + err.Error()
+	}
+	if len(pending) == 0 {
+		return false, "pkg: " + dest + " already " + t.State
+	}
+	names := make([]string, len(pending))
+	for i, s := range pending {
+		names[i] = s.name
+	}
+	verb := map[string]string{"present": "install", "latest": "install or upgrade", "absent": "remove", "hold": "hold", "unhold": "unhold"}[t.State]
+	return true, "pkg: would " + verb + " " + strings.Join(names, " ") + " (" + m.name + ")"
+}
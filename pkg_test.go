@@ -0,0 +1,127 @@
+package porter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// pkgExec returns an executor on a host whose facts report manager, with
+// installed answering the package version query.
+func pkgExec(manager, installed string, extra ...rule) (*Executor, *fakeRunner) {
+	fr := &fakeRunner{rules: append([]rule{
+		{contains: "/etc/os-release", out: "os_ID=debian\nos_VERSION_CODENAME=bookworm\npkg=" + manager},
+		{contains: "for p in", out: installed},
+	}, extra...)}
+	return newTestExec(fr), fr
+}
+
+func TestPkgPresentInstallsOnlyMissing(t *testing.T) {
+	e, fr := pkgExec("dnf", "nginx 1.24.0-1.el9\ncurl ")
+	changed, err := e.exec(Pkg("nginx", "curl").Present().Build(), NewVars())
+	if err != nil || !changed {
+		t.Fatalf("changed=%v err=%v", changed, err)
+	}
+	if !fr.ran("dnf install -y 'curl'") || fr.ran("dnf install -y 'nginx'") {
+		t.Errorf("calls = %q", fr.calls)
+	}
+
+	e, fr = pkgExec("dnf", "nginx 1.24.0-1.el9\ncurl 8.5.0-1.el9")
+	changed, err = e.exec(Pkg("nginx", "curl").Present().Build(), NewVars())
+	if err != nil || changed || fr.ran("dnf install") {
+		t.Errorf("converged host: changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+}
+
+func TestPkgPinAndHold(t *testing.T) {
+	e, fr := pkgExec("apt", "nginx 1.22.1-1", rule{contains: "showhold", out: ""})
+	changed, err := e.exec(Pkg("nginx=1.24.0").Hold().Build(), NewVars())
+	if err != nil || !changed {
+		t.Fatalf("changed=%v err=%v", changed, err)
+	}
+	if !fr.ran("apt-get install -y --allow-downgrades 'nginx=1.24.0'") || !fr.ran("apt-mark hold 'nginx'") {
+		t.Errorf("calls = %q", fr.calls)
+	}
+
+	e, fr = pkgExec("apt", "nginx 1.24.0-1", rule{contains: "showhold", out: "nginx\n"})
+	changed, err = e.exec(Pkg("nginx=1.24.0").Hold().Build(), NewVars())
+	if err != nil || changed || fr.ran("apt-mark hold") {
+		t.Errorf("held at pin: changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+
+	e, _ = pkgExec("apk", "nginx 1.24.0-r7")
+	if _, err := e.exec(Pkg("nginx").Hold().Build(), NewVars()); err == nil || !strings.Contains(err.Error(), "apk cannot hold") {
+		t.Errorf("apk hold: err = %v", err)
+	}
+	e, _ = pkgExec("pacman", "nginx ")
+	if _, err := e.exec(Pkg("nginx=1.24.0").Present().Build(), NewVars()); err == nil || !strings.Contains(err.Error(), "pinned") {
+		t.Errorf("pacman pin: err = %v", err)
+	}
+}
+
+func TestPkgAbsentAndLatest(t *testing.T) {
+	e, fr := pkgExec("zypper", "telnet 1.2-1\nrsh ")
+	changed, err := e.exec(Pkg("telnet", "rsh").Absent().Build(), NewVars())
+	if err != nil || !changed || !fr.ran("zypper --non-interactive remove 'telnet'") || fr.ran("remove 'telnet' 'rsh'") {
+		t.Errorf("absent: changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+
+	// The version query answers the same before and after: nothing moved.
+	e, fr = pkgExec("apk", "nginx 1.24.0-r7")
+	changed, err = e.exec(Pkg("nginx").Latest().Build(), NewVars())
+	if err != nil || changed || !fr.ran("apk add --upgrade 'nginx'") {
+		t.Errorf("latest: changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+}
+
+func TestPkgRepoApt(t *testing.T) {
+	e, fr := pkgExec("apt", "", rule{contains: "test -e /etc/apt/keyrings/docker.asc", err: errors.New("missing")})
+	changed, err := e.exec(PkgRepo("docker", "https://download.docker.com/linux/debian").Key("https://download.docker.com/linux/debian/gpg").Present().Build(), NewVars())
+	if err != nil || !changed {
+		t.Fatalf("changed=%v err=%v", changed, err)
+	}
+	for _, want := range []string{
+		"curl -fsSL 'https://download.docker.com/linux/debian/gpg' -o '/etc/apt/keyrings/docker.asc'",
+		"deb [signed-by=/etc/apt/keyrings/docker.asc] https://download.docker.com/linux/debian bookworm main",
+		"> '/etc/apt/sources.list.d/docker.list'",
+		"apt-get update",
+	} {
+		if !fr.ran(want) {
+			t.Errorf("missing %q in %q", want, fr.calls)
+		}
+	}
+
+	content := "deb https://repo.example.com/apt stable main\n"
+	e, fr = pkgExec("apt", "", rule{contains: "sha256sum", out: sha256Hex(content)})
+	changed, err = e.exec(PkgRepo("example", "https://repo.example.com/apt stable").Present().Build(), NewVars())
+	if err != nil || changed || fr.ran("apt-get update") {
+		t.Errorf("configured repo: changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+}
+
+func TestPkgVersionMatches(t *testing.T) {
+	for _, tt := range []struct {
+		installed, want string
+		ok              bool
+	}{
+		{"1.24.0-1ubuntu1", "1.24.0", true},
+		{"1:1.24.0-1", "1.24.0", true},
+		{"1:1.24.0-1", "2:1.24.0-1", false},
+		{"16.4-1.pgdg120+1", "16.4*", true},
+		{"16.3-1", "16.4*", false},
+		{"1.24.0-r7", "1.24.0-r7", true},
+		{"1.24.01", "1.24.0", false},
+		{"", "", false},
+		{"1.0", "", true},
+	} {
+		if got := pkgVersionMatches(tt.installed, tt.want); got != tt.ok {
+			t.Errorf("pkgVersionMatches(%q, %q) = %v", tt.installed, tt.want, got)
+		}
+	}
+	if got := lockName("nginx-1:1.24.0-1.el9.*"); got != "nginx" {
+		t.Errorf("lockName = %q", got)
+	}
+	if got := lockName("python3-dnf-4.14.0-9.el9.*"); got != "python3-dnf" {
+		t.Errorf("lockName = %q", got)
+	}
+}
@@ -0,0 +1,395 @@
+package porter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// =============================================================================
+// PLAYBOOKS (declarative YAML / JSON)
+//
+// A playbook is the data form of a task list, for deploys authored without
+// Go. Each task names a registered action and sets the Task fields that
+// action reads — the same fields its Go builder fills in — plus the builder
+// options (sudo, retry, when, loop, register, failed_when, changed_when,
+// creates, mode, owner, ...):
+//
+//	version: 1
+//	name: deploy api
+//	gather_facts: true
+//	vars:
+//	  app: api
+//	  upstreams: [10.0.0.1, 10.0.0.2]
+//	tasks:
+//	  - action: upload
+//	    src: build/api
+//	    dest: /tmp/api
+//	  - action: install
+//	    src: /tmp/api
+//	    dest: /usr/local/bin/api
+//	    sudo: true
+//	  - action: service
+//	    dest: api
+//	    state: restart
+//	    sudo: true
+//	    when: env == "prod"
+//	  - block:
+//	      - {action: run, body: /opt/api/migrate}
+//	    rescue:
+//	      - {action: run, body: /opt/api/migrate --down}
+//	handlers:
+//	  - name: reload nginx
+//	    tasks:
+//	      - {action: service, dest: nginx, state: restart, sudo: true}
+//
+// when is an expression (see CompileWhen), or a text/template condition (see
+// IfTemplate) if it contains {{. JSON is accepted too (it is valid YAML).
+// Unknown keys, unregistered
+// actions, malformed durations or modes, unparsable conditions and notify
+// targets without a handler are all rejected at load time, each reported with
+// its path (tasks[2].retry_delay).
+// =============================================================================
+
+// PlaybookVersion is the playbook schema version this package reads.
+const PlaybookVersion = 1
+
+// Playbook is a parsed playbook document. GatherFacts runs GatherFacts
+// before the first task.
+type Playbook struct {
+	Version     int               `yaml:"version" json:"version"`
+	Name        string            `yaml:"name,omitempty" json:"name,omitempty"`
+	GatherFacts bool              `yaml:"gather_facts,omitempty" json:"gather_facts,omitempty"`
+	Vars        map[string]any    `yaml:"vars,omitempty" json:"vars,omitempty"`
+	Tasks       []PlaybookTask    `yaml:"tasks" json:"tasks"`
+	Handlers    []PlaybookHandler `yaml:"handlers,omitempty" json:"handlers,omitempty"`
+}
+
+// PlaybookHandler is a named handler (see Handler).
+type PlaybookHandler struct {
+	Name  string         `yaml:"name" json:"name"`
+	Tasks []PlaybookTask `yaml:"tasks" json:"tasks"`
+}
+
+// PlaybookTask is one task of a playbook. Action names a registered action;
+// Src, Dest, Body and State carry what its Go builder would put there, and
+// Options are appended to Body as the key:value pairs option-taking builders
+// produce; an action that takes none, or an option it does not read, is
+// rejected. Block (with Rescue and Always) replaces Action to group tasks.
+type PlaybookTask struct {
+	Name       string            `yaml:"name,omitempty" json:"name,omitempty"`
+	Action     string            `yaml:"action,omitempty" json:"action,omitempty"`
+	Src        string            `yaml:"src,omitempty" json:"src,omitempty"`
+	Dest       string            `yaml:"dest,omitempty" json:"dest,omitempty"`
+	Body       string            `yaml:"body,omitempty" json:"body,omitempty"`
+	State      string            `yaml:"state,omitempty" json:"state,omitempty"`
+	Options    map[string]string `yaml:"options,omitempty" json:"options,omitempty"`
+	Sudo       bool              `yaml:"sudo,omitempty" json:"sudo,omitempty"`
+	User       bool              `yaml:"user,omitempty" json:"user,omitempty"`
+	Recursive  bool              `yaml:"recursive,omitempty" json:"recursive,omitempty"`
+	Mode       string            `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Owner      string            `yaml:"owner,omitempty" json:"owner,omitempty"`
+	When       string            `yaml:"when,omitempty" json:"when,omitempty"`
+	Loop       []string          `yaml:"loop,omitempty" json:"loop,omitempty"`
+	Ignore     bool              `yaml:"ignore,omitempty" json:"ignore,omitempty"`
+	Retry      int               `yaml:"retry,omitempty" json:"retry,omitempty"`
+	RetryDelay string            `yaml:"retry_delay,omitempty" json:"retry_delay,omitempty"`
+	Timeout    string            `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Deadline   string            `yaml:"deadline,omitempty" json:"deadline,omitempty"`
+	Register   string            `yaml:"register,omitempty" json:"register,omitempty"`
+	Creates    string            `yaml:"creates,omitempty" json:"creates,omitempty"`
+	StdinFile  string            `yaml:"stdin_file,omitempty" json:"stdin_file,omitempty"`
+	Sensitive  bool              `yaml:"sensitive,omitempty" json:"sensitive,omitempty"`
+	Notify     []string          `yaml:"notify,omitempty" json:"notify,omitempty"`
+	Block      []PlaybookTask    `yaml:"block,omitempty" json:"block,omitempty"`
+	Rescue     []PlaybookTask    `yaml:"rescue,omitempty" json:"rescue,omitempty"`
+	Always     []PlaybookTask    `yaml:"always,omitempty" json:"always,omitempty"`
+
+	FailedWhen  string `yaml:"failed_when,omitempty" json:"failed_when,omitempty"`
+	ChangedWhen string `yaml:"changed_when,omitempty" json:"changed_when,omitempty"`
+
+	Match        string `yaml:"match,omitempty" json:"match,omitempty"`
+	InsertAfter  string `yaml:"insert_after,omitempty" json:"insert_after,omitempty"`
+	InsertBefore string `yaml:"insert_before,omitempty" json:"insert_before,omitempty"`
+	Validate     string `yaml:"validate,omitempty" json:"validate,omitempty"`
+	Backup       bool   `yaml:"backup,omitempty" json:"backup,omitempty"`
+
+	Checksum string   `yaml:"checksum,omitempty" json:"checksum,omitempty"`
+	Headers  []string `yaml:"headers,omitempty" json:"headers,omitempty"`
+
+	BecomeUser string `yaml:"become_user,omitempty" json:"become_user,omitempty"`
+}
+
+// LoadPlaybook reads, validates and compiles the playbook at path.
+func LoadPlaybook(path string) ([]Task, error) {
+	p, err := ReadPlaybook(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.Compile()
+}
+
+// ReadPlaybook reads and parses the playbook at path without compiling it,
+// for callers that also want its Name or Vars.
+func ReadPlaybook(path string) (*Playbook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePlaybook(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// ParsePlaybook parses a YAML or JSON playbook, rejecting unknown keys and an
+// unsupported version.
+func ParsePlaybook(data []byte) (*Playbook, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var p Playbook
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("playbook: %w", err)
+	}
+	switch p.Version {
+	case PlaybookVersion:
+	case 0:
+		return nil, fmt.Errorf("playbook: version is required (current: %d)", PlaybookVersion)
+	default:
+		return nil, fmt.Errorf("playbook: unsupported version %d (this porter reads %d)", p.Version, PlaybookVersion)
+	}
+	return &p, nil
+}
+
+// Compile validates the playbook and converts it to Tasks, handlers
+// included. Every problem found is reported, not just the first.
+func (p *Playbook) Compile() ([]Task, error) {
+	var errs []error
+	tasks := compileTasks("tasks", p.Tasks, &errs)
+	if p.GatherFacts {
+		tasks = append([]Task{GatherFacts().Build()}, tasks...)
+	}
+
+	var handlers []Task
+	for i, h := range p.Handlers {
+		path := fmt.Sprintf("handlers[%d]", i)
+		if h.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name: required", path))
+		}
+		handlers = append(handlers, Task{Action: "handler", Name: h.Name, Tasks: compileTasks(path+".tasks", h.Tasks, &errs)})
+	}
+	if err := checkNotify(tasks, handlers); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("playbook: %w", errors.Join(errs...))
+	}
+	return append(tasks, handlers...), nil
+}
+
+// NewVars returns Vars holding the playbook's vars: strings as-is, lists and
+// maps as structured values (see Vars.SetValue), other scalars formatted.
+func (p *Playbook) NewVars() *Vars {
+	vars := NewVars()
+	for k, val := range p.Vars {
+		vars.setAny(k, val)
+	}
+	return vars
+}
+
+// Task validates and converts a single playbook task.
+func (pt PlaybookTask) Task() (Task, error) {
+	var errs []error
+	t := pt.compile("task", &errs)
+	if len(errs) > 0 {
+		return Task{}, errors.Join(errs...)
+	}
+	return t, nil
+}
+
+func compileTasks(path string, pts []PlaybookTask, errs *[]error) []Task {
+	tasks := make([]Task, len(pts))
+	for i, pt := range pts {
+		tasks[i] = pt.compile(fmt.Sprintf("%s[%d]", path, i), errs)
+	}
+	return tasks
+}
+
+// playbookModeRe accepts octal modes like 644 or 0755.
+var playbookModeRe = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+func (pt PlaybookTask) compile(path string, errs *[]error) Task {
+	fail := func(field, format string, args ...any) {
+		*errs = append(*errs, fmt.Errorf("%s.%s: %s", path, field, fmt.Sprintf(format, args...)))
+	}
+
+	t := Task{
+		Name:      pt.Name,
+		Action:    pt.Action,
+		Src:       pt.Src,
+		Dest:      pt.Dest,
+		Body:      pt.Body,
+		State:     pt.State,
+		User:      pt.User,
+		Sudo:      pt.Sudo,
+		Rec:       pt.Recursive,
+		Perm:      pt.Mode,
+		Own:       pt.Owner,
+		Loop:      pt.Loop,
+		Ignore:    pt.Ignore,
+		Retry:     pt.Retry,
+		Register:  pt.Register,
+		Creates:   pt.Creates,
+		StdinFile: pt.StdinFile,
+		Sensitive: pt.Sensitive,
+		Notify:    pt.Notify,
+
+		FailedWhen:  pt.FailedWhen,
+		ChangedWhen: pt.ChangedWhen,
+
+		Match:        pt.Match,
+		InsertAfter:  pt.InsertAfter,
+		InsertBefore: pt.InsertBefore,
+		Validate:     pt.Validate,
+		Backup:       pt.Backup,
+
+		Checksum: pt.Checksum,
+		Headers:  pt.Headers,
+
+		BecomeUser: pt.BecomeUser,
+	}
+	if pt.BecomeUser != "" {
+		t.Sudo = true
+	}
+
+	switch {
+	case len(pt.Block) > 0:
+		if pt.Action != "" {
+			fail("action", "a task has either an action or a block, not both")
+		}
+		t.Action = "block"
+		if t.Name == "" {
+			t.Name = "Block"
+		}
+		t.Tasks = compileTasks(path+".block", pt.Block, errs)
+		t.Rescue = compileTasks(path+".rescue", pt.Rescue, errs)
+		t.Always = compileTasks(path+".always", pt.Always, errs)
+	case len(pt.Rescue) > 0 || len(pt.Always) > 0:
+		fail("block", "rescue and always need a block")
+	case pt.Action == "":
+		fail("action", "required")
+	case pt.Action == "block":
+		fail("action", "write a block as the block key")
+	case pt.Action == "handler":
+		fail("action", "define handlers in the top-level handlers list")
+	case pt.Action != "flush_handlers" && actionHandlers[pt.Action] == nil:
+		fail("action", "unknown action %q", pt.Action)
+	}
+
+	if len(pt.Options) > 0 {
+		keys := make([]string, 0, len(pt.Options))
+		for k := range pt.Options {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		accepted, ok := actionOptions[t.Action]
+		if !ok && t.Action != "" {
+			fail("options", "%s takes no options", t.Action)
+		}
+		b := TaskBuilder{t}
+		for _, k := range keys {
+			if ok && !slices.Contains(accepted, k) {
+				fail("options."+k, "not an option of %s", t.Action)
+			}
+			b = b.appendOpt(k, pt.Options[k])
+		}
+		t = b.t
+	}
+
+	if t.Name == "" {
+		t.Name = t.Action
+		for _, s := range []string{t.Dest, t.Src, t.Body} {
+			if s != "" {
+				t.Name += " " + s
+				break
+			}
+		}
+	}
+	if pt.Mode != "" && !strings.Contains(pt.Mode, "{{") && !playbookModeRe.MatchString(pt.Mode) {
+		fail("mode", "%q is not an octal file mode", pt.Mode)
+	}
+	if pt.Retry < 0 {
+		fail("retry", "must not be negative")
+	}
+	for _, d := range []struct {
+		field, src string
+		dst        *time.Duration
+	}{
+		{"retry_delay", pt.RetryDelay, &t.Delay},
+		{"timeout", pt.Timeout, &t.Timeout},
+		{"deadline", pt.Deadline, &t.Deadline},
+	} {
+		if d.src == "" {
+			continue
+		}
+		dur, err := time.ParseDuration(d.src)
+		if err != nil {
+			fail(d.field, "%q is not a duration", d.src)
+			continue
+		}
+		*d.dst = dur
+	}
+	if pt.When != "" {
+		t.WhenExpr = pt.When
+		if strings.Contains(pt.When, "{{") {
+			if _, err := NewVars().parseTemplate(pt.When); err != nil {
+				fail("when", "%v", err)
+			} else {
+				t.When = IfTemplate(pt.When)
+			}
+		} else if w, err := CompileWhen(pt.When); err != nil {
+			fail("when", "%v", err)
+		} else {
+			t.When = w
+		}
+	}
+	for _, p := range []struct{ field, src string }{{"failed_when", pt.FailedWhen}, {"changed_when", pt.ChangedWhen}} {
+		if p.src == "" {
+			continue
+		}
+		if _, err := CompileWhen(p.src); err != nil {
+			fail(p.field, "%v", err)
+		}
+	}
+	for _, p := range []struct{ field, src string }{{"match", pt.Match}, {"insert_after", pt.InsertAfter}, {"insert_before", pt.InsertBefore}} {
+		if _, err := compileAnchor(p.src); err != nil && !strings.Contains(p.src, "{{") {
+			fail(p.field, "%v", err)
+		}
+	}
+	if pt.Validate != "" && !strings.Contains(pt.Validate, "%s") {
+		fail("validate", "must contain %%s, the staged file's path")
+	}
+	if pt.Action == "fetch" && !strings.Contains(pt.Checksum, "{{") {
+		if _, err := parseChecksum(pt.Checksum); err != nil {
+			fail("checksum", "%v", err)
+		}
+	}
+	for _, h := range pt.Headers {
+		if name, _, ok := strings.Cut(h, ":"); !ok || strings.TrimSpace(name) == "" {
+			fail("headers", "%q is not \"Name: value\"", h)
+		}
+	}
+	if slices.Contains(pt.Notify, "") {
+		fail("notify", "empty handler name")
+	}
+	return t
+}
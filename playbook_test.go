@@ -0,0 +1,158 @@
+package porter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPlaybook = `
+version: 1
+name: deploy api
+vars:
+  env: prod
+  upstreams: [10.0.0.1, 10.0.0.2]
+tasks:
+  - action: upload
+    src: build/api
+    dest: /tmp/api
+  - action: install
+    src: /tmp/api
+    dest: /usr/local/bin/api
+    sudo: true
+    mode: "0755"
+    retry: 2
+    retry_delay: 3s
+    notify: [restart api]
+  - action: run
+    body: echo {{item}}
+    loop: [a, b]
+    when: '{{eq .env "prod"}}'
+  - action: docker
+    dest: web
+    state: run
+    src: nginx:1.27
+    options: {restart: always}
+  - block:
+      - {action: run, body: migrate}
+    rescue:
+      - {action: run, body: migrate --down}
+handlers:
+  - name: restart api
+    tasks:
+      - {action: service, dest: api, state: restart, sudo: true}
+`
+
+func TestLoadPlaybookMapsFieldsAndOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deploy.yml")
+	if err := os.WriteFile(path, []byte(testPlaybook), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := LoadPlaybook(path)
+	if err != nil {
+		t.Fatalf("LoadPlaybook: %v", err)
+	}
+	if len(tasks) != 6 {
+		t.Fatalf("got %d tasks, want 5 + 1 handler", len(tasks))
+	}
+	install := tasks[1]
+	if !install.Sudo || install.Perm != "0755" || install.Retry != 2 || install.Delay != 3*time.Second || install.Notify[0] != "restart api" {
+		t.Errorf("install task = %+v", install)
+	}
+	if tasks[2].When == nil || len(tasks[2].Loop) != 2 {
+		t.Errorf("when/loop not mapped: %+v", tasks[2])
+	}
+	if tasks[3].Body != "restart:always" || tasks[3].Src != "nginx:1.27" {
+		t.Errorf("options body = %q", tasks[3].Body)
+	}
+	if tasks[4].Action != "block" || len(tasks[4].Rescue) != 1 {
+		t.Errorf("block = %+v", tasks[4])
+	}
+	if tasks[5].Action != "handler" || tasks[5].Name != "restart api" {
+		t.Errorf("handler = %+v", tasks[5])
+	}
+}
+
+func TestPlaybookRunsThroughExecutor(t *testing.T) {
+	p, err := ParsePlaybook([]byte(testPlaybook))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := p.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := p.NewVars()
+	if v, _ := vars.Value("upstreams"); len(v.([]any)) != 2 {
+		t.Errorf("structured var upstreams = %v", v)
+	}
+	e := newTestExec(&fakeRunner{})
+	e.SetDryRun(true)
+	if _, err := e.Run(p.Name, tasks, vars); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+}
+
+func TestParsePlaybookJSON(t *testing.T) {
+	p, err := ParsePlaybook([]byte(`{"version": 1, "tasks": [{"action": "mkdir", "dest": "/opt/app"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := p.Compile()
+	if err != nil || tasks[0].Name != "mkdir /opt/app" {
+		t.Errorf("tasks = %+v, err = %v", tasks, err)
+	}
+}
+
+func TestPlaybookValidation(t *testing.T) {
+	if _, err := ParsePlaybook([]byte("tasks: []")); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("missing version: %v", err)
+	}
+	if _, err := ParsePlaybook([]byte("version: 1\ntasks:\n  - action: run\n    sudoo: true\n")); err == nil {
+		t.Error("unknown key must be rejected")
+	}
+
+	p, err := ParsePlaybook([]byte(`
+version: 1
+tasks:
+  - action: frobnicate
+  - action: run
+    body: x
+    mode: "rwx"
+    retry_delay: soon
+    when: '{{eq .env'
+    notify: [missing]
+  - rescue: [{action: run, body: x}]
+  - action: write
+    dest: /etc/motd
+    body: hello
+    options: {mode: "0644"}
+  - action: upload
+    src: api
+    dest: /tmp/api
+    options: {compress: "true", gzip: "9"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Compile()
+	if err == nil {
+		t.Fatal("invalid playbook compiled")
+	}
+	for _, want := range []string{
+		`tasks[0].action: unknown action "frobnicate"`,
+		"tasks[1].mode",
+		"tasks[1].retry_delay",
+		"tasks[1].when",
+		`undefined handler "missing"`,
+		"tasks[2].block: rescue and always need a block",
+		"tasks[3].options: write takes no options",
+		"tasks[4].options.gzip: not an option of upload",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not report %q:\n%v", want, err)
+		}
+	}
+}
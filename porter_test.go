@@ -1,6 +1,7 @@
 package porter
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -105,6 +106,81 @@ func TestVars_Expand(t *testing.T) {
 	}
 }
 
+func TestVars_ExpandTemplates(t *testing.T) {
+	vars := NewVars().SetTemplates(true)
+	vars.Set("name", "api")
+	vars.Set("secret", "s3cr3t")
+	vars.SetValue("hosts", []string{"a", "b"})
+	vars.SetValue("db", map[string]any{"host": "db1", "port": 5432})
+	vars.Item = "x"
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"{{.name | upper}}", "API"},
+		{"{{.env | default \"staging\"}}", "staging"},
+		{"{{.secret | b64}}", "czNjcjN0"},
+		{"{{\"it's\" | quote}}", `'it'\''s'`},
+		{"{{.hosts | join \",\"}}", "a,b"},
+		{"{{range .hosts}}[{{.}}]{{end}}", "[a][b]"},
+		{"{{.db.host}}:{{.db.port}}", "db1:5432"},
+		{"{{.db | toJSON}}", `{"host":"db1","port":5432}`},
+		{"{{item}}-{{.item}}", "x-x"},
+		{"{{if eq .name \"api\"}}yes{{end}}", "yes"},
+		{"[{{.missing}}]", "[]"},
+		{"[{{.db.user}}][{{.nope.deep}}]", "[][]"},
+		{"[{{.missing | default \"d\"}}]", "[d]"},
+		{"echo '<no value>' {{.name}}", "echo '<no value>' api"},
+		{"{{.name}} {{\"<no value>\"}}", "api <no value>"},
+	}
+	for _, tt := range tests {
+		got, err := vars.Render(tt.input)
+		if err != nil || got != tt.expected {
+			t.Errorf("Render(%q) = %q, %v; want %q", tt.input, got, err, tt.expected)
+		}
+	}
+	if db, _ := vars.Value("db"); len(db.(map[string]any)) != 2 {
+		t.Errorf("rendering wrote into the vars: db = %v", db)
+	}
+	if got := NewVars().SetValue("hosts", []string{"a"}).Expand("{{hosts}}"); got != `["a"]` {
+		t.Errorf("plain expansion of a list = %q, want JSON", got)
+	}
+}
+
+func TestVars_Strict(t *testing.T) {
+	plain := NewVars().SetStrict(true).Set("name", "api")
+	if _, err := plain.Render("{{name}} {{version}} --format '{{.Names}}'"); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("plain strict: err = %v, want undefined version", err)
+	}
+	tmpl := NewVars().SetTemplates(true).SetStrict(true).Set("name", "api")
+	if _, err := tmpl.Render("{{.name}} {{.version}}"); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("template strict: err = %v, want undefined version", err)
+	}
+	tmpl.SetValue("servers", []map[string]string{{"addr": "10.0.0.1"}})
+	for _, ok := range []string{`{{.version | default "1"}}`, `{{range .servers}}{{.addr}}{{end}}`, "{{item}}"} {
+		if _, err := tmpl.Render(ok); err != nil {
+			t.Errorf("Render(%q): %v", ok, err)
+		}
+	}
+}
+
+func TestStrictFailsTaskOnUndefinedWhenAndFields(t *testing.T) {
+	fr := &fakeRunner{}
+	vars := NewVars().SetStrict(true)
+	_, err := newTestExec(fr).Run("deploy", Tasks(Run("x").When(IfEquals("env", "prod"))), vars)
+	if err == nil || !strings.Contains(err.Error(), "env") {
+		t.Errorf("When on undefined var: err = %v", err)
+	}
+	stats, err := newTestExec(fr).Run("deploy", Tasks(Run("echo {{nope}}"), Run("next")), vars)
+	if err == nil || stats.Failed != 1 || len(fr.calls) != 0 {
+		t.Errorf("undefined field: err=%v stats=%+v calls=%q", err, stats, fr.calls)
+	}
+	if _, err := newTestExec(fr).Run("deploy", Tasks(Run("x").When(IfNotSet("nope"))), vars); err != nil {
+		t.Errorf("IfNotSet must not trip strict mode: %v", err)
+	}
+}
+
 // =============================================================================
 // CONDITIONS TESTS
 // =============================================================================
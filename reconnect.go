@@ -0,0 +1,272 @@
+package porter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/melbahja/goph"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// =============================================================================
+// RECONNECT
+// =============================================================================
+//
+// An Executor built with NewExecutorDial (or given a dialer with SetDialer)
+// survives a dropped SSH link — an sshd restart, a NAT timeout, a reboot.
+// When a command, session or SFTP channel fails because the connection is
+// gone, the executor redials with backoff (up to SetReconnectTimeout) and
+// restarts its keepalives. A command that never started is then retried; one
+// that was cut off mid-run still fails, since whether it took effect is
+// unknown, and the task's own Retry decides what happens next. Later tasks
+// run on the new connection.
+//
+// Reboot().WaitForReconnect("5m") reboots and blocks until the host is back:
+// it redials until a connection succeeds and the kernel's boot ID differs
+// from the one read before the reboot.
+
+// defaultReconnectTimeout bounds the redial loop when SetReconnectTimeout was
+// not called.
+const defaultReconnectTimeout = 2 * time.Minute
+
+// defaultRebootTimeout is WaitForReconnect's timeout when none is parsed.
+const defaultRebootTimeout = 5 * time.Minute
+
+// rebootPoll is how often WaitForReconnect checks whether the host is back.
+var rebootPoll = 2 * time.Second
+
+// bootIDCmd prints the kernel's per-boot random ID.
+const bootIDCmd = "cat /proc/sys/kernel/random/boot_id"
+
+// NewExecutorDial creates an Executor that connects with dial and redials
+// with it whenever the connection drops. Call Close when done.
+func NewExecutorDial(dial func() (*goph.Client, error), password string) (*Executor, error) {
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	e := NewExecutor(client, password).SetDialer(dial)
+	e.ownsClient = true
+	return e, nil
+}
+
+// SetDialer lets the executor redial with dial when its connection drops.
+// The client it was created with stays the caller's to close; clients the
+// executor dials itself are closed by Close.
+func (e *Executor) SetDialer(dial func() (*goph.Client, error)) *Executor { e.dial = dial; return e }
+
+// SetReconnectTimeout bounds how long a dropped connection is redialled
+// before the command fails (default 2m).
+func (e *Executor) SetReconnectTimeout(d time.Duration) *Executor { e.reconnectTimeout = d; return e }
+
+// SetKeepalive sends keepalives every interval (see StartKeepalive), and
+// restarts them on every new connection. 0 stops them.
+func (e *Executor) SetKeepalive(interval time.Duration) *Executor {
+	e.keepalive = interval
+	e.restartKeepalive()
+	return e
+}
+
+func (e *Executor) restartKeepalive() {
+	if e.stopKeepalive != nil {
+		e.stopKeepalive()
+		e.stopKeepalive = nil
+	}
+	if e.keepalive > 0 {
+		e.stopKeepalive = StartKeepalive(e.client, e.keepalive)
+	}
+}
+
+// Close stops the keepalives, ends the persistent session if there is one,
+// and closes the connection if the executor dialled it.
+func (e *Executor) Close() error {
+	if e.stopKeepalive != nil {
+		e.stopKeepalive()
+		e.stopKeepalive = nil
+	}
+	if r, ok := e.runner.(*shellRunner); ok {
+		r.close()
+	}
+	if e.ownsClient && e.client != nil {
+		return e.client.Close()
+	}
+	return nil
+}
+
+// noSessionError marks a failure to open a session or channel: the command
+// never started, so it is safe to run again on a new connection.
+type noSessionError struct{ err error }
+
+func (e *noSessionError) Error() string { return e.err.Error() }
+func (e *noSessionError) Unwrap() error { return e.err }
+
+// connLost reports whether err means the SSH connection itself is gone, as
+// opposed to a command failing on a live one.
+func connLost(err error) bool {
+	var exitMissing *ssh.ExitMissingError
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.As(err, &exitMissing), errors.As(err, &opErr):
+		return true
+	}
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// withConn runs op, and when it fails because the connection dropped,
+// redials; op is run again only if it never got a session.
+func (e *Executor) withConn(op func() error) error {
+	err := e.roundTrip(op)
+	if e.dial == nil || !connLost(err) || e.taskCtx().Err() != nil {
+		return err
+	}
+	if rerr := e.reconnect(e.reconnectTimeout); rerr != nil {
+		return fmt.Errorf("%w (reconnect failed: %v)", err, rerr)
+	}
+	var ns *noSessionError
+	if !errors.As(err, &ns) {
+		return err
+	}
+	return e.roundTrip(op)
+}
+
+// roundTrip runs op, counting it against the task in flight.
+func (e *Executor) roundTrip(op func() error) error {
+	if e.inflight != nil {
+		e.inflight.RoundTrips++
+	}
+	return op()
+}
+
+// reconnect redials with backoff until a connection is made or timeout (the
+// default when 0) passes, and adopts it.
+func (e *Executor) reconnect(timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultReconnectTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	delay := 500 * time.Millisecond
+	for {
+		c, err := e.dial()
+		if err == nil {
+			e.adopt(c)
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("no connection within %s: %w", timeout, err)
+		}
+		if serr := e.sleep(delay); serr != nil {
+			return serr
+		}
+		delay = min(delay*2, 10*time.Second)
+	}
+}
+
+// adopt switches the executor to client c, closing the one it replaces if
+// the executor dialled it.
+func (e *Executor) adopt(c *goph.Client) {
+	if e.ownsClient && e.client != nil {
+		_ = e.client.Close()
+	}
+	e.client, e.ownsClient = c, true
+	switch r := e.runner.(type) {
+	case sshRunner:
+		e.runner = sshRunner{c}
+	case *shellRunner:
+		r.close()
+		e.runner = newShellRunner(c)
+	}
+	e.restartKeepalive()
+	if e.verbose {
+		log.Printf("    \033[36mreconnected\033[0m")
+	}
+}
+
+// newSession opens an SSH session, redialling first if the link is gone.
+func (e *Executor) newSession() (*ssh.Session, error) {
+	var s *ssh.Session
+	err := e.withConn(func() error {
+		var err error
+		s, err = e.client.NewSession()
+		if err != nil {
+			return &noSessionError{err}
+		}
+		return nil
+	})
+	return s, err
+}
+
+// newSftp opens an SFTP client, redialling first if the link is gone.
+func (e *Executor) newSftp() (*sftp.Client, error) {
+	var ftp *sftp.Client
+	err := e.withConn(func() error {
+		var err error
+		ftp, err = e.client.NewSftp()
+		if err != nil {
+			return &noSessionError{err}
+		}
+		return nil
+	})
+	return ftp, err
+}
+
+// WaitForReconnect makes a Reboot block until the host is back, up to d
+// (a duration such as "5m"): the executor redials until it connects to a
+// host whose boot ID changed. It needs a dialer (NewExecutorDial or
+// SetDialer).
+func (b TaskBuilder) WaitForReconnect(d string) TaskBuilder {
+	if dur, err := time.ParseDuration(d); err == nil {
+		b.t.Timeout = dur
+	}
+	return b.appendOpt("wait", "true")
+}
+
+// reboot reboots the host and, with wait, blocks until it is back on a new
+// boot.
+func (e *Executor) reboot(wait bool, timeout time.Duration) error {
+	if !wait {
+		return e.runSudo("reboot")
+	}
+	if e.dial == nil {
+		return errors.New("reboot: WaitForReconnect needs a dialer (NewExecutorDial or SetDialer)")
+	}
+	if timeout <= 0 {
+		timeout = defaultRebootTimeout
+	}
+	before, err := e.runCapture(bootIDCmd)
+	if err != nil {
+		return fmt.Errorf("reboot: read boot id: %w", err)
+	}
+	// The link usually drops before reboot reports back.
+	if _, err := e.runner.Run(e.taskCtx(), e.sudo("reboot")); err != nil && !connLost(err) {
+		return fmt.Errorf("reboot: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := e.sleep(rebootPoll); err != nil {
+			return err
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("reboot: host not back on a new boot within %s", timeout)
+		}
+		if err := e.reconnect(left); err != nil {
+			return fmt.Errorf("reboot: %w", err)
+		}
+		// Until the host goes down, a redial can still reach the old boot.
+		if after, err := e.runner.Run(e.taskCtx(), bootIDCmd); err == nil && strings.TrimSpace(string(after)) != before {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package porter
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/melbahja/goph"
+	"golang.org/x/crypto/ssh"
+)
+
+// funcRunner answers each command with fn, recording it.
+type funcRunner struct {
+	calls []string
+	fn    func(cmd string) ([]byte, error)
+}
+
+func (r *funcRunner) Run(ctx context.Context, cmd string) ([]byte, error) {
+	r.calls = append(r.calls, unwrapSudo(cmd))
+	return r.fn(unwrapSudo(cmd))
+}
+
+func dialCounter(n *int) func() (*goph.Client, error) {
+	return func() (*goph.Client, error) { *n++; return nil, nil }
+}
+
+func TestReconnectRetriesCommandThatNeverStarted(t *testing.T) {
+	dropped := true
+	r := &funcRunner{fn: func(cmd string) ([]byte, error) {
+		if dropped {
+			dropped = false
+			return nil, &noSessionError{io.EOF}
+		}
+		return nil, nil
+	}}
+	var dials int
+	e := (&Executor{runner: r}).SetDialer(dialCounter(&dials))
+	if _, err := e.Run("deploy", Tasks(Run("systemctl restart app")), NewVars()); err != nil {
+		t.Fatal(err)
+	}
+	if dials != 1 || len(r.calls) != 2 {
+		t.Errorf("dials=%d calls=%q", dials, r.calls)
+	}
+}
+
+func TestReconnectRetriesFileProbes(t *testing.T) {
+	dropped := map[string]bool{}
+	r := &funcRunner{fn: func(cmd string) ([]byte, error) {
+		if !dropped[cmd] {
+			dropped[cmd] = true
+			return nil, &noSessionError{io.EOF}
+		}
+		return []byte("PORT=80\n"), nil
+	}}
+	var dials int
+	e := (&Executor{runner: r}).SetDialer(dialCounter(&dials))
+	if !e.pathExists("'/etc/app.env'") {
+		t.Error("pathExists read a dropped link as missing")
+	}
+	content, exists, err := e.readRemote("/etc/app.env", false)
+	if err != nil || !exists || content != "PORT=80\n" {
+		t.Errorf("readRemote = %q, %v, %v", content, exists, err)
+	}
+	if dials != 2 {
+		t.Errorf("dials = %d, want a redial per probe", dials)
+	}
+}
+
+func TestReconnectDoesNotRerunInterruptedCommand(t *testing.T) {
+	r := &funcRunner{fn: func(cmd string) ([]byte, error) {
+		if strings.Contains(cmd, "migrate") {
+			return nil, &ssh.ExitMissingError{}
+		}
+		return nil, nil
+	}}
+	var dials int
+	e := (&Executor{runner: r}).SetDialer(dialCounter(&dials))
+	_, err := e.Run("deploy", Tasks(Run("./migrate").Ignore(), Run("systemctl restart app")), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dials != 1 || len(r.calls) != 2 {
+		t.Errorf("dials=%d calls=%q", dials, r.calls)
+	}
+
+	// Without a dialer the error is the command's, as before.
+	if err := (&Executor{runner: r}).run("./migrate"); !connLost(err) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestRebootWaitsForNewBootID(t *testing.T) {
+	defer func(d time.Duration) { rebootPoll = d }(rebootPoll)
+	rebootPoll = time.Millisecond
+
+	boots := []string{"boot-a", "boot-a", "boot-b"} // before, old boot still up, new boot
+	r := &funcRunner{fn: func(cmd string) ([]byte, error) {
+		switch {
+		case cmd == bootIDCmd:
+			id := boots[0]
+			boots = boots[1:]
+			return []byte(id + "\n"), nil
+		case cmd == "reboot":
+			return nil, io.EOF
+		}
+		return nil, nil
+	}}
+	var dials int
+	e := (&Executor{runner: r}).SetDialer(dialCounter(&dials))
+	if _, err := e.Run("patch", Tasks(Reboot().WaitForReconnect("1m"), Run("uptime")), NewVars()); err != nil {
+		t.Fatal(err)
+	}
+	if dials != 2 || len(boots) != 0 || r.calls[len(r.calls)-1] != "uptime" {
+		t.Errorf("dials=%d calls=%q", dials, r.calls)
+	}
+
+	_, err := (&Executor{runner: r}).Run("patch", Tasks(Reboot().WaitForReconnect("1m")), NewVars())
+	if err == nil || !strings.Contains(err.Error(), "needs a dialer") {
+		t.Errorf("err = %v", err)
+	}
+}
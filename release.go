@@ -56,6 +56,12 @@ func (r *Release) HealthCheck(cmd string) *Release { r.health = cmd; return r }
 // output, extracted archive) into this path.
 func (r *Release) Dir() string { return r.releaseDir }
 
+// Unarchive returns a task extracting src into the release directory: a
+// local archive, or one already on the host with .RemoteSrc().
+func (r *Release) Unarchive(src string) TaskBuilder {
+	return r.maybeSudo(Unarchive(src, r.releaseDir))
+}
+
 // Current is the live symlink path (point your systemd unit / web root here).
 func (r *Release) Current() string { return r.base + "/current" }
 
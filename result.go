@@ -0,0 +1,199 @@
+package porter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// REGISTERED RESULTS
+//
+// Run, Capture and CaptureSudo record a Result for their command: stdout and
+// stderr kept apart, the exit code, whether the task changed anything, and
+// its timing. With .Register(name) the record is stored as a structured var,
+// addressable from templates and conditions:
+//
+//	porter.Run("systemctl is-enabled app").Register("enabled").Ignore(),
+//	porter.Run("systemctl enable app").WhenExpr(`enabled.rc != 0`),
+//	porter.Run("echo rc={{enabled.rc}} out={{enabled}}"),   // {{enabled}} is stdout+stderr
+//
+// FailedWhen and ChangedWhen replace the default judgement — fail on a
+// non-zero exit, change unless the action is read-only — with an expression
+// over the record's fields (stdout, stderr, rc, ...), which are in scope
+// by name:
+//
+//	porter.Run("grep -q app /etc/hosts").FailedWhen(`rc > 1`).ChangedWhen(`false`)
+//	porter.Run("createuser app").FailedWhen(`rc != 0 && "already exists" not in stderr`)
+// =============================================================================
+
+// Result is the record of a command task.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	RC       int // exit code; -1 when the command did not report one (connection lost)
+	Changed  bool
+	Failed   bool
+	Duration time.Duration
+	Start    time.Time
+	End      time.Time
+}
+
+// registered is a Result as stored in Vars: a map, so templates and
+// expressions reach its fields by name ({{.r.rc}}, r.stderr). It reads as the
+// command's whole output wherever a plain string is expected, as a captured
+// output always has ({{r}}, Vars.Get): stdout, then stderr.
+type registered map[string]any
+
+func (r registered) String() string {
+	stdout, _ := r["stdout"].(string)
+	stderr, _ := r["stderr"].(string)
+	if stdout == "" || stderr == "" {
+		return stdout + stderr
+	}
+	return stdout + "\n" + stderr
+}
+
+func (r Result) value() registered {
+	return registered{
+		"stdout":   r.Stdout,
+		"stderr":   r.Stderr,
+		"rc":       r.RC,
+		"changed":  r.Changed,
+		"failed":   r.Failed,
+		"duration": r.Duration.Seconds(),
+		"start":    r.Start.Format(time.RFC3339Nano),
+		"end":      r.End.Format(time.RFC3339Nano),
+	}
+}
+
+// Result returns the record registered under name by a command task. ok is
+// false if name is not set or holds something else.
+func (v *Vars) Result(name string) (r Result, ok bool) {
+	val, _ := v.values[name].(registered)
+	if val == nil {
+		return Result{}, false
+	}
+	r.Stdout, _ = val["stdout"].(string)
+	r.Stderr, _ = val["stderr"].(string)
+	r.RC, _ = val["rc"].(int)
+	r.Changed, _ = val["changed"].(bool)
+	r.Failed, _ = val["failed"].(bool)
+	secs, _ := val["duration"].(float64)
+	r.Duration = time.Duration(secs * float64(time.Second))
+	start, _ := val["start"].(string)
+	end, _ := val["end"].(string)
+	r.Start, _ = time.Parse(time.RFC3339Nano, start)
+	r.End, _ = time.Parse(time.RFC3339Nano, end)
+	return r, true
+}
+
+// FailedWhen fails a command task when the expression holds over its Result
+// fields, instead of on a non-zero exit. A command that could not run at all
+// still fails.
+func (b TaskBuilder) FailedWhen(src string) TaskBuilder { b.t.FailedWhen = src; return b }
+
+// ChangedWhen reports a command task as changed when the expression holds over
+// its Result fields, instead of whenever it ran.
+func (b TaskBuilder) ChangedWhen(src string) TaskBuilder { b.t.ChangedWhen = src; return b }
+
+// splitRunner is a cmdRunner that can keep stdout and stderr apart. Runners
+// that cannot report their combined output as stdout.
+type splitRunner interface {
+	RunSplit(ctx context.Context, cmd string) (stdout, stderr []byte, err error)
+}
+
+// runResult runs cmd and records it. err is the command's error, as run
+// would return it.
+func (e *Executor) runResult(cmd string) (*Result, error) {
+	r := &Result{Start: time.Now()}
+	var stdout, stderr []byte
+	err := e.withConn(func() (err error) {
+		if st, ok := e.streaming(); ok {
+			stdout, stderr, err = st.RunStream(e.taskCtx(), cmd, e.emitOutput)
+		} else if sr, ok := e.runner.(splitRunner); ok {
+			stdout, stderr, err = sr.RunSplit(e.taskCtx(), cmd)
+		} else {
+			stdout, err = e.runner.Run(e.taskCtx(), cmd)
+		}
+		return err
+	})
+	r.End = time.Now()
+	r.Duration = r.End.Sub(r.Start)
+	r.Stdout = strings.TrimSpace(string(stdout))
+	r.Stderr = strings.TrimSpace(string(stderr))
+	r.RC = exitCode(err)
+	e.result = r
+	return r, err
+}
+
+// exitCode extracts a command's exit status from its error.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exit interface{ ExitStatus() int }
+	if errors.As(err, &exit) {
+		return exit.ExitStatus()
+	}
+	return -1
+}
+
+// judge applies FailedWhen and ChangedWhen to a command task's Result and
+// registers it, returning the task's final outcome.
+func (e *Executor) judge(t Task, vars *Vars, r *Result, changed bool, err error) (bool, error) {
+	scope := func() *Vars {
+		c := vars.Clone()
+		for k, val := range r.value() {
+			c.SetValue(k, val)
+		}
+		return c
+	}
+	if t.FailedWhen != "" && r.RC >= 0 && e.taskCtx().Err() == nil {
+		failed, ferr := evalExpr(scope(), t.FailedWhen)
+		switch {
+		case ferr != nil:
+			err = fmt.Errorf("failed_when: %w", ferr)
+		case failed:
+			err = fmt.Errorf("failed_when %s (rc=%d): %s", t.FailedWhen, r.RC, firstNonEmpty(r.Stderr, r.Stdout))
+		default:
+			err = nil
+			changed = !e.noOp && !readOnlyActions[t.Action]
+		}
+	}
+	if t.ChangedWhen != "" && err == nil {
+		c, cerr := evalExpr(scope(), t.ChangedWhen)
+		if cerr != nil {
+			err = fmt.Errorf("changed_when: %w", cerr)
+		}
+		changed = c
+	}
+	if err != nil {
+		changed = false
+	}
+	r.Changed, r.Failed = changed, err != nil
+	if t.Register != "" {
+		vars.SetValue(t.Register, r.value())
+	}
+	return changed, err
+}
+
+// evalExpr compiles and evaluates an expression against vars.
+func evalExpr(vars *Vars, src string) (bool, error) {
+	w, err := CompileWhen(src)
+	if err != nil {
+		return false, err
+	}
+	return vars.eval(w)
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+package porter
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// exitErr is a command error carrying an exit status, like *ssh.ExitError.
+type exitErr int
+
+func (e exitErr) Error() string   { return "Process exited with status " + itoa(int(e)) }
+func (e exitErr) ExitStatus() int { return int(e) }
+
+// splitFake answers every command with fixed stdout, stderr and error,
+// keeping the streams apart.
+type splitFake struct {
+	fakeRunner
+	stdout, stderr string
+	err            error
+}
+
+func (s *splitFake) RunSplit(ctx context.Context, cmd string) ([]byte, []byte, error) {
+	s.calls = append(s.calls, cmd)
+	return []byte(s.stdout), []byte(s.stderr), s.err
+}
+
+func TestRegisterResult(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{
+		{contains: "is-enabled", out: "disabled\n", err: exitErr(1)},
+		{contains: "hostname", out: "web1\n"},
+	}}
+	vars := NewVars()
+	_, err := newTestExec(fr).Run("deploy", Tasks(
+		Run("systemctl is-enabled app").Register("enabled").Ignore(),
+		Capture("hostname").Register("host"),
+		Run("echo rc={{enabled.rc}} out={{enabled}} host={{host}}"),
+		Run("systemctl enable app").WhenExpr(`enabled.rc != 0 && enabled == "disabled"`),
+	), vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fr.ran("echo rc=1 out=disabled host=web1") || !fr.ran("systemctl enable app") {
+		t.Errorf("calls = %q", fr.calls)
+	}
+	r, ok := vars.Result("enabled")
+	if !ok || r.RC != 1 || !r.Failed || r.Changed || r.Stdout != "disabled" || r.Start.IsZero() || r.End.Before(r.Start) {
+		t.Errorf("Result(enabled) = %+v, %v", r, ok)
+	}
+	if vars.Get("host") != "web1" {
+		t.Errorf("Get(host) = %q, want the captured stdout", vars.Get("host"))
+	}
+
+	tv := vars.Clone().SetTemplates(true)
+	if got := tv.Expand("{{.enabled.rc}} {{.host}} {{.host.changed}}"); got != "1 web1 false" {
+		t.Errorf("template = %q", got)
+	}
+}
+
+func TestRegisteredReadsAsCombinedOutput(t *testing.T) {
+	sf := &splitFake{stderr: "openjdk version \"21\"\n"}
+	vars := NewVars()
+	if _, err := (&Executor{runner: sf}).Run("x", Tasks(
+		Capture("java -version").Register("java"),
+		Run("echo {{java}} / {{java.stdout}}"),
+	), vars); err != nil {
+		t.Fatal(err)
+	}
+	if !sf.ran(`echo openjdk version "21" / `) || vars.Get("java") != `openjdk version "21"` {
+		t.Errorf("calls = %q, Get(java) = %q", sf.calls, vars.Get("java"))
+	}
+
+	sf.stdout = "done"
+	if _, err := (&Executor{runner: sf}).Run("x", Tasks(Capture("build").Register("b")), vars); err != nil {
+		t.Fatal(err)
+	}
+	if got := vars.Get("b"); got != "done\nopenjdk version \"21\"" {
+		t.Errorf("Get(b) = %q, want stdout then stderr", got)
+	}
+}
+
+func TestFailedWhenChangedWhen(t *testing.T) {
+	sf := &splitFake{stdout: "", stderr: "role \"app\" already exists", err: exitErr(1)}
+	e := &Executor{runner: sf}
+	vars := NewVars()
+	stats, err := e.Run("deploy", Tasks(
+		Run("createuser app").Register("create").
+			FailedWhen(`rc != 0 && "already exists" not in stderr`).
+			ChangedWhen(`rc == 0`),
+	), vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Changed != 0 || stats.OK != 1 {
+		t.Errorf("stats = %+v, want ok and unchanged", stats)
+	}
+	if r, _ := vars.Result("create"); r.Stderr != `role "app" already exists` || r.Failed {
+		t.Errorf("result = %+v", r)
+	}
+
+	sf = &splitFake{stdout: "", stderr: "permission denied", err: exitErr(1)}
+	_, err = (&Executor{runner: sf}).Run("deploy", Tasks(
+		Run("createuser app").FailedWhen(`rc != 0 && "already exists" not in stderr`),
+	), NewVars())
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("err = %v, want failed_when failure with stderr", err)
+	}
+
+	sf = &splitFake{stdout: "3 rows\n"}
+	stats, err = (&Executor{runner: sf}).Run("deploy", Tasks(
+		Capture("psql -c 'update ...'").ChangedWhen(`stdout != "0 rows"`),
+		Run("grep -q x /etc/hosts").ChangedWhen(`false`),
+	), NewVars())
+	if err != nil || stats.Changed != 1 {
+		t.Errorf("stats = %+v err = %v, want only the capture changed", stats, err)
+	}
+}
+
+func TestFailedWhenParseErrorFailsBeforeRun(t *testing.T) {
+	fr := &fakeRunner{}
+	_, err := newTestExec(fr).Run("deploy", Tasks(Run("first"), Run("second").ChangedWhen(`rc ==`)), NewVars())
+	if err == nil || !strings.Contains(err.Error(), "changed_when") || len(fr.calls) != 0 {
+		t.Errorf("err = %v calls = %q", err, fr.calls)
+	}
+}
@@ -1,7 +1,9 @@
 package porter
 
 import (
+	"context"
 	"errors"
+	"io"
 	"strings"
 	"testing"
 	"time"
@@ -13,7 +15,8 @@ import (
 type fakeRunner struct {
 	calls   []string
 	rules   []rule
-	fallErr error // returned when no rule matches (nil = success, empty output)
+	fallErr error             // returned when no rule matches (nil = success, empty output)
+	stdin   map[string]string // what RunStdin fed each command
 }
 
 type rule struct {
@@ -22,7 +25,7 @@ type rule struct {
 	err      error
 }
 
-func (f *fakeRunner) Run(cmd string) ([]byte, error) {
+func (f *fakeRunner) Run(ctx context.Context, cmd string) ([]byte, error) {
 	f.calls = append(f.calls, cmd)
 	logical := unwrapSudo(cmd)
 	for _, r := range f.rules {
@@ -33,6 +36,18 @@ func (f *fakeRunner) Run(cmd string) ([]byte, error) {
 	return nil, f.fallErr
 }
 
+func (f *fakeRunner) RunStdin(ctx context.Context, cmd string, stdin io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(stdin)
+	if err != nil {
+		return nil, err
+	}
+	if f.stdin == nil {
+		f.stdin = map[string]string{}
+	}
+	f.stdin[cmd] = string(b)
+	return f.Run(ctx, cmd)
+}
+
 func (f *fakeRunner) ran(substr string) bool {
 	for _, c := range f.calls {
 		if strings.Contains(c, substr) || strings.Contains(unwrapSudo(c), substr) {
@@ -265,7 +280,7 @@ type countingRunner struct {
 	attempts  *int
 }
 
-func (c *countingRunner) Run(cmd string) ([]byte, error) {
+func (c *countingRunner) Run(ctx context.Context, cmd string) ([]byte, error) {
 	*c.attempts++
 	if *c.attempts <= c.failFirst {
 		return nil, errors.New("transient failure")
@@ -295,3 +310,71 @@ func TestExecSudoWrapsCompoundCommand(t *testing.T) {
 		t.Errorf("the && chain is not contained within the sudo sh -c: %s", got)
 	}
 }
+
+// blockingRunner blocks every command until ctx is done, like a hung remote
+// apt-get, and reports ctx's error the way sshRunner does on cancellation.
+type blockingRunner struct{ started chan struct{} }
+
+func (b *blockingRunner) Run(ctx context.Context, cmd string) ([]byte, error) {
+	select {
+	case b.started <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRunContextCancelReportsCancelled(t *testing.T) {
+	br := &blockingRunner{started: make(chan struct{}, 1)}
+	e := &Executor{runner: br, verbose: false}
+	var statuses []TaskStatus
+	e.OnProgress(func(p TaskProgress) { statuses = append(statuses, p.Status) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-br.started
+		cancel()
+	}()
+	stats, err := e.RunContext(ctx, "cancel play", Tasks(
+		Run("apt-get install -y big").Retry(3).Ignore(),
+		Run("never reached"),
+	), NewVars())
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if stats.Cancelled != 1 || stats.Failed != 0 || stats.OK != 0 {
+		t.Errorf("stats: %+v", stats)
+	}
+	if last := statuses[len(statuses)-1]; last != StatusCancelled {
+		t.Errorf("last status = %s, want %s", last, StatusCancelled)
+	}
+}
+
+func TestRunTaskDeadlineFailsWithoutRetry(t *testing.T) {
+	br := &blockingRunner{started: make(chan struct{}, 1)}
+	e := &Executor{runner: br, verbose: false}
+	stats, err := e.Run("deadline play", Tasks(
+		Run("sleep 600").Deadline("20ms").Retry(5).RetryDelay("1h"),
+	), NewVars())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if stats.Failed != 1 || stats.Cancelled != 0 {
+		t.Errorf("a passed deadline is a failure, not a cancellation: %+v", stats)
+	}
+}
+
+func TestWaitLoopReturnsOnCancel(t *testing.T) {
+	fr := &fakeRunner{fallErr: errors.New("connection refused")}
+	e := newTestExec(fr)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e.ctx = ctx
+	start := time.Now()
+	if err := e.waitForPort("localhost", "8080", time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("wait loop kept polling after cancellation")
+	}
+}
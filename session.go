@@ -0,0 +1,245 @@
+package porter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/melbahja/goph"
+	"golang.org/x/crypto/ssh"
+)
+
+// =============================================================================
+// PERSISTENT SESSION
+// =============================================================================
+//
+// By default every command opens its own SSH session: a channel open, an exec
+// request and a close, each a round trip before and after the command itself.
+// On a high-latency link a deploy of a few hundred tasks is dominated by that
+// setup. SetPersistentSession(true) instead keeps one remote shell open and
+// feeds it the commands one after another over stdin, so each costs a single
+// round trip.
+//
+// Each command runs as `( eval '<cmd>' ) </dev/null` in /bin/sh, whatever
+// the user's login shell, so it cannot change the directory or
+// environment of the commands after it, and cannot read the protocol from
+// stdin. A marker line carrying the exit status ends its stdout, and another
+// ends its stderr. A cancelled command is killed with its shell; the next
+// command starts a new one.
+//
+// TaskProgress.RoundTrips counts the remote operations (commands, sessions
+// and SFTP channels) a task made, in either mode.
+
+// SetPersistentSession runs commands through one long-lived remote shell
+// instead of a session each. Has no effect with a non-SSH runner.
+func (e *Executor) SetPersistentSession(v bool) *Executor {
+	switch r := e.runner.(type) {
+	case sshRunner:
+		if v {
+			e.runner = newShellRunner(r.client)
+		}
+	case *shellRunner:
+		if !v {
+			r.close()
+			e.runner = sshRunner{r.client}
+		}
+	}
+	return e
+}
+
+// shellRunner is a cmdRunner backed by one remote shell (see
+// SetPersistentSession). It implements splitRunner and streamRunner too.
+type shellRunner struct {
+	client *goph.Client
+	marker string // random, so no output can end a frame early
+	seq    int
+	sh     *remoteShell // nil until the first command, and after a failure
+}
+
+type remoteShell struct {
+	session        *ssh.Session
+	stdin          io.WriteCloser
+	stdout, stderr *bufio.Reader
+}
+
+// sessionShell starts the persistent shell. It is always /bin/sh, not the
+// login shell: the framing (frameScript) is POSIX syntax, and under fish or
+// csh the end markers would never be printed.
+const sessionShell = "exec /bin/sh"
+
+func newShellRunner(client *goph.Client) *shellRunner {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &shellRunner{client: client, marker: "__PORTER_END_" + hex.EncodeToString(b)}
+}
+
+func (r *shellRunner) open() error {
+	session, err := r.client.NewSession()
+	if err != nil {
+		return err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return err
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		session.Close()
+		return err
+	}
+	if err := session.Start(sessionShell); err != nil {
+		session.Close()
+		return err
+	}
+	r.sh = &remoteShell{session: session, stdin: stdin, stdout: bufio.NewReader(stdout), stderr: bufio.NewReader(stderr)}
+	return nil
+}
+
+func (r *shellRunner) close() {
+	if r.sh != nil {
+		_ = r.sh.session.Close()
+		r.sh = nil
+	}
+}
+
+// shellExitError is a non-zero exit status reported by the remote shell.
+type shellExitError struct{ status int }
+
+func (e *shellExitError) Error() string {
+	return "Process exited with status " + strconv.Itoa(e.status)
+}
+func (e *shellExitError) ExitStatus() int { return e.status }
+
+// framed is what reading one stream of a command produced.
+type framed struct {
+	data []byte
+	rc   int
+	err  error
+}
+
+// exec runs cmd in the shell. With combined, stderr is folded into stdout in
+// the order it was written, as CombinedOutput would.
+func (r *shellRunner) exec(ctx context.Context, cmd string, combined bool, emit StreamFunc) (stdout, stderr []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if r.sh == nil {
+		if err := r.open(); err != nil {
+			return nil, nil, &noSessionError{err}
+		}
+	}
+	r.seq++
+	end := r.marker + "_" + strconv.Itoa(r.seq)
+	sh := r.sh
+	if _, err := io.WriteString(sh.stdin, frameScript(cmd, end, combined)); err != nil {
+		r.close()
+		return nil, nil, &noSessionError{err}
+	}
+
+	var mu sync.Mutex
+	lineTo := func(typ string) func(string) {
+		if emit == nil {
+			return nil
+		}
+		return func(l string) {
+			mu.Lock()
+			defer mu.Unlock()
+			emit(StreamEvent{Type: typ, Data: strings.TrimSuffix(l, "\r")})
+		}
+	}
+	outc, errc := make(chan framed, 1), make(chan framed, 1)
+	go func() { outc <- readFrame(sh.stdout, end, lineTo("stdout")) }()
+	go func() { errc <- readFrame(sh.stderr, end, lineTo("stderr")) }()
+
+	var out, serr framed
+	for got := 0; got < 2; {
+		select {
+		case out = <-outc:
+			got++
+		case serr = <-errc:
+			got++
+		case <-ctx.Done():
+			// Killing the shell kills the command; the readers end on EOF.
+			_ = sh.session.Signal(ssh.SIGKILL)
+			r.close()
+			return nil, nil, ctx.Err()
+		}
+	}
+	if out.err != nil || serr.err != nil {
+		r.close()
+		if out.err != nil {
+			return out.data, serr.data, out.err
+		}
+		return out.data, serr.data, serr.err
+	}
+	if out.rc != 0 {
+		err = &shellExitError{out.rc}
+	}
+	return out.data, serr.data, err
+}
+
+// frameScript is the shell input that runs cmd and ends its stdout and
+// stderr with end marker lines, the stdout one carrying the exit status.
+func frameScript(cmd, end string, combined bool) string {
+	redirect := " </dev/null"
+	if combined {
+		redirect += " 2>&1"
+	}
+	return "( eval " + shellEscape(cmd) + " )" + redirect + "\n" +
+		"printf '\\n%s %d\\n' " + end + " $?\n" +
+		"printf '\\n%s\\n' " + end + " >&2\n"
+}
+
+// readFrame reads one command's output from rd up to its end marker line,
+// passing each complete line to line (when non-nil). The newline printed
+// before the marker is not part of the output.
+func readFrame(rd *bufio.Reader, end string, line func(string)) framed {
+	var buf bytes.Buffer
+	var held *string // the last line, withheld until we know it is not the injected one
+	for {
+		s, err := rd.ReadString('\n')
+		if err != nil {
+			buf.WriteString(s)
+			return framed{data: buf.Bytes(), err: err}
+		}
+		l := strings.TrimSuffix(s, "\n")
+		if l == end || strings.HasPrefix(l, end+" ") {
+			data := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+			if held != nil && *held != "" && line != nil {
+				line(*held)
+			}
+			rc, _ := strconv.Atoi(strings.TrimPrefix(l, end+" "))
+			return framed{data: data, rc: rc}
+		}
+		if held != nil && line != nil {
+			line(*held)
+		}
+		buf.WriteString(s)
+		held = &l
+	}
+}
+
+func (r *shellRunner) Run(ctx context.Context, cmd string) ([]byte, error) {
+	out, _, err := r.exec(ctx, cmd, true, nil)
+	return out, err
+}
+
+func (r *shellRunner) RunSplit(ctx context.Context, cmd string) (stdout, stderr []byte, err error) {
+	return r.exec(ctx, cmd, false, nil)
+}
+
+func (r *shellRunner) RunStream(ctx context.Context, cmd string, emit StreamFunc) (stdout, stderr []byte, err error) {
+	return r.exec(ctx, cmd, false, emit)
+}
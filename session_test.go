@@ -0,0 +1,128 @@
+package porter
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFrameProtocolThroughShell feeds several framed commands to one local
+// sh, as the persistent session does, and reads each back by its markers.
+// startSessionShell starts sessionShell locally, as sshd would run it
+// through the login shell, with SHELL set to shell.
+func startSessionShell(t *testing.T, shell string) (stdin io.WriteCloser, stdout, stderr *bufio.Reader) {
+	t.Helper()
+	sh := exec.Command("sh", "-c", sessionShell)
+	sh.Env = append(os.Environ(), "SHELL="+shell)
+	stdin, _ = sh.StdinPipe()
+	stdoutPipe, _ := sh.StdoutPipe()
+	stderrPipe, _ := sh.StderrPipe()
+	if err := sh.Start(); err != nil {
+		t.Skip("no sh:", err)
+	}
+	t.Cleanup(func() { stdin.Close(); _ = sh.Wait() })
+	return stdin, bufio.NewReader(stdoutPipe), bufio.NewReader(stderrPipe)
+}
+
+func TestFrameProtocolThroughShell(t *testing.T) {
+	stdin, stdout, stderr := startSessionShell(t, "/bin/sh")
+
+	type want struct {
+		stdout, stderr string
+		rc             int
+		lines          []string
+	}
+	cases := []struct {
+		cmd      string
+		combined bool
+		want     want
+	}{
+		{"echo one; echo two >&2; printf 'partial'", false, want{"one\npartial", "two\n", 0, []string{"one", "partial"}}},
+		{"cd /; exit 3", false, want{"", "", 3, nil}},
+		{"pwd", false, want{"", "", 0, nil}}, // cd above did not leak
+		{"cat <<'EOF'\nit's a $HOME heredoc\n\nEOF", false, want{"it's a $HOME heredoc\n\n", "", 0, []string{"it's a $HOME heredoc", ""}}},
+		{"read x; echo \"got:$x\"", false, want{"got:\n", "", 0, []string{"got:"}}}, // stdin is not the protocol
+		{"echo out; echo err >&2", true, want{"out\nerr\n", "", 0, []string{"out", "err"}}},
+	}
+	for i, c := range cases {
+		end := "__PORTER_END_test_" + itoa(i)
+		if _, err := io.WriteString(stdin, frameScript(c.cmd, end, c.combined)); err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		out := readFrame(stdout, end, func(l string) { lines = append(lines, l) })
+		serr := readFrame(stderr, end, nil)
+		if out.err != nil || serr.err != nil {
+			t.Fatalf("%q: %v / %v", c.cmd, out.err, serr.err)
+		}
+		if c.cmd == "pwd" {
+			c.want.stdout = mustOutput(t, "pwd")
+			c.want.lines = []string{strings.TrimSpace(c.want.stdout)}
+		}
+		got := want{string(out.data), string(serr.data), out.rc, lines}
+		if got.stdout != c.want.stdout || got.stderr != c.want.stderr || got.rc != c.want.rc || !slices.Equal(got.lines, c.want.lines) {
+			t.Errorf("%q = %+v, want %+v", c.cmd, got, c.want)
+		}
+	}
+}
+
+// TestSessionShellIgnoresLoginShell frames a command with SHELL pointing at
+// a shell that does not speak POSIX sh (here one that swallows its input, as
+// fish would the framing); the markers must still come back.
+func TestSessionShellIgnoresLoginShell(t *testing.T) {
+	fish := filepath.Join(t.TempDir(), "fish")
+	if err := os.WriteFile(fish, []byte("#!/bin/sh\ncat >/dev/null\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stdin, stdout, _ := startSessionShell(t, fish)
+	if _, err := io.WriteString(stdin, frameScript("echo ok", "__PORTER_END_fish", false)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan framed, 1)
+	go func() { done <- readFrame(stdout, "__PORTER_END_fish", nil) }()
+	select {
+	case out := <-done:
+		if out.err != nil || string(out.data) != "ok\n" {
+			t.Errorf("frame = %q, %v", out.data, out.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no end marker: the framing ran in the login shell")
+	}
+}
+
+func mustOutput(t *testing.T, cmd string) string {
+	t.Helper()
+	out, err := exec.Command("sh", "-c", cmd).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestRoundTripsCountedPerTask(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{{contains: "test -e", err: exitErr(1)}}}
+	var final []TaskProgress
+	e := newTestExec(fr).OnProgress(func(p TaskProgress) {
+		if p.Status != StatusRunning {
+			final = append(final, p)
+		}
+	})
+	_, err := e.Run("deploy", Tasks(
+		Run("uptime"),
+		Run("touch /a").Creates("/a"),
+	), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(final) != 2 || final[0].RoundTrips != 1 || final[1].RoundTrips != 2 {
+		for _, p := range final {
+			t.Errorf("%s: %d round trips", p.Name, p.RoundTrips)
+		}
+	}
+}
@@ -38,6 +38,21 @@ func ConnectWithCert(ip, user, keyPath, certPath, passphrase string, port uint,
 		return nil, fmt.Errorf("parse private key: %w", err)
 	}
 
+	cert, err := readCert(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("build certificate signer: %w", err)
+	}
+
+	return dialBounded(user, ip, port, goph.Auth{ssh.PublicKeys(certSigner)}, timeout)
+}
+
+// readCert reads an SSH user certificate ("<key>-cert.pub").
+func readCert(certPath string) (*ssh.Certificate, error) {
 	certBytes, err := os.ReadFile(certPath)
 	if err != nil {
 		return nil, fmt.Errorf("read certificate: %w", err)
@@ -50,13 +65,7 @@ func ConnectWithCert(ip, user, keyPath, certPath, passphrase string, port uint,
 	if !ok {
 		return nil, fmt.Errorf("%s is not an SSH certificate", certPath)
 	}
-
-	certSigner, err := ssh.NewCertSigner(cert, signer)
-	if err != nil {
-		return nil, fmt.Errorf("build certificate signer: %w", err)
-	}
-
-	return dialBounded(user, ip, port, goph.Auth{ssh.PublicKeys(certSigner)}, timeout)
+	return cert, nil
 }
 
 // StartKeepalive sends OpenSSH keepalive requests over the connection every
@@ -0,0 +1,581 @@
+package porter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/melbahja/goph"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// =============================================================================
+// SSH_CONFIG (host aliases)
+// =============================================================================
+//
+// ConnectHost dials a host the way `ssh <alias>` would: the alias is resolved
+// through ~/.ssh/config (HostName, User, Port, IdentityFile, CertificateFile,
+// ProxyJump, IdentitiesOnly, ConnectTimeout), honouring Include, Host
+// wildcards and negations, and Match host/originalhost/user/localuser/all.
+// As in OpenSSH the first value obtained for a keyword wins, except
+// IdentityFile and CertificateFile, which accumulate. The other Match
+// criteria (exec, canonical, tagged, ...) are not evaluated and never match.
+//
+// The auth chain is the same one ssh builds: each identity file (a matching
+// certificate first — CertificateFile or <key>-cert.pub — then the bare key),
+// then the ssh-agent's keys unless IdentitiesOnly is set. Encrypted keys are
+// only usable through the agent. Host keys are verified by HostKeyCallback,
+// not by the config's UserKnownHostsFile/StrictHostKeyChecking.
+
+var (
+	sshConfigMu   sync.RWMutex
+	sshConfigPath = defaultSSHConfigPath()
+)
+
+func defaultSSHConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// SetSSHConfigPath overrides the ssh_config file ConnectHost reads.
+func SetSSHConfigPath(path string) {
+	sshConfigMu.Lock()
+	defer sshConfigMu.Unlock()
+	sshConfigPath = path
+}
+
+func sshConfigFile() string {
+	sshConfigMu.RLock()
+	defer sshConfigMu.RUnlock()
+	return sshConfigPath
+}
+
+// ConnectHost connects to alias as configured in ~/.ssh/config (see
+// SetSSHConfigPath), through its ProxyJump chain when it has one. An alias
+// with no entry is dialled as a plain hostname with the default identities.
+func ConnectHost(alias string) (*goph.Client, error) {
+	cfg, err := LoadSSHConfig(sshConfigFile())
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Connect(alias)
+}
+
+// ResolveHost resolves alias through ~/.ssh/config without connecting.
+func ResolveHost(alias string) (SSHHost, error) {
+	cfg, err := LoadSSHConfig(sshConfigFile())
+	if err != nil {
+		return SSHHost{}, err
+	}
+	return cfg.Resolve(alias), nil
+}
+
+// SSHHost is a host alias resolved through ssh_config, with defaults filled
+// in and tokens (%h, %r, %p, %n, %u, %d, ~) expanded.
+type SSHHost struct {
+	Alias            string
+	HostName         string
+	User             string
+	Port             uint
+	IdentityFiles    []string // as configured, else the default ~/.ssh/id_* keys
+	CertificateFiles []string
+	ProxyJump        []string // jump hosts, first hop first: "[user@]host[:port]"
+	IdentitiesOnly   bool
+	ConnectTimeout   time.Duration
+}
+
+// SSHConfig is a parsed ssh_config file, Includes expanded.
+type SSHConfig struct {
+	blocks []sshBlock
+}
+
+// sshBlock is a run of directives that applies when all of its conditions
+// hold: its own Host or Match line, and those of the block it was Included
+// from.
+type sshBlock struct {
+	conds      []sshCond
+	directives []sshDirective
+}
+
+// sshCond decides whether a block applies to the host being resolved.
+type sshCond func(st *sshResolve) bool
+
+type sshDirective struct {
+	key  string // lower-cased keyword
+	args []string
+}
+
+// maxIncludeDepth matches OpenSSH's limit on nested Includes.
+const maxIncludeDepth = 16
+
+// LoadSSHConfig parses the ssh_config file at path. A missing file is an
+// empty config. Relative Include paths are taken from path's directory.
+func LoadSSHConfig(path string) (*SSHConfig, error) {
+	c := &SSHConfig{}
+	if err := c.parseFile(path, filepath.Dir(path), nil, 0); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return c, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *SSHConfig) parseFile(path, dir string, outer []sshCond, depth int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Directives before the first Host/Match apply under the outer
+	// conditions only.
+	c.blocks = append(c.blocks, sshBlock{conds: outer})
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		key, args, err := splitSSHLine(sc.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if key == "" {
+			continue
+		}
+		switch key {
+		case "host":
+			c.blocks = append(c.blocks, sshBlock{conds: appendCond(outer, hostCond(args))})
+		case "match":
+			cond, err := matchCond(args)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			c.blocks = append(c.blocks, sshBlock{conds: appendCond(outer, cond)})
+		case "include":
+			if depth >= maxIncludeDepth {
+				return fmt.Errorf("%s:%d: Include nested too deeply", path, n)
+			}
+			conds := c.blocks[len(c.blocks)-1].conds
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(dir, pattern)
+				}
+				files, _ := filepath.Glob(pattern)
+				for _, f := range files {
+					if err := c.parseFile(f, dir, conds, depth+1); err != nil && !errors.Is(err, fs.ErrNotExist) {
+						return err
+					}
+				}
+			}
+			// Directives after the Include continue the including block.
+			c.blocks = append(c.blocks, sshBlock{conds: conds})
+		default:
+			b := &c.blocks[len(c.blocks)-1]
+			b.directives = append(b.directives, sshDirective{key: key, args: args})
+		}
+	}
+	return sc.Err()
+}
+
+func appendCond(outer []sshCond, cond sshCond) []sshCond {
+	return append(outer[:len(outer):len(outer)], cond)
+}
+
+// splitSSHLine splits a config line into its lower-cased keyword and
+// arguments. The keyword may be followed by "=", and arguments may be
+// double-quoted. A blank or comment line yields "".
+func splitSSHLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	key := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+
+	var args []string
+	for rest != "" {
+		if rest[0] == '"' {
+			i := strings.IndexByte(rest[1:], '"')
+			if i < 0 {
+				return "", nil, errors.New("unterminated quote")
+			}
+			args = append(args, rest[1:i+1])
+			rest = rest[i+2:]
+		} else {
+			i := strings.IndexAny(rest, " \t")
+			if i < 0 {
+				i = len(rest)
+			}
+			args = append(args, rest[:i])
+			rest = rest[i:]
+		}
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return key, args, nil
+}
+
+// hostCond matches the alias against Host patterns: any positive pattern
+// must match and no negated one may.
+func hostCond(patterns []string) sshCond {
+	return func(st *sshResolve) bool { return matchPatternList(patterns, st.alias) }
+}
+
+// matchPatternList reports whether s matches the pattern list (each entry
+// possibly "!"-negated), case-insensitively.
+func matchPatternList(patterns []string, s string) bool {
+	matched := false
+	for _, p := range patterns {
+		if neg, ok := strings.CutPrefix(p, "!"); ok {
+			if wildcardMatch(strings.ToLower(neg), strings.ToLower(s)) {
+				return false
+			}
+			continue
+		}
+		if wildcardMatch(strings.ToLower(p), strings.ToLower(s)) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// wildcardMatch matches s against an ssh_config pattern, where * matches
+// any run of characters and ? exactly one.
+func wildcardMatch(pattern, s string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+// matchCond compiles a Match line's criteria, all of which must hold.
+func matchCond(args []string) (sshCond, error) {
+	var conds []sshCond
+	for i := 0; i < len(args); i++ {
+		crit, neg := strings.CutPrefix(strings.ToLower(args[i]), "!")
+		var cond sshCond
+		switch crit {
+		case "all":
+			cond = func(*sshResolve) bool { return true }
+		case "final":
+			// Resolution is a single pass, which is the final one.
+			cond = func(*sshResolve) bool { return true }
+		case "canonical":
+			cond = func(*sshResolve) bool { return false }
+		case "host", "originalhost", "user", "localuser", "exec", "localnetwork", "tagged", "version", "sessiontype", "command":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("Match %s needs an argument", crit)
+			}
+			i++
+			list := strings.Split(args[i], ",")
+			switch crit {
+			case "host":
+				cond = func(st *sshResolve) bool { return matchPatternList(list, st.hostName()) }
+			case "originalhost":
+				cond = func(st *sshResolve) bool { return matchPatternList(list, st.alias) }
+			case "user":
+				cond = func(st *sshResolve) bool { return matchPatternList(list, st.user()) }
+			case "localuser":
+				cond = func(*sshResolve) bool { return matchPatternList(list, localUser()) }
+			default:
+				cond = func(*sshResolve) bool { return false }
+			}
+		default:
+			return nil, fmt.Errorf("unsupported Match criterion %q", args[i])
+		}
+		if neg {
+			c := cond
+			cond = func(st *sshResolve) bool { return !c(st) }
+		}
+		conds = append(conds, cond)
+	}
+	return func(st *sshResolve) bool {
+		for _, c := range conds {
+			if !c(st) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// sshResolve is the state of one alias's resolution: the first value seen
+// for each keyword, and the accumulated identity and certificate files.
+type sshResolve struct {
+	alias  string
+	first  map[string]string
+	idents []string
+	certs  []string
+}
+
+func (st *sshResolve) hostName() string {
+	if h := st.first["hostname"]; h != "" {
+		return strings.ReplaceAll(h, "%h", st.alias)
+	}
+	return st.alias
+}
+
+func (st *sshResolve) user() string {
+	if u := st.first["user"]; u != "" {
+		return u
+	}
+	return localUser()
+}
+
+func (st *sshResolve) apply(d sshDirective) {
+	if len(d.args) == 0 {
+		return
+	}
+	switch d.key {
+	case "identityfile":
+		st.idents = append(st.idents, d.args[0])
+	case "certificatefile":
+		st.certs = append(st.certs, d.args[0])
+	default:
+		if _, ok := st.first[d.key]; !ok {
+			st.first[d.key] = strings.Join(d.args, " ")
+		}
+	}
+}
+
+// Resolve returns alias's settings. Blocks are applied in file order, and a
+// Match host sees the HostName set by the blocks before it.
+func (c *SSHConfig) Resolve(alias string) SSHHost {
+	st := &sshResolve{alias: alias, first: map[string]string{}}
+	for _, b := range c.blocks {
+		applies := true
+		for _, cond := range b.conds {
+			if !cond(st) {
+				applies = false
+				break
+			}
+		}
+		if !applies {
+			continue
+		}
+		for _, d := range b.directives {
+			st.apply(d)
+		}
+	}
+
+	h := SSHHost{Alias: alias, HostName: st.hostName(), User: st.user(), Port: 22}
+	if p, err := strconv.ParseUint(st.first["port"], 10, 16); err == nil && p > 0 {
+		h.Port = uint(p)
+	}
+	h.IdentitiesOnly = strings.EqualFold(st.first["identitiesonly"], "yes")
+	if secs, err := strconv.Atoi(st.first["connecttimeout"]); err == nil && secs > 0 {
+		h.ConnectTimeout = time.Duration(secs) * time.Second
+	}
+	if jump := st.first["proxyjump"]; jump != "" && !strings.EqualFold(jump, "none") {
+		h.ProxyJump = strings.Split(jump, ",")
+	}
+	for _, f := range st.idents {
+		if !strings.EqualFold(f, "none") {
+			h.IdentityFiles = append(h.IdentityFiles, h.expandTokens(f))
+		}
+	}
+	if len(st.idents) == 0 {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			h.IdentityFiles = append(h.IdentityFiles, expandHome("~/.ssh/"+name))
+		}
+	}
+	for _, f := range st.certs {
+		h.CertificateFiles = append(h.CertificateFiles, h.expandTokens(f))
+	}
+	return h
+}
+
+// expandTokens expands ~ and the %-tokens ssh allows in file paths.
+func (h SSHHost) expandTokens(s string) string {
+	home, _ := os.UserHomeDir()
+	s = strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", h.HostName,
+		"%n", h.Alias,
+		"%p", strconv.Itoa(int(h.Port)),
+		"%r", h.User,
+		"%u", localUser(),
+	).Replace(s)
+	return expandHome(s)
+}
+
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, p[1:])
+		}
+	}
+	return p
+}
+
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// parseJump splits a ProxyJump entry ("[user@]host[:port]", optionally as an
+// ssh:// URI) into its parts; user and port are zero when not given.
+func parseJump(spec string) (userName, host string, port uint) {
+	spec = strings.TrimPrefix(strings.TrimSpace(spec), "ssh://")
+	if at := strings.LastIndexByte(spec, '@'); at >= 0 {
+		userName, spec = spec[:at], spec[at+1:]
+	}
+	if h, p, err := net.SplitHostPort(spec); err == nil {
+		if n, err := strconv.ParseUint(p, 10, 16); err == nil {
+			return userName, h, uint(n)
+		}
+	}
+	return userName, strings.Trim(spec, "[]"), 0
+}
+
+// Auth builds h's auth chain: each identity's certificates, then the key
+// itself, then (unless IdentitiesOnly) the ssh-agent's keys. Identity files
+// that are missing or encrypted are skipped. The agent's keys sign through a
+// connection to the agent that stays open until release is called, once the
+// handshakes using auth are done.
+func (h SSHHost) Auth() (auth goph.Auth, release func(), err error) {
+	signers, release := h.signers()
+	if len(signers) == 0 {
+		release()
+		return nil, nil, fmt.Errorf("%s: no usable identity (checked %s and the ssh-agent)", h.Alias, strings.Join(h.IdentityFiles, ", "))
+	}
+	// One publickey method: crypto/ssh tries each method only once, so the
+	// signers must not be split across several.
+	return goph.Auth{ssh.PublicKeys(signers...)}, release, nil
+}
+
+// signers returns h's signers and a func closing the agent connection the
+// agent's signers use.
+func (h SSHHost) signers() ([]ssh.Signer, func()) {
+	var signers []ssh.Signer
+	for _, keyPath := range h.IdentityFiles {
+		data, err := os.ReadFile(keyPath)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			continue
+		}
+		for _, certPath := range append(slices.Clone(h.CertificateFiles), keyPath+"-cert.pub") {
+			cert, err := readCert(certPath)
+			if err != nil || !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+				continue
+			}
+			if cs, err := ssh.NewCertSigner(cert, signer); err == nil {
+				signers = append(signers, cs)
+			}
+		}
+		signers = append(signers, signer)
+	}
+	release := func() {}
+	if !h.IdentitiesOnly {
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			if conn, err := net.Dial("unix", sock); err == nil {
+				if keys, err := agent.NewClient(conn).Signers(); err == nil && len(keys) > 0 {
+					signers = append(signers, keys...)
+					release = func() { conn.Close() }
+				} else {
+					conn.Close()
+				}
+			}
+		}
+	}
+	return signers, release
+}
+
+// Hop builds the Hop for h, auth included. Call release once the connection
+// through the Hop is established (see Auth).
+func (h SSHHost) Hop() (hop Hop, release func(), err error) {
+	auth, release, err := h.Auth()
+	if err != nil {
+		return Hop{}, nil, err
+	}
+	return Hop{User: h.User, Host: h.HostName, Port: h.Port, Auth: auth, Timeout: h.ConnectTimeout}, release, nil
+}
+
+// Connect dials alias as resolved by c: directly, or through ConnectViaJump
+// when it has a ProxyJump. Each jump host is itself resolved through c, with
+// the user and port given in the ProxyJump entry taking precedence.
+func (c *SSHConfig) Connect(alias string) (*goph.Client, error) {
+	h := c.Resolve(alias)
+	target, release, err := h.Hop()
+	if err != nil {
+		return nil, err
+	}
+	// The agent connections are only needed for the handshakes.
+	defer release()
+	if len(h.ProxyJump) == 0 {
+		return dialBounded(target.User, target.Host, target.Port, target.Auth, target.Timeout)
+	}
+	jumps, releaseJumps, err := c.jumpHops(h.ProxyJump)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseJumps()
+	return ConnectViaJump(target, jumps...)
+}
+
+func (c *SSHConfig) jumpHops(specs []string) ([]Hop, func(), error) {
+	hops := make([]Hop, 0, len(specs))
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, spec := range specs {
+		userName, host, port := parseJump(spec)
+		jh := c.Resolve(host)
+		if userName != "" {
+			jh.User = userName
+		}
+		if port != 0 {
+			jh.Port = port
+		}
+		hop, r, err := jh.Hop()
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("jump host %s: %w", spec, err)
+		}
+		hops = append(hops, hop)
+		releases = append(releases, r)
+	}
+	return hops, release, nil
+}
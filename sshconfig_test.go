@@ -0,0 +1,192 @@
+package porter
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func writeSSHConfig(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSSHConfigResolve(t *testing.T) {
+	dir := t.TempDir()
+	writeSSHConfig(t, dir, "conf.d/prod", `
+Host web-*
+    User deploy
+    ProxyJump ops@bastion:2222,inner
+    IdentityFile %d/keys/%h.key
+`)
+	main := writeSSHConfig(t, dir, "config", `
+# fleet
+Include conf.d/*
+Host web-1
+    HostName 10.0.0.11
+    User ignored-first-value-wins
+Host bastion
+    HostName=bastion.example.com
+    ProxyJump none
+Host *.internal !db.internal
+    Port 2200
+Match host 10.0.0.*
+    IdentityFile "~/keys/lan key"
+    CertificateFile ~/keys/lan-cert.pub
+Match originalhost db.internal user admin
+    IdentitiesOnly yes
+Host *
+    ConnectTimeout 7
+`)
+	cfg, err := LoadSSHConfig(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, _ := os.UserHomeDir()
+
+	web := cfg.Resolve("web-1")
+	if web.HostName != "10.0.0.11" || web.User != "deploy" || web.Port != 22 || web.ConnectTimeout.Seconds() != 7 {
+		t.Errorf("web-1 = %+v", web)
+	}
+	if want := []string{home + "/keys/10.0.0.11.key", home + "/keys/lan key"}; !slices.Equal(web.IdentityFiles, want) {
+		t.Errorf("identities = %q, want %q", web.IdentityFiles, want)
+	}
+	if !slices.Equal(web.ProxyJump, []string{"ops@bastion:2222", "inner"}) || len(web.CertificateFiles) != 1 {
+		t.Errorf("web-1 = %+v", web)
+	}
+
+	if b := cfg.Resolve("bastion"); b.HostName != "bastion.example.com" || b.ProxyJump != nil {
+		t.Errorf("bastion = %+v", b)
+	}
+	if p := cfg.Resolve("cache.internal").Port; p != 2200 {
+		t.Errorf("cache.internal port = %d", p)
+	}
+	db := cfg.Resolve("db.internal")
+	if db.Port != 22 || db.IdentitiesOnly {
+		t.Errorf("db.internal = %+v", db)
+	}
+	if len(db.IdentityFiles) != 3 || filepath.Base(db.IdentityFiles[0]) != "id_ed25519" {
+		t.Errorf("default identities = %q", db.IdentityFiles)
+	}
+
+	// Match user sees the User set so far.
+	cfg, _ = LoadSSHConfig(writeSSHConfig(t, dir, "root", "Host db\n User root\nMatch originalhost db user root\n IdentitiesOnly yes\n"))
+	if !cfg.Resolve("db").IdentitiesOnly {
+		t.Error("Match user root did not apply")
+	}
+
+	if cfg, err := LoadSSHConfig(filepath.Join(dir, "missing")); err != nil || cfg.Resolve("h").HostName != "h" {
+		t.Errorf("missing config: %v", err)
+	}
+	if _, err := LoadSSHConfig(writeSSHConfig(t, dir, "bad", "Match frobnicate x\n")); err == nil {
+		t.Error("unknown Match criterion accepted")
+	}
+}
+
+func TestParseJump(t *testing.T) {
+	for in, want := range map[string][3]any{
+		"bastion":                {"", "bastion", uint(0)},
+		"ops@bastion:2222":       {"ops", "bastion", uint(2222)},
+		"ssh://ops@10.0.0.1:22":  {"ops", "10.0.0.1", uint(22)},
+		"[fd00::1]:2022":         {"", "fd00::1", uint(2022)},
+		"me@corp@jump.example":   {"me@corp", "jump.example", uint(0)},
+		" spaced.example.com:22": {"", "spaced.example.com", uint(22)},
+	} {
+		u, h, p := parseJump(in)
+		if got := [3]any{u, h, p}; got != want {
+			t.Errorf("parseJump(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestSSHHostAuthPairsCertificates(t *testing.T) {
+	dir := t.TempDir()
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(key, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, _ := ssh.NewPublicKey(pub)
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := ssh.NewSignerFromKey(caKey)
+	cert := &ssh.Certificate{Key: sshPub, CertType: ssh.UserCert, ValidPrincipals: []string{"deploy"}, ValidBefore: ssh.CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(key+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := SSHHost{Alias: "web", IdentityFiles: []string{filepath.Join(dir, "missing"), key}, IdentitiesOnly: true}
+	signers, _ := h.signers()
+	if len(signers) != 2 {
+		t.Fatalf("%d signers, want the certificate and the key", len(signers))
+	}
+	if _, ok := signers[0].PublicKey().(*ssh.Certificate); !ok {
+		t.Errorf("first signer is %s, want the certificate", signers[0].PublicKey().Type())
+	}
+
+	h.IdentityFiles = []string{filepath.Join(dir, "missing")}
+	if _, _, err := h.Auth(); err == nil {
+		t.Error("auth without any identity succeeded")
+	}
+}
+
+func TestSSHHostAuthReleasesAgent(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	keyring := agent.NewKeyring()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if c, err := l.Accept(); err == nil {
+			_ = agent.ServeAgent(keyring, c)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	_, release, err := SSHHost{Alias: "web"}.Auth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-served:
+		t.Fatal("agent connection closed before release")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Error("release left the agent connection open")
+	}
+}
@@ -2,8 +2,11 @@ package porter
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
 
@@ -21,6 +24,135 @@ type StreamEvent struct {
 // StreamFunc is called for each line of output during streaming execution.
 type StreamFunc func(event StreamEvent)
 
+// OutputFunc is called for each line a task's commands print while they run,
+// with the progress record of that task.
+type OutputFunc func(p TaskProgress, ev StreamEvent)
+
+// streamRunner is a cmdRunner that can report output line by line as the
+// command prints it, keeping stdout and stderr apart like splitRunner.
+type streamRunner interface {
+	RunStream(ctx context.Context, cmd string, emit StreamFunc) (stdout, stderr []byte, err error)
+}
+
+// RunStream is RunSplit with each line also passed to emit as it arrives
+// (see streamRunner). emit is never called concurrently.
+func (r sshRunner) RunStream(ctx context.Context, cmd string, emit StreamFunc) (stdout, stderr []byte, err error) {
+	session, err := r.client.NewSession()
+	if err != nil {
+		return nil, nil, &noSessionError{err}
+	}
+	defer session.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+	})
+	defer stop()
+
+	var mu sync.Mutex
+	outW := &lineWriter{typ: "stdout", mu: &mu, emit: emit}
+	errW := &lineWriter{typ: "stderr", mu: &mu, emit: emit}
+	session.Stdout, session.Stderr = outW, errW
+	err = session.Run(cmd)
+	outW.flush()
+	errW.flush()
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return outW.buf.Bytes(), errW.buf.Bytes(), err
+}
+
+// maxLine caps a buffered partial line; a longer run without a newline (a
+// progress bar redrawn with \r, a minified blob) is emitted in pieces.
+const maxLine = 64 << 10
+
+// lineWriter keeps everything written to it and emits each complete line.
+// The two writers of a session share mu, so emit sees one line at a time.
+type lineWriter struct {
+	typ     string
+	mu      *sync.Mutex
+	emit    StreamFunc
+	buf     bytes.Buffer
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(w.partial[:i])
+		w.partial = w.partial[i+1:]
+	}
+	if len(w.partial) >= maxLine {
+		w.line(w.partial)
+		w.partial = nil
+	}
+	return len(p), nil
+}
+
+// flush emits a final line that had no trailing newline.
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.line(w.partial)
+		w.partial = nil
+	}
+}
+
+func (w *lineWriter) line(b []byte) {
+	w.emit(StreamEvent{Type: w.typ, Data: string(bytes.TrimSuffix(b, []byte("\r")))})
+}
+
+// streaming reports whether commands should be run through the output hook.
+func (e *Executor) streaming() (streamRunner, bool) {
+	if e.onOutput == nil {
+		return nil, false
+	}
+	sr, ok := e.runner.(streamRunner)
+	return sr, ok
+}
+
+// emitOutput passes a line of output to the OnOutput hook, redacted, with the
+// progress record of the task in flight.
+func (e *Executor) emitOutput(ev StreamEvent) {
+	var p TaskProgress
+	if e.inflight != nil {
+		p = *e.inflight
+	}
+	ev.Data = e.redactOutput(ev.Data)
+	e.onOutput(p, ev)
+}
+
+// redactedOutput replaces the output lines of a Sensitive task.
+const redactedOutput = "[redacted]"
+
+// redactOutput masks the sudo and Become passwords and every Redact value in
+// line, and the whole line while a Sensitive task runs.
+func (e *Executor) redactOutput(line string) string {
+	if e.sensitive {
+		return redactedOutput
+	}
+	secrets := append([]string{e.password}, e.redact...)
+	if e.becomePass != nil {
+		secrets = append(secrets, *e.becomePass)
+	}
+	// Longest first, so a secret containing another is masked whole.
+	slices.SortFunc(secrets, func(a, b string) int { return len(b) - len(a) })
+	for _, s := range secrets {
+		if s != "" {
+			line = strings.ReplaceAll(line, s, "****")
+		}
+	}
+	return line
+}
+
 // RunStreaming executes a command with real-time output streaming.
 // The callback is called for each line of stdout/stderr output.
 // Returns the combined output, exit code, and any error.
@@ -0,0 +1,69 @@
+package porter
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// streamFake is a fakeRunner whose output is also streamed through a
+// lineWriter, as sshRunner.RunStream does.
+type streamFake struct{ *fakeRunner }
+
+func (f streamFake) RunStream(ctx context.Context, cmd string, emit StreamFunc) ([]byte, []byte, error) {
+	out, err := f.Run(ctx, cmd)
+	w := &lineWriter{typ: "stdout", mu: new(sync.Mutex), emit: emit}
+	_, _ = w.Write(out)
+	w.flush()
+	return w.buf.Bytes(), nil, err
+}
+
+func TestOnOutputStreamsRedactedLines(t *testing.T) {
+	fr := &fakeRunner{rules: []rule{
+		{contains: "apt-get", out: "Reading lists\r\nusing token tok-123 as hunter2\npartial"},
+		{contains: "cat /etc/app.key", out: "-----BEGIN KEY-----"},
+	}}
+	e := newTestExec(fr)
+	e.runner = streamFake{fr}
+	e.password = "hunter2"
+	var got []string
+	e.Redact("tok-123").OnOutput(func(p TaskProgress, ev StreamEvent) {
+		got = append(got, p.Name+"|"+ev.Type+"|"+ev.Data)
+	})
+
+	_, err := e.Run("deploy", Tasks(
+		Run("apt-get -y upgrade").Name("Upgrade"),
+		Run("cat /etc/app.key").Name("Key").Sensitive(),
+	), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Upgrade|stdout|Reading lists",
+		"Upgrade|stdout|using token **** as ****",
+		"Upgrade|stdout|partial",
+		"Key|stdout|[redacted]",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("output =\n%q\nwant\n%q", got, want)
+	}
+	if r := e.result; r == nil || r.Stdout != "-----BEGIN KEY-----" {
+		t.Errorf("result not recorded from the stream: %+v", r)
+	}
+}
+
+func TestLineWriterSplitsAcrossWrites(t *testing.T) {
+	var got []string
+	w := &lineWriter{typ: "stderr", mu: new(sync.Mutex), emit: func(ev StreamEvent) { got = append(got, ev.Data) }}
+	for _, chunk := range []string{"comp", "iling\nlinking", "\n", "done"} {
+		_, _ = w.Write([]byte(chunk))
+	}
+	w.flush()
+	if want := []string{"compiling", "linking", "done"}; !slices.Equal(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+	if w.buf.String() != "compiling\nlinking\ndone" {
+		t.Errorf("buffered %q", w.buf.String())
+	}
+}
@@ -0,0 +1,488 @@
+package porter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// =============================================================================
+// DIRECTORY SYNC (pure Go, over SFTP)
+// =============================================================================
+//
+// SyncDir mirrors a local tree into a remote directory through the
+// executor's own SFTP session, so neither side needs rsync. Both trees are
+// listed, compared, and only the difference is applied: new and changed files
+// are sent (to a temp name, then renamed into place), modes, mtimes and
+// symlinks are carried over, and with .Delete() remote entries missing
+// locally are removed. The plan is a per-file change list:
+//
+//	+ conf/new.yaml     created
+//	~ bin/app           content, mode or link target changed
+//	- old/              deleted (with .Delete())
+//
+// A dry-run prints it without touching the host, TaskProgress.Changes carries
+// it to the ProgressFunc, and .Register(name) stores it one entry per line.
+
+// SyncBuilder provides a fluent API for building SyncDir tasks.
+type SyncBuilder struct{ t Task }
+
+// SyncDir mirrors the local directory into remote. Files are compared by size
+// and mtime unless .Checksum() is set, and are written as the SSH user.
+func SyncDir(local, remote string) SyncBuilder {
+	return SyncBuilder{Task{Action: "sync_dir", Src: local, Dest: remote, Name: "Sync " + local + " -> " + remote}}
+}
+
+// Build returns a TaskBuilder for use with Tasks().
+func (s SyncBuilder) Build() TaskBuilder { return TaskBuilder(s) }
+
+// Name sets a custom name for the task.
+func (s SyncBuilder) Name(n string) SyncBuilder { s.t.Name = n; return s }
+
+// When sets a condition for execution.
+func (s SyncBuilder) When(w When) SyncBuilder { s.t.When = w; return s }
+
+// Ignore ignores errors from this task.
+func (s SyncBuilder) Ignore() SyncBuilder { s.t.Ignore = true; return s }
+
+// Register stores the change list in a variable, one entry per line.
+func (s SyncBuilder) Register(name string) SyncBuilder { s.t.Register = name; return s }
+
+// appendOpt appends key:value to Body.
+func (s SyncBuilder) appendOpt(key, val string) SyncBuilder {
+	return SyncBuilder(TaskBuilder(s).appendOpt(key, val))
+}
+
+// Delete removes remote entries that do not exist locally. Excluded paths
+// are left alone.
+func (s SyncBuilder) Delete() SyncBuilder { return s.appendOpt("delete", "true") }
+
+// Exclude skips paths matching any of the comma-separated globs. A glob
+// matches the path relative to the tree's root or its base name; an excluded
+// directory is skipped with everything under it.
+func (s SyncBuilder) Exclude(patterns string) SyncBuilder { return s.appendOpt("exclude", patterns) }
+
+// Include keeps paths matching any of the comma-separated globs even when an
+// Exclude pattern matches them.
+func (s SyncBuilder) Include(patterns string) SyncBuilder { return s.appendOpt("include", patterns) }
+
+// Checksum compares same-sized files by sha256 instead of mtime.
+func (s SyncBuilder) Checksum() SyncBuilder { return s.appendOpt("checksum", "true") }
+
+// syncOpts are the SyncDir options parsed from the task body.
+type syncOpts struct {
+	delete, checksum bool
+	include, exclude []string
+}
+
+func (e *Executor) parseSyncOpts(body string) syncOpts {
+	globs := func(v string) []string {
+		var out []string
+		for p := range strings.SplitSeq(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				out = append(out, p)
+			}
+		}
+		return out
+	}
+	return syncOpts{
+		delete:   e.parseOpt(body, "delete") == "true",
+		checksum: e.parseOpt(body, "checksum") == "true",
+		include:  globs(e.parseOpt(body, "include")),
+		exclude:  globs(e.parseOpt(body, "exclude")),
+	}
+}
+
+// excluded reports whether rel (slash-separated, relative to the root) is
+// filtered out.
+func (o syncOpts) excluded(rel string) bool {
+	matches := func(globs []string) bool {
+		for _, g := range globs {
+			if ok, _ := path.Match(g, rel); ok {
+				return true
+			}
+			if ok, _ := path.Match(g, path.Base(rel)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return matches(o.exclude) && !matches(o.include)
+}
+
+// syncEntry is one file, directory or symlink of a tree.
+type syncEntry struct {
+	mode  fs.FileMode
+	size  int64
+	mtime time.Time
+	link  string // symlink target
+	sum   string // sha256, filled in only for Checksum comparisons
+}
+
+// syncChange is one step of a sync plan.
+type syncChange struct {
+	op      byte // '+' created, '~' changed, '-' deleted
+	rel     string
+	entry   syncEntry // the local entry, or for '-' the remote one
+	data    bool      // the file's content has to be sent
+	replace bool      // the remote entry is of another type and goes first
+}
+
+// String renders the change as a change-list entry; directories end in "/".
+func (c syncChange) String() string {
+	if c.entry.mode.IsDir() && c.rel != "." {
+		return string(c.op) + " " + c.rel + "/"
+	}
+	return string(c.op) + " " + c.rel
+}
+
+// planSync compares the trees, keyed by slash-separated relative path, and
+// returns the changes that make remote match local: creations and updates in
+// path order (parents first), then deletions of the topmost extraneous
+// entries.
+func planSync(local, remote map[string]syncEntry, o syncOpts) []syncChange {
+	var changes []syncChange
+	gone := map[string]bool{} // remote entries removed, with what is under them
+	for _, rel := range sortedKeys(local) {
+		l := local[rel]
+		r, ok := remote[rel]
+		switch {
+		case !ok:
+			changes = append(changes, syncChange{op: '+', rel: rel, entry: l, data: l.mode.IsRegular()})
+		case l.mode.Type() != r.mode.Type():
+			gone[rel] = true
+			changes = append(changes, syncChange{op: '~', rel: rel, entry: l, data: l.mode.IsRegular(), replace: true})
+		case l.mode&fs.ModeSymlink != 0:
+			if l.link != r.link {
+				changes = append(changes, syncChange{op: '~', rel: rel, entry: l})
+			}
+		case l.mode.IsRegular() && fileDiffers(l, r, o.checksum):
+			changes = append(changes, syncChange{op: '~', rel: rel, entry: l, data: true})
+		case l.mode.Perm() != r.mode.Perm():
+			changes = append(changes, syncChange{op: '~', rel: rel, entry: l})
+		}
+	}
+	if !o.delete {
+		return changes
+	}
+	for _, rel := range sortedKeys(remote) {
+		if _, ok := local[rel]; ok || goneWithParent(rel, gone) {
+			continue
+		}
+		gone[rel] = true
+		changes = append(changes, syncChange{op: '-', rel: rel, entry: remote[rel]})
+	}
+	return changes
+}
+
+// goneWithParent reports whether a directory above rel is already deleted.
+func goneWithParent(rel string, gone map[string]bool) bool {
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if gone[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// fileDiffers compares two regular files by size, then by sha256 or by mtime
+// at the one-second resolution SFTP keeps.
+func fileDiffers(l, r syncEntry, checksum bool) bool {
+	if l.size != r.size {
+		return true
+	}
+	if checksum {
+		return l.sum != r.sum
+	}
+	return l.mtime.Unix() != r.mtime.Unix()
+}
+
+func sortedKeys(m map[string]syncEntry) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// listLocal walks root into a syncEntry map, skipping excluded paths.
+func listLocal(root string, o syncOpts) (map[string]syncEntry, error) {
+	tree := map[string]syncEntry{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if o.excluded(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		ent := syncEntry{mode: info.Mode(), size: info.Size(), mtime: info.ModTime()}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if ent.link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case !info.Mode().IsRegular() && !info.IsDir():
+			return nil // sockets, devices and pipes are not synced
+		}
+		tree[rel] = ent
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk local %s: %w", root, err)
+	}
+	return tree, nil
+}
+
+// listRemote walks root over SFTP into a syncEntry map, skipping excluded
+// paths. A missing root is an empty tree; exists reports which it was.
+func listRemote(ftp *sftp.Client, root string, o syncOpts) (tree map[string]syncEntry, exists bool, err error) {
+	tree = map[string]syncEntry{}
+	if _, err := ftp.Stat(root); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return tree, false, nil
+		}
+		return nil, false, fmt.Errorf("stat remote %s: %w", root, err)
+	}
+	walker := ftp.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, true, fmt.Errorf("walk remote %s: %w", root, err)
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), root), "/")
+		if rel == "" {
+			continue
+		}
+		info := walker.Stat()
+		if o.excluded(rel) {
+			if info.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		ent := syncEntry{mode: info.Mode(), size: info.Size(), mtime: info.ModTime()}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if ent.link, err = ftp.ReadLink(walker.Path()); err != nil {
+				return nil, true, fmt.Errorf("readlink remote %s: %w", walker.Path(), err)
+			}
+		}
+		tree[rel] = ent
+	}
+	return tree, true, nil
+}
+
+// syncSums fills in the sha256 of every regular file present on both sides
+// with the same size, the only ones Checksum has to compare by content.
+func (e *Executor) syncSums(localRoot, remoteRoot string, local, remote map[string]syncEntry) error {
+	var rels []string
+	for rel, l := range local {
+		if r, ok := remote[rel]; ok && l.mode.IsRegular() && r.mode.IsRegular() && l.size == r.size {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+	const batch = 200
+	for i := 0; i < len(rels); i += batch {
+		chunk := rels[i:min(i+batch, len(rels))]
+		args := make([]string, len(chunk))
+		for j, rel := range chunk {
+			args[j] = shellEscape(rel)
+			l := local[rel]
+			sum, err := fileSHA256(filepath.Join(localRoot, filepath.FromSlash(rel)))
+			if err != nil {
+				return err
+			}
+			l.sum = sum
+			local[rel] = l
+		}
+		out, err := e.runCapture("cd " + shellEscape(remoteRoot) + " && sha256sum " + strings.Join(args, " "))
+		if err != nil {
+			return fmt.Errorf("remote checksums: %w", err)
+		}
+		for line := range strings.SplitSeq(out, "\n") {
+			sum, rel, ok := strings.Cut(line, "  ")
+			if r, found := remote[rel]; ok && found {
+				r.sum = sum
+				remote[rel] = r
+			}
+		}
+	}
+	return nil
+}
+
+// syncPlan lists both trees over ftp and returns the changes to apply. A
+// missing remote root is reported as the first change.
+func (e *Executor) syncPlan(ftp *sftp.Client, localRoot, remoteRoot string, o syncOpts) ([]syncChange, error) {
+	info, err := os.Stat(localRoot)
+	if err != nil {
+		return nil, fmt.Errorf("stat local %s: %w", localRoot, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("sync_dir: %s is not a directory", localRoot)
+	}
+	local, err := listLocal(localRoot, o)
+	if err != nil {
+		return nil, err
+	}
+	remote, exists, err := listRemote(ftp, remoteRoot, o)
+	if err != nil {
+		return nil, err
+	}
+	if o.checksum && exists {
+		if err := e.syncSums(localRoot, remoteRoot, local, remote); err != nil {
+			return nil, err
+		}
+	}
+	changes := planSync(local, remote, o)
+	if !exists {
+		root := syncChange{op: '+', rel: ".", entry: syncEntry{mode: info.Mode()}}
+		changes = append([]syncChange{root}, changes...)
+	}
+	return changes, nil
+}
+
+// applySync carries out changes, sending file content through tr. It stops
+// with the context's error once the run is cancelled.
+func (e *Executor) applySync(ftp *sftp.Client, localRoot, remoteRoot string, changes []syncChange, tr *transfer) error {
+	ctx := e.taskCtx()
+	for _, c := range changes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dst := path.Join(remoteRoot, c.rel)
+		src := filepath.Join(localRoot, filepath.FromSlash(c.rel))
+		if c.op == '-' || c.replace {
+			if err := ftp.RemoveAll(dst); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("remove %s: %w", dst, err)
+			}
+			if c.op == '-' {
+				continue
+			}
+		}
+		var err error
+		switch {
+		case c.entry.mode.IsDir():
+			if c.op == '+' || c.replace {
+				err = ftp.MkdirAll(dst)
+			}
+			if err == nil {
+				err = ftp.Chmod(dst, c.entry.mode.Perm())
+			}
+		case c.entry.mode&fs.ModeSymlink != 0:
+			if c.op == '~' && !c.replace {
+				_ = ftp.Remove(dst)
+			}
+			err = ftp.Symlink(c.entry.link, dst)
+		case c.data:
+			err = e.syncFile(ftp, src, dst, c.entry, tr)
+		default:
+			err = ftp.Chmod(dst, c.entry.mode.Perm())
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("sync %s: %w", c.rel, err)
+		}
+	}
+	return nil
+}
+
+// syncFile sends one file to a temp name beside dst, sets its mode and mtime,
+// and renames it into place so readers never see a partial file.
+func (e *Executor) syncFile(ftp *sftp.Client, src, dst string, ent syncEntry, tr *transfer) error {
+	local, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	tmp := path.Join(path.Dir(dst), "."+path.Base(dst)+".porter-sync")
+	remote, err := ftp.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(remote, &countingReader{local, tr}); err != nil {
+		remote.Close()
+		_ = ftp.Remove(tmp)
+		return err
+	}
+	if err := remote.Close(); err != nil {
+		return err
+	}
+	if err := ftp.Chmod(tmp, ent.mode.Perm()); err != nil {
+		return err
+	}
+	if err := ftp.Chtimes(tmp, ent.mtime, ent.mtime); err != nil {
+		return err
+	}
+	if err := ftp.PosixRename(tmp, dst); err != nil {
+		_ = ftp.Remove(dst)
+		return ftp.Rename(tmp, dst)
+	}
+	return nil
+}
+
+// syncDir runs a SyncDir task: in dry-run (apply false) it only plans. The
+// change list is returned either way.
+func (e *Executor) syncDir(localRoot, remoteRoot string, o syncOpts, apply bool) ([]string, error) {
+	ftp, err := e.newSftp()
+	if err != nil {
+		return nil, fmt.Errorf("sftp session failed: %w", err)
+	}
+	defer ftp.Close()
+	stop := context.AfterFunc(e.taskCtx(), func() { _ = ftp.Close() })
+	defer stop()
+
+	changes, err := e.syncPlan(ftp, localRoot, remoteRoot, o)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, len(changes))
+	var total int64
+	for i, c := range changes {
+		list[i] = c.String()
+		if c.data {
+			total += c.entry.size
+		}
+	}
+	if p := e.inflight; p != nil {
+		p.Changes = list
+	}
+	if !apply || len(changes) == 0 {
+		return list, nil
+	}
+	if e.verbose {
+		for _, l := range list {
+			log.Printf("  \033[36m%s\033[0m", l)
+		}
+	}
+	tr := e.newTransfer(total)
+	defer tr.finish(localRoot)
+	return list, e.applySync(ftp, localRoot, remoteRoot, changes, tr)
+}
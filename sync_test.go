@@ -0,0 +1,148 @@
+package porter
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPlanSync(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	file := func(size int64, mtime time.Time, perm fs.FileMode) syncEntry {
+		return syncEntry{mode: perm, size: size, mtime: mtime}
+	}
+	dir := syncEntry{mode: fs.ModeDir | 0755}
+	link := func(to string) syncEntry { return syncEntry{mode: fs.ModeSymlink | 0777, link: to} }
+
+	local := map[string]syncEntry{
+		"bin":         dir,
+		"bin/app":     file(10, t0.Add(time.Hour), 0755),
+		"bin/tool":    file(5, t0, 0755),
+		"conf":        dir,
+		"conf/a.yaml": file(3, t0, 0644),
+		"conf/b.yaml": file(3, t0, 0600),
+		"current":     link("releases/2"),
+		"data":        file(1, t0, 0644),
+	}
+	remote := map[string]syncEntry{
+		"bin":         dir,
+		"bin/app":     file(10, t0, 0755),
+		"bin/tool":    file(5, t0.Add(300*time.Millisecond), 0755),
+		"conf":        dir,
+		"conf/b.yaml": file(3, t0, 0644),
+		"current":     link("releases/1"),
+		"data":        dir,
+		"data/x":      file(1, t0, 0644),
+		"old":         dir,
+		"old/sub":     dir,
+		"old/sub/f":   file(1, t0, 0644),
+		"old-notes":   file(1, t0, 0644),
+	}
+
+	list := func(cs []syncChange) []string {
+		out := make([]string, len(cs))
+		for i, c := range cs {
+			out[i] = c.String()
+		}
+		return out
+	}
+	got := list(planSync(local, remote, syncOpts{delete: true}))
+	want := []string{
+		"~ bin/app",     // newer mtime
+		"+ conf/a.yaml", // new
+		"~ conf/b.yaml", // mode only
+		"~ current",     // link target
+		"~ data",        // directory replaced by a file
+		"- old/",        // removed with everything under it
+		"- old-notes",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("plan =\n%q\nwant\n%q", got, want)
+	}
+
+	changes := planSync(local, remote, syncOpts{})
+	if slices.ContainsFunc(changes, func(c syncChange) bool { return c.op == '-' }) {
+		t.Errorf("deleted without Delete: %q", list(changes))
+	}
+	for _, c := range changes {
+		if want := c.rel == "bin/app" || c.rel == "conf/a.yaml" || c.rel == "data"; c.data != want {
+			t.Errorf("%s: data = %v", c, c.data)
+		}
+		if c.replace != (c.rel == "data") {
+			t.Errorf("%s: replace = %v", c, c.replace)
+		}
+	}
+
+	// Same size and mtime, different content: only Checksum notices.
+	l := map[string]syncEntry{"f": {mode: 0644, size: 3, mtime: t0, sum: "aaa"}}
+	r := map[string]syncEntry{"f": {mode: 0644, size: 3, mtime: t0, sum: "bbb"}}
+	if n := len(planSync(l, r, syncOpts{})); n != 0 {
+		t.Errorf("size+mtime plan has %d changes", n)
+	}
+	if got := list(planSync(l, r, syncOpts{checksum: true})); !slices.Equal(got, []string{"~ f"}) {
+		t.Errorf("checksum plan = %q", got)
+	}
+}
+
+func TestSyncExcludeInclude(t *testing.T) {
+	o := (&Executor{}).parseSyncOpts(SyncDir("a", "b").Exclude("*.log, .git,cache/*").Include("keep.log").Delete().t.Body)
+	if !o.delete || o.checksum {
+		t.Errorf("opts = %+v", o)
+	}
+	for rel, want := range map[string]bool{
+		"app.log":        true,
+		"logs/app.log":   true,
+		"keep.log":       false,
+		".git":           true,
+		"cache/x":        true,
+		"cache/sub/x":    false,
+		"src/main.go":    false,
+		"src/.gitignore": false,
+	} {
+		if got := o.excluded(rel); got != want {
+			t.Errorf("excluded(%q) = %v, want %v", rel, got, want)
+		}
+	}
+
+	root := t.TempDir()
+	for _, p := range []string{".git/HEAD", "src/main.go", "src/debug.log"} {
+		full := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("src/main.go", filepath.Join(root, "main")); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := listLocal(root, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := sortedKeys(tree)
+	if want := []string{"main", "src", "src/main.go"}; !slices.Equal(got, want) {
+		t.Errorf("listed %q, want %q", got, want)
+	}
+	if tree["main"].link != "src/main.go" {
+		t.Errorf("symlink = %+v", tree["main"])
+	}
+}
+
+func TestApplySyncStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e := newTestExec(&fakeRunner{})
+	e.ctx = ctx
+	// A nil client would panic on the first change applied.
+	changes := []syncChange{{op: '+', rel: "app", entry: syncEntry{mode: fs.ModeDir | 0755}}}
+	if err := e.applySync(nil, t.TempDir(), "/srv", changes, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
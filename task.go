@@ -19,19 +19,53 @@ type Task struct {
 	Perm      string        // File mode (chmod, write) e.g. "0600"
 	Own       string        // Owner spec (chown, write) e.g. "idx:idx"
 	When      When          // Condition for execution
+	WhenExpr  string        // Source of When when it came from an expression (see CompileWhen)
 	Loop      []string      // Items to loop over
 	Ignore    bool          // Ignore errors
 	Retry     int           // Retry count on failure
 	Delay     time.Duration // Delay between retries
 	Timeout   time.Duration // Timeout for wait operations
-	Register  string        // Variable name to store output
+	Deadline  time.Duration // Max wall time for the whole task, retries included (0 = none)
+	Register  string        // Variable name to store output (a Result for command tasks)
 	Creates   string        // Skip if this path exists
 	StdinFile string        // Local file streamed into the command's stdin (Run)
+	Sensitive bool          // Content is secret: diffs are redacted
+	Notify    []string      // Handlers to run at the next flush if this task changed something
+	Tasks     []Task        // Nested tasks (the body of a Block or Handler)
+	Rescue    []Task        // Block: run if a task in Tasks fails
+	Always    []Task        // Block: run after Tasks (and Rescue) regardless of outcome
+
+	// Command tasks (Run, Capture): expressions over the Result that decide
+	// failure and change in place of the exit code and the action's kind.
+	FailedWhen  string
+	ChangedWhen string
+
+	// File edits (EnsureLine, EnsureBlock, ...): the regexp selecting lines
+	// to replace or remove, the anchors placing new content, and how a
+	// changed file is placed.
+	Match        string
+	InsertAfter  string // regexp, or "EOF"
+	InsertBefore string // regexp, or "BOF"
+	Validate     string // command run against the staged file; %s is its path
+	Backup       bool   // copy the file aside before changing it
+
+	// Fetch: the pinned digest ("sha256:<hex>", or the algorithm and a
+	// checksum file URL) and the request headers, "Name: value".
+	Checksum string
+	Headers  []string
+
+	// Sudo tasks: the user to become instead of the executor's Become user
+	// (root by default).
+	BecomeUser string
 }
 
-// Stats holds execution statistics.
+// Stats holds execution statistics. The unit is the task run: a loop counts
+// each iteration, a Block each task it ran (the block itself counts none), and
+// every handler task run adds one to Total. Each run has one outcome, OK,
+// Skipped, Failed, Cancelled or Rescued, so for a run that went to the end
+// they add up to Total; Changed counts the OK ones that changed something.
 type Stats struct {
-	Total, OK, Changed, Skipped, Failed int
+	Total, OK, Changed, Skipped, Failed, Cancelled, Rescued int
 }
 
 // TaskStatus represents the current status of a task.
@@ -45,6 +79,12 @@ const (
 	StatusSkipped  TaskStatus = "skipped"
 	StatusFailed   TaskStatus = "failed"
 	StatusRetrying TaskStatus = "retrying"
+	// StatusCancelled marks a task aborted because the context passed to
+	// RunContext was cancelled — not a failure of the task itself.
+	StatusCancelled TaskStatus = "cancelled"
+	// StatusRescued marks a Block whose tasks failed but whose Rescue
+	// section recovered.
+	StatusRescued TaskStatus = "rescued"
 )
 
 // TaskProgress represents the progress of a single task.
@@ -59,6 +99,13 @@ type TaskProgress struct {
 	Error      error         // Error if failed
 	Duration   time.Duration // Time taken (set on completion)
 	StartTime  time.Time     // When task started
+	When       string        // Source of the task's When expression, if any
+	Diff       string        // Unified diff of the content a file task changed (SetDiff)
+	Bytes      int64         // Bytes in place so far (Upload)
+	TotalBytes int64         // Bytes the transfer covers (Upload)
+	Throughput float64       // Bytes per second actually sent (Upload)
+	Changes    []string      // Per-file change list, e.g. "+ conf/app.yaml" (SyncDir)
+	RoundTrips int           // Remote operations so far: commands, sessions, SFTP channels
 }
 
 // ProgressFunc is called for each task state change.
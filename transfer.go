@@ -0,0 +1,450 @@
+package porter
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// UPLOADS (sha256 compare, resume, compression)
+// =============================================================================
+//
+// Upload hashes the local file and compares it with `sha256sum` of the remote
+// copy; when they match nothing is sent and the task reports ok. Otherwise the
+// file is streamed over SFTP into a partial file under ~/.porter-partial named
+// after its hash, so a transfer cut off by a dropped connection resumes from
+// the bytes already there on the next attempt (pair it with .Retry). The
+// partial is verified against the hash, validated if asked, and only then
+// placed into dest. A local directory is uploaded file by file the same way.
+//
+// With .Compress() the content is gzipped in flight and unpacked by the
+// remote gzip; compressed transfers restart rather than resume. Neither side
+// needs rsync.
+
+// partialDir holds in-flight uploads, relative to the SSH user's home where
+// both SFTP and remote commands start, so it survives a reconnect and stays
+// private to that user.
+const partialDir = ".porter-partial"
+
+// progressEvery throttles the byte counts sent to the ProgressFunc.
+const progressEvery = 250 * time.Millisecond
+
+// Compress gzips an Upload's content in flight. Worth it for compressible
+// files over slow links; compressed transfers cannot resume.
+func (b TaskBuilder) Compress() TaskBuilder { return b.appendOpt("compress", "true") }
+
+// uploadSpec is how an Upload places each file it transfers.
+type uploadSpec struct {
+	sudo     bool
+	perm     string
+	owner    string
+	validate string
+	compress bool
+}
+
+// upload transfers localPath (a file or a directory tree) to dest, setting
+// e.noOp when every file was already in place.
+func (e *Executor) upload(localPath, dest string, spec uploadSpec) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("stat local %s: %w", localPath, err)
+	}
+	var changed bool
+	if info.IsDir() {
+		changed, err = e.uploadTree(localPath, dest, spec)
+	} else {
+		tr := e.newTransfer(info.Size())
+		changed, err = e.uploadOne(tr, localPath, dest, info, spec)
+		tr.finish(localPath)
+	}
+	if err == nil && !changed {
+		e.noOp = true
+	}
+	return err
+}
+
+// localFile is one regular file of a tree being uploaded.
+type localFile struct {
+	path, dest string
+	info       fs.FileInfo
+}
+
+// localLink is one symlink of a tree being uploaded.
+type localLink struct{ dest, target string }
+
+// uploadTree uploads every regular file under localDir to the same relative
+// path under dest, creating missing directories. Symlinks are recreated
+// pointing at the same target, as Sync does; sockets, devices and pipes are
+// skipped.
+func (e *Executor) uploadTree(localDir, dest string, spec uploadSpec) (bool, error) {
+	dirs := []string{dest}
+	var files []localFile
+	var links []localLink
+	var total int64
+	err := filepath.WalkDir(localDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := path.Join(dest, filepath.ToSlash(rel))
+		switch {
+		case d.IsDir():
+			dirs = append(dirs, target)
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files = append(files, localFile{p, target, info})
+			total += info.Size()
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			links = append(links, localLink{target, link})
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("walk local %s: %w", localDir, err)
+	}
+
+	changed, err := e.ensureDirs(dirs, spec)
+	if err != nil {
+		return false, err
+	}
+	tr := e.newTransfer(total)
+	defer tr.finish(localDir)
+	for _, f := range files {
+		c, err := e.uploadOne(tr, f.path, f.dest, f.info, spec)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || c
+	}
+	for _, l := range links {
+		c, err := e.uploadLink(l, spec)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || c
+	}
+	return changed, nil
+}
+
+// uploadLink points the remote symlink l.dest at l.target, replacing
+// whatever is there, unless it already does.
+func (e *Executor) uploadLink(l localLink, spec uploadSpec) (bool, error) {
+	if got, err := e.runCaptureMaybeSudo(spec.sudo, "readlink "+shellEscape(l.dest)); err == nil && got == l.target {
+		return false, nil
+	}
+	// -n replaces a symlink to a directory instead of creating the link
+	// inside it.
+	if err := e.runMaybeSudo(spec.sudo, "ln -sfn "+shellEscape(l.target)+" "+shellEscape(l.dest)); err != nil {
+		return false, fmt.Errorf("symlink %s: %w", l.dest, err)
+	}
+	if spec.owner != "" {
+		if err := e.runMaybeSudo(spec.sudo, "chown -h "+shellEscape(spec.owner)+" "+shellEscape(l.dest)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ensureDirs creates whichever of dirs are missing (owned by spec.owner when
+// set) and reports whether any were.
+func (e *Executor) ensureDirs(dirs []string, spec uploadSpec) (bool, error) {
+	quoted := make([]string, len(dirs))
+	for i, d := range dirs {
+		quoted[i] = shellEscape(d)
+	}
+	out, _ := e.runCaptureMaybeSudo(spec.sudo, "for d in "+strings.Join(quoted, " ")+`; do test -d "$d" || echo "$d"; done`)
+	if out == "" {
+		return false, nil
+	}
+	var missing []string
+	for d := range strings.SplitSeq(out, "\n") {
+		if d = strings.TrimSpace(d); d != "" {
+			missing = append(missing, shellEscape(d))
+		}
+	}
+	args := strings.Join(missing, " ")
+	if err := e.runMaybeSudo(spec.sudo, "mkdir -p "+args); err != nil {
+		return false, err
+	}
+	if spec.owner != "" {
+		if err := e.runMaybeSudo(spec.sudo, "chown "+shellEscape(spec.owner)+" "+args); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// uploadOne brings dest in line with the local file at localPath and reports
+// whether anything changed.
+func (e *Executor) uploadOne(tr *transfer, localPath, dest string, info fs.FileInfo, spec uploadSpec) (bool, error) {
+	sum, err := fileSHA256(localPath)
+	if err != nil {
+		return false, err
+	}
+	if e.remoteDigest("sha256", dest, spec.sudo) == sum {
+		tr.add(info.Size(), false)
+		return e.fixAttrs(dest, spec)
+	}
+
+	part, err := e.stageUpload(tr, localPath, sum, info.Size(), spec.compress)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = e.run("rm -f " + shellEscape(part)) }()
+	if spec.validate != "" {
+		if err := e.validateStaged(spec.validate, part, spec.sudo); err != nil {
+			return false, err
+		}
+	}
+	if spec.perm == "" {
+		// A new dest takes the local file's mode (cp keeps an existing one's).
+		if err := e.run(fmt.Sprintf("chmod %04o %s", info.Mode().Perm(), shellEscape(part))); err != nil {
+			return false, err
+		}
+	}
+	return true, e.placeStaged(shellEscape(part), shellEscape(dest), spec.sudo, spec.perm, spec.owner)
+}
+
+// stageUpload sends the local file whose sha256 is sum into its partial file
+// under partialDir, resuming an earlier attempt, and verifies it. It returns
+// the partial's path; the caller removes it once placed.
+func (e *Executor) stageUpload(tr *transfer, localPath, sum string, size int64, compress bool) (string, error) {
+	part := partialDir + "/" + sum + ".part"
+	if err := e.sendPartial(tr, localPath, part, size, compress); err != nil {
+		return "", err
+	}
+	got, err := e.runCapture("sha256sum " + shellEscape(part) + " | cut -d' ' -f1")
+	if err != nil {
+		return "", err
+	}
+	if got != sum {
+		_ = e.run("rm -f " + shellEscape(part))
+		return "", fmt.Errorf("upload %s: checksum mismatch after transfer (got %s, want %s)", localPath, got, sum)
+	}
+	return part, nil
+}
+
+// uploadPending reports whether an Upload of localPath would transfer
+// anything; a directory is always reported pending.
+func (e *Executor) uploadPending(localPath, dest string, sudo bool) bool {
+	info, err := os.Stat(localPath)
+	if err != nil || info.IsDir() {
+		return true
+	}
+	sum, err := fileSHA256(localPath)
+	return err != nil || e.remoteDigest("sha256", dest, sudo) != sum
+}
+
+// fixAttrs applies spec's mode and owner to a dest whose content is already
+// right, reporting whether either had to change.
+func (e *Executor) fixAttrs(dest string, spec uploadSpec) (bool, error) {
+	changed := false
+	if spec.perm != "" && !e.modeMatches(dest, spec.perm, spec.sudo) {
+		if err := e.runMaybeSudo(spec.sudo, "chmod "+spec.perm+" "+shellEscape(dest)); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	if spec.owner != "" && !e.ownerMatches(dest, spec.owner, spec.sudo) {
+		if err := e.runMaybeSudo(spec.sudo, "chown "+shellEscape(spec.owner)+" "+shellEscape(dest)); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// sendPartial streams localPath into the remote partial file, appending to
+// whatever an earlier, interrupted attempt left there.
+func (e *Executor) sendPartial(tr *transfer, localPath, part string, size int64, compress bool) error {
+	local, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("open local %s: %w", localPath, err)
+	}
+	defer local.Close()
+	if err := e.run("mkdir -p -m 700 " + partialDir); err != nil {
+		return err
+	}
+	if compress {
+		return e.sendCompressed(tr, local, part)
+	}
+
+	ftp, err := e.newSftp()
+	if err != nil {
+		return fmt.Errorf("sftp session failed: %w", err)
+	}
+	defer ftp.Close()
+	stop := context.AfterFunc(e.taskCtx(), func() { _ = ftp.Close() })
+	defer stop()
+
+	var offset int64
+	if fi, err := ftp.Stat(part); err == nil && fi.Size() <= size {
+		offset = fi.Size()
+	}
+	remote, err := ftp.OpenFile(part, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return fmt.Errorf("open remote partial failed: %w", err)
+	}
+	if err := ftp.Chmod(part, 0600); err != nil {
+		remote.Close()
+		return fmt.Errorf("chmod remote partial failed: %w", err)
+	}
+	if err := remote.Truncate(offset); err != nil {
+		remote.Close()
+		return fmt.Errorf("truncate remote partial failed: %w", err)
+	}
+	if offset > 0 {
+		if e.verbose {
+			log.Printf("  \033[36mresuming %s at %d of %d bytes\033[0m", filepath.Base(localPath), offset, size)
+		}
+		if _, err := remote.Seek(offset, io.SeekStart); err != nil {
+			remote.Close()
+			return err
+		}
+		if _, err := local.Seek(offset, io.SeekStart); err != nil {
+			remote.Close()
+			return err
+		}
+		tr.add(offset, false)
+	}
+	if _, err := io.Copy(remote, &countingReader{local, tr}); err != nil {
+		remote.Close()
+		if e.taskCtx().Err() != nil {
+			return e.taskCtx().Err()
+		}
+		return fmt.Errorf("upload copy failed: %w", err)
+	}
+	return remote.Close()
+}
+
+// sendCompressed gzips local into the stdin of a remote `gzip -d` writing
+// the partial file from scratch.
+func (e *Executor) sendCompressed(tr *transfer, local io.Reader, part string) error {
+	session, err := e.newSession()
+	if err != nil {
+		return fmt.Errorf("ssh session failed: %w", err)
+	}
+	defer session.Close()
+	stop := context.AfterFunc(e.taskCtx(), func() { _ = session.Close() })
+	defer stop()
+
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, &countingReader{local, tr})
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	session.Stdin = pr
+	out, err := session.CombinedOutput("umask 077; gzip -dc > " + shellEscape(part))
+	pr.Close()
+	if err != nil {
+		if e.taskCtx().Err() != nil {
+			return e.taskCtx().Err()
+		}
+		return fmt.Errorf("compressed upload failed: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex sha256 of a local file, in sha256sum's format.
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", fmt.Errorf("open local %s: %w", p, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hash local %s: %w", p, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// transfer counts the bytes of one Upload task, which may cover many files,
+// and reports them on the progress record of the task in flight.
+type transfer struct {
+	e     *Executor
+	total int64 // bytes the task covers
+	done  int64 // bytes in place so far: sent, resumed or already matching
+	sent  int64 // bytes that crossed the wire, for throughput
+	start time.Time
+	last  time.Time
+}
+
+func (e *Executor) newTransfer(total int64) *transfer {
+	now := time.Now()
+	return &transfer{e: e, total: total, start: now, last: now}
+}
+
+// add records n more bytes in place; sent says whether they were transferred.
+func (tr *transfer) add(n int64, sent bool) {
+	tr.done += n
+	if sent {
+		tr.sent += n
+	}
+	p := tr.e.inflight
+	if p == nil {
+		return
+	}
+	p.Bytes, p.TotalBytes, p.Throughput = tr.done, tr.total, tr.rate()
+	if tr.done >= tr.total || time.Since(tr.last) >= progressEvery {
+		tr.last = time.Now()
+		tr.e.emitProgress(*p)
+	}
+}
+
+// rate is the throughput so far in bytes per second.
+func (tr *transfer) rate() float64 {
+	secs := time.Since(tr.start).Seconds()
+	if secs <= 0 {
+		return 0
+	}
+	return float64(tr.sent) / secs
+}
+
+// finish logs what the transfer sent, in verbose mode.
+func (tr *transfer) finish(what string) {
+	if !tr.e.verbose || tr.sent == 0 {
+		return
+	}
+	log.Printf("  \033[36m%s: sent %.1f MB of %.1f MB at %.1f MB/s\033[0m",
+		filepath.Base(what), float64(tr.sent)/1e6, float64(tr.total)/1e6, tr.rate()/1e6)
+}
+
+// countingReader feeds the bytes read through it into a transfer.
+type countingReader struct {
+	r  io.Reader
+	tr *transfer
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		c.tr.add(int64(n), true)
+	}
+	return n, err
+}
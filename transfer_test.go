@@ -0,0 +1,81 @@
+package porter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadSkipsFilesWithMatchingChecksum(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"app": "binary v2\n", "sub/conf": "port=80\n"}
+	var rules []rule
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule{contains: "sha256sum '/srv/app/" + name + "'", out: sha256Hex(body) + "\n"})
+	}
+	fr := &fakeRunner{rules: append(rules, rule{contains: "test -d", out: ""})}
+
+	e := newTestExec(fr)
+	var last TaskProgress
+	e.onProgress = func(p TaskProgress) { last = p }
+	e.inflight = &TaskProgress{Action: "upload"}
+	changed, err := e.exec(Upload(dir, "/srv/app").Compress().Build(), NewVars())
+	if err != nil || changed {
+		t.Fatalf("changed=%v err=%v calls=%q", changed, err, fr.calls)
+	}
+	if fr.ran(partialDir) || fr.ran("mkdir") {
+		t.Errorf("transferred a matching file: %q", fr.calls)
+	}
+	if last.TotalBytes != 18 || last.Bytes != 18 || last.Throughput != 0 {
+		t.Errorf("progress = %d/%d bytes at %v B/s, want 18/18 and none sent", last.Bytes, last.TotalBytes, last.Throughput)
+	}
+}
+
+func TestUploadFixesModeOfMatchingFile(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "app")
+	if err := os.WriteFile(local, []byte("bin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRunner{rules: []rule{
+		{contains: "sha256sum", out: sha256Hex("bin")},
+		{contains: "stat -c '%a'", out: "644"},
+	}}
+	changed, err := newTestExec(fr).exec(Upload(local, "/usr/local/bin/app").Mode("0755").Sudo().Build(), NewVars())
+	if err != nil || !changed {
+		t.Fatalf("changed=%v err=%v", changed, err)
+	}
+	if !fr.ran("chmod 0755 '/usr/local/bin/app'") || fr.ran(partialDir) {
+		t.Errorf("calls = %q", fr.calls)
+	}
+}
+
+func TestUploadTreeRecreatesSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app-v2"), []byte("bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("app-v2", filepath.Join(dir, "current")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/app", filepath.Join(dir, "conf")); err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRunner{rules: []rule{
+		{contains: "sha256sum", out: sha256Hex("bin")},
+		{contains: "readlink '/srv/app/conf'", out: "/etc/app"},
+		{contains: "readlink", err: exitErr(1)},
+	}}
+	changed, err := newTestExec(fr).exec(Upload(dir, "/srv/app").Build(), NewVars())
+	if err != nil || !changed {
+		t.Fatalf("changed=%v err=%v", changed, err)
+	}
+	if !fr.ran("ln -sfn 'app-v2' '/srv/app/current'") || fr.ran("ln -sfn '/etc/app'") {
+		t.Errorf("calls = %q", fr.calls)
+	}
+}
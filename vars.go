@@ -1,36 +1,118 @@
 package porter
 
-import "strings"
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
 
 // Vars holds variables for template expansion during task execution.
 type Vars struct {
-	data  map[string]string
-	bytes map[string][]byte
-	Item  string // Current loop item
+	data   map[string]string
+	values map[string]any
+	bytes  map[string][]byte
+	Item   string // Current loop item
+
+	templates bool     // Expand with text/template (see SetTemplates)
+	strict    bool     // Undefined references are errors (see SetStrict)
+	refErrs   []string // Undefined references seen while evaluating a When
+	whenErr   error    // A template error from IfTemplate in strict mode
 }
 
 // NewVars creates a new Vars instance.
 func NewVars() *Vars {
-	return &Vars{data: make(map[string]string), bytes: make(map[string][]byte)}
+	return &Vars{data: make(map[string]string), values: make(map[string]any), bytes: make(map[string][]byte)}
 }
 
 // Set stores a string value.
-func (v *Vars) Set(key, val string) *Vars { v.data[key] = val; return v }
+func (v *Vars) Set(key, val string) *Vars {
+	v.data[key] = val
+	delete(v.values, key)
+	return v
+}
+
+// SetValue stores a structured value — a map or slice (e.g. []string,
+// map[string]string, or decoded JSON) — that templates can index, range over
+// and pipe through filters. In plain {{key}} expansion and Get it reads as
+// JSON.
+func (v *Vars) SetValue(key string, val any) *Vars {
+	if s, ok := val.(string); ok {
+		return v.Set(key, s)
+	}
+	v.values[key] = val
+	delete(v.data, key)
+	return v
+}
+
+// setAny stores a decoded playbook or host value: a string as-is, a list or
+// map as a structured value, any other scalar formatted.
+func (v *Vars) setAny(key string, val any) *Vars {
+	if s, ok := val.(string); ok {
+		return v.Set(key, s)
+	}
+	switch reflect.ValueOf(val).Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return v.SetValue(key, val)
+	}
+	return v.Set(key, fmt.Sprint(val))
+}
+
+// Value retrieves a variable as stored: a string set with Set, or the
+// structured value set with SetValue. ok is false if key is undefined.
+func (v *Vars) Value(key string) (val any, ok bool) {
+	if s, ok := v.data[key]; ok {
+		return s, true
+	}
+	val, ok = v.values[key]
+	return val, ok
+}
 
 // Get retrieves a string value.
-func (v *Vars) Get(key string) string { return v.data[key] }
+func (v *Vars) Get(key string) string { return v.ref(key) }
 
 // GetBool retrieves a boolean value (true if value is "true").
-func (v *Vars) GetBool(key string) bool { return v.data[key] == "true" }
+func (v *Vars) GetBool(key string) bool { return v.ref(key) == "true" }
 
 // SetBool stores a boolean value.
 func (v *Vars) SetBool(key string, b bool) *Vars {
 	if b {
-		v.data[key] = "true"
-	} else {
-		v.data[key] = "false"
+		return v.Set(key, "true")
 	}
-	return v
+	return v.Set(key, "false")
+}
+
+// lookup returns key's value as a string (structured values as JSON, a
+// registered Result as its output).
+func (v *Vars) lookup(key string) (string, bool) {
+	if s, ok := v.data[key]; ok {
+		return s, true
+	}
+	val, ok := v.values[key]
+	if !ok {
+		return "", false
+	}
+	if s, ok := val.(fmt.Stringer); ok {
+		return s.String(), true
+	}
+	b, err := json.Marshal(val)
+	if err != nil {
+		return "", true
+	}
+	return string(b), true
+}
+
+// ref is lookup for condition evaluation: in strict mode an undefined key is
+// recorded so the task whose When referenced it fails instead of silently
+// evaluating against "".
+func (v *Vars) ref(key string) string {
+	s, ok := v.lookup(key)
+	if !ok && v.strict && !slices.Contains(v.refErrs, key) {
+		v.refErrs = append(v.refErrs, key)
+	}
+	return s
 }
 
 // SetBytes stores binary data.
@@ -39,21 +121,57 @@ func (v *Vars) SetBytes(key string, data []byte) *Vars { v.bytes[key] = data; re
 // GetBytes retrieves binary data.
 func (v *Vars) GetBytes(key string) []byte { return v.bytes[key] }
 
-// Clear removes all variables.
+// Clone returns an independent copy of v, so separate runs (one per host in
+// a Fleet) can Register into their own Vars without sharing a map.
+func (v *Vars) Clone() *Vars {
+	c := NewVars()
+	maps.Copy(c.data, v.data)
+	maps.Copy(c.values, v.values)
+	maps.Copy(c.bytes, v.bytes)
+	c.Item = v.Item
+	c.templates, c.strict = v.templates, v.strict
+	return c
+}
+
+// Clear removes all variables. The expansion modes are kept.
 func (v *Vars) Clear() {
 	v.data = make(map[string]string)
+	v.values = make(map[string]any)
 	v.bytes = make(map[string][]byte)
 	v.Item = ""
 }
 
-// Expand replaces {{key}} placeholders with variable values.
+// Expand replaces {{key}} placeholders with variable values (or renders s as
+// a text/template when SetTemplates is on). It never fails: use Render where
+// an undefined variable or a template error must be reported.
 func (v *Vars) Expand(s string) string {
-	if s == "" {
+	out, err := v.Render(s)
+	if err != nil && v.templates {
 		return s
 	}
+	return out
+}
+
+// expandPlain is the classic expansion: a literal replace of {{item}} and
+// every {{key}}, then of dotted paths into structured values
+// ({{result.rc}}, {{facts.os.family}}). Unknown placeholders are left as
+// they are.
+func (v *Vars) expandPlain(s string) string {
 	s = strings.ReplaceAll(s, "{{item}}", v.Item)
 	for key, val := range v.data {
 		s = strings.ReplaceAll(s, "{{"+key+"}}", val)
 	}
+	for key := range v.values {
+		val, _ := v.lookup(key)
+		s = strings.ReplaceAll(s, "{{"+key+"}}", val)
+	}
+	if len(v.values) > 0 && strings.Contains(s, ".") {
+		s = dottedRe.ReplaceAllStringFunc(s, func(m string) string {
+			if val, ok := v.resolve(m[2 : len(m)-2]); ok {
+				return scalarString(val)
+			}
+			return m
+		})
+	}
 	return s
 }
@@ -0,0 +1,185 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/booyaka101/porter"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyRoutes manages the known_hosts file porter verifies machines
+// against (see knownhosts.go in the library): list every entry, show a
+// machine's pinned key beside the one it presents now, re-pin it after a
+// rebuild once the operator has confirmed the new fingerprint on the host,
+// forget it, and revoke a key everywhere. Changes need machines:write when
+// authentication is on.
+func HostKeyRoutes(r *mux.Router) {
+	r.HandleFunc("/api/host-keys", listHostKeys).Methods("GET")
+	r.HandleFunc("/api/host-keys/revoke", revokeHostKey).Methods("POST")
+	r.HandleFunc("/api/machines/{id}/host-key", getMachineHostKey).Methods("GET")
+	r.HandleFunc("/api/machines/{id}/host-key", replaceMachineHostKey).Methods("PUT")
+	r.HandleFunc("/api/machines/{id}/host-key", forgetMachineHostKey).Methods("DELETE")
+}
+
+// hostKeyScanTimeout bounds reading the key a machine presents.
+const hostKeyScanTimeout = 10 * time.Second
+
+// canEditHostKeys reports whether the caller may change known_hosts,
+// answering 403 if not.
+func canEditHostKeys(w http.ResponseWriter, r *http.Request) bool {
+	if claims := GetCurrentUser(r); claims != nil && !HasPermission(claims.Permissions, "machines:write") {
+		sendError(w, http.StatusForbidden, "forbidden")
+		return false
+	}
+	return true
+}
+
+func listHostKeys(w http.ResponseWriter, _ *http.Request) {
+	entries, err := porter.KnownHosts()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []porter.KnownHost{}
+	}
+	writeJSON(w, entries)
+}
+
+func revokeHostKey(w http.ResponseWriter, r *http.Request) {
+	if !canEditHostKeys(w, r) {
+		return
+	}
+	var body struct {
+		PublicKey string `json:"public_key"` // authorized_keys form: "ssh-ed25519 AAAA..."
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(body.PublicKey))
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "invalid public_key")
+		return
+	}
+	err = porter.RevokeHostKey(key)
+	fingerprint := ssh.FingerprintSHA256(key)
+	AddAuditLog("revoke_host_key", "security", "", "", map[string]any{"fingerprint": fingerprint}, err == nil, errString(err))
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, map[string]any{"success": true, "fingerprint": fingerprint})
+}
+
+// machineHostKey is a machine's pinned keys and the key it presents now.
+type machineHostKey struct {
+	Host      string             `json:"host"`
+	Pinned    []porter.KnownHost `json:"pinned"`
+	Presented *presentedKey      `json:"presented,omitempty"`
+	ScanError string             `json:"scan_error,omitempty"`
+	// Status is "match", "mismatch" (re-pin after confirming the
+	// fingerprint), "unpinned", or "unknown" when the scan failed.
+	Status string `json:"status"`
+}
+
+type presentedKey struct {
+	KeyType     string `json:"key_type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func getMachineHostKey(w http.ResponseWriter, r *http.Request) {
+	machine, ok := machineRepo.Get(mux.Vars(r)["id"])
+	if !ok {
+		sendError(w, http.StatusNotFound, "machine not found")
+		return
+	}
+	pinned, err := porter.PinnedHostKeys(machine.IP)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := machineHostKey{Host: machine.IP, Pinned: pinned, Status: "unknown"}
+	if out.Pinned == nil {
+		out.Pinned = []porter.KnownHost{}
+	}
+	key, err := porter.ScanHostKey(machine.IP, hostKeyScanTimeout)
+	if err != nil {
+		out.ScanError = err.Error()
+		writeJSON(w, out)
+		return
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	out.Presented = &presentedKey{KeyType: key.Type(), Fingerprint: fingerprint}
+	out.Status = "unpinned"
+	for _, k := range pinned {
+		if k.Fingerprint == fingerprint {
+			out.Status = "match"
+			break
+		}
+		out.Status = "mismatch"
+	}
+	writeJSON(w, out)
+}
+
+// replaceMachineHostKey re-pins a machine to the key it presents now. The
+// body carries the fingerprint the operator read on the machine itself;
+// a machine presenting any other key is refused.
+func replaceMachineHostKey(w http.ResponseWriter, r *http.Request) {
+	if !canEditHostKeys(w, r) {
+		return
+	}
+	machine, ok := machineRepo.Get(mux.Vars(r)["id"])
+	if !ok {
+		sendError(w, http.StatusNotFound, "machine not found")
+		return
+	}
+	var body struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Fingerprint == "" {
+		sendError(w, http.StatusBadRequest, "fingerprint required")
+		return
+	}
+	key, err := porter.ScanHostKey(machine.IP, hostKeyScanTimeout)
+	if err == nil {
+		err = porter.ReplaceHostKey(machine.IP, key, body.Fingerprint)
+	}
+	AddAuditLog("replace_host_key", "security", machine.ID, machine.Name,
+		map[string]any{"fingerprint": body.Fingerprint}, err == nil, errString(err))
+	if err != nil {
+		sendError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, map[string]any{"success": true, "fingerprint": body.Fingerprint})
+}
+
+// forgetMachineHostKey removes a machine's pins; in TOFU mode the next
+// connection pins whatever key it presents.
+func forgetMachineHostKey(w http.ResponseWriter, r *http.Request) {
+	if !canEditHostKeys(w, r) {
+		return
+	}
+	machine, ok := machineRepo.Get(mux.Vars(r)["id"])
+	if !ok {
+		sendError(w, http.StatusNotFound, "machine not found")
+		return
+	}
+	n, err := porter.RemoveHostKey(machine.IP)
+	AddAuditLog("forget_host_key", "security", machine.ID, machine.Name, map[string]any{"removed": n}, err == nil, errString(err))
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, map[string]any{"success": true, "removed": n})
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,54 @@
+package web
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/booyaka101/porter"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeyEndpoints(t *testing.T) {
+	porter.SetKnownHostsPath(filepath.Join(t.TempDir(), "known_hosts"))
+	defer porter.SetKnownHostsPath(filepath.Join(t.TempDir(), "unused"))
+
+	r := mux.NewRouter()
+	HostKeyRoutes(r)
+
+	list := func() []porter.KnownHost {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/host-keys", nil))
+		var entries []porter.KnownHost
+		if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &entries) != nil {
+			t.Fatalf("list: %d %s", rec.Code, rec.Body)
+		}
+		return entries
+	}
+	if got := list(); len(got) != 0 {
+		t.Fatalf("empty file listed %+v", got)
+	}
+
+	pub, _, _ := ed25519.GenerateKey(nil)
+	key, _ := ssh.NewPublicKey(pub)
+	body := `{"public_key":"` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + `"}`
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/api/host-keys/revoke", strings.NewReader(body)))
+	if rec.Code != 200 {
+		t.Fatalf("revoke: %d %s", rec.Code, rec.Body)
+	}
+	got := list()
+	if len(got) != 1 || got[0].Marker != porter.MarkerRevoked || got[0].Fingerprint != ssh.FingerprintSHA256(key) {
+		t.Errorf("after revoke: %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/api/host-keys/revoke", strings.NewReader(`{"public_key":"nope"}`)))
+	if rec.Code != 400 {
+		t.Errorf("bad key: %d", rec.Code)
+	}
+}
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -462,11 +463,17 @@ func (h *ExecutionHistory) List() []ExecutionResult {
 
 type ExecutionTracker struct {
 	executions map[string]*ScriptExecution
+	contexts   map[string]context.Context
+	cancels    map[string]context.CancelFunc
 	mu         sync.RWMutex
 }
 
 func NewExecutionTracker() *ExecutionTracker {
-	return &ExecutionTracker{executions: make(map[string]*ScriptExecution)}
+	return &ExecutionTracker{
+		executions: make(map[string]*ScriptExecution),
+		contexts:   make(map[string]context.Context),
+		cancels:    make(map[string]context.CancelFunc),
+	}
 }
 
 func (t *ExecutionTracker) Create(id, scriptPath, args string, machineIDs []string) *ScriptExecution {
@@ -484,12 +491,26 @@ func (t *ExecutionTracker) Create(id, scriptPath, args string, machineIDs []stri
 		Args:       args,
 		StartedAt:  time.Now(),
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	t.mu.Lock()
 	t.executions[id] = exec
+	t.contexts[id] = ctx
+	t.cancels[id] = cancel
 	t.mu.Unlock()
 	return exec
 }
 
+// Context returns the context Porter runs for this execution should use, so
+// Cancel aborts them mid-task. Unknown IDs get a background context.
+func (t *ExecutionTracker) Context(id string) context.Context {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if ctx, ok := t.contexts[id]; ok {
+		return ctx
+	}
+	return context.Background()
+}
+
 func (t *ExecutionTracker) Get(id string) (*ScriptExecution, bool) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
@@ -505,20 +526,37 @@ func (t *ExecutionTracker) AddResult(id string, result ExecutionResult) {
 	t.mu.Unlock()
 }
 
+// SetStatus records an execution's status. Any status other than "running"
+// is terminal: the execution's context is released.
 func (t *ExecutionTracker) SetStatus(id, status string) {
 	t.mu.Lock()
 	if exec, ok := t.executions[id]; ok {
-		exec.Status = status
+		// A cancelled execution stays cancelled when its goroutines finish.
+		if exec.Status != "cancelled" {
+			exec.Status = status
+		}
+	}
+	if status != "running" {
+		if cancel, ok := t.cancels[id]; ok {
+			cancel()
+		}
+		delete(t.cancels, id)
+		delete(t.contexts, id)
 	}
 	t.mu.Unlock()
 }
 
+// Cancel marks a running execution cancelled and cancels its context, which
+// kills the Porter task in flight on every machine it targets.
 func (t *ExecutionTracker) Cancel(id string) bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if exec, ok := t.executions[id]; ok {
 		if exec.Status == "running" {
 			exec.Status = "cancelled"
+			if cancel, ok := t.cancels[id]; ok {
+				cancel()
+			}
 			return true
 		}
 	}
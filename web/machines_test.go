@@ -132,6 +132,28 @@ func TestRateLimiter(t *testing.T) {
 	}
 }
 
+func TestExecutionTrackerReleasesContext(t *testing.T) {
+	tr := NewExecutionTracker()
+	tr.Create("done", "/scripts/a.sh", "", nil)
+	ctx := tr.Context("done")
+	tr.SetStatus("done", "completed")
+	if ctx.Err() == nil || len(tr.contexts) != 0 || len(tr.cancels) != 0 {
+		t.Errorf("context not released: err=%v contexts=%d cancels=%d", ctx.Err(), len(tr.contexts), len(tr.cancels))
+	}
+	if exec, _ := tr.Get("done"); exec.Status != "completed" {
+		t.Errorf("status = %q", exec.Status)
+	}
+
+	tr.Create("stopped", "/scripts/a.sh", "", nil)
+	if !tr.Cancel("stopped") || tr.Context("stopped").Err() == nil {
+		t.Error("Cancel did not cancel the context")
+	}
+	tr.SetStatus("stopped", "failed")
+	if exec, _ := tr.Get("stopped"); exec.Status != "cancelled" || len(tr.contexts) != 0 {
+		t.Errorf("status = %q, contexts = %d", exec.Status, len(tr.contexts))
+	}
+}
+
 func TestEncryptDecrypt(t *testing.T) {
 	// Initialize encryption for testing
 	if err := InitEncryption(); err != nil {
@@ -6,11 +6,13 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/booyaka101/porter"
 	"github.com/gorilla/mux"
+	"github.com/melbahja/goph"
 )
 
 // TaskType represents the type of Porter task
@@ -120,152 +122,107 @@ var (
 	manifestExecsMu sync.RWMutex
 )
 
-// buildPorterTask converts a TaskDefinition to a Porter TaskBuilder
-func buildPorterTask(td TaskDefinition) porter.TaskBuilder {
-	var task porter.TaskBuilder
-
-	switch td.Type {
-	case TaskUpload:
-		task = porter.Upload(td.Params["src"], td.Params["dest"])
-	case TaskCopy:
-		task = porter.Copy(td.Params["src"], td.Params["dest"])
-	case TaskMove:
-		task = porter.Move(td.Params["src"], td.Params["dest"])
-	case TaskWrite:
-		task = porter.Write(td.Params["dest"], td.Params["content"])
-	case TaskMkdir:
-		task = porter.Mkdir(td.Params["path"])
-	case TaskRm:
-		task = porter.Rm(td.Params["path"])
-	case TaskChmod:
-		t := porter.Chmod(td.Params["path"])
-		if mode := td.Params["mode"]; mode != "" {
-			t = t.Mode(mode)
-		}
-		task = t
-	case TaskChown:
-		t := porter.Chown(td.Params["path"])
-		if owner := td.Params["owner"]; owner != "" {
-			t = t.Owner(owner)
-		}
-		task = t
-	case TaskSymlink:
-		task = porter.Symlink(td.Params["src"], td.Params["dest"])
-	case TaskTemplate:
-		task = porter.Template(td.Params["dest"], td.Params["content"])
-	case TaskRun:
-		t := porter.Run(td.Params["command"])
-		if td.Options.Sudo {
-			t = t.Sudo()
-		}
-		task = t
-	case TaskCapture:
-		t := porter.Capture(td.Params["command"])
-		if td.Options.Register != "" {
-			t = t.Register(td.Options.Register)
-		}
-		task = t
-	case TaskSvcStart:
-		t := porter.Svc(td.Params["name"]).Start()
-		if td.Options.User {
-			t = t.User()
-		}
-		task = t
-	case TaskSvcStop:
-		t := porter.Svc(td.Params["name"]).Stop()
-		if td.Options.User {
-			t = t.User()
-		}
-		task = t
-	case TaskSvcRestart:
-		t := porter.Svc(td.Params["name"]).Restart()
-		if td.Options.User {
-			t = t.User()
-		}
-		task = t
-	case TaskSvcEnable:
-		t := porter.Svc(td.Params["name"]).Enable()
-		if td.Options.User {
-			t = t.User()
-		}
-		task = t
-	case TaskDaemonReload:
-		t := porter.DaemonReload()
-		if td.Options.User {
-			t = t.User()
+// legacyTaskTypes maps the dashboard's original task types onto porter
+// actions. Any other type is taken as a porter action name directly (see
+// porter.Actions), so every registered action is available to manifests.
+var legacyTaskTypes = map[TaskType]struct{ action, state string }{
+	TaskSvcStart:     {"service", "start"},
+	TaskSvcStop:      {"service", "stop"},
+	TaskSvcRestart:   {"service", "restart"},
+	TaskSvcEnable:    {"service", "enable"},
+	TaskDockerStart:  {"docker", "start"},
+	TaskDockerStop:   {"docker", "stop"},
+	TaskComposeUp:    {"compose", "up"},
+	TaskComposeDown:  {"compose", "down"},
+	TaskComposePull:  {"compose", "pull"},
+	TaskScript:       {"run", ""},
+	TaskDaemonReload: {"daemon_reload", ""},
+}
+
+// paramFields maps the dashboard's parameter names onto playbook task fields.
+// Any other parameter must be one of the action's options (porter.ActionOptions).
+var paramFields = map[string]func(*porter.PlaybookTask, string){
+	"src":     func(pt *porter.PlaybookTask, v string) { pt.Src = v },
+	"dest":    func(pt *porter.PlaybookTask, v string) { pt.Dest = v },
+	"path":    func(pt *porter.PlaybookTask, v string) { pt.Dest = v },
+	"name":    func(pt *porter.PlaybookTask, v string) { pt.Dest = v },
+	"image":   func(pt *porter.PlaybookTask, v string) { pt.Dest = v },
+	"url":     func(pt *porter.PlaybookTask, v string) { pt.Dest = v },
+	"host":    func(pt *porter.PlaybookTask, v string) { pt.Dest = v },
+	"body":    func(pt *porter.PlaybookTask, v string) { pt.Body = v },
+	"command": func(pt *porter.PlaybookTask, v string) { pt.Body = v },
+	"content": func(pt *porter.PlaybookTask, v string) { pt.Body = v },
+	"port":    func(pt *porter.PlaybookTask, v string) { pt.Body = v },
+	"state":   func(pt *porter.PlaybookTask, v string) { pt.State = v },
+	"mode":    func(pt *porter.PlaybookTask, v string) { pt.Mode = v },
+	"owner":   func(pt *porter.PlaybookTask, v string) { pt.Owner = v },
+}
+
+// playbookTask converts a TaskDefinition to a porter playbook task, rejecting
+// parameters that are neither a task field nor an option of its action.
+func playbookTask(td TaskDefinition) (porter.PlaybookTask, error) {
+	pt := porter.PlaybookTask{
+		Name:     td.Name,
+		Action:   string(td.Type),
+		Sudo:     td.Options.Sudo,
+		User:     td.Options.User,
+		Retry:    td.Options.Retry,
+		Ignore:   td.Options.Ignore,
+		Creates:  td.Options.Creates,
+		When:     td.Options.When,
+		Register: td.Options.Register,
+		Timeout:  td.Options.Timeout,
+	}
+	if legacy, ok := legacyTaskTypes[td.Type]; ok {
+		pt.Action, pt.State = legacy.action, legacy.state
+	}
+	for k, v := range td.Params {
+		if td.Type == TaskScript && k == "path" {
+			pt.Body = "bash " + v
+			continue
 		}
-		task = t
-	case TaskDockerStart:
-		task = porter.Docker(td.Params["name"]).Start()
-	case TaskDockerStop:
-		task = porter.Docker(td.Params["name"]).Stop()
-	case TaskDockerPull:
-		task = porter.DockerPull(td.Params["image"])
-	case TaskComposeUp:
-		task = porter.Compose(td.Params["path"]).Up()
-	case TaskComposeDown:
-		task = porter.Compose(td.Params["path"]).Down()
-	case TaskComposePull:
-		task = porter.Compose(td.Params["path"]).Pull()
-	case TaskWaitPort:
-		t := porter.WaitForPort(td.Params["host"], td.Params["port"])
-		if td.Options.Timeout != "" {
-			t = t.Timeout(td.Options.Timeout)
+		if set, ok := paramFields[k]; ok {
+			set(&pt, v)
+			continue
 		}
-		task = t
-	case TaskWaitHTTP:
-		t := porter.WaitForHttp(td.Params["url"])
-		if td.Options.Timeout != "" {
-			t = t.Timeout(td.Options.Timeout)
+		if !slices.Contains(porter.ActionOptions(pt.Action), k) {
+			return pt, fmt.Errorf("task %q: unknown parameter %q for %s", td.Name, k, pt.Action)
 		}
-		task = t
-	case TaskScript:
-		t := porter.Run(fmt.Sprintf("bash %s", td.Params["path"]))
-		if td.Options.Sudo {
-			t = t.Sudo()
+		if pt.Options == nil {
+			pt.Options = make(map[string]string)
 		}
-		task = t
-	default:
-		task = porter.Run(fmt.Sprintf("echo 'Unknown task type: %s'", td.Type))
+		pt.Options[k] = v
 	}
+	return pt, nil
+}
 
-	// Apply common options
-	if td.Options.Retry > 0 {
-		task = task.Retry(td.Options.Retry)
-	}
-	if td.Options.Ignore {
-		task = task.Ignore()
-	}
-	if td.Options.Creates != "" {
-		task = task.Creates(td.Options.Creates)
+// manifestTasks validates a manifest and compiles it to porter tasks.
+func manifestTasks(manifest *Manifest) ([]porter.Task, error) {
+	pb := porter.Playbook{Version: porter.PlaybookVersion, Name: manifest.Name}
+	for _, td := range manifest.Tasks {
+		pt, err := playbookTask(td)
+		if err != nil {
+			return nil, err
+		}
+		pb.Tasks = append(pb.Tasks, pt)
 	}
-
-	return task
+	return pb.Compile()
 }
 
-// executeManifestOnMachine executes a manifest on a single machine
-func executeManifestOnMachine(exec *ManifestExecution, manifest *Manifest, machine *Machine, resultIdx int) {
-	result := &exec.Results[resultIdx]
-	result.Status = "running"
-	result.StartedAt = time.Now()
-
-	// Connect to machine
-	client, err := porter.Connect(machine.IP, porter.DefaultConfig(machine.Username, machine.Password))
+// executeManifest runs a manifest across the execution's machines as one
+// porter.Fleet (every machine in parallel) and records each machine's outcome
+// in exec.Results.
+func executeManifest(exec *ManifestExecution, manifest *Manifest) {
+	tasks, err := manifestTasks(manifest)
 	if err != nil {
-		result.Status = "failed"
-		result.Error = fmt.Sprintf("Connection failed: %v", err)
 		now := time.Now()
-		result.FinishedAt = &now
+		for i := range exec.Results {
+			exec.Results[i].Status = "failed"
+			exec.Results[i].Error = err.Error()
+			exec.Results[i].FinishedAt = &now
+		}
 		return
 	}
-	defer client.Close()
-
-	// Build tasks
-	var taskBuilders []porter.TaskBuilder
-	for _, td := range manifest.Tasks {
-		taskBuilders = append(taskBuilders, buildPorterTask(td))
-	}
-	tasks := porter.Tasks(taskBuilders...)
 
 	// Set up variables
 	vars := porter.NewVars()
@@ -276,42 +233,79 @@ func executeManifestOnMachine(exec *ManifestExecution, manifest *Manifest, machi
 		vars.Set(k, v)
 	}
 
-	// Execute, recording the deploy as an OpenTelemetry-shaped trace (one span
-	// per task) under the data dir, plus structured logs.
-	executor := porter.NewExecutor(client, machine.Password)
-	if tracer, closeTrace := newDeployTracer(manifest.Name, machine.Name); tracer != nil {
-		executor.SetTracer(tracer)
-		defer closeTrace()
+	// One inventory host per known machine, keyed by machine ID so the recap
+	// maps back onto exec.Results.
+	var hosts []porter.Host
+	resultIdx := make(map[string]int)
+	machines := make(map[string]*Machine)
+	for i, machineID := range exec.MachineIDs {
+		machine, exists := machineRepo.Get(machineID)
+		if !exists {
+			continue
+		}
+		resultIdx[machineID] = i
+		machines[machineID] = machine
+		hosts = append(hosts, porter.Host{
+			Name:     machineID,
+			Password: machine.Password,
+			Dial: func() (*goph.Client, error) {
+				return porter.Connect(machine.IP, porter.DefaultConfig(machine.Username, machine.Password))
+			},
+		})
 	}
-	executor.SetLogger(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
-	stats, err := executor.Run(manifest.Name, tasks, vars)
 
-	now := time.Now()
-	result.FinishedAt = &now
+	// Execute, recording each machine's deploy as an OpenTelemetry-shaped
+	// trace (one span per task) under the data dir, plus structured logs.
+	fleet := porter.NewFleet(hosts...).Forks(0).SetVerbose(true).
+		Setup(func(h porter.Host, executor *porter.Executor) func() {
+			result := &exec.Results[resultIdx[h.Name]]
+			result.Status = "running"
+			result.StartedAt = time.Now()
+
+			executor.SetLogger(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+			tracer, closeTrace := newDeployTracer(manifest.Name, machines[h.Name].Name)
+			if tracer == nil {
+				return nil
+			}
+			executor.SetTracer(tracer)
+			return closeTrace
+		})
+	recap, _ := fleet.Run(manifest.Name, tasks, vars)
 
-	if err != nil {
-		result.Status = "failed"
-		result.Error = fmt.Sprintf("Execution failed: %v", err)
-	} else if stats.Failed > 0 {
-		result.Status = "failed"
-		result.Error = fmt.Sprintf("%d tasks failed", stats.Failed)
-	} else {
-		result.Status = "success"
-	}
+	for _, hr := range recap.Hosts {
+		result := &exec.Results[resultIdx[hr.Host]]
+		now := time.Now()
+		result.FinishedAt = &now
 
-	// Update task results
-	for i, td := range manifest.Tasks {
-		if i < len(result.TaskResults) {
-			result.TaskResults[i].Status = "ok"
-			result.TaskResults[i].FinishedAt = &now
-		} else {
-			result.TaskResults = append(result.TaskResults, TaskResult{
-				TaskID:     td.ID,
-				TaskName:   td.Name,
-				Status:     "ok",
-				StartedAt:  result.StartedAt,
-				FinishedAt: &now,
-			})
+		switch {
+		case hr.Unreachable:
+			result.Status = "failed"
+			result.Error = fmt.Sprintf("Connection failed: %v", hr.Err)
+			continue
+		case hr.Err != nil:
+			result.Status = "failed"
+			result.Error = fmt.Sprintf("Execution failed: %v", hr.Err)
+		case hr.Stats.Failed > 0:
+			result.Status = "failed"
+			result.Error = fmt.Sprintf("%d tasks failed", hr.Stats.Failed)
+		default:
+			result.Status = "success"
+		}
+
+		// Update task results
+		for i, td := range manifest.Tasks {
+			if i < len(result.TaskResults) {
+				result.TaskResults[i].Status = "ok"
+				result.TaskResults[i].FinishedAt = &now
+			} else {
+				result.TaskResults = append(result.TaskResults, TaskResult{
+					TaskID:     td.ID,
+					TaskName:   td.Name,
+					Status:     "ok",
+					StartedAt:  result.StartedAt,
+					FinishedAt: &now,
+				})
+			}
 		}
 	}
 }
@@ -350,6 +344,16 @@ func ManifestRoutes(r *mux.Router) {
 			{"type": "wait_port", "name": "Wait for Port", "category": "health", "params": []string{"host", "port"}},
 			{"type": "wait_http", "name": "Wait for HTTP", "category": "health", "params": []string{"url"}},
 		}
+		// Every other registered porter action, addressed by its own name.
+		legacy := make(map[string]bool, len(taskTypes))
+		for _, tt := range taskTypes {
+			legacy[tt["type"].(string)] = true
+		}
+		for _, action := range porter.Actions() {
+			if !legacy[action] {
+				taskTypes = append(taskTypes, map[string]any{"type": action, "name": action, "category": "action", "params": []string{"src", "dest", "body", "state"}})
+			}
+		}
 		json.NewEncoder(w).Encode(taskTypes)
 	}).Methods("GET")
 
@@ -375,6 +379,11 @@ func ManifestRoutes(r *mux.Router) {
 			return
 		}
 
+		if _, err := manifestTasks(&manifest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		manifest.ID = fmt.Sprintf("manifest-%d", time.Now().UnixNano())
 		manifest.CreatedAt = time.Now()
 
@@ -471,25 +480,9 @@ func ManifestRoutes(r *mux.Router) {
 		manifestExecs[exec.ID] = exec
 		manifestExecsMu.Unlock()
 
-		// Execute in parallel
-		var wg sync.WaitGroup
-		for i, machineID := range execReq.MachineIDs {
-			machine, exists := machineRepo.Get(machineID)
-
-			if !exists {
-				continue
-			}
-
-			wg.Add(1)
-			go func(idx int, m *Machine) {
-				defer wg.Done()
-				executeManifestOnMachine(exec, manifest, m, idx)
-			}(i, machine)
-		}
-
-		// Wait for completion in background
+		// Execute across all machines in the background
 		go func() {
-			wg.Wait()
+			executeManifest(exec, manifest)
 			now := time.Now()
 			exec.FinishedAt = &now
 
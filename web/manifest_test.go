@@ -0,0 +1,57 @@
+package web
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestManifestTasksMapsLegacyAndPorterActions(t *testing.T) {
+	m := &Manifest{Name: "deploy", Tasks: []TaskDefinition{
+		{Type: TaskSvcRestart, Params: map[string]string{"name": "nginx"}, Options: TaskOptions{Sudo: true}},
+		{Type: TaskScript, Params: map[string]string{"path": "/opt/setup.sh"}},
+		{Type: TaskWaitPort, Params: map[string]string{"host": "localhost", "port": "8080"}, Options: TaskOptions{Timeout: "30s"}},
+		{Type: "ensure_line", Params: map[string]string{"dest": "/etc/hosts", "body": "10.0.0.1 db"}},
+	}}
+	tasks, err := manifestTasks(m)
+	if err != nil {
+		t.Fatalf("manifestTasks: %v", err)
+	}
+	if tasks[0].Action != "service" || tasks[0].State != "restart" || tasks[0].Dest != "nginx" || !tasks[0].Sudo {
+		t.Errorf("svc_restart = %+v", tasks[0])
+	}
+	if tasks[1].Action != "run" || tasks[1].Body != "bash /opt/setup.sh" {
+		t.Errorf("script = %+v", tasks[1])
+	}
+	if tasks[2].Dest != "localhost" || tasks[2].Body != "8080" || tasks[2].Timeout.String() != "30s" {
+		t.Errorf("wait_port = %+v", tasks[2])
+	}
+	if tasks[3].Action != "ensure_line" {
+		t.Errorf("porter action = %+v", tasks[3])
+	}
+}
+
+func TestManifestTasksRejectsUnknownType(t *testing.T) {
+	_, err := manifestTasks(&Manifest{Tasks: []TaskDefinition{{Type: "frobnicate"}}})
+	if err == nil || !strings.Contains(err.Error(), "frobnicate") {
+		t.Errorf("err = %v, want unknown action", err)
+	}
+}
+
+func TestManifestTasksRejectsUnknownParams(t *testing.T) {
+	_, err := manifestTasks(&Manifest{Tasks: []TaskDefinition{
+		{Name: "motd", Type: TaskWrite, Params: map[string]string{"dest": "/etc/motd", "content": "hi", "perms": "0644"}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), `"perms"`) {
+		t.Errorf("err = %v, want unknown parameter", err)
+	}
+
+	tasks, err := manifestTasks(&Manifest{Tasks: []TaskDefinition{
+		{Type: TaskComposeUp, Params: map[string]string{"path": "/opt/app/compose.yml", "service": "api"}},
+	}})
+	if err != nil {
+		t.Fatalf("manifestTasks: %v", err)
+	}
+	if tasks[0].Body != "service:api" {
+		t.Errorf("compose body = %q", tasks[0].Body)
+	}
+}
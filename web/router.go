@@ -31,6 +31,7 @@ func SetupRoutes(r *mux.Router) {
 	WOLRoutes(r)
 	NetworkToolsRoutes(r)
 	SSHKeyRoutes(r)
+	HostKeyRoutes(r)
 	BackupRoutes(r)
 	DiffRoutes(r)
 	MultiTerminalRoutes(r)
@@ -2,6 +2,7 @@ package web
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -161,15 +162,44 @@ func RunScriptWithStreaming(m *Machine, scriptPath, args, execID string, useSudo
 	broadcastStatus(execID, m.ID, m.Name, "Connected. Uploading files...")
 
 	executor := porter.NewExecutor(client, m.Password)
+	executor.OnOutput(func(p porter.TaskProgress, ev porter.StreamEvent) {
+		execStream.Broadcast(execID, StreamEvent{
+			Type:      "output",
+			MachineID: m.ID,
+			Machine:   m.Name,
+			Data:      ev.Data,
+			Timestamp: time.Now(),
+		})
+	})
 	vars := porter.NewVars()
+	ctx := execTracker.Context(execID)
+
+	// abort ends the run after a failed or cancelled step, removing whatever
+	// was already uploaded.
+	abort := func(step string, err error) ExecutionResult {
+		result.Error = fmt.Sprintf("%s failed: %v", step, err)
+		if ctx.Err() != nil {
+			result.Error = "Cancelled"
+		}
+		executor.Run("Cleanup", porter.Tasks(
+			porter.Rm(cfg.RemoteBase).Name("Cleanup temp files"),
+		), vars)
+		result.FinishedAt = time.Now()
+		broadcastError(execID, m.ID, m.Name, result.Error)
+		return result
+	}
 
 	// Execute setup manifest
-	executor.Run("Setup Directories", BuildSetupManifest(cfg), vars)
+	if _, err := executor.RunContext(ctx, "Setup Directories", BuildSetupManifest(cfg), vars); err != nil {
+		return abort("Setup", err)
+	}
 
 	// Execute upload manifest
 	uploadTasks := BuildUploadManifest(cfg)
 	if len(uploadTasks) > 0 {
-		executor.Run("Upload Files", uploadTasks, vars)
+		if _, err := executor.RunContext(ctx, "Upload Files", uploadTasks, vars); err != nil {
+			return abort("Upload", err)
+		}
 	}
 
 	broadcastStatus(execID, m.ID, m.Name, "Files uploaded. Executing script...")
@@ -178,12 +208,17 @@ func RunScriptWithStreaming(m *Machine, scriptPath, args, execID string, useSudo
 	remotePath := fmt.Sprintf("%s/%s", cfg.RemoteScriptDir, cfg.ScriptName)
 
 	// Make script executable first
-	executor.Run("Prepare Script", porter.Tasks(
+	if _, err := executor.RunContext(ctx, "Prepare Script", porter.Tasks(
 		porter.Chmod(remotePath).Mode("755").Name("Make script executable"),
 		porter.Run(fmt.Sprintf("chmod 755 %s/lib/*.sh 2>/dev/null || true", cfg.RemoteBase)).
 			Name("Make lib scripts executable").
 			Ignore(),
-	), vars)
+	), vars); err != nil {
+		return abort("Prepare", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return abort("Prepare", err)
+	}
 
 	// Now execute with real-time streaming
 	var scriptCmd string
@@ -195,7 +230,7 @@ func RunScriptWithStreaming(m *Machine, scriptPath, args, execID string, useSudo
 		scriptCmd = fmt.Sprintf("cd ~ && bash %s %s 2>&1; echo \"EXIT_CODE:$?\"", remotePath, cfg.Args)
 	}
 
-	output, err := executeWithStreamingSSH(m, scriptCmd, execID)
+	output, err := executeWithStreamingSSH(ctx, m, scriptCmd, execID)
 
 	result.Output = output
 	result.FinishedAt = time.Now()
@@ -205,7 +240,10 @@ func RunScriptWithStreaming(m *Machine, scriptPath, args, execID string, useSudo
 		result.Success = true
 	}
 
-	if err != nil {
+	if ctx.Err() != nil {
+		result.Error = "Cancelled"
+		result.Success = false
+	} else if err != nil {
 		result.Error = fmt.Sprintf("Script error: %v", err)
 		result.Success = false
 	} else if !result.Success {
@@ -229,8 +267,9 @@ func RunScriptWithStreaming(m *Machine, scriptPath, args, execID string, useSudo
 	return result
 }
 
-// executeWithStreamingSSH runs a command and streams output in real-time using direct SSH
-func executeWithStreamingSSH(m *Machine, cmd, execID string) (string, error) {
+// executeWithStreamingSSH runs a command and streams output in real-time using direct SSH.
+// Cancelling ctx kills the command and closes its session.
+func executeWithStreamingSSH(ctx context.Context, m *Machine, cmd, execID string) (string, error) {
 	// Create SSH config with extended timeout for long-running operations
 	sshConfig := &ssh.ClientConfig{
 		User: m.Username,
@@ -271,6 +310,12 @@ func executeWithStreamingSSH(m *Machine, cmd, execID string) (string, error) {
 	}
 	defer session.Close()
 
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+	})
+	defer stop()
+
 	// Get stdout and stderr pipes
 	stdout, err := session.StdoutPipe()
 	if err != nil {
@@ -332,6 +377,9 @@ func executeWithStreamingSSH(m *Machine, cmd, execID string) (string, error) {
 
 	// Wait for command to finish
 	err = session.Wait()
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
 
 	return outputBuilder.String(), err
 }